@@ -0,0 +1,9 @@
+// gokr-packer packs gokrazy installations into SD card or file system images.
+// The implementation is in package github.com/gokrazy/tools/packer.
+package main
+
+import "github.com/gokrazy/tools/packer"
+
+func main() {
+	packer.Main()
+}
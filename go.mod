@@ -5,5 +5,8 @@ go 1.14
 require (
 	github.com/gokrazy/gokrazy v0.0.0-20200527062450-9e57e3cf2ee6
 	github.com/gokrazy/internal v0.0.0-20200531194636-d96421c60091
+	github.com/golang/protobuf v1.4.2
 	golang.org/x/sys v0.0.0-20200523222454-059865788121
+	google.golang.org/grpc v1.30.0
+	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,143 @@
+package gokrazyinit
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// runFirstBoot copies the first-boot payload (gokr-packer -firstboot_payload)
+// to /perm and runs the first-boot programs (gokr-packer -firstboot) and the
+// commands of the first-boot manifest (gokr-packer -firstboot_manifest) in
+// order, unless they already completed successfully on this device, as
+// recorded in /perm/firstboot/<name>.done. A failed program (and all programs
+// after it) is retried on the next boot.
+func runFirstBoot(cfg *Config) {
+	const dir = "/perm/firstboot"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("not running first-boot programs: %v", err)
+		return
+	}
+	if cfg.FirstBootPayload != "" {
+		if err := copyFirstBootPayload(dir, cfg.FirstBootPayloadDir, cfg.FirstBootPayload); err != nil {
+			log.Printf("copying the first-boot payload failed, retrying on the next boot: %v", err)
+			return
+		}
+	}
+	for _, path := range cfg.FirstBoot {
+		if !runFirstBootStep(dir, filepath.Base(path), []string{path}, cfg.BuildTimestamp) {
+			return
+		}
+	}
+	if cfg.FirstBootManifest == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(cfg.FirstBootManifest)
+	if err != nil {
+		log.Printf("not running first-boot manifest: %v", err)
+		return
+	}
+	var cmds []struct {
+		ID   string
+		Args []string
+	}
+	if err := json.Unmarshal(b, &cmds); err != nil {
+		log.Printf("not running first-boot manifest: %v", err)
+		return
+	}
+	for _, cmd := range cmds {
+		if !runFirstBootStep(dir, "manifest-"+cmd.ID, cmd.Args, cfg.BuildTimestamp) {
+			return
+		}
+	}
+}
+
+// runFirstBootStep runs the first-boot program args (named name in dir)
+// unless it already completed, and returns whether it completed. The
+// completion is recorded with the buildTimestamp of the image.
+func runFirstBootStep(dir, name string, args []string, buildTimestamp string) bool {
+	done := filepath.Join(dir, name+".done")
+	if _, err := os.Stat(done); err == nil {
+		return true
+	}
+	logf, err := os.OpenFile(filepath.Join(dir, name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("not running first-boot programs: %v", err)
+		return false
+	}
+	log.Printf("running first-boot program %s", args[0])
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = io.MultiWriter(os.Stdout, logf)
+	cmd.Stderr = io.MultiWriter(os.Stderr, logf)
+	err = cmd.Run()
+	logf.Close()
+	if err != nil {
+		log.Printf("first-boot program %s failed, retrying on the next boot: %v", args[0], err)
+		return false
+	}
+	if err := ioutil.WriteFile(done, []byte(buildTimestamp+"\n"), 0644); err != nil {
+		log.Printf("recording completion of %s: %v", args[0], err)
+		return false
+	}
+	syscall.Sync() // do not run the program again after a power loss
+	return true
+}
+
+// copyFirstBootPayload copies the first-boot payload in payload to /perm,
+// unless the version identified by hash was already copied.
+func copyFirstBootPayload(dir, payload, hash string) error {
+	done := filepath.Join(dir, "payload.done")
+	if b, err := ioutil.ReadFile(done); err == nil && strings.TrimSpace(string(b)) == hash {
+		return nil
+	}
+	err := filepath.Walk(payload, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(payload, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join("/perm", rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(dest, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.Remove(dest)
+			return os.Symlink(target, dest)
+		default:
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			tmp := dest + ".firstboot"
+			if err := ioutil.WriteFile(tmp, b, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := os.Chmod(tmp, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Rename(tmp, dest)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	syscall.Sync()
+	if err := ioutil.WriteFile(done, []byte(hash+"\n"), 0644); err != nil {
+		return err
+	}
+	syscall.Sync()
+	log.Printf("copied the first-boot payload to /perm")
+	return nil
+}
@@ -0,0 +1,235 @@
+// Package gokrazyinit implements the init process which gokr-packer generates
+// for gokrazy installations. The generated init only contains the
+// configuration of the installation (see Config) and calls Main.
+package gokrazyinit
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+	"github.com/gokrazy/internal/rootdev"
+)
+
+// Config is the configuration of a gokrazy installation which gokr-packer
+// embeds into the generated init.
+type Config struct {
+	// BuildTimestamp identifies the build.
+	BuildTimestamp string
+
+	// Programs are the paths of the programs which init supervises, in the
+	// order in which they are started.
+	Programs []string
+
+	// Services maps the paths of programs to the configuration which is
+	// applied when starting them. Programs with a ServiceConfig are started
+	// via init, see ServiceConfig.
+	Services map[string]ServiceConfig
+
+	// PermMode (rw, ro or none), PermFS and PermMountOptions describe the
+	// permanent data partition (gokr-packer -perm, -perm_fs and
+	// -perm_mount_options).
+	PermMode         string
+	PermFS           string
+	PermMountOptions string
+
+	// PermTrimInterval is how often unused blocks of /perm are discarded, or
+	// zero (gokr-packer -perm_trim_interval).
+	PermTrimInterval time.Duration
+
+	// PermPersist are the directories whose changes are stored on /perm
+	// (gokr-packer -perm_persist).
+	PermPersist []PersistMount
+
+	// PermLUKS is set if the permanent data partition is a LUKS2 volume
+	// (gokr-packer -perm_luks), opened with the key file PermKeyFile of the
+	// boot partition. PermDiscard passes discards through to the partition.
+	PermLUKS    bool
+	PermKeyFile string
+	PermDiscard bool
+
+	// RootOverlay is the -root_overlay which the image supports: empty, tmpfs
+	// or perm.
+	RootOverlay string
+
+	// FirstBoot are the paths of the -firstboot programs.
+	FirstBoot []string
+
+	// FirstBootPayload is the hash of the -firstboot_payload in
+	// FirstBootPayloadDir, or empty.
+	FirstBootPayload    string
+	FirstBootPayloadDir string
+
+	// FirstBootManifest is the path of the -firstboot_manifest, or empty.
+	FirstBootManifest string
+
+	// Sealed is set if the image contains -sealed_secrets, which start with
+	// SealMagic.
+	Sealed    bool
+	SealMagic string
+
+	// StaticNetwork is set if the image contains /etc/gokrazy/network.json
+	// (gokr-packer -static_ip and -dns).
+	StaticNetwork bool
+
+	// WiFi is set if /etc/wifi.json (gokr-packer -wifi_ssid) is to be copied
+	// to /perm.
+	WiFi bool
+
+	// TLSOnPerm is set if the certificate of the web interface is copied from
+	// TLSBootDir on the boot partition to TLSPermDir (gokr-packer
+	// -tls_location=perm).
+	TLSOnPerm  bool
+	TLSBootDir string
+	TLSPermDir string
+}
+
+// PersistMount is an overlay which stores all changes to Dir in Upper (with
+// the overlayfs work directory Work) on the permanent data partition.
+type PersistMount struct {
+	Dir, Upper, Work string
+}
+
+// Main runs the init process of the gokrazy installation described by cfg. It
+// does not return.
+func Main(cfg *Config) {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	if os.Getpid() != 1 {
+		// The supervisor started init on behalf of a program.
+		svc, ok := cfg.Services[os.Args[0]]
+		if !ok {
+			log.Fatalf("BUG: no service configuration for %s", os.Args[0])
+		}
+		log.Fatal(execService(os.Args[0], svc))
+	}
+
+	if cfg.RootOverlay != "" && os.Getenv("GOKRAZY_OVERLAY") == "" {
+		if err := setupRootOverlay(cfg); err != nil {
+			log.Printf("not using a writable root file system overlay: %v", err)
+		}
+	}
+
+	fmt.Printf("gokrazy build timestamp %s\n", cfg.BuildTimestamp)
+	if err := gokrazy.Boot(cfg.BuildTimestamp); err != nil {
+		log.Fatal(err)
+	}
+
+	mountPerm(cfg)
+	for _, p := range cfg.PermPersist {
+		if err := persistDir(p.Dir, p.Upper, p.Work); err != nil {
+			log.Printf("not persisting changes to %s: %v", p.Dir, err)
+		}
+	}
+	if cfg.TLSOnPerm {
+		if err := installTLSFiles(cfg.TLSBootDir, cfg.TLSPermDir); err != nil {
+			log.Printf("installing the TLS certificate: %v", err)
+		}
+	}
+	if cfg.Sealed {
+		if err := unsealSecrets(cfg.SealMagic); err != nil {
+			log.Printf("sealed secrets are not available: %v", err)
+		}
+	}
+	if cfg.PermTrimInterval > 0 {
+		go trimPeriodically("/perm", cfg.PermTrimInterval)
+	}
+	if usesCgroups(cfg.Services) {
+		if err := mountCgroup2(); err != nil {
+			log.Printf("cgroup resource limits will not be applied: %v", err)
+		}
+	}
+	if cfg.StaticNetwork {
+		go func() {
+			if err := configureNetwork(); err != nil {
+				log.Printf("configuring static network: %v", err)
+			}
+		}()
+	}
+	if cfg.WiFi {
+		if err := provisionWiFi(); err != nil {
+			log.Printf("provisioning WiFi credentials: %v", err)
+		}
+	}
+
+	go func() {
+		if err := mdnsResponder(); err != nil {
+			log.Printf("not advertising via mDNS: %v", err)
+		}
+	}()
+
+	// The device side of gokr-packer push and run-on, served (with
+	// authentication) by gokrazy’s web interface:
+	supervised := make(map[string]bool)
+	for _, path := range cfg.Programs {
+		supervised[path] = true
+	}
+	http.HandleFunc("/uploadtemp/", uploadTempHandler)
+	http.HandleFunc("/divert", divertHandler(supervised))
+	http.HandleFunc("/runtemp", runTempHandler)
+
+	if err := gokrazy.Supervise(commands(cfg)); err != nil {
+		log.Fatal(err)
+	}
+	if len(cfg.FirstBoot) > 0 || cfg.FirstBootPayload != "" || cfg.FirstBootManifest != "" {
+		// Run the first-boot programs once the network services are started,
+		// so that they can e.g. enroll the device:
+		go runFirstBoot(cfg)
+	}
+	select {}
+}
+
+// commands returns the commands which the supervisor starts for the programs
+// of cfg: programs with a ServiceConfig are started via init, which applies
+// the configuration.
+func commands(cfg *Config) []*exec.Cmd {
+	cmds := make([]*exec.Cmd, 0, len(cfg.Programs))
+	for _, path := range cfg.Programs {
+		if _, ok := cfg.Services[path]; ok {
+			cmds = append(cmds, &exec.Cmd{
+				Path: "/gokrazy/init",
+				Args: []string{path},
+			})
+		} else {
+			cmds = append(cmds, exec.Command(path))
+		}
+	}
+	return cmds
+}
+
+// mountPerm mounts the permanent data partition if gokrazy.Boot cannot, or
+// remounts it as configured.
+func mountPerm(cfg *Config) {
+	var flags uintptr
+	if cfg.PermMode == "ro" {
+		flags = syscall.MS_RDONLY
+	}
+	switch {
+	case cfg.PermLUKS:
+		// gokrazy.Boot cannot mount the encrypted permanent data partition:
+		if err := unlockPerm(cfg); err != nil {
+			log.Printf("Could not unlock permanent storage partition: %v", err)
+		}
+	case cfg.PermMode != "none" && cfg.PermFS == "f2fs":
+		// gokrazy.Boot only mounts ext4 permanent data partitions:
+		dev := rootdev.Partition(rootdev.Perm)
+		if err := syscall.Mount(dev, "/perm", "f2fs", flags, cfg.PermMountOptions); err != nil {
+			log.Printf("Could not mount permanent storage partition %s: %v", dev, err)
+		}
+	case cfg.PermMode == "ro":
+		// The permanent data partition must never change (gokr-packer
+		// -perm=ro):
+		if err := syscall.Mount("", "/perm", "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			log.Printf("remounting /perm read-only: %v", err)
+		}
+	case cfg.PermMountOptions != "":
+		if err := syscall.Mount("", "/perm", "", syscall.MS_REMOUNT, cfg.PermMountOptions); err != nil {
+			log.Printf("remounting /perm with options %s: %v", cfg.PermMountOptions, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package gokrazyinit
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingWriter writes to a log file in dir, rotating it once it exceeds
+// maxBytes. At most maxFiles log files are kept.
+type rotatingWriter struct {
+	dir      string
+	maxBytes int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func (rw *rotatingWriter) name(n int) string {
+	if n == 0 {
+		return filepath.Join(rw.dir, "log.txt")
+	}
+	return filepath.Join(rw.dir, fmt.Sprintf("log.txt.%d", n))
+}
+
+func (rw *rotatingWriter) open() error {
+	f, err := os.OpenFile(rw.name(0), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rw.f = f
+	rw.size = st.Size()
+	return nil
+}
+
+func (rw *rotatingWriter) rotate() error {
+	rw.f.Close()
+	os.Remove(rw.name(rw.maxFiles - 1))
+	for n := rw.maxFiles - 2; n >= 0; n-- {
+		os.Rename(rw.name(n), rw.name(n+1))
+	}
+	return rw.open()
+}
+
+func (rw *rotatingWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.f == nil {
+		if err := rw.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rw.size > 0 && rw.size+int64(len(p)) > rw.maxBytes {
+		if err := rw.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rw.f.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+// syslogWriter sends each line written to it as an RFC 5424 message to a
+// remote syslog server, reconnecting as required. Lines written while the
+// server is unreachable (e.g. before the network is up) are buffered.
+type syslogWriter struct {
+	network, addr string
+	tlsConfig     *tls.Config
+	hostname, tag string
+	pri           int
+
+	mu        sync.Mutex
+	conn      net.Conn
+	remainder []byte
+	pending   [][]byte
+}
+
+// syslogMaxPending limits how many messages are buffered while the remote
+// syslog server is unreachable.
+const syslogMaxPending = 1000
+
+func newSyslogWriter(target, tag string, severity int) (*syslogWriter, error) {
+	idx := strings.Index(target, "://")
+	if idx == -1 {
+		return nil, fmt.Errorf("malformed syslog target %q", target)
+	}
+	hostname, _ := os.Hostname()
+	sw := &syslogWriter{
+		network:  target[:idx],
+		addr:     target[idx+len("://"):],
+		hostname: hostname,
+		tag:      tag,
+		pri:      1*8 + severity, // facility user
+	}
+	if sw.network == "tls" {
+		sw.tlsConfig = &tls.Config{}
+		if b, err := ioutil.ReadFile("/etc/gokrazy/syslog-ca.pem"); err == nil {
+			sw.tlsConfig.RootCAs = x509.NewCertPool()
+			sw.tlsConfig.RootCAs.AppendCertsFromPEM(b)
+		}
+	}
+	go sw.flushPeriodically()
+	return sw, nil
+}
+
+func (sw *syslogWriter) dial() (net.Conn, error) {
+	switch sw.network {
+	case "tls":
+		return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", sw.addr, sw.tlsConfig)
+	default:
+		return net.DialTimeout(sw.network, sw.addr, 10*time.Second)
+	}
+}
+
+func (sw *syslogWriter) message(line []byte) []byte {
+	msg := []byte(fmt.Sprintf("<%d>1 %s %s %s %d - - ",
+		sw.pri,
+		time.Now().Format(time.RFC3339Nano),
+		sw.hostname,
+		sw.tag,
+		os.Getpid()))
+	msg = append(msg, line...)
+	if sw.network != "udp" {
+		// octet counting framing, see RFC 5425 section 4.3
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	return msg
+}
+
+// flush sends pending messages. sw.mu must be held.
+func (sw *syslogWriter) flush() {
+	for len(sw.pending) > 0 {
+		if sw.conn == nil {
+			conn, err := sw.dial()
+			if err != nil {
+				return
+			}
+			sw.conn = conn
+		}
+		if _, err := sw.conn.Write(sw.pending[0]); err != nil {
+			sw.conn.Close()
+			sw.conn = nil
+			return
+		}
+		sw.pending = sw.pending[1:]
+	}
+}
+
+func (sw *syslogWriter) flushPeriodically() {
+	for range time.Tick(5 * time.Second) {
+		sw.mu.Lock()
+		sw.flush()
+		sw.mu.Unlock()
+	}
+}
+
+func (sw *syslogWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	text := append(sw.remainder, p...)
+	for {
+		idx := bytes.IndexByte(text, '\n')
+		if idx == -1 {
+			break
+		}
+		if len(sw.pending) == syslogMaxPending {
+			sw.pending = sw.pending[1:]
+		}
+		sw.pending = append(sw.pending, sw.message(text[:idx]))
+		text = text[idx+1:]
+	}
+	sw.remainder = append([]byte(nil), text...)
+	if sw.conn != nil {
+		// Only send directly when connected, so that the program does not
+		// block while (re-)connecting, which flushPeriodically does.
+		sw.flush()
+	}
+	return len(p), nil
+}
@@ -0,0 +1,353 @@
+package gokrazyinit
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// luksMetadata is the part of the JSON metadata of a LUKS2 header which
+// openLUKS uses. encoding/json matches the field names to the keys (e.g.
+// key_size) case-insensitively.
+type luksMetadata struct {
+	Keyslots map[string]struct {
+		Key_size int
+		AF       struct {
+			Stripes int
+			Hash    string
+		}
+		Area struct {
+			Offset     string
+			Encryption string
+			Key_size   int
+		}
+		KDF struct {
+			Type       string
+			Hash       string
+			Iterations int
+			Salt       string
+		}
+	}
+	Segments map[string]struct {
+		Offset      string
+		Encryption  string
+		Sector_size int
+	}
+	Digests map[string]struct {
+		Type       string
+		Hash       string
+		Iterations int
+		Salt       string
+		Digest     string
+	}
+}
+
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// xtsDecrypt decrypts b (512 byte sectors, aes-xts-plain64) in place.
+func xtsDecrypt(key, b []byte) error {
+	data, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return err
+	}
+	tweak, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return err
+	}
+	var t [16]byte
+	for sector := uint64(0); len(b) >= 512; b, sector = b[512:], sector+1 {
+		t = [16]byte{}
+		binary.LittleEndian.PutUint64(t[:], sector)
+		tweak.Encrypt(t[:], t[:])
+		for blk := b[:512]; len(blk) > 0; blk = blk[16:] {
+			for i := range t {
+				blk[i] ^= t[i]
+			}
+			data.Decrypt(blk[:16], blk[:16])
+			for i := range t {
+				blk[i] ^= t[i]
+			}
+			carry := t[15] >> 7
+			for i := 15; i > 0; i-- {
+				t[i] = t[i]<<1 | t[i-1]>>7
+			}
+			t[0] = t[0]<<1 ^ carry*0x87
+		}
+	}
+	return nil
+}
+
+// afDiffuse is the diffusion function of the LUKS anti-forensic splitter.
+func afDiffuse(b []byte) {
+	for i := 0; i*sha256.Size < len(b); i++ {
+		h := sha256.New()
+		binary.Write(h, binary.BigEndian, uint32(i))
+		end := (i + 1) * sha256.Size
+		if end > len(b) {
+			end = len(b)
+		}
+		h.Write(b[i*sha256.Size : end])
+		copy(b[i*sha256.Size:end], h.Sum(nil))
+	}
+}
+
+// openLUKS returns the volume key and the offset (in bytes) of the data of the
+// LUKS2 volume on dev, using key (the contents of the key file) as passphrase.
+// Only the PBKDF2 keyslots and aes-xts-plain64 which gokr-packer creates are
+// supported.
+func openLUKS(dev string, key []byte) ([]byte, int64, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	hdr := make([]byte, 4096)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		return nil, 0, err
+	}
+	if string(hdr[:6]) != "LUKS\xba\xbe" || binary.BigEndian.Uint16(hdr[6:]) != 2 {
+		return nil, 0, fmt.Errorf("%s is not a LUKS2 volume", dev)
+	}
+	js := make([]byte, binary.BigEndian.Uint64(hdr[8:])-4096)
+	if _, err := f.ReadAt(js, 4096); err != nil {
+		return nil, 0, err
+	}
+	var md luksMetadata
+	if err := json.Unmarshal(bytes.TrimRight(js, "\x00"), &md); err != nil {
+		return nil, 0, err
+	}
+	seg, ok := md.Segments["0"]
+	if !ok || seg.Encryption != "aes-xts-plain64" || seg.Sector_size != 512 {
+		return nil, 0, fmt.Errorf("%s: unsupported LUKS2 segment", dev)
+	}
+	offset, err := strconv.ParseInt(seg.Offset, 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, ks := range md.Keyslots {
+		if ks.KDF.Type != "pbkdf2" || ks.KDF.Hash != "sha256" || ks.AF.Hash != "sha256" || ks.Area.Encryption != "aes-xts-plain64" {
+			continue
+		}
+		salt, err := base64.StdEncoding.DecodeString(ks.KDF.Salt)
+		if err != nil {
+			return nil, 0, err
+		}
+		areaOffset, err := strconv.ParseInt(ks.Area.Offset, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		material := make([]byte, (ks.Key_size*ks.AF.Stripes+511)/512*512)
+		if _, err := f.ReadAt(material, areaOffset); err != nil {
+			return nil, 0, err
+		}
+		if err := xtsDecrypt(pbkdf2SHA256(key, salt, ks.KDF.Iterations, ks.Area.Key_size), material); err != nil {
+			return nil, 0, err
+		}
+		// Merge the stripes of the anti-forensic splitter:
+		vk := make([]byte, ks.Key_size)
+		for i := 0; i < ks.AF.Stripes; i++ {
+			for j := range vk {
+				vk[j] ^= material[i*ks.Key_size+j]
+			}
+			if i < ks.AF.Stripes-1 {
+				afDiffuse(vk)
+			}
+		}
+		for _, d := range md.Digests {
+			if d.Type != "pbkdf2" || d.Hash != "sha256" {
+				continue
+			}
+			salt, err := base64.StdEncoding.DecodeString(d.Salt)
+			if err != nil {
+				return nil, 0, err
+			}
+			want, err := base64.StdEncoding.DecodeString(d.Digest)
+			if err != nil {
+				return nil, 0, err
+			}
+			if bytes.Equal(pbkdf2SHA256(vk, salt, d.Iterations, len(want)), want) {
+				return vk, offset, nil
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("the key file does not open any keyslot of %s", dev)
+}
+
+// dmIoctl issues the device-mapper ioctl nr (see <linux/dm-ioctl.h>) for the
+// mapped device name, with data (e.g. a table) following its struct dm_ioctl,
+// which it returns as filled in by the kernel.
+func dmIoctl(control *os.File, nr uintptr, name string, targets uint32, data []byte) ([]byte, error) {
+	const sizeofDMIoctl = 312
+	b := make([]byte, sizeofDMIoctl+len(data))
+	// All gokrazy platforms are little endian:
+	binary.LittleEndian.PutUint32(b[0:], 4) // version 4.0.0
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[16:], sizeofDMIoctl)
+	binary.LittleEndian.PutUint32(b[20:], targets)
+	copy(b[48:48+127], name)
+	copy(b[sizeofDMIoctl:], data)
+	req := uintptr(3<<30|sizeofDMIoctl<<16|0xfd<<8) | nr // _IOWR(DM_IOCTL, nr, struct dm_ioctl)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, control.Fd(), req, uintptr(unsafe.Pointer(&b[0]))); errno != 0 {
+		return nil, errno
+	}
+	return b, nil
+}
+
+// partitionDevice returns the device node of partition n of the disk which
+// the root file system is mounted from.
+func partitionDevice(n int) (string, error) {
+	// With a root file system overlay, the root file system is /oldroot:
+	for _, dir := range []string{"/oldroot", "/"} {
+		var st syscall.Stat_t
+		if err := syscall.Stat(dir, &st); err != nil {
+			continue
+		}
+		dev := uint64(st.Dev)
+		major, minor := dev>>8&0xfff, dev&0xff|dev>>12&^0xff
+		if major == 0 {
+			continue // e.g. overlay or tmpfs
+		}
+		part, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+		if err != nil {
+			return "", err
+		}
+		disk := filepath.Dir(part)
+		fis, err := ioutil.ReadDir(disk)
+		if err != nil {
+			return "", err
+		}
+		for _, fi := range fis {
+			b, err := ioutil.ReadFile(filepath.Join(disk, fi.Name(), "partition"))
+			if err == nil && strings.TrimSpace(string(b)) == strconv.Itoa(n) {
+				return "/dev/" + fi.Name(), nil
+			}
+		}
+		return "", fmt.Errorf("partition %d of %s not found", n, filepath.Base(disk))
+	}
+	return "", fmt.Errorf("block device of the root file system not found")
+}
+
+// unlockPerm opens the LUKS2 volume on the permanent data partition (created by
+// gokr-packer -perm_luks) with the key file of the boot partition, maps it to
+// /dev/mapper/perm using dm-crypt and mounts it on /perm.
+func unlockPerm(cfg *Config) error {
+	// The boot partition is only mounted for reading the key file:
+	const boot = "/tmp/.perm-boot"
+	if err := os.MkdirAll(boot, 0700); err != nil {
+		return err
+	}
+	bootDev, err := partitionDevice(1)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount(bootDev, boot, "vfat", syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("mounting the boot partition: %v", err)
+	}
+	key, err := ioutil.ReadFile(filepath.Join(boot, cfg.PermKeyFile))
+	syscall.Unmount(boot, 0)
+	os.Remove(boot)
+	if err != nil {
+		return err
+	}
+
+	dev, err := partitionDevice(4)
+	if err != nil {
+		return err
+	}
+	volumeKey, offset, err := openLUKS(dev, key)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(filepath.Join("/sys/class/block", filepath.Base(dev), "size"))
+	if err != nil {
+		return err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	control, err := os.OpenFile("/dev/mapper/control", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+	const (
+		dmDevCreate  = 3
+		dmDevSuspend = 6 // without DM_SUSPEND_FLAG: resume, activating the table
+		dmTableLoad  = 9
+	)
+	created, err := dmIoctl(control, dmDevCreate, "perm", 0, nil)
+	if err != nil {
+		return fmt.Errorf("creating the mapped device: %v", err)
+	}
+	devno := binary.LittleEndian.Uint64(created[40:])
+	mapped := fmt.Sprintf("/dev/dm-%d", devno&0xff|(devno>>12)&^0xff)
+
+	spec := cryptTable(volumeKey, dev, offset, sectors, cfg.PermDiscard)
+	if _, err := dmIoctl(control, dmTableLoad, "perm", 1, spec); err != nil {
+		return fmt.Errorf("loading the dm-crypt table: %v", err)
+	}
+	if _, err := dmIoctl(control, dmDevSuspend, "perm", 0, nil); err != nil {
+		return fmt.Errorf("activating the mapped device: %v", err)
+	}
+	if err := os.MkdirAll("/dev/mapper", 0755); err == nil {
+		os.Symlink(filepath.Join("..", filepath.Base(mapped)), "/dev/mapper/perm")
+	}
+	var flags uintptr
+	if cfg.PermMode == "ro" {
+		flags = syscall.MS_RDONLY
+	}
+	if err := syscall.Mount(mapped, "/perm", cfg.PermFS, flags, cfg.PermMountOptions); err != nil {
+		return fmt.Errorf("mounting %s: %v", mapped, err)
+	}
+	return nil
+}
+
+// cryptTable returns the device-mapper table which maps the LUKS2 volume on
+// dev (of sectors 512 byte sectors, with its data at offset bytes) using
+// dm-crypt: a struct dm_target_spec followed by the (NUL-terminated) dm-crypt
+// parameters, padded to 8 bytes.
+func cryptTable(volumeKey []byte, dev string, offset, sectors int64, discard bool) []byte {
+	params := fmt.Sprintf("aes-xts-plain64 %x 0 %s %d", volumeKey, dev, offset/512)
+	if discard {
+		params += " 1 allow_discards"
+	}
+	spec := make([]byte, 40)
+	binary.LittleEndian.PutUint64(spec[8:], uint64(sectors-offset/512))
+	copy(spec[24:], "crypt")
+	spec = append(spec, params...)
+	return append(spec, make([]byte, 8-len(spec)%8)...)
+}
@@ -0,0 +1,216 @@
+package gokrazyinit
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// xtsEncrypt encrypts b (512 byte sectors, aes-xts-plain64) in place.
+func xtsEncrypt(t *testing.T, key, b []byte) {
+	t.Helper()
+	data, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tweak, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tw [16]byte
+	for sector := uint64(0); len(b) >= 512; b, sector = b[512:], sector+1 {
+		tw = [16]byte{}
+		binary.LittleEndian.PutUint64(tw[:], sector)
+		tweak.Encrypt(tw[:], tw[:])
+		for blk := b[:512]; len(blk) > 0; blk = blk[16:] {
+			for i := range tw {
+				blk[i] ^= tw[i]
+			}
+			data.Encrypt(blk[:16], blk[:16])
+			for i := range tw {
+				blk[i] ^= tw[i]
+			}
+			carry := tw[15] >> 7
+			for i := 15; i > 0; i-- {
+				tw[i] = tw[i]<<1 | tw[i-1]>>7
+			}
+			tw[0] = tw[0]<<1 ^ carry*0x87
+		}
+	}
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// writeTestLUKS2 writes a LUKS2 volume whose keyslot passphrase opens, laid
+// out like the volumes of gokr-packer -perm_luks, to fn and returns its volume
+// key.
+func writeTestLUKS2(t *testing.T, fn string, passphrase []byte) []byte {
+	t.Helper()
+	const (
+		keySize    = 64
+		stripes    = 4000
+		iterations = 1000
+		hdrSize    = 16384
+		dataOffset = 16 << 20
+	)
+	volumeKey := randomBytes(t, keySize)
+
+	// Split the volume key into stripes (anti-forensic splitter):
+	material := randomBytes(t, keySize*stripes)
+	d := make([]byte, keySize)
+	for i := 0; i < stripes-1; i++ {
+		for j := range d {
+			d[j] ^= material[i*keySize+j]
+		}
+		afDiffuse(d)
+	}
+	for j := range d {
+		material[(stripes-1)*keySize+j] = d[j] ^ volumeKey[j]
+	}
+	material = append(material, make([]byte, (4096-len(material)%4096)%4096)...)
+	keyslotSalt := randomBytes(t, 32)
+	xtsEncrypt(t, pbkdf2SHA256(passphrase, keyslotSalt, iterations, keySize), material)
+
+	digestSalt := randomBytes(t, 32)
+	js, err := json.Marshal(map[string]interface{}{
+		"keyslots": map[string]interface{}{"0": map[string]interface{}{
+			"type":     "luks2",
+			"key_size": keySize,
+			"af":       map[string]interface{}{"type": "luks1", "stripes": stripes, "hash": "sha256"},
+			"area": map[string]interface{}{
+				"type":       "raw",
+				"offset":     "32768",
+				"size":       "258048",
+				"encryption": "aes-xts-plain64",
+				"key_size":   keySize,
+			},
+			"kdf": map[string]interface{}{
+				"type":       "pbkdf2",
+				"hash":       "sha256",
+				"iterations": iterations,
+				"salt":       base64.StdEncoding.EncodeToString(keyslotSalt),
+			},
+		}},
+		"segments": map[string]interface{}{"0": map[string]interface{}{
+			"type":        "crypt",
+			"offset":      "16777216",
+			"size":        "dynamic",
+			"iv_tweak":    "0",
+			"encryption":  "aes-xts-plain64",
+			"sector_size": 512,
+		}},
+		"digests": map[string]interface{}{"0": map[string]interface{}{
+			"type":       "pbkdf2",
+			"keyslots":   []string{"0"},
+			"segments":   []string{"0"},
+			"hash":       "sha256",
+			"iterations": iterations,
+			"salt":       base64.StdEncoding.EncodeToString(digestSalt),
+			"digest":     base64.StdEncoding.EncodeToString(pbkdf2SHA256(volumeKey, digestSalt, iterations, sha256.Size)),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	hdr := make([]byte, hdrSize)
+	copy(hdr, "LUKS\xba\xbe")
+	binary.BigEndian.PutUint16(hdr[6:], 2)
+	binary.BigEndian.PutUint64(hdr[8:], hdrSize)
+	copy(hdr[4096:], js)
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(material, 2*hdrSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(dataOffset + 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	return volumeKey
+}
+
+func TestOpenLUKS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokrazyinit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "perm.img")
+	volumeKey := writeTestLUKS2(t, fn, []byte("secret key file"))
+
+	got, offset, err := openLUKS(fn, []byte("secret key file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, volumeKey) {
+		t.Errorf("openLUKS: got volume key %x, want %x", got, volumeKey)
+	}
+	if want := int64(16 << 20); offset != want {
+		t.Errorf("openLUKS: got offset %d, want %d", offset, want)
+	}
+
+	if _, _, err := openLUKS(fn, []byte("wrong key file")); err == nil {
+		t.Errorf("openLUKS with the wrong key: unexpectedly succeeded")
+	}
+
+	plain := filepath.Join(dir, "plain.img")
+	if err := ioutil.WriteFile(plain, make([]byte, 8192), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openLUKS(plain, []byte("secret key file")); err == nil || !strings.Contains(err.Error(), "not a LUKS2 volume") {
+		t.Errorf("openLUKS(unencrypted partition) = %v, want a not a LUKS2 volume error", err)
+	}
+}
+
+func TestCryptTable(t *testing.T) {
+	volumeKey := bytes.Repeat([]byte{0xab}, 64)
+	for _, tt := range []struct {
+		discard bool
+		params  string
+	}{
+		{false, "aes-xts-plain64 " + strings.Repeat("ab", 64) + " 0 /dev/mmcblk0p4 32768"},
+		{true, "aes-xts-plain64 " + strings.Repeat("ab", 64) + " 0 /dev/mmcblk0p4 32768 1 allow_discards"},
+	} {
+		b := cryptTable(volumeKey, "/dev/mmcblk0p4", 16<<20, 100000, tt.discard)
+		if len(b)%8 != 0 {
+			t.Errorf("discard=%v: length %d is not a multiple of 8", tt.discard, len(b))
+		}
+		if got, want := binary.LittleEndian.Uint64(b[0:]), uint64(0); got != want {
+			t.Errorf("discard=%v: start sector: got %d, want %d", tt.discard, got, want)
+		}
+		if got, want := binary.LittleEndian.Uint64(b[8:]), uint64(100000-32768); got != want {
+			t.Errorf("discard=%v: length: got %d sectors, want %d", tt.discard, got, want)
+		}
+		if got, want := string(bytes.TrimRight(b[24:40], "\x00")), "crypt"; got != want {
+			t.Errorf("discard=%v: target type: got %q, want %q", tt.discard, got, want)
+		}
+		params := b[40:]
+		if i := bytes.IndexByte(params, 0); i < 0 {
+			t.Errorf("discard=%v: parameters are not NUL-terminated", tt.discard)
+		} else if got := string(params[:i]); got != tt.params {
+			t.Errorf("discard=%v: parameters: got %q, want %q", tt.discard, got, tt.params)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package gokrazyinit
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mdnsConfig is the contents of /etc/gokrazy/mdns.json (gokr-packer
+// -mdns_instance and -mdns_txt). encoding/json matches the lower-case keys
+// case-insensitively.
+type mdnsConfig struct {
+	Service  string
+	Instance string
+	Port     int
+	TXT      map[string]string
+}
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeANY  = 255
+
+	dnsClassIN = 1
+	// dnsCacheFlush marks the records which only this host answers with
+	// (RFC 6762 section 10.2).
+	dnsCacheFlush = 0x8000
+)
+
+// dnsRecord is a resource record of an mDNS response. name is a list of
+// labels, as the instance name may contain dots.
+type dnsRecord struct {
+	name   []string
+	typ    uint16
+	unique bool
+	rdata  []byte
+}
+
+// appendDNSName appends the wire format of name to b, without compression.
+func appendDNSName(b []byte, name []string) []byte {
+	for _, label := range name {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readDNSName reads a (possibly compressed) name from msg at off and returns
+// its labels and the offset following it.
+func readDNSName(msg []byte, off int) ([]string, int, error) {
+	var (
+		labels []string
+		next   = -1
+	)
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 64 {
+			return nil, 0, fmt.Errorf("malformed DNS message")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next == -1 {
+				next = off + 1
+			}
+			return labels, next, nil
+		case l&0xC0 == 0xC0: // compression pointer
+			if off+1 >= len(msg) {
+				return nil, 0, fmt.Errorf("malformed DNS message")
+			}
+			if next == -1 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+l > len(msg) {
+				return nil, 0, fmt.Errorf("malformed DNS message")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+func dnsNameEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// mdnsRecords returns the records describing this host and the DNS-SD service
+// of cfg: the service’s PTR, SRV and TXT records and the host’s A and AAAA
+// records.
+func mdnsRecords(cfg *mdnsConfig) (ptr, srv, txt dnsRecord, addrs []dnsRecord, _ error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ptr, srv, txt, nil, err
+	}
+	host := []string{hostname, "local"}
+	service := append(strings.Split(cfg.Service, "."), "local")
+	instance := append([]string{cfg.Instance}, service...)
+
+	ptr = dnsRecord{name: service, typ: dnsTypePTR, rdata: appendDNSName(nil, instance)}
+
+	srvData := []byte{0, 0, 0, 0, byte(cfg.Port >> 8), byte(cfg.Port)} // priority, weight, port
+	srv = dnsRecord{name: instance, typ: dnsTypeSRV, unique: true, rdata: appendDNSName(srvData, host)}
+
+	keys := make([]string, 0, len(cfg.TXT))
+	for key := range cfg.TXT {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var txtData []byte
+	for _, key := range keys {
+		kv := key + "=" + cfg.TXT[key]
+		txtData = append(txtData, byte(len(kv)))
+		txtData = append(txtData, kv...)
+	}
+	txt = dnsRecord{name: instance, typ: dnsTypeTXT, unique: true, rdata: txtData}
+
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ptr, srv, txt, nil, err
+	}
+	for _, addr := range ifaddrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			addrs = append(addrs, dnsRecord{name: host, typ: dnsTypeA, unique: true, rdata: ip4})
+		} else {
+			addrs = append(addrs, dnsRecord{name: host, typ: dnsTypeAAAA, unique: true, rdata: ipnet.IP.To16()})
+		}
+	}
+	return ptr, srv, txt, addrs, nil
+}
+
+// mdnsResponse returns the response to the mDNS query msg (nil if there is
+// nothing to answer) and whether it needs to be sent via unicast. legacy
+// queries (RFC 6762 section 6.7) are sent from a port other than 5353, e.g.
+// by gokr-packer discover.
+func mdnsResponse(cfg *mdnsConfig, msg []byte, legacy bool) ([]byte, bool, error) {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return nil, false, nil // malformed or not a query
+	}
+	ptr, srv, txt, addrs, err := mdnsRecords(cfg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var answers, additionals []dnsRecord
+	unicast := legacy
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return nil, false, nil
+		}
+		qtype := binary.BigEndian.Uint16(msg[next:])
+		// The top bit of the class requests a unicast response:
+		unicast = unicast || binary.BigEndian.Uint16(msg[next+2:])&0x8000 != 0
+		off = next + 4
+
+		matches := func(typ uint16) bool { return qtype == typ || qtype == dnsTypeANY }
+		switch {
+		case dnsNameEqual(name, ptr.name) && matches(dnsTypePTR):
+			answers = append(answers, ptr)
+			additionals = append(append(additionals, srv, txt), addrs...)
+		case dnsNameEqual(name, srv.name):
+			if matches(dnsTypeSRV) {
+				answers = append(answers, srv)
+				additionals = append(additionals, addrs...)
+			}
+			if matches(dnsTypeTXT) {
+				answers = append(answers, txt)
+			}
+		case len(addrs) > 0 && dnsNameEqual(name, addrs[0].name):
+			for _, rr := range addrs {
+				if matches(rr.typ) {
+					answers = append(answers, rr)
+				}
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return nil, false, nil
+	}
+
+	resp := make([]byte, 12)
+	binary.BigEndian.PutUint16(resp[2:], 0x8400) // response, authoritative answer
+	if legacy {
+		// Repeat the ID and the questions of the query:
+		copy(resp, msg[:2])
+		binary.BigEndian.PutUint16(resp[4:], binary.BigEndian.Uint16(msg[4:]))
+		resp = append(resp, msg[12:off]...)
+	}
+	seen := make(map[string]bool)
+	appendRecords := func(records []dnsRecord) (n uint16) {
+		for _, rr := range records {
+			key := strings.ToLower(strings.Join(rr.name, "\x00")) + fmt.Sprint(rr.typ) + string(rr.rdata)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			class, ttl := uint16(dnsClassIN), uint32(120)
+			if rr.unique && !legacy {
+				class |= dnsCacheFlush
+			}
+			if legacy {
+				ttl = 10 // RFC 6762 section 6.7
+			}
+			resp = appendDNSName(resp, rr.name)
+			resp = append(resp, byte(rr.typ>>8), byte(rr.typ), byte(class>>8), byte(class))
+			resp = append(resp, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+			resp = append(resp, byte(len(rr.rdata)>>8), byte(len(rr.rdata)))
+			resp = append(resp, rr.rdata...)
+			n++
+		}
+		return n
+	}
+	ancount := appendRecords(answers)
+	arcount := appendRecords(additionals)
+	binary.BigEndian.PutUint16(resp[6:], ancount)
+	binary.BigEndian.PutUint16(resp[10:], arcount)
+	return resp, unicast, nil
+}
+
+// mdnsResponder answers mDNS queries for the host name and the DNS-SD service
+// described in /etc/gokrazy/mdns.json (written by gokr-packer), so that
+// gokr-packer discover finds the installation.
+func mdnsResponder() error {
+	b, err := ioutil.ReadFile("/etc/gokrazy/mdns.json")
+	if err != nil {
+		return err
+	}
+	var cfg mdnsConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return err
+	}
+	var conn *net.UDPConn
+	for {
+		// Joining the multicast group fails until the network is up:
+		conn, err = net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+		if err == nil {
+			break
+		}
+		time.Sleep(5 * time.Second)
+	}
+	defer conn.Close()
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		resp, unicast, err := mdnsResponse(&cfg, buf[:n], src.Port != mdnsGroup.Port)
+		if err != nil {
+			log.Printf("mDNS: %v", err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+		dst := mdnsGroup
+		if unicast {
+			dst = src
+		}
+		if _, err := conn.WriteToUDP(resp, dst); err != nil {
+			log.Printf("mDNS: %v", err)
+		}
+	}
+}
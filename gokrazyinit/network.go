@@ -0,0 +1,182 @@
+package gokrazyinit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// staticNetwork is the contents of /etc/gokrazy/network.json
+// (gokr-packer -static_ip and -dns). encoding/json matches the lower-case
+// keys case-insensitively.
+type staticNetwork struct {
+	Interface string
+	Addresses []string
+	Gateways  []string
+	DNS       []string
+}
+
+// netlinkRequest sends the rtnetlink request typ with payload (a fixed-size
+// header followed by attributes) and waits for the kernel’s acknowledgement.
+func netlinkRequest(typ, flags uint16, payload []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	b := make([]byte, syscall.SizeofNlMsghdr+len(payload))
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&b[0])) = syscall.NlMsghdr{
+		Len:   uint32(len(b)),
+		Type:  typ,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Seq:   1,
+	}
+	copy(b[syscall.SizeofNlMsghdr:], payload)
+	if err := syscall.Sendto(fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	resp := make([]byte, 4096)
+	n, _, err := syscall.Recvfrom(fd, resp, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(resp[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Header.Type == syscall.NLMSG_ERROR && len(m.Data) >= 4 {
+			if errno := *(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no netlink acknowledgement received")
+}
+
+// netlinkAttr appends the rtnetlink attribute typ with data to b.
+func netlinkAttr(b []byte, typ uint16, data []byte) []byte {
+	attr := make([]byte, (syscall.SizeofRtAttr+len(data)+syscall.RTA_ALIGNTO-1)&^(syscall.RTA_ALIGNTO-1))
+	*(*syscall.RtAttr)(unsafe.Pointer(&attr[0])) = syscall.RtAttr{
+		Len:  uint16(syscall.SizeofRtAttr + len(data)),
+		Type: typ,
+	}
+	copy(attr[syscall.SizeofRtAttr:], data)
+	return append(b, attr...)
+}
+
+// family returns the address family of ip and its 4 (IPv4) or 16 (IPv6) byte
+// representation.
+func family(ip net.IP) (uint8, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return syscall.AF_INET, ip4
+	}
+	return syscall.AF_INET6, ip.To16()
+}
+
+// configureNetwork applies /etc/gokrazy/network.json: it brings up the
+// interface, adds the addresses and default routes and writes the DNS servers
+// to /etc/resolv.conf.
+func configureNetwork() error {
+	b, err := ioutil.ReadFile("/etc/gokrazy/network.json")
+	if err != nil {
+		return err
+	}
+	var cfg staticNetwork
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return err
+	}
+
+	if len(cfg.DNS) > 0 {
+		var resolv bytes.Buffer
+		for _, ns := range cfg.DNS {
+			fmt.Fprintf(&resolv, "nameserver %s\n", ns)
+		}
+		// /etc/resolv.conf is a symlink to /tmp/resolv.conf, which in turn
+		// is a symlink to /proc/net/pnp:
+		os.Remove("/tmp/resolv.conf")
+		if err := ioutil.WriteFile("/tmp/resolv.conf", resolv.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Addresses) == 0 {
+		return nil
+	}
+
+	// Network interfaces (e.g. USB ethernet adapters) can appear a few
+	// seconds after boot:
+	var ifc *net.Interface
+	for start := time.Now(); ; time.Sleep(1 * time.Second) {
+		ifc, err = net.InterfaceByName(cfg.Interface)
+		if err == nil {
+			break
+		}
+		if time.Since(start) > 1*time.Minute {
+			return err
+		}
+	}
+
+	link := syscall.IfInfomsg{
+		Family: syscall.AF_UNSPEC,
+		Index:  int32(ifc.Index),
+		Flags:  syscall.IFF_UP,
+		Change: syscall.IFF_UP,
+	}
+	if err := netlinkRequest(syscall.RTM_NEWLINK, 0, (*[syscall.SizeofIfInfomsg]byte)(unsafe.Pointer(&link))[:]); err != nil {
+		return fmt.Errorf("bringing up %s: %v", cfg.Interface, err)
+	}
+
+	for _, addr := range cfg.Addresses {
+		ip, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return err
+		}
+		fam, ip := family(ip)
+		ones, _ := ipnet.Mask.Size()
+		msg := syscall.IfAddrmsg{
+			Family:    fam,
+			Prefixlen: uint8(ones),
+			Scope:     syscall.RT_SCOPE_UNIVERSE,
+			Index:     uint32(ifc.Index),
+		}
+		b := append([]byte(nil), (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&msg))[:]...)
+		b = netlinkAttr(b, syscall.IFA_LOCAL, ip)
+		b = netlinkAttr(b, syscall.IFA_ADDRESS, ip)
+		if fam == syscall.AF_INET {
+			brd := make(net.IP, len(ip))
+			for i := range ip {
+				brd[i] = ip[i] | ^ipnet.Mask[i]
+			}
+			b = netlinkAttr(b, syscall.IFA_BROADCAST, brd)
+		}
+		if err := netlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, b); err != nil {
+			return fmt.Errorf("adding address %s to %s: %v", addr, cfg.Interface, err)
+		}
+	}
+
+	for _, gw := range cfg.Gateways {
+		fam, ip := family(net.ParseIP(gw))
+		msg := syscall.RtMsg{
+			Family:   fam,
+			Table:    syscall.RT_TABLE_MAIN,
+			Protocol: syscall.RTPROT_STATIC,
+			Scope:    syscall.RT_SCOPE_UNIVERSE,
+			Type:     syscall.RTN_UNICAST,
+		}
+		oif := uint32(ifc.Index)
+		b := append([]byte(nil), (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&msg))[:]...)
+		b = netlinkAttr(b, syscall.RTA_GATEWAY, ip)
+		b = netlinkAttr(b, syscall.RTA_OIF, (*[4]byte)(unsafe.Pointer(&oif))[:])
+		if err := netlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, b); err != nil {
+			return fmt.Errorf("adding default route via %s: %v", gw, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package gokrazyinit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/gokrazy/internal/rootdev"
+)
+
+// fstrimRange corresponds to struct fstrim_range from linux/fs.h.
+type fstrimRange struct {
+	Start  uint64
+	Len    uint64
+	Minlen uint64
+}
+
+// fitrim is FITRIM, _IOWR('X', 121, struct fstrim_range) from linux/fs.h.
+const fitrim = 0xc0185879
+
+// trimPeriodically discards the unused blocks of the file system mounted at
+// dir, like fstrim(8).
+func trimPeriodically(dir string, interval time.Duration) {
+	for range time.Tick(interval) {
+		f, err := os.Open(dir)
+		if err != nil {
+			log.Printf("trim %s: %v", dir, err)
+			continue
+		}
+		r := fstrimRange{Len: ^uint64(0)}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fitrim, uintptr(unsafe.Pointer(&r))); errno != 0 {
+			log.Printf("trim %s: %v", dir, errno)
+		} else {
+			log.Printf("trim %s: discarded %d bytes", dir, r.Len)
+		}
+		f.Close()
+	}
+}
+
+// persistDir mounts an overlay over dir which stores all changes in upper on
+// the permanent data partition.
+func persistDir(dir, upper, work string) error {
+	for _, d := range []string{upper, work} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	opts := "lowerdir=" + dir + ",upperdir=" + upper + ",workdir=" + work
+	return syscall.Mount("overlay", dir, "overlay", 0, opts)
+}
+
+// setupRootOverlay mounts a writable overlay file system over the (read-only)
+// root file system as requested by the gokrazy.overlay= kernel parameter and
+// restarts init within the overlay. The perm mode requires an image built with
+// -root_overlay=perm.
+func setupRootOverlay(cfg *Config) error {
+	if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
+		return err
+	}
+	cmdline, err := ioutil.ReadFile("/proc/cmdline")
+	syscall.Unmount("/proc", 0)
+	if err != nil {
+		return err
+	}
+	var mode string
+	for _, param := range strings.Fields(string(cmdline)) {
+		if strings.HasPrefix(param, "gokrazy.overlay=") {
+			mode = strings.TrimPrefix(param, "gokrazy.overlay=")
+		}
+	}
+
+	var dir string
+	switch mode {
+	case "", "none":
+		return nil
+	case "tmpfs":
+		if err := syscall.Mount("tmpfs", "/overlay", "tmpfs", 0, "size=50%"); err != nil {
+			return fmt.Errorf("tmpfs on /overlay: %v", err)
+		}
+		dir = "/overlay"
+	case "perm":
+		if cfg.RootOverlay != "perm" {
+			return fmt.Errorf("gokrazy.overlay=perm requires an image built with -root_overlay=perm")
+		}
+		// gokrazy.Boot takes care of mounting /dev and /perm (again) in the
+		// overlay root.
+		if err := syscall.Mount("devtmpfs", "/dev", "devtmpfs", 0, ""); err != nil {
+			return fmt.Errorf("devtmpfs: %v", err)
+		}
+		dev := rootdev.Partition(rootdev.Perm)
+		if err := syscall.Mount(dev, "/perm", cfg.PermFS, 0, ""); err != nil {
+			return fmt.Errorf("mounting %s: %v", dev, err)
+		}
+		dir = "/perm/overlay"
+	default:
+		return fmt.Errorf("unknown gokrazy.overlay=%s", mode)
+	}
+
+	upper, work, merged := filepath.Join(dir, "upper"), filepath.Join(dir, "work"), filepath.Join(dir, "merged")
+	for _, d := range []string{upper, work, merged} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	opts := "lowerdir=/,upperdir=" + upper + ",workdir=" + work
+	if err := syscall.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("overlay: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(merged, "oldroot"), 0755); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(merged, filepath.Join(merged, "oldroot")); err != nil {
+		return fmt.Errorf("pivot_root: %v", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	log.Printf("using a writable root file system overlay (changes stored in %s)", dir)
+	return syscall.Exec("/gokrazy/init", os.Args, append(os.Environ(), "GOKRAZY_OVERLAY=1"))
+}
+
+// installTLSFiles copies the certificate and private key of the web interface
+// from the boot partition (written by gokr-packer -tls_location=perm) to
+// permDir on /perm, which /etc/ssl/gokrazy-web.pem and gokrazy-web.key.pem
+// link to.
+func installTLSFiles(bootDir, permDir string) error {
+	// The boot partition is only mounted for reading the files:
+	const boot = "/tmp/.tls-boot"
+	if err := os.MkdirAll(boot, 0700); err != nil {
+		return err
+	}
+	defer os.Remove(boot)
+	if err := syscall.Mount(rootdev.Partition(rootdev.Boot), boot, "vfat", syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("mounting the boot partition: %v", err)
+	}
+	defer syscall.Unmount(boot, 0)
+	if err := os.MkdirAll(permDir, 0700); err != nil {
+		return err
+	}
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		b, err := ioutil.ReadFile(filepath.Join(boot, bootDir, name))
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(permDir, name)
+		if old, err := ioutil.ReadFile(dest); err == nil && bytes.Equal(old, b) {
+			continue // up to date
+		}
+		if err := ioutil.WriteFile(dest+".tmp", b, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(dest+".tmp", dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// provisionWiFi copies /etc/wifi.json (gokr-packer -wifi_ssid) to
+// /perm/wifi.json, where github.com/gokrazy/wifi reads it.
+func provisionWiFi() error {
+	b, err := ioutil.ReadFile("/etc/wifi.json")
+	if err != nil {
+		return err
+	}
+	if old, err := ioutil.ReadFile("/perm/wifi.json"); err == nil && bytes.Equal(old, b) {
+		return nil // up to date
+	}
+	return ioutil.WriteFile("/perm/wifi.json", b, 0600)
+}
@@ -0,0 +1,96 @@
+package gokrazyinit
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// unsealSecrets decrypts the files sealed by gokr-packer -sealed_secrets using
+// the device’s private seal key, making them available in /tmp/secrets. The
+// sealed files start with magic.
+func unsealSecrets(magic string) error {
+	b, err := ioutil.ReadFile("/perm/gokrazy/seal.key.pem")
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return fmt.Errorf("/perm/gokrazy/seal.key.pem: no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("/perm/gokrazy/seal.key.pem: not an RSA private key")
+	}
+	if err := os.MkdirAll("/tmp/secrets", 0700); err != nil {
+		return err
+	}
+	fis, err := ioutil.ReadDir("/etc/gokrazy/sealed")
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		plaintext, err := unseal(priv, magic, name, filepath.Join("/etc/gokrazy/sealed", name))
+		if err != nil {
+			log.Printf("unsealing %s: %v", name, err)
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join("/tmp/secrets", name), plaintext, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unseal decrypts the sealed file fn (see sealMagic in gokr-packer).
+func unseal(priv *rsa.PrivateKey, magic, name, fn string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(magic)) {
+		return nil, fmt.Errorf("not a sealed file")
+	}
+	b = b[len(magic):]
+	if len(b) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), nil, priv, b[:n], nil)
+	if err != nil {
+		return nil, fmt.Errorf("sealed for a different seal key? %v", err)
+	}
+	b = b[n:]
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], []byte(name))
+}
@@ -0,0 +1,420 @@
+package gokrazyinit
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ServiceConfig holds settings which are applied to a supervised program
+// before it is started, see execService. gokr-packer reads them from the
+// per-package configuration files (e.g. resources.txt).
+type ServiceConfig struct {
+	// Env contains additional environment variables (key=value).
+	Env []string
+
+	// Nice is the nice value (-20 to 19) to run the program with, if non-empty.
+	Nice string
+
+	// OOMScoreAdj is written to /proc/<pid>/oom_score_adj, if non-empty.
+	OOMScoreAdj string
+
+	// Cgroup maps cgroup v2 interface files (e.g. memory.max) of the
+	// program’s cgroup to their contents.
+	Cgroup map[string]string
+
+	// Log is where the program’s stdout and stderr are written to in addition
+	// to the supervisor’s log buffer: empty (nowhere), “discard” (also not to
+	// the supervisor), “tmp” (rotating files in /tmp/logs) or “perm” (rotating
+	// files in /perm/logs). LogMaxBytes and LogMaxFiles limit the size of each
+	// log file and the number of log files kept.
+	Log         string
+	LogMaxBytes int64
+	LogMaxFiles int
+
+	// Syslog is the remote syslog server (<network>://<host>:<port>) to
+	// forward the program’s stdout and stderr to, if non-empty.
+	Syslog string
+
+	// Delay and Every schedule the program instead of supervising it as a
+	// daemon: it is started Delay after boot and then every Every (if
+	// non-zero).
+	Delay time.Duration
+	Every time.Duration
+
+	// Restart is the restart policy: empty (always restart), “on-failure” or
+	// “never”. RestartDelay is the time to wait before restarting.
+	Restart      string
+	RestartDelay time.Duration
+
+	// After contains the paths of the programs which must have been started
+	// before the program is started, waiting for at most AfterTimeout.
+	After        []string
+	AfterTimeout time.Duration
+
+	// Started is set if other programs are started after the program: it
+	// then records that it was started, see After.
+	Started bool
+
+	// Files is set if the program has /etc/gokrazy/<program>/flags or env
+	// files, whose command-line flags and environment variables are passed to
+	// the program.
+	Files bool
+}
+
+// usesCgroups returns whether any of services configures cgroup resource
+// limits.
+func usesCgroups(services map[string]ServiceConfig) bool {
+	for _, svc := range services {
+		if len(svc.Cgroup) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// mountCgroup2 mounts the cgroup v2 hierarchy and enables the controllers
+// used in ServiceConfig.Cgroup for the programs’ cgroups.
+func mountCgroup2() error {
+	if err := syscall.Mount("cgroup2", "/sys/fs/cgroup", "cgroup2", 0, ""); err != nil {
+		return fmt.Errorf("mounting cgroup2: %v", err)
+	}
+	return ioutil.WriteFile("/sys/fs/cgroup/cgroup.subtree_control", []byte("+memory +cpu"), 0644)
+}
+
+// execService is run when the supervisor starts init on behalf of a program
+// with a ServiceConfig: init applies the configuration to its own process,
+// then replaces itself with the program.
+func execService(path string, cfg ServiceConfig) error {
+	waitStarted(path, cfg)
+	if (cfg.Delay != 0 || cfg.Every != 0) && os.Getenv("GOKRAZY_SCHEDULED") == "" {
+		return runScheduled(path, cfg)
+	}
+	if (cfg.Restart != "" || cfg.RestartDelay != 0) && os.Getenv("GOKRAZY_SUPERVISED") == "" {
+		return runSupervised(path, cfg)
+	}
+	if cfg.Nice != "" {
+		nice, err := strconv.Atoi(cfg.Nice)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice); err != nil {
+			return fmt.Errorf("setpriority: %v", err)
+		}
+	}
+	if cfg.OOMScoreAdj != "" {
+		if err := ioutil.WriteFile("/proc/self/oom_score_adj", []byte(cfg.OOMScoreAdj), 0644); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Cgroup) > 0 {
+		dir := filepath.Join("/sys/fs/cgroup", programName(path))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		for file, val := range cfg.Cgroup {
+			if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(val), 0644); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			return err
+		}
+	}
+	if cfg.Started {
+		if err := os.MkdirAll(startedDir, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(startedMarker(path), nil, 0644); err != nil {
+			return err
+		}
+	}
+	args, env := os.Args, os.Environ()
+	if cfg.Files {
+		flags, fileEnv, err := programFiles(path)
+		if err != nil {
+			return err
+		}
+		args = append(args[:len(args):len(args)], flags...)
+		env = append(env, fileEnv...)
+	}
+	env = append(env, cfg.Env...)
+	switch cfg.Log {
+	case "discard":
+		null, err := os.OpenFile("/dev/null", os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		for _, fd := range []int{1, 2} {
+			if err := syscall.Dup3(int(null.Fd()), fd, 0); err != nil {
+				return err
+			}
+		}
+	case "tmp", "perm":
+		return runLogged(path, cfg, args, env)
+	}
+	if cfg.Syslog != "" {
+		return runLogged(path, cfg, args, env)
+	}
+	return syscall.Exec(path, args, env)
+}
+
+// programName returns the name of the program path for file names, e.g.
+// user-hello for /user/hello.
+func programName(path string) string {
+	return strings.TrimPrefix(strings.ReplaceAll(path, "/", "-"), "-")
+}
+
+// programFilesDir contains the flags and env files of the programs.
+var programFilesDir = "/etc/gokrazy" // for testing
+
+// programFiles returns the command-line flags and environment variables (one
+// per line) of /etc/gokrazy/<program>/flags and env, if present.
+func programFiles(path string) (flags, env []string, _ error) {
+	dir := filepath.Join(programFilesDir, filepath.Base(path))
+	for _, f := range []struct {
+		name  string
+		lines *[]string
+	}{
+		{"flags", &flags},
+		{"env", &env},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line != "" {
+				*f.lines = append(*f.lines, line)
+			}
+		}
+	}
+	return flags, env, nil
+}
+
+// childProcess tracks the program which init runs as a child process, so that
+// signals from the supervisor can be forwarded to it.
+type childProcess struct {
+	mu      sync.Mutex
+	running *os.Process
+}
+
+// forwardSignals stops the current child process when the supervisor stops
+// the program (SIGTERM or SIGINT), then exits.
+func (cp *childProcess) forwardSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		cp.mu.Lock()
+		if cp.running != nil {
+			cp.running.Signal(sig)
+		}
+		cp.mu.Unlock()
+		os.Exit(0)
+	}()
+}
+
+// run runs the program path via init, with envVar (e.g. GOKRAZY_SCHEDULED=1)
+// telling init which part of the ServiceConfig is already taken care of.
+func (cp *childProcess) run(path, envVar string) error {
+	cmd := &exec.Cmd{
+		Path:   "/gokrazy/init",
+		Args:   []string{path},
+		Env:    append(os.Environ(), envVar),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	cp.mu.Lock()
+	cp.running = cmd.Process
+	cp.mu.Unlock()
+	err := cmd.Wait()
+	cp.mu.Lock()
+	cp.running = nil
+	cp.mu.Unlock()
+	return err
+}
+
+// runScheduled starts the program cfg.Delay after boot and then every
+// cfg.Every, instead of keeping it running. Each run is started via init, which
+// applies the remainder of the configuration.
+func runScheduled(path string, cfg ServiceConfig) error {
+	var cp childProcess
+	cp.forwardSignals()
+	time.Sleep(cfg.Delay)
+	for {
+		start := time.Now()
+		if err := cp.run(path, "GOKRAZY_SCHEDULED=1"); err != nil {
+			log.Printf("%s: %v", path, err)
+		}
+		if cfg.Every == 0 {
+			// Ran once after boot. Keep running so that the supervisor does
+			// not restart the program:
+			select {}
+		}
+		time.Sleep(time.Until(nextRun(start, cfg.Every, time.Now())))
+	}
+}
+
+// nextRun returns the start time of the run following the run started at
+// start, skipping runs which were missed (as of now) because the program ran
+// for too long.
+func nextRun(start time.Time, every time.Duration, now time.Time) time.Time {
+	next := start.Add(every)
+	for !now.Before(next) {
+		next = next.Add(every)
+	}
+	return next
+}
+
+// startedDir contains a file for each program which other programs are
+// started after (ServiceConfig.After), created when the program is started.
+var startedDir = "/tmp/gokrazy-started" // for testing
+
+func startedMarker(path string) string {
+	return filepath.Join(startedDir, programName(path))
+}
+
+// waitStarted waits until the programs in cfg.After were started, or until
+// cfg.AfterTimeout passed.
+func waitStarted(path string, cfg ServiceConfig) {
+	deadline := time.Now().Add(cfg.AfterTimeout)
+	for _, after := range cfg.After {
+		for {
+			if _, err := os.Stat(startedMarker(after)); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				log.Printf("%s: not waiting any longer for %s to be started", path, after)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// runSupervised runs the program via init and restarts it according to
+// cfg.Restart. Once the program is not restarted anymore, runSupervised keeps
+// running so that the supervisor does not restart the program either.
+func runSupervised(path string, cfg ServiceConfig) error {
+	var cp childProcess
+	cp.forwardSignals()
+	superviseRestarts(path, cfg, func() error {
+		return cp.run(path, "GOKRAZY_SUPERVISED=1")
+	})
+	select {}
+}
+
+// superviseRestarts calls run (which runs the program path) and calls it
+// again after cfg.RestartDelay for as long as cfg.Restart says so.
+func superviseRestarts(path string, cfg ServiceConfig, run func() error) {
+	for {
+		err := run()
+		if err != nil {
+			log.Printf("%s: %v", path, err)
+		}
+		if !restart(cfg.Restart, err) {
+			log.Printf("%s: not restarting (restart=%s)", path, cfg.Restart)
+			return
+		}
+		time.Sleep(cfg.RestartDelay)
+	}
+}
+
+// restart returns whether the restart policy restarts a program which exited
+// with err.
+func restart(policy string, err error) bool {
+	switch policy {
+	case "never":
+		return false
+	case "on-failure":
+		return err != nil
+	default:
+		return true
+	}
+}
+
+// runLogged runs the program as a child process, writing its output to both
+// the supervisor and rotating log files and/or a remote syslog server.
+func runLogged(path string, cfg ServiceConfig, args, env []string) error {
+	stdout := []io.Writer{os.Stdout}
+	stderr := []io.Writer{os.Stderr}
+	if cfg.Log == "tmp" || cfg.Log == "perm" {
+		base := "/tmp/logs"
+		if cfg.Log == "perm" {
+			base = "/perm/logs"
+		}
+		dir := filepath.Join(base, programName(path))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		rw := &rotatingWriter{
+			dir:      dir,
+			maxBytes: cfg.LogMaxBytes,
+			maxFiles: cfg.LogMaxFiles,
+		}
+		stdout = append(stdout, rw)
+		stderr = append(stderr, rw)
+	}
+	if cfg.Syslog != "" {
+		const (
+			severityNotice = 5
+			severityInfo   = 6
+		)
+		tag := filepath.Base(path)
+		sw, err := newSyslogWriter(cfg.Syslog, tag, severityInfo)
+		if err != nil {
+			return err
+		}
+		stdout = append(stdout, sw)
+		sw, err = newSyslogWriter(cfg.Syslog, tag, severityNotice)
+		if err != nil {
+			return err
+		}
+		stderr = append(stderr, sw)
+	}
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   args,
+		Env:    env,
+		Stdout: io.MultiWriter(stdout...),
+		Stderr: io.MultiWriter(stderr...),
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Forward signals (e.g. SIGTERM when the supervisor stops the program):
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs)
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+				os.Exit(ws.ExitStatus())
+			}
+		}
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
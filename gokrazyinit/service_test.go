@@ -0,0 +1,180 @@
+package gokrazyinit
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRestart(t *testing.T) {
+	failed := errors.New("exit status 1")
+	for _, tt := range []struct {
+		policy string
+		err    error
+		want   bool
+	}{
+		{"", nil, true},
+		{"", failed, true},
+		{"on-failure", nil, false},
+		{"on-failure", failed, true},
+		{"never", nil, false},
+		{"never", failed, false},
+	} {
+		if got := restart(tt.policy, tt.err); got != tt.want {
+			t.Errorf("restart(%q, %v) = %v, want %v", tt.policy, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSuperviseRestarts(t *testing.T) {
+	failed := errors.New("exit status 1")
+	for _, tt := range []struct {
+		policy string
+		errs   []error // returned by the successive runs
+		want   int
+	}{
+		{"never", []error{failed}, 1},
+		{"on-failure", []error{failed, failed, nil}, 3},
+	} {
+		var runs int
+		start := time.Now()
+		superviseRestarts("/gokrazy/test", ServiceConfig{
+			Restart:      tt.policy,
+			RestartDelay: 10 * time.Millisecond,
+		}, func() error {
+			err := tt.errs[runs]
+			runs++
+			return err
+		})
+		if runs != tt.want {
+			t.Errorf("restart=%q: got %d runs, want %d", tt.policy, runs, tt.want)
+		}
+		if got, want := time.Since(start), time.Duration(tt.want-1)*10*time.Millisecond; got < want {
+			t.Errorf("restart=%q: returned after %v, want at least %v (restart_delay)", tt.policy, got, want)
+		}
+	}
+}
+
+func TestSuperviseRestartsAlways(t *testing.T) {
+	runs := make(chan struct{})
+	go superviseRestarts("/gokrazy/test", ServiceConfig{}, func() error {
+		runs <- struct{}{}
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		select {
+		case <-runs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("program was not restarted after %d successful runs", i)
+		}
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		now  time.Duration // since start
+		want time.Duration // since start
+	}{
+		{10 * time.Second, time.Minute},
+		{time.Minute, 2 * time.Minute},
+		// Runs missed while the program ran for too long are skipped:
+		{150 * time.Second, 3 * time.Minute},
+	} {
+		if got := nextRun(start, time.Minute, start.Add(tt.now)); !got.Equal(start.Add(tt.want)) {
+			t.Errorf("nextRun(now=start+%v) = start+%v, want start+%v", tt.now, got.Sub(start), tt.want)
+		}
+	}
+}
+
+func TestWaitStarted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokrazyinit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { startedDir = d }(startedDir)
+	startedDir = dir
+
+	cfg := ServiceConfig{
+		After:        []string{"/gokrazy/dhcp"},
+		AfterTimeout: 5 * time.Second,
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		ioutil.WriteFile(startedMarker("/gokrazy/dhcp"), nil, 0644)
+	}()
+	start := time.Now()
+	waitStarted("/gokrazy/app", cfg)
+	if got := time.Since(start); got < 200*time.Millisecond || got >= cfg.AfterTimeout {
+		t.Errorf("waitStarted returned after %v, want after /gokrazy/dhcp was started", got)
+	}
+
+	// Programs which are never started delay the program by AfterTimeout:
+	cfg = ServiceConfig{
+		After:        []string{"/gokrazy/missing"},
+		AfterTimeout: 300 * time.Millisecond,
+	}
+	start = time.Now()
+	waitStarted("/gokrazy/app", cfg)
+	if got := time.Since(start); got < cfg.AfterTimeout {
+		t.Errorf("waitStarted returned after %v, want after %v", got, cfg.AfterTimeout)
+	}
+}
+
+func TestProgramFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokrazyinit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { programFilesDir = d }(programFilesDir)
+	programFilesDir = dir
+
+	if err := os.MkdirAll(filepath.Join(dir, "hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "hello", "flags"), []byte("-v\n-name=gokrazy\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "hello", "env"), []byte("GOGC=50\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	flags, env, err := programFiles("/gokrazy/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-v", "-name=gokrazy"}; !reflect.DeepEqual(flags, want) {
+		t.Errorf("flags: got %q, want %q", flags, want)
+	}
+	if want := []string{"GOGC=50"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("env: got %q, want %q", env, want)
+	}
+
+	flags, env, err = programFiles("/gokrazy/other")
+	if err != nil || flags != nil || env != nil {
+		t.Errorf("program without files: got %q, %q, %v, want none", flags, env, err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	cmds := commands(&Config{
+		Programs: []string{"/gokrazy/dhcp", "/gokrazy/hello"},
+		Services: map[string]ServiceConfig{
+			"/gokrazy/hello": {Restart: "never"},
+		},
+	})
+	if len(cmds) != 2 {
+		t.Fatalf("got %d commands, want 2", len(cmds))
+	}
+	if got, want := cmds[0].Args, []string{"/gokrazy/dhcp"}; cmds[0].Path != "/gokrazy/dhcp" || !reflect.DeepEqual(got, want) {
+		t.Errorf("unconfigured program: got %s %q, want it started directly", cmds[0].Path, got)
+	}
+	if got, want := cmds[1].Args, []string{"/gokrazy/hello"}; cmds[1].Path != "/gokrazy/init" || !reflect.DeepEqual(got, want) {
+		t.Errorf("configured program: got %s %q, want it started via /gokrazy/init", cmds[1].Path, got)
+	}
+}
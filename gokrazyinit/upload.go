@@ -0,0 +1,217 @@
+package gokrazyinit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// uploadDir contains the programs uploaded by gokr-packer push and run-on. It
+// is on tmpfs, so uploads (and diversions) do not survive a reboot.
+const uploadDir = "/tmp/gokrazy-upload"
+
+// uploadPath returns the path of the uploaded program name.
+func uploadPath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid upload name %q", name)
+	}
+	return filepath.Join(uploadDir, name), nil
+}
+
+// uploadTempHandler stores (PUT) or removes (DELETE) the uploaded program
+// /uploadtemp/<name>.
+func uploadTempHandler(w http.ResponseWriter, r *http.Request) {
+	path, err := uploadPath(strings.TrimPrefix(r.URL.Path, "/uploadtemp/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if err := storeUpload(path, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "expected a PUT or DELETE request", http.StatusMethodNotAllowed)
+	}
+}
+
+// storeUpload atomically replaces the executable at path with the contents
+// of r.
+func storeUpload(path string, r io.Reader) error {
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(uploadDir, ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // in case of an error
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0755); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+var (
+	divertedMu sync.Mutex
+	diverted   = make(map[string]bool)
+)
+
+// divertHandler returns a handler which replaces the supervised program path
+// with the uploaded program diversion by bind-mounting it over path, then
+// restarts the program. supervised contains the paths of the supervised
+// programs.
+func divertHandler(supervised map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		path := r.FormValue("path")
+		if !supervised[path] {
+			http.Error(w, fmt.Sprintf("%s is not a supervised program", path), http.StatusNotFound)
+			return
+		}
+		upload, err := uploadPath(r.FormValue("diversion"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(upload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		divertedMu.Lock()
+		defer divertedMu.Unlock()
+		if diverted[path] {
+			// Replace the previous diversion instead of stacking mounts:
+			if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil {
+				http.Error(w, fmt.Sprintf("unmounting previous diversion: %v", err), http.StatusInternalServerError)
+				return
+			}
+			diverted[path] = false
+		}
+		if err := syscall.Mount(upload, path, "", syscall.MS_BIND, ""); err != nil {
+			http.Error(w, fmt.Sprintf("mounting %s over %s: %v", upload, path, err), http.StatusInternalServerError)
+			return
+		}
+		diverted[path] = true
+		log.Printf("diverted %s to %s", path, upload)
+		if err := signalSupervised(path, syscall.SIGTERM); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// signalSupervised sends sig to the process which the supervisor started for
+// the program path (if it is running), so that the supervisor restarts it.
+// Programs with a ServiceConfig are started via init, which keeps the
+// program’s path as argv[0].
+func signalSupervised(path string, sig syscall.Signal) error {
+	fis, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		pid, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue // not a process
+		}
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue // exited in the meantime
+		}
+		// The fields after the (parenthesized) command name start with the
+		// state and the parent pid:
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 2 || fields[1] != "1" {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if err != nil {
+			continue
+		}
+		if argv0 := bytes.SplitN(cmdline, []byte{0}, 2)[0]; string(argv0) != path {
+			continue
+		}
+		return syscall.Kill(pid, sig)
+	}
+	return nil // not running, the diversion applies once it is started
+}
+
+// flushWriter flushes each write, so that the output of a program run by
+// runTempHandler arrives as it is written.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// runTempHandler runs the uploaded program name once with the arguments arg,
+// streaming its combined stdout and stderr. The exit status is sent as the
+// X-Gokrazy-Exit-Status trailer. The program is killed when the client
+// disconnects.
+func runTempHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	path, err := uploadPath(r.FormValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Trailer", "X-Gokrazy-Exit-Status")
+	out := &flushWriter{w: w}
+	cmd := exec.CommandContext(r.Context(), path, r.Form["arg"]...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	status := 0
+	if err := cmd.Run(); err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			status = ee.ExitCode()
+		} else {
+			fmt.Fprintf(out, "%v\n", err)
+			status = 1
+		}
+	}
+	w.Header().Set("X-Gokrazy-Exit-Status", strconv.Itoa(status))
+}
@@ -0,0 +1,65 @@
+package packer
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var (
+	mdnsInstance = flag.String("mdns_instance",
+		"",
+		"DNS-SD instance name which the target system advertises via mDNS (default: the -hostname value)")
+
+	mdnsTXT = flag.String("mdns_txt",
+		"",
+		"comma-separated list of key=value TXT records which the target system advertises via mDNS in addition to version=<build timestamp>, e.g. role=kiosk,site=office")
+)
+
+// mdnsConfig is stored in /etc/gokrazy/mdns.json and describes the DNS-SD
+// service which the mDNS responder of the generated init advertises (see
+// gokr-packer discover).
+type mdnsConfig struct {
+	Service  string            `json:"service"`
+	Instance string            `json:"instance"`
+	Port     int               `json:"port"`
+	TXT      map[string]string `json:"txt"`
+}
+
+// mdnsAdvertisement returns the contents of /etc/gokrazy/mdns.json for the
+// web interface of hostname reachable via schema.
+func mdnsAdvertisement(hostname, schema string) (string, error) {
+	cfg := mdnsConfig{
+		Service:  "_gokrazy._tcp",
+		Instance: *mdnsInstance,
+		Port:     80,
+		TXT: map[string]string{
+			"version": buildTimestamp,
+		},
+	}
+	if cfg.Instance == "" {
+		cfg.Instance = hostname
+	}
+	if schema == "https" {
+		cfg.Port = 443
+	}
+	if *mdnsTXT != "" {
+		for _, kv := range strings.Split(*mdnsTXT, ",") {
+			idx := strings.IndexByte(kv, '=')
+			if idx < 1 {
+				return "", fmt.Errorf("-mdns_txt: %q is not of the form key=value", kv)
+			}
+			// Each TXT record is prefixed with a single length byte:
+			if len(kv) > 255 {
+				return "", fmt.Errorf("-mdns_txt: %q exceeds 255 bytes", kv)
+			}
+			cfg.TXT[kv[:idx]] = kv[idx+1:]
+		}
+	}
+	b, err := json.MarshalIndent(&cfg, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
@@ -0,0 +1,175 @@
+// Package packer builds gokrazy installations: SD card images, boot and root
+// file system images, and updates of running installations. It implements the
+// gokr-packer command (see Main) and can be used by programs (e.g. CI systems)
+// to build images without running the gokr-packer binary (see Build).
+package packer
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+)
+
+// Config describes a build. Zero values select the gokr-packer defaults.
+type Config struct {
+	// Packages are the Go packages to install, like the arguments of
+	// gokr-packer.
+	Packages []string
+
+	// Hostname is the -hostname of the installation.
+	Hostname string
+
+	// Board is the -board to build for, e.g. rpi4.
+	Board string
+
+	// KernelPackage and FirmwarePackage are the (comma-separated)
+	// -kernel_package and -firmware_package. Empty values select the
+	// packages of the board or target architecture.
+	KernelPackage   string
+	FirmwarePackage string
+
+	// SerialConsole is the -serial_console, e.g. ttyS0,115200 or disabled.
+	// Empty selects the console of the board.
+	SerialConsole string
+
+	// TLS is the -tls setting of the web interface, e.g. self-signed.
+	TLS string
+
+	// Image is the path of the SD card image (-overwrite) to write, of
+	// TargetStorageBytes bytes.
+	Image              string
+	TargetStorageBytes uint64
+
+	// Boot, Root and MBR are the paths of the boot and root file system
+	// images and the MBR (-overwrite_boot, -overwrite_root, -overwrite_mbr) to
+	// write.
+	Boot, Root, MBR string
+
+	// Update is the URL of the gokrazy installation to update (-update).
+	Update string
+
+	// Hooks are run in addition to the hook_pre_pack and hook_post_pack
+	// commands, in order.
+	Hooks []Hook
+
+	// sudo is the -sudo mode of gokr-packer. Build leaves it empty, which
+	// never uses sudo.
+	sudo string
+}
+
+// Hook is a build step for vendor-specific processing, e.g. generating assets
+// or flashing tools.
+type Hook interface {
+	// PrePack is called after the programs are built and before the file
+	// systems are written. Files placed in stagingDir are added to the root
+	// file system.
+	PrePack(ctx context.Context, stagingDir string) error
+
+	// PostPack is called after the outputs were written (and before an
+	// update is installed).
+	PostPack(ctx context.Context, artifacts *Artifacts) error
+}
+
+// Artifacts describes the outputs of a build.
+type Artifacts struct {
+	// Image, Boot, Root and MBR are the paths of the written outputs of the
+	// Config (empty if not requested). QCOW2 is the path of the qcow2 image
+	// written with the output_format=qcow2 flag, Compressed the path of the
+	// compressed image written with the compress flag.
+	Image      string `json:"image,omitempty"`
+	Boot       string `json:"boot,omitempty"`
+	Root       string `json:"root,omitempty"`
+	MBR        string `json:"mbr,omitempty"`
+	QCOW2      string `json:"qcow2,omitempty"`
+	Compressed string `json:"compressed,omitempty"`
+
+	// SBOM is the path of the Software Bill of Materials (sbom flag), if any.
+	SBOM string `json:"sbom,omitempty"`
+
+	// BuildTimestamp identifies the build, see gokrazy.Boot.
+	BuildTimestamp string `json:"build_timestamp,omitempty"`
+}
+
+// buildMu serializes builds, as builds share state like the Go environment
+// of the target architecture.
+var buildMu sync.Mutex
+
+// flagConfig returns the Config of the gokr-packer command line. Flags which
+// were not specified are left empty, so that their defaults are derived like
+// for Build (see resolveConfig).
+func flagConfig() *Config {
+	set := explicitFlags()
+	explicit := func(name, value string) string {
+		if !set[name] {
+			return ""
+		}
+		return value
+	}
+	return &Config{
+		Packages:           flag.Args(),
+		Hostname:           *hostname,
+		Board:              *targetBoard,
+		KernelPackage:      explicit("kernel_package", kernelPackageFlag.String()),
+		FirmwarePackage:    explicit("firmware_package", *firmwarePackage),
+		SerialConsole:      *serialConsole,
+		TLS:                *useTLS,
+		Image:              *overwrite,
+		TargetStorageBytes: uint64(*targetStorageBytes),
+		Boot:               *overwriteBoot,
+		Root:               *overwriteRoot,
+		MBR:                *overwriteMBR,
+		Update:             *update,
+		sudo:               *sudo,
+	}
+}
+
+// Build builds the gokrazy installation described by cfg, like gokr-packer.
+// Builds are serialized, i.e. concurrent calls wait for each other. Progress
+// is logged using the log package. The gokr-packer flags, config files and
+// profiles are not used: settings which Config does not cover keep their
+// defaults.
+//
+// Build does not elevate privileges using sudo, so writing to devices requires
+// running as root. Canceling ctx aborts the compilation of the packages.
+func Build(ctx context.Context, cfg *Config) (*Artifacts, error) {
+	buildMu.Lock()
+	defer buildMu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c := *cfg
+	c.sudo = ""
+	if err := resolveConfig(&c); err != nil {
+		return nil, err
+	}
+	if !haveOutput(&c) {
+		return nil, fmt.Errorf("no output specified (Image, Boot, Root or Update)")
+	}
+	if err := checkFlags(&c); err != nil {
+		return nil, err
+	}
+	if err := logic(ctx, &c); err != nil {
+		return nil, err
+	}
+	return currentArtifacts(&c), nil
+}
+
+// currentArtifacts returns the Artifacts of the build of cfg.
+func currentArtifacts(cfg *Config) *Artifacts {
+	artifacts := &Artifacts{
+		Image:          cfg.Image,
+		Boot:           cfg.Boot,
+		Root:           cfg.Root,
+		MBR:            cfg.MBR,
+		SBOM:           *sbomFile,
+		BuildTimestamp: buildTimestamp,
+	}
+	if cfg.Image != "" && *outputFormat == "qcow2" {
+		artifacts.QCOW2 = cfg.Image + ".qcow2"
+	}
+	if cfg.Image != "" && *compressImage != "" {
+		artifacts.Compressed = compressedImagePath(cfg.Image)
+	}
+	return artifacts
+}
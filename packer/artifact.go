@@ -0,0 +1,532 @@
+package packer
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	kernelSource = flag.String("kernel_source",
+		"",
+		"if non-empty, copy vmlinuz and *.dtb from a prebuilt kernel artifact instead of -kernel_package: either a .tar.gz archive (https://example.com/kernel.tar.gz#sha256=<hex>) or an OCI image (oci://ghcr.io/example/kernel@sha256:<hex>, or :<tag>). Pinned digests are verified, and the extracted artifact is cached in sources/ of -cache_dir (e.g. ~/.cache/gokrazy/sources)")
+
+	firmwareSource = flag.String("firmware_source",
+		"",
+		"like -kernel_source, but replaces -firmware_package")
+)
+
+// artifactClient downloads -kernel_source and -firmware_source artifacts.
+var artifactClient = &http.Client{Timeout: 10 * time.Minute}
+
+// isArtifactSource returns whether pkg refers to a -kernel_source or
+// -firmware_source artifact instead of a Go package.
+func isArtifactSource(pkg string) bool {
+	return strings.HasPrefix(pkg, "https://") ||
+		strings.HasPrefix(pkg, "http://") ||
+		strings.HasPrefix(pkg, "oci://")
+}
+
+// goPackages returns the pkgs which are Go packages, i.e. no artifacts.
+func goPackages(pkgs []string) []string {
+	var result []string
+	for _, pkg := range pkgs {
+		if !isArtifactSource(pkg) {
+			result = append(result, pkg)
+		}
+	}
+	return result
+}
+
+var sha256Re = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// artifactRef is a parsed -kernel_source or -firmware_source.
+type artifactRef struct {
+	// url is the URL of a .tar.gz archive, or empty for OCI images.
+	url string
+
+	// registry, repository and reference (a tag or digest) of OCI images.
+	registry, repository, reference string
+
+	// digest is the pinned sha256 digest (hex) of the archive or the OCI
+	// manifest, or empty.
+	digest string
+}
+
+func parseArtifactRef(source string) (artifactRef, error) {
+	if strings.HasPrefix(source, "oci://") {
+		rest := strings.TrimPrefix(source, "oci://")
+		slash := strings.IndexByte(rest, '/')
+		if slash == -1 {
+			return artifactRef{}, fmt.Errorf("%s: expected oci://<registry>/<repository>[:<tag>|@sha256:<hex>]", source)
+		}
+		ref := artifactRef{registry: rest[:slash], repository: rest[slash+1:], reference: "latest"}
+		if idx := strings.LastIndex(ref.repository, "@"); idx != -1 {
+			ref.reference = ref.repository[idx+1:]
+			ref.repository = ref.repository[:idx]
+			ref.digest = strings.TrimPrefix(ref.reference, "sha256:")
+			if !strings.HasPrefix(ref.reference, "sha256:") || !sha256Re.MatchString(ref.digest) {
+				return artifactRef{}, fmt.Errorf("%s: malformed digest %q, expected sha256:<hex>", source, ref.reference)
+			}
+		} else if idx := strings.LastIndex(ref.repository, ":"); idx > strings.LastIndex(ref.repository, "/") {
+			ref.reference = ref.repository[idx+1:]
+			ref.repository = ref.repository[:idx]
+		}
+		if ref.repository == "" {
+			return artifactRef{}, fmt.Errorf("%s: empty repository", source)
+		}
+		return ref, nil
+	}
+	ref := artifactRef{url: source}
+	if idx := strings.Index(source, "#"); idx != -1 {
+		ref.url = source[:idx]
+		frag := source[idx+1:]
+		ref.digest = strings.TrimPrefix(frag, "sha256=")
+		if !strings.HasPrefix(frag, "sha256=") || !sha256Re.MatchString(ref.digest) {
+			return artifactRef{}, fmt.Errorf("%s: malformed digest %q, expected #sha256=<hex>", source, frag)
+		}
+	}
+	if !strings.HasSuffix(ref.url, ".tar.gz") && !strings.HasSuffix(ref.url, ".tgz") {
+		return artifactRef{}, fmt.Errorf("%s: only .tar.gz archives are supported", source)
+	}
+	return ref, nil
+}
+
+// checkArtifactSources verifies the syntax of -kernel_source and
+// -firmware_source.
+func checkArtifactSources() error {
+	for name, source := range map[string]string{"kernel_source": *kernelSource, "firmware_source": *firmwareSource} {
+		if source == "" {
+			continue
+		}
+		if !isArtifactSource(source) {
+			return fmt.Errorf("-%s=%s: expected an https:// or oci:// URL", name, source)
+		}
+		if _, err := parseArtifactRef(source); err != nil {
+			return fmt.Errorf("-%s: %v", name, err)
+		}
+	}
+	if *kernelSource != "" && *kernelFlavor != "" {
+		return fmt.Errorf("-kernel_source and -kernel are mutually exclusive")
+	}
+	return nil
+}
+
+// applyArtifactSources replaces the default kernel package and the firmware
+// packages with -kernel_source and -firmware_source, whose directories are
+// returned by packageDir.
+func applyArtifactSources(cfg *Config) {
+	if *kernelSource != "" {
+		setDefaultKernelPackage(cfg, *kernelSource)
+	}
+	if *firmwareSource != "" {
+		cfg.FirmwarePackage = *firmwareSource
+	}
+}
+
+func artifactCacheDir() (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sources"), nil
+}
+
+// artifactDirs caches the directories of the artifacts fetched by this
+// process, so that each unpinned artifact is only downloaded once per build.
+var artifactDirs = make(map[string]string)
+
+// artifactDir returns the directory containing the extracted artifact source
+// (see -kernel_source), downloading it unless it is cached.
+func artifactDir(ctx context.Context, source string) (string, error) {
+	if dir, ok := artifactDirs[source]; ok {
+		return dir, nil
+	}
+	ref, err := parseArtifactRef(source)
+	if err != nil {
+		return "", err
+	}
+	cache, err := artifactCacheDir()
+	if err != nil {
+		return "", err
+	}
+	if ref.digest != "" {
+		dir := filepath.Join(cache, ref.digest)
+		if _, err := os.Stat(dir); err == nil {
+			now := time.Now()
+			os.Chtimes(dir, now, now) // most recently used, see gcCache
+			artifactDirs[source] = dir
+			return dir, nil
+		}
+	}
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(cache, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	log.Printf("fetching %s", source)
+	var digest string
+	if ref.url != "" {
+		digest, err = fetchArchive(ctx, ref.url, tmp)
+	} else {
+		digest, err = fetchOCI(ctx, ref, tmp)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", source, err)
+	}
+	if ref.digest != "" && digest != ref.digest {
+		return "", fmt.Errorf("%s: digest mismatch: got sha256:%s, want sha256:%s", source, digest, ref.digest)
+	}
+	if ref.digest == "" {
+		log.Printf("%s is not pinned, its current digest is sha256:%s", source, digest)
+	}
+	dir := filepath.Join(cache, digest)
+	if _, err := os.Stat(dir); err != nil {
+		if err := os.Rename(tmp, dir); err != nil {
+			return "", err
+		}
+	}
+	artifactDirs[source] = dir
+	return dir, nil
+}
+
+// fetchArchive downloads and extracts the .tar.gz archive at rawurl into dir
+// and returns the sha256 digest (hex) of the archive.
+func fetchArchive(ctx context.Context, rawurl, dir string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := artifactClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
+	}
+	h := sha256.New()
+	prog := newProgress("downloading "+path.Base(rawurl), resp.ContentLength)
+	defer prog.finish()
+	if err := extractTar(io.TeeReader(resp.Body, io.MultiWriter(h, prog)), dir); err != nil {
+		return "", err
+	}
+	// Hash any trailing bytes (e.g. tar padding) which were not read:
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// extractTar extracts the regular files and directories of the (optionally
+// gzip-compressed) tar archive r into dir. If all files are contained in a
+// single top-level directory (as in GitHub release archives), its contents
+// are extracted instead.
+func extractTar(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("archive entry %q is outside of the archive", hdr.Name)
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			names = append(names, name)
+		default:
+			continue // symlinks etc. are not needed for boot files
+		}
+	}
+	return flattenTopLevelDir(dir, names)
+}
+
+// flattenTopLevelDir moves the contents of the single top-level directory of
+// dir (if all files are contained in one) into dir.
+func flattenTopLevelDir(dir string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	top := strings.SplitN(names[0], "/", 2)[0]
+	for _, name := range names {
+		if !strings.HasPrefix(name, top+"/") {
+			return nil
+		}
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(fis) != 1 {
+		return nil
+	}
+	sub := filepath.Join(dir, top)
+	entries, err := ioutil.ReadDir(sub)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if err := os.Rename(filepath.Join(sub, fi.Name()), filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(sub)
+}
+
+// OCI media types of manifests and image indexes (including their Docker
+// equivalents).
+const (
+	ociManifest        = "application/vnd.oci.image.manifest.v1+json"
+	ociIndex           = "application/vnd.oci.image.index.v1+json"
+	dockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type ociManifestJSON struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociRegistry talks to an OCI distribution (Docker registry v2) API, fetching
+// an anonymous bearer token when the registry requires one.
+type ociRegistry struct {
+	ctx   context.Context
+	ref   artifactRef
+	token string
+}
+
+var bearerParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+func (r *ociRegistry) get(p, accept string) (*http.Response, error) {
+	rawurl := "https://" + r.ref.registry + "/v2/" + r.ref.repository + p
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, rawurl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		}
+		resp, err := artifactClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err := r.authenticate(challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: unexpected HTTP status code: got %d, want %d", rawurl, got, want)
+		}
+		return resp, nil
+	}
+}
+
+// authenticate fetches an anonymous pull token as described by the
+// WWW-Authenticate challenge of the registry.
+func (r *ociRegistry) authenticate(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("registry %s requires unsupported authentication %q", r.ref.registry, challenge)
+	}
+	params := make(map[string]string)
+	for _, m := range bearerParamRe.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("registry %s: no realm in %q", r.ref.registry, challenge)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + r.ref.repository + ":pull"
+	}
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, params["realm"], nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+	req.URL.RawQuery = q.Encode()
+	resp, err := artifactClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return fmt.Errorf("%s: unexpected HTTP status code: got %d, want %d", req.URL, got, want)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	return nil
+}
+
+// manifest returns the manifest with the specified reference and its sha256
+// digest (hex).
+func (r *ociRegistry) manifest(reference string) (*ociManifestJSON, string, error) {
+	resp, err := r.get("/manifests/"+reference, strings.Join([]string{ociManifest, ociIndex, dockerManifest, dockerManifestList}, ", "))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var m ociManifestJSON
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, "", err
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+	return &m, fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// fetchOCI extracts the layers of the OCI image ref (for the target
+// architecture, if the image is multi-platform) into dir and returns the
+// sha256 digest (hex) of the referenced manifest.
+func fetchOCI(ctx context.Context, ref artifactRef, dir string) (string, error) {
+	r := &ociRegistry{ctx: ctx, ref: ref}
+	m, digest, err := r.manifest(ref.reference)
+	if err != nil {
+		return "", err
+	}
+	if m.MediaType == ociIndex || m.MediaType == dockerManifestList || len(m.Manifests) > 0 {
+		goarch := targetGOARCH()
+		var platform string
+		for _, desc := range m.Manifests {
+			if desc.Platform == nil || (desc.Platform.OS == "linux" && desc.Platform.Architecture == goarch) {
+				platform = desc.Digest
+				break
+			}
+		}
+		if platform == "" {
+			return "", fmt.Errorf("image index contains no linux/%s image", goarch)
+		}
+		if m, _, err = r.manifest(platform); err != nil {
+			return "", err
+		}
+	}
+	if len(m.Layers) == 0 {
+		return "", fmt.Errorf("image contains no layers")
+	}
+	for _, layer := range m.Layers {
+		if err := r.extractBlob(layer.Digest, dir); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+// extractBlob downloads the layer blob with the specified digest, verifies
+// it and extracts it into dir.
+func (r *ociRegistry) extractBlob(digest, dir string) error {
+	want := strings.TrimPrefix(digest, "sha256:")
+	if !strings.HasPrefix(digest, "sha256:") || !sha256Re.MatchString(want) {
+		return fmt.Errorf("unsupported layer digest %q", digest)
+	}
+	resp, err := r.get("/blobs/"+digest, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	h := sha256.New()
+	prog := newProgress("downloading "+digest[:len("sha256:")+12], resp.ContentLength)
+	defer prog.finish()
+	if err := extractTar(io.TeeReader(resp.Body, io.MultiWriter(h, prog)), dir); err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != want {
+		return fmt.Errorf("layer %s: digest mismatch: got sha256:%s", digest, got)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package packer
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var extraFiles = flag.String("extrafiles",
+	"",
+	"comma-separated list of host directories whose contents are merged into the root file system (e.g. a directory containing etc/myapp/config.json), retaining file permissions, symbolic links, hard links, device nodes and FIFOs")
+
+// assetDestinations maps the keys of assets.txt to the directory of the root
+// file system which contains the per-package asset directories.
+var assetDestinations = map[string]string{
+	"etc":   "etc",       // e.g. configuration files
+	"share": "usr/share", // e.g. templates, web assets or models
+}
+
+// addPackageAssets copies the data directories declared in the
+// assets/<importPath>/assets.txt file of each program into the root file
+// system, so that programs and their assets are versioned (and updated)
+// together. Each line of assets.txt is of the form <destination>=<directory>,
+// e.g. share=templates copies the templates directory (relative to the
+// package’s source directory) to /usr/share/<program>/.
+func addPackageAssets(ctx context.Context, root *fileInfo) error {
+	user := root.mustFindDirent("user")
+	for _, bin := range user.dirents {
+		if bin.importPath == "" {
+			continue
+		}
+		lines, err := readPackageConfig("assets", bin.importPath)
+		if err != nil {
+			return err
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		pkgDir, err := packageDir(ctx, bin.importPath)
+		if err != nil {
+			return fmt.Errorf("%s: %v", bin.importPath, err)
+		}
+		for _, line := range lines {
+			idx := strings.IndexByte(line, '=')
+			if idx == -1 {
+				return fmt.Errorf("assets.txt of %s: malformed line %q, expected <destination>=<directory>", bin.importPath, line)
+			}
+			key, src := strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+			destDir, ok := assetDestinations[key]
+			if !ok {
+				return fmt.Errorf("assets.txt of %s: unknown destination %q (one of etc or share)", bin.importPath, key)
+			}
+			if !filepath.IsAbs(src) {
+				src = filepath.Join(pkgDir, src)
+			}
+			destPath := "/" + destDir + "/" + bin.filename
+			dest, err := root.mkdirAll(destPath)
+			if err != nil {
+				return fmt.Errorf("assets of %s: %v", bin.importPath, err)
+			}
+			if err := addHostDir(dest, destPath, src, newHostCopy(false)); err != nil {
+				return fmt.Errorf("assets of %s: %v", bin.importPath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// addExtraFiles merges the directories specified via -extrafiles into the root
+// file system. Files which gokr-packer itself installs cannot be replaced.
+func addExtraFiles(root *fileInfo) error {
+	if *extraFiles == "" {
+		return nil
+	}
+	for _, src := range strings.Split(*extraFiles, ",") {
+		st, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("-extrafiles: %v", err)
+		}
+		if !st.IsDir() {
+			return fmt.Errorf("-extrafiles: %s is not a directory", src)
+		}
+		if err := addHostDir(root, "", src, newHostCopy(*extraFilesOwners)); err != nil {
+			return fmt.Errorf("-extrafiles: %v", err)
+		}
+	}
+	return nil
+}
+
+// hostInode identifies a file on the host, for retaining hard links.
+type hostInode struct {
+	dev, ino uint64
+}
+
+// hostCopy is the state of copying a host directory, see addHostDir.
+type hostCopy struct {
+	// links maps the hard linked host files to their path in the root file
+	// system.
+	links map[hostInode]string
+
+	// owners retains the owner and group of the host files.
+	owners bool
+}
+
+func newHostCopy(owners bool) *hostCopy {
+	return &hostCopy{links: make(map[hostInode]string), owners: owners}
+}
+
+// addHostDir adds the contents of the directory src on the host (recursively)
+// to dir, which is at path dest of the root file system. Symbolic links, hard
+// links (within src), device nodes, FIFOs and file capabilities are retained.
+func addHostDir(dir *fileInfo, dest, src string, hc *hostCopy) error {
+	if !dir.isDir() {
+		return fmt.Errorf("cannot copy %s: destination %s is not a directory", src, dir.filename)
+	}
+	fis, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		path := filepath.Join(src, fi.Name())
+		mode := fi.Mode()
+		st, _ := fi.Sys().(*syscall.Stat_t)
+		switch {
+		case fi.IsDir():
+			existing := lookupFile(dir, fi.Name()) != nil
+			sub := dir.dir(fi.Name())
+			if hc.owners && !existing && st != nil {
+				// Directories of the root file system keep their owner.
+				sub.uid, sub.gid = st.Uid, st.Gid
+			}
+			if err := addHostDir(sub, dest+"/"+fi.Name(), path, hc); err != nil {
+				return err
+			}
+			continue
+		case !mode.IsRegular() && mode&(os.ModeSymlink|os.ModeDevice|os.ModeNamedPipe) == 0:
+			return fmt.Errorf("%s: unsupported file type %v", path, mode)
+		}
+		for _, ent := range dir.dirents {
+			if ent.filename == fi.Name() {
+				return fmt.Errorf("%s: conflicts with an existing file in the root file system", path)
+			}
+		}
+		ent := &fileInfo{filename: fi.Name()}
+		if hc.owners && st != nil {
+			ent.uid, ent.gid = st.Uid, st.Gid
+		}
+		switch {
+		case mode&os.ModeSymlink != 0:
+			dest, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			ent.symlinkDest = dest
+		case mode&os.ModeNamedPipe != 0:
+			if ent.device, err = newDeviceNode('p', 0, 0, mode); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		case mode&os.ModeDevice != 0:
+			if st == nil {
+				return fmt.Errorf("%s: device number unknown", path)
+			}
+			typ := byte('b')
+			if mode&os.ModeCharDevice != 0 {
+				typ = 'c'
+			}
+			rdev := uint64(st.Rdev)
+			if ent.device, err = newDeviceNode(typ, unix.Major(rdev), unix.Minor(rdev), mode); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		default:
+			ent.fromHost = path
+			if st != nil && st.Nlink > 1 {
+				id := hostInode{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+				if target, ok := hc.links[id]; ok {
+					ent.fromHost = ""
+					ent.hardlinkTarget = target
+					break
+				}
+				hc.links[id] = dest + "/" + fi.Name()
+			}
+			caps, err := hostCapabilities(path)
+			if err != nil {
+				return err
+			}
+			if caps != nil {
+				ent.xattrs = map[string][]byte{"security.capability": caps}
+			}
+		}
+		dir.dirents = append(dir.dirents, ent)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package packer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/updater"
+)
+
+// backupMain streams the contents of the permanent data partition of a
+// gokrazy installation into a (compressed) tar archive.
+func backupMain(args []string) error {
+	fset := packerFlagSet("backup")
+	output := fset.String("o",
+		"",
+		"path of the tar archive to create. Compressed if the name ends in .gz/.tgz (gzip) or .zst (requires the zstd program)")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer backup [-flags] <host> -o <perm.tar[.gz|.zst]>\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	host := parseSingleArg(fset, args)
+	if *output == "" {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	updaterObj, err := connectHost(host)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, updaterObj.BaseUrl.String()+"backup/perm", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := updaterObj.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("backup/perm: %w (is the gokrazy installation up to date?)", updater.ErrUpdateHandlerNotImplemented)
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("backup/perm: unexpected HTTP status code: got %d, want %d (body %q)", got, want, string(body))
+	}
+
+	// Write to a temporary file first so that an interrupted backup does not
+	// replace a previous, complete one.
+	f, err := ioutil.TempFile(filepath.Dir(*output), filepath.Base(*output)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	cw, err := compressWriter(*output, f)
+	if err != nil {
+		return err
+	}
+	log.Printf("backing up %s:/perm to %s", host, *output)
+	n, err := io.Copy(cw, resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), *output); err != nil {
+		return err
+	}
+	log.Printf("backed up %d bytes (uncompressed)", n)
+	return nil
+}
+
+// restoreMain replaces the contents of the permanent data partition of a
+// gokrazy installation with a tar archive created by backupMain, then reboots
+// the installation so that all programs pick up the restored state.
+func restoreMain(args []string) error {
+	fset := packerFlagSet("restore")
+	input := fset.String("i",
+		"",
+		"path of the tar archive to restore (optionally compressed, see backup -o)")
+	reboot := fset.Bool("reboot",
+		true,
+		"reboot the gokrazy installation once the contents are restored")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer restore [-flags] <host> -i <perm.tar[.gz|.zst]>\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	host := parseSingleArg(fset, args)
+	if *input == "" {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dr, err := decompressReader(*input, f)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	updaterObj, err := connectHost(host)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("restoring %s to %s:/perm (replacing its contents)", *input, host)
+	if _, err := deviceDo(updaterObj, http.MethodPut, "restore/perm", "application/x-tar", dr); err != nil {
+		return err
+	}
+	if err := dr.Close(); err != nil {
+		return err
+	}
+
+	if !*reboot {
+		log.Printf("restored, reboot %s for all programs to use the restored contents", host)
+		return nil
+	}
+	log.Printf("restored, rebooting")
+	if err := updater.Reboot(updaterObj); err != nil {
+		return fmt.Errorf("reboot: %v", err)
+	}
+	return nil
+}
+
+// cmdWriter is an io.WriteCloser which writes to the standard input of a
+// (filter) process and waits for it to exit on Close.
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (w *cmdWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if err := w.cmd.Wait(); err != nil {
+		return fmt.Errorf("%v: %v", w.cmd.Args, err)
+	}
+	return nil
+}
+
+// cmdReader is an io.ReadCloser which reads from the standard output of a
+// (filter) process and waits for it to exit on Close.
+type cmdReader struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	done bool
+}
+
+func (r *cmdReader) Close() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	r.ReadCloser.Close()
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("%v: %v", r.cmd.Args, err)
+	}
+	return nil
+}
+
+// compressWriter returns a writer which compresses into w according to the
+// file name extension of filename.
+func compressWriter(filename string, w io.Writer) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(filename, ".gz"), strings.HasSuffix(filename, ".tgz"):
+		return gzip.NewWriter(w), nil
+	case strings.HasSuffix(filename, ".zst"):
+		zstd := exec.Command("zstd", "-q", "-c")
+		zstd.Stdout = w
+		zstd.Stderr = os.Stderr
+		stdin, err := zstd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := zstd.Start(); err != nil {
+			return nil, fmt.Errorf("%v: %v (is zstd installed?)", zstd.Args, err)
+		}
+		return &cmdWriter{WriteCloser: stdin, cmd: zstd}, nil
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// decompressReader is the counterpart to compressWriter.
+func decompressReader(filename string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(filename, ".gz"), strings.HasSuffix(filename, ".tgz"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(filename, ".zst"):
+		zstd := exec.Command("zstd", "-q", "-d", "-c")
+		zstd.Stdin = r
+		zstd.Stderr = os.Stderr
+		stdout, err := zstd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := zstd.Start(); err != nil {
+			return nil, fmt.Errorf("%v: %v (is zstd installed?)", zstd.Args, err)
+		}
+		return &cmdReader{ReadCloser: stdout, cmd: zstd}, nil
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
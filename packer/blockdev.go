@@ -0,0 +1,330 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// blockDeviceList is the value of the repeatable -overwrite_block_device flag.
+type blockDeviceList []string
+
+func (l *blockDeviceList) String() string { return strings.Join(*l, ",") }
+
+func (l *blockDeviceList) Set(value string) error {
+	for _, dev := range strings.Split(value, ",") {
+		if dev = strings.TrimSpace(dev); dev != "" && !containsString(*l, dev) {
+			*l = append(*l, dev)
+		}
+	}
+	return nil
+}
+
+var (
+	overwriteBlockDevices blockDeviceList
+
+	assumeYes = flag.Bool("yes",
+		false,
+		"do not ask for confirmation before overwriting the -overwrite_block_device")
+)
+
+func init() {
+	flag.Var(&overwriteBlockDevices, "overwrite_block_device",
+		"Destination block device (e.g. /dev/sdb or /dev/mmcblk0) to overwrite with a full disk image, like -overwrite, but refusing to overwrite partitions, mounted devices and the disks of the running system, asking for confirmation and verifying the written data by reading it back. Can be specified multiple times (or comma-separated) to write the same image to multiple devices concurrently, e.g. for provisioning a stack of SD cards. Currently only supported on Linux")
+}
+
+// blockDevice describes the whole-disk block device which
+// -overwrite_block_device refers to.
+type blockDevice struct {
+	path      string // device node, e.g. /dev/sdb
+	model     string // vendor and model, if known
+	serial    string // if known
+	size      uint64 // in bytes
+	removable bool   // removable media (e.g. SD card readers and USB sticks)
+}
+
+func (bd *blockDevice) String() string {
+	model := bd.model
+	if model == "" {
+		model = "unknown model"
+	}
+	if bd.serial != "" {
+		model += ", serial " + bd.serial
+	}
+	return fmt.Sprintf("%s (%s, %.1f GB)", bd.path, model, float64(bd.size)/1e9)
+}
+
+// confirmBlockDevices checks the -overwrite_block_device devices and asks for
+// confirmation on stdin, unless -yes is specified.
+func confirmBlockDevices(devs []string) error {
+	var bds []*blockDevice
+	for _, dev := range devs {
+		bd, err := inspectBlockDevice(dev)
+		if err != nil {
+			return err
+		}
+		if bd.size < layout.minBytes() {
+			return fmt.Errorf("%s is too small: %d bytes, the partitions (see -boot_size, -root_size and -perm_size) require %d bytes", bd.path, bd.size, layout.minBytes())
+		}
+		for _, other := range bds {
+			if other.path == bd.path {
+				return fmt.Errorf("-overwrite_block_device: %s and %s refer to the same device", other.path, dev)
+			}
+		}
+		bds = append(bds, bd)
+	}
+	for _, bd := range bds {
+		fmt.Printf("All data on %s will be overwritten.\n", bd)
+	}
+	if *assumeYes {
+		return nil
+	}
+	fmt.Printf("Type yes to continue: ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return fmt.Errorf("not overwriting %s", strings.Join(devs, ", "))
+	}
+	return nil
+}
+
+// openBlockDevice opens dev for writing, exclusively (i.e. failing if it is
+// in use) where supported, using sudo if required (see -sudo).
+func openBlockDevice(cfg *Config, dev string) (*os.File, error) {
+	if cfg.sudo == "always" {
+		return sudoOpen(dev, openExclusive)
+	}
+	f, err := openExclusive(dev)
+	if err != nil {
+		pe, ok := err.(*os.PathError)
+		if ok && pe.Err == syscall.EACCES && cfg.sudo == "auto" {
+			log.Printf("Using sudo to gain permission to overwrite %s", dev)
+			log.Printf("If you prefer, cancel and use: sudo setfacl -m u:${USER}:rw %s", dev)
+			return sudoOpen(dev, openExclusive)
+		}
+		if ok && pe.Err == syscall.EBUSY {
+			return nil, fmt.Errorf("%s is in use (mounted?)", dev)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// sudoOpenBlockDevice opens dev in the partitioning child process started by
+// sudoOpen, which passes the device in $GOKR_PACKER_DEVICE. Only the
+// -overwrite_block_device devices are opened.
+func sudoOpenBlockDevice(dev string) (*os.File, error) {
+	for _, d := range overwriteBlockDevices {
+		if d == dev {
+			return sudoOpen(dev, openExclusive)
+		}
+		if bd, err := inspectBlockDevice(d); err == nil && bd.path == dev {
+			return sudoOpen(dev, openExclusive)
+		}
+	}
+	return nil, fmt.Errorf("%q is not an -overwrite_block_device", dev)
+}
+
+// region is a byte range of a disk image.
+type region struct {
+	offset, length int64
+}
+
+// flashImage is a full disk image for devices of a specific size.
+type flashImage struct {
+	f       *os.File
+	regions []region // containing data
+	total   int64    // bytes of data
+}
+
+// flashTarget is an -overwrite_block_device device, opened for writing.
+type flashTarget struct {
+	bd   *blockDevice
+	f    *os.File
+	size uint64
+	img  *flashImage
+
+	err      error
+	duration time.Duration
+}
+
+// writeBlockDevices writes a full disk image to the -overwrite_block_device
+// devs: the image is assembled in a temporary file (per device size, so that
+// the permanent data partition fills each device), of which only the parts
+// containing data are written to the devices, concurrently. The data is then
+// read back (bypassing the page cache) and compared to the image.
+func writeBlockDevices(ctx context.Context, cfg *Config, devs []string, root *fileInfo, partuuid uint32, usePartuuid bool) error {
+	// The checks were done (and confirmed) before building, but the devices
+	// might have been replaced or mounted in the meantime:
+	var targets []*flashTarget
+	for _, dev := range devs {
+		bd, err := inspectBlockDevice(dev)
+		if err != nil {
+			return err
+		}
+		f, err := openBlockDevice(cfg, bd.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		size, err := deviceSize(f.Fd())
+		if err != nil {
+			return err
+		}
+		targets = append(targets, &flashTarget{bd: bd, f: f, size: size})
+	}
+
+	images := make(map[uint64]*flashImage)
+	for _, t := range targets {
+		if img, ok := images[t.size]; ok {
+			t.img = img
+			continue
+		}
+		f, err := ioutil.TempFile("", "gokr-packer")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if err := f.Truncate(int64(t.size)); err != nil {
+			return err
+		}
+		// The devices are not zeroed, so the image must contain all zeros
+		// which are required, e.g. for the ext4 journal:
+		if _, _, err := writeImage(ctx, cfg, f, t.size, false, root, partuuid, usePartuuid); err != nil {
+			return err
+		}
+		regions, err := dataRegions(f, int64(t.size))
+		if err != nil {
+			return err
+		}
+		img := &flashImage{f: f, regions: regions}
+		for _, r := range regions {
+			img.total += r.length
+		}
+		images[t.size] = img
+		t.img = img
+	}
+
+	if len(targets) == 1 {
+		t := targets[0]
+		log.Printf("writing %s of data to %s", formatBytes(t.img.total), t.bd)
+		if err := flashBlockDevice(t, true); err != nil {
+			return err
+		}
+		printMkfsHint(cfg, t.bd.path)
+		return nil
+	}
+
+	stage := startStage(fmt.Sprintf("flash and verify %d devices", len(targets)))
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		log.Printf("writing %s of data to %s", formatBytes(t.img.total), t.bd)
+		wg.Add(1)
+		go func(t *flashTarget) {
+			defer wg.Done()
+			start := time.Now()
+			t.err = flashBlockDevice(t, false)
+			t.duration = time.Since(start)
+		}(t)
+	}
+	wg.Wait()
+	stage.done()
+
+	var failed []string
+	fmt.Printf("\nSummary:\n")
+	for _, t := range targets {
+		result := fmt.Sprintf("written and verified in %v", t.duration.Round(time.Second))
+		if t.err != nil {
+			result = "FAILED: " + t.err.Error()
+			failed = append(failed, t.bd.path)
+		}
+		fmt.Printf("\t%s: %s\n", t.bd, result)
+	}
+	fmt.Printf("\n")
+	if len(failed) > 0 {
+		return fmt.Errorf("writing %d of %d devices failed: %s", len(failed), len(targets), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// flashBlockDevice writes the image of t to its device and verifies it. The
+// build stages are only recorded if single is true, as concurrent flashing
+// would interleave them.
+func flashBlockDevice(t *flashTarget, single bool) error {
+	bd, f, img := t.bd, t.f, t.img
+	startStage := startStage
+	if !single {
+		startStage = func(name string) *buildStage { return &buildStage{name: name, bytes: -1} }
+	}
+	buf := make([]byte, 4*MB)
+	stage := startStage("flash image")
+	prog := newProgress("flashing "+bd.path, img.total)
+	if !single && prog.mode == "bar" {
+		prog.mode = "log" // progress bars of multiple devices would overwrite each other
+	}
+	for _, r := range img.regions {
+		if _, err := f.Seek(r.offset, io.SeekStart); err != nil {
+			return err
+		}
+		src := &countingReader{io.NewSectionReader(img.f, r.offset, r.length), stage}
+		if _, err := io.CopyBuffer(io.MultiWriter(f, prog), src, buf); err != nil {
+			return err
+		}
+	}
+	prog.finish()
+	stage.done()
+
+	stage = startStage("sync")
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	stage.done()
+
+	if err := dropCache(f); err != nil {
+		return fmt.Errorf("cannot verify %s: dropping the page cache: %v", bd.path, err)
+	}
+	stage = startStage("verify image")
+	stage.bytes = 0
+	want := make([]byte, len(buf))
+	for _, r := range img.regions {
+		for off := r.offset; off < r.offset+r.length; off += int64(len(buf)) {
+			n := r.offset + r.length - off
+			if n > int64(len(buf)) {
+				n = int64(len(buf))
+			}
+			if _, err := img.f.ReadAt(want[:n], off); err != nil {
+				return err
+			}
+			if _, err := f.ReadAt(buf[:n], off); err != nil {
+				return err
+			}
+			if !bytes.Equal(buf[:n], want[:n]) {
+				return fmt.Errorf("verifying %s failed: the data read back at offset %d differs from the written data. The SD card might be damaged or report a larger size than it has", bd.path, off)
+			}
+			stage.bytes += n
+		}
+	}
+	stage.done()
+
+	if err := rereadPartitions(f.Fd()); err != nil {
+		log.Printf("Re-reading partition table of %s failed: %v. Remember to unplug and re-plug the SD card before creating a file system for persistent data, if desired.", bd.path, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("wrote and verified %s", bd.path)
+	return nil
+}
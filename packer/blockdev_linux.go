@@ -0,0 +1,206 @@
+package packer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysfsAttr returns the contents of the sysfs attribute fn (without
+// surrounding whitespace), or the empty string if it does not exist.
+func sysfsAttr(fn string) string {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// devNumber returns the device number (major:minor, like in sysfs and
+// /proc/self/mountinfo) of the device node path.
+func devNumber(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", path)
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))), nil
+}
+
+// inspectBlockDevice looks up dev in sysfs and returns an error if it must not
+// be overwritten: partitions, read-only devices, devices which are (or of which
+// a partition is) mounted, used as swap or used by other block devices (e.g.
+// LVM, LUKS or RAID), and internal disks.
+func inspectBlockDevice(dev string) (*blockDevice, error) {
+	path, err := filepath.EvalSymlinks(dev) // e.g. /dev/disk/by-id/…
+	if err != nil {
+		return nil, err
+	}
+	num, err := devNumber(path)
+	if err != nil {
+		return nil, err
+	}
+	sysdir, err := filepath.EvalSymlinks("/sys/dev/block/" + num)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(sysdir, "partition")); err == nil {
+		return nil, fmt.Errorf("%s is a partition, specify the whole device (e.g. /dev/%s)", path, filepath.Base(filepath.Dir(sysdir)))
+	}
+	if sysfsAttr(filepath.Join(sysdir, "ro")) == "1" {
+		return nil, fmt.Errorf("%s is read-only; check if you have a physical write-protect switch on your SD card?", path)
+	}
+
+	// The device and its partitions:
+	nums := map[string]string{num: path}
+	names := []string{filepath.Base(sysdir)}
+	fis, err := ioutil.ReadDir(sysdir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		part := filepath.Join(sysdir, fi.Name())
+		if _, err := os.Stat(filepath.Join(part, "partition")); err != nil {
+			continue
+		}
+		nums[sysfsAttr(filepath.Join(part, "dev"))] = "/dev/" + fi.Name()
+		names = append(names, fi.Name())
+	}
+	for _, name := range names {
+		dir := sysdir
+		if name != filepath.Base(sysdir) {
+			dir = filepath.Join(sysdir, name)
+		}
+		holders, _ := ioutil.ReadDir(filepath.Join(dir, "holders"))
+		if len(holders) > 0 {
+			return nil, fmt.Errorf("/dev/%s is in use by /dev/%s (e.g. LVM, LUKS or RAID)", name, holders[0].Name())
+		}
+	}
+
+	b, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		source := ""
+		for idx, f := range fields {
+			if f == "-" && idx+2 < len(fields) {
+				source = fields[idx+2]
+			}
+		}
+		mounted, ok := nums[fields[2]]
+		if !ok && strings.HasPrefix(source, "/dev/") {
+			// e.g. btrfs, which reports a different device number
+			if n, err := devNumber(source); err == nil {
+				mounted, ok = nums[n]
+			}
+		}
+		if ok {
+			return nil, fmt.Errorf("%s is mounted on %s, refusing to overwrite %s", mounted, fields[4], path)
+		}
+	}
+
+	swaps, err := ioutil.ReadFile("/proc/swaps")
+	if err == nil {
+		for _, line := range strings.Split(string(swaps), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if n, err := devNumber(fields[0]); err == nil && nums[n] != "" {
+				return nil, fmt.Errorf("%s is used as swap, refusing to overwrite %s", nums[n], path)
+			}
+		}
+	}
+
+	size, err := strconv.ParseUint(sysfsAttr(filepath.Join(sysdir, "size")), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("size of %s: %v", path, err)
+	}
+	bd := &blockDevice{
+		path:      path,
+		size:      size * 512, // sysfs sizes are always in 512 byte units
+		removable: sysfsAttr(filepath.Join(sysdir, "removable")) == "1",
+	}
+	devdir := filepath.Join(sysdir, "device")
+	bd.model = strings.Join(strings.Fields(sysfsAttr(filepath.Join(devdir, "vendor"))+" "+sysfsAttr(filepath.Join(devdir, "model"))), " ")
+	if bd.model == "" {
+		bd.model = sysfsAttr(filepath.Join(devdir, "name")) // SD cards
+	}
+	bd.serial = sysfsAttr(filepath.Join(devdir, "serial"))
+	if bd.serial == "" {
+		// USB mass storage devices expose their serial number via udev:
+		udev, _ := ioutil.ReadFile("/run/udev/data/b" + num)
+		for _, line := range strings.Split(string(udev), "\n") {
+			if strings.HasPrefix(line, "E:ID_SERIAL_SHORT=") {
+				bd.serial = strings.TrimPrefix(line, "E:ID_SERIAL_SHORT=")
+			}
+		}
+	}
+
+	// SD cards (mmcblk), USB devices and loop devices are fine, but internal
+	// disks are much more likely a typo than the intended target:
+	name := filepath.Base(sysdir)
+	usb := strings.Contains(sysdir, "/usb")
+	if !bd.removable && !usb && !strings.HasPrefix(name, "mmcblk") && !strings.HasPrefix(name, "loop") {
+		return nil, fmt.Errorf("%s is an internal disk, refusing to overwrite it. Use -overwrite if you are sure", bd)
+	}
+	return bd, nil
+}
+
+// openExclusive opens the block device path for reading and writing. Linux
+// fails with EBUSY if the device is in use (e.g. mounted).
+func openExclusive(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|syscall.O_EXCL, 0)
+}
+
+// dropCache removes the contents of f from the page cache, so that they are
+// read from the device again.
+func dropCache(f *os.File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// dataRegions returns the regions of the sparse file f of size bytes which
+// contain data, i.e. are not holes. The first 4 MiB (the partition table area)
+// are always included, so that no stale partition table remains on the device.
+func dataRegions(f *os.File, size int64) ([]region, error) {
+	const (
+		head     = bootStartSector * 512
+		seekData = 3 // SEEK_DATA, see lseek(2)
+		seekHole = 4 // SEEK_HOLE
+	)
+	regions := []region{{0, head}}
+	fd := int(f.Fd())
+	for off := int64(head); off < size; {
+		data, err := unix.Seek(fd, off, seekData)
+		if err == unix.ENXIO {
+			break // no more data
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := unix.Seek(fd, data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if last := &regions[len(regions)-1]; last.offset+last.length == data {
+			last.length += hole - data
+		} else {
+			regions = append(regions, region{data, hole - data})
+		}
+		off = hole
+	}
+	return regions, nil
+}
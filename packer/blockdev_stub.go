@@ -0,0 +1,24 @@
+// +build !linux
+
+package packer
+
+import (
+	"fmt"
+	"os"
+)
+
+func inspectBlockDevice(dev string) (*blockDevice, error) {
+	return nil, fmt.Errorf("-overwrite_block_device is currently only supported on Linux, use -overwrite instead")
+}
+
+func openExclusive(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
+
+func dropCache(f *os.File) error {
+	return fmt.Errorf("not supported on this operating system")
+}
+
+func dataRegions(f *os.File, size int64) ([]region, error) {
+	return []region{{0, size}}, nil
+}
@@ -0,0 +1,258 @@
+package packer
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var targetBoard = flag.String("board",
+	"",
+	"target board, which selects defaults like -serial_console and -target_arch and is checked against the kernel package: rpi3, rpi4, rpi5, rpizero2w or amd64 (PC). Empty uses the Raspberry Pi 3 defaults (or those of -target_arch) without checks")
+
+var targetArch = flag.String("target_arch",
+	"",
+	"architecture to build binaries for: arm (32 bit, with GOARM=6 unless $GOARM is set), arm64, amd64 or riscv64. Also selects the default -kernel_package, -firmware_package and -serial_console. Empty uses $GOARCH, or the architecture of -board (arm64 by default)")
+
+// board describes the board-specific defaults and kernel requirements.
+type board struct {
+	// SerialConsole is the default -serial_console value.
+	SerialConsole string
+
+	// KernelArch is the architecture of the kernel image: arm64 or x86.
+	KernelArch string
+
+	// GOARCH is the default -target_arch.
+	GOARCH string
+
+	// DTB is the device tree blob which the kernel package needs to provide,
+	// if any.
+	DTB string
+}
+
+var boards = map[string]board{
+	"rpi3": {
+		SerialConsole: "ttyAMA0,115200",
+		KernelArch:    "arm64",
+		GOARCH:        "arm64",
+		DTB:           "bcm2710-rpi-3-b.dtb",
+	},
+	"rpi4": {
+		// The PL011 UART (ttyAMA0) is used for Bluetooth, the GPIO header
+		// pins are connected to the mini UART:
+		SerialConsole: "ttyS0,115200",
+		KernelArch:    "arm64",
+		GOARCH:        "arm64",
+		DTB:           "bcm2711-rpi-4-b.dtb",
+	},
+	"rpi5": {
+		// The dedicated debug UART connector:
+		SerialConsole: "ttyAMA10,115200",
+		KernelArch:    "arm64",
+		GOARCH:        "arm64",
+		DTB:           "bcm2712-rpi-5-b.dtb",
+	},
+	"rpizero2w": {
+		SerialConsole: "ttyS0,115200",
+		KernelArch:    "arm64",
+		GOARCH:        "arm64",
+		DTB:           "bcm2710-rpi-zero-2-w.dtb",
+	},
+	"amd64": {
+		SerialConsole: "ttyS0,115200",
+		KernelArch:    "x86",
+		GOARCH:        "amd64",
+	},
+}
+
+func boardNames() string {
+	names := make([]string, 0, len(boards))
+	for name := range boards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// selectedBoard returns the configuration of cfg.Board, defaulting to the
+// Raspberry Pi 3 (or a PC, for -target_arch=amd64).
+func selectedBoard(cfg *Config) board {
+	if b, ok := boards[cfg.Board]; ok {
+		return b
+	}
+	switch targetArchSetting(cfg) {
+	case "amd64":
+		return boards["amd64"]
+	case "riscv64":
+		return board{SerialConsole: "ttyS0,115200", KernelArch: "riscv64", GOARCH: "riscv64"}
+	}
+	return boards["rpi3"]
+}
+
+// targetArchDefaults describes a -target_arch.
+type targetArchDefaults struct {
+	// KernelArchs are the kernel image architectures which can run the
+	// binaries.
+	KernelArchs []string
+
+	// KernelPackage is the default -kernel_package, if there is one.
+	KernelPackage string
+
+	// FirmwarePackage is the default -firmware_package.
+	FirmwarePackage string
+}
+
+var targetArchs = map[string]targetArchDefaults{
+	"arm": {
+		// There is no 32 bit gokrazy kernel, but 64 bit kernels can run
+		// 32 bit binaries:
+		KernelArchs:     []string{"arm", "arm64"},
+		FirmwarePackage: "github.com/gokrazy/firmware",
+	},
+	"arm64": {
+		KernelArchs:     []string{"arm64"},
+		KernelPackage:   "github.com/gokrazy/kernel",
+		FirmwarePackage: "github.com/gokrazy/firmware",
+	},
+	"amd64": {
+		// PCs boot via the MBR boot code, no firmware files are needed:
+		KernelArchs:   []string{"x86"},
+		KernelPackage: "github.com/rtr7/kernel",
+	},
+	"riscv64": {
+		KernelArchs: []string{"riscv64"},
+	},
+}
+
+// targetArchSetting returns the GOARCH to build for: -target_arch, $GOARCH or
+// the architecture of cfg.Board.
+func targetArchSetting(cfg *Config) string {
+	if *targetArch != "" {
+		return *targetArch
+	}
+	if e := os.Getenv("GOARCH"); e != "" {
+		return e
+	}
+	if b, ok := boards[cfg.Board]; ok {
+		return b.GOARCH
+	}
+	return "arm64" // Raspberry Pi 3
+}
+
+// applyTargetArch verifies -target_arch against cfg.Board, applies its default
+// kernel and firmware packages (unless specified) and configures the Go
+// environment accordingly.
+func applyTargetArch(cfg *Config) error {
+	if *targetArch != "" {
+		if _, ok := targetArchs[*targetArch]; !ok {
+			return fmt.Errorf("-target_arch=%q is not one of arm, arm64, amd64 or riscv64", *targetArch)
+		}
+	}
+	goarch := targetArchSetting(cfg)
+	env = goEnv(cfg)
+	defaults, ok := targetArchs[goarch]
+	if !ok {
+		// e.g. $GOARCH=386, which has no defaults of its own:
+		defaults = targetArchs["arm64"]
+	} else if b, ok := boards[cfg.Board]; ok && !containsString(defaults.KernelArchs, b.KernelArch) {
+		return fmt.Errorf("-target_arch=%s binaries cannot run on -board=%s (%s)", goarch, cfg.Board, b.KernelArch)
+	}
+	if cfg.KernelPackage == "" {
+		if defaults.KernelPackage == "" {
+			return fmt.Errorf("there is no default kernel package for %s, specify -kernel_package", goarch)
+		}
+		cfg.KernelPackage = defaults.KernelPackage
+	}
+	if cfg.FirmwarePackage == "" && *bootMode == "firmware" {
+		// Only the Raspberry Pi firmware is part of the boot file system, the
+		// UEFI firmware or u-boot are not:
+		cfg.FirmwarePackage = defaults.FirmwarePackage
+	}
+	return nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// serialConsoleSetting returns the effective -serial_console value.
+func serialConsoleSetting(cfg *Config) string {
+	if cfg.SerialConsole != "" {
+		return cfg.SerialConsole
+	}
+	return selectedBoard(cfg).SerialConsole
+}
+
+// kernelArch returns the architecture of the kernel image at path (arm,
+// arm64, riscv64 or x86), or an empty string if it cannot be determined.
+func kernelArch(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, 0x206)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return "", nil // too short for either format
+	}
+	if bytes.Equal(header[0x38:0x3c], []byte("ARM\x64")) {
+		return "arm64", nil
+	}
+	if bytes.Equal(header[0x38:0x3c], []byte("RSC\x05")) {
+		return "riscv64", nil
+	}
+	if bytes.Equal(header[0x24:0x28], []byte{0x18, 0x28, 0x6f, 0x01}) { // zImage
+		return "arm", nil
+	}
+	if bytes.Equal(header[0x202:0x206], []byte("HdrS")) { // bzImage
+		return "x86", nil
+	}
+	return "", nil
+}
+
+// checkBoardKernel verifies that the kernel package in kernelDir and the
+// serial console are suitable for cfg.Board, so that a mismatch results in an
+// error instead of a silent serial console or a device which does not boot.
+func checkBoardKernel(cfg *Config, pkg, kernelDir string) error {
+	if cfg.Board == "" && *targetArch == "" {
+		return nil
+	}
+	arch, err := kernelArch(filepath.Join(kernelDir, "vmlinuz"))
+	if err != nil {
+		return err
+	}
+	if defaults, ok := targetArchs[*targetArch]; ok && arch != "" && !containsString(defaults.KernelArchs, arch) {
+		return fmt.Errorf("-kernel_package=%s contains a %s kernel, which cannot run -target_arch=%s binaries", pkg, arch, *targetArch)
+	}
+	if cfg.Board == "" {
+		return nil
+	}
+	b := selectedBoard(cfg)
+	if arch != "" && arch != b.KernelArch {
+		return fmt.Errorf("-kernel_package=%s contains a %s kernel, but -board=%s requires an %s kernel", pkg, arch, cfg.Board, b.KernelArch)
+	}
+	if b.DTB != "" {
+		if _, err := os.Stat(filepath.Join(kernelDir, b.DTB)); err != nil {
+			return fmt.Errorf("-kernel_package=%s does not support -board=%s: %s not found", pkg, cfg.Board, b.DTB)
+		}
+	}
+
+	console := serialConsoleSetting(cfg)
+	switch {
+	case console == "disabled":
+	case b.KernelArch == "x86" && (strings.HasPrefix(console, "ttyAMA") || console == "UART0"):
+		return fmt.Errorf("-serial_console=%s: PCs have no ttyAMA (PL011) UARTs, use e.g. ttyS0,115200", console)
+	case strings.HasPrefix(console, "ttyAMA10") && cfg.Board != "rpi5":
+		return fmt.Errorf("-serial_console=%s: ttyAMA10 only exists on the Raspberry Pi 5", console)
+	}
+	return nil
+}
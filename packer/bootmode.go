@@ -0,0 +1,57 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+)
+
+var bootMode = flag.String("boot_mode",
+	"firmware",
+	"how the target boots the kernel: firmware (the Raspberry Pi firmware files and config.txt, or the MBR boot code on x86), uefi (an EFI system partition with a boot loader such as systemd-boot and a loader entry with the kernel command line, for x86 and UEFI firmware on arm64 boards like the Raspberry Pi 4) or uboot (extlinux.conf and boot.scr for u-boot, which is written before the boot partition, for other ARM boards)")
+
+// applyBootMode selects FAT32 for the EFI system partition of -boot_mode=uefi,
+// unless -boot_fs is set explicitly.
+func applyBootMode() {
+	if *bootMode == "uefi" && !explicitFlags()["boot_fs"] {
+		// Not using flag.Set, so that the default is not saved in profiles and
+		// bundles:
+		*bootFS = "fat32"
+	}
+}
+
+// checkBootMode verifies -boot_mode and the flags which only apply to one boot
+// mode.
+func checkBootMode(cfg *Config) error {
+	if *efiLoader != "" && *bootMode != "uefi" {
+		return fmt.Errorf("-efi_loader requires -boot_mode=uefi")
+	}
+	if (*ubootPackage != "" || *ubootFiles != "" || *ubootFDT != "") && *bootMode != "uboot" {
+		return fmt.Errorf("-uboot_package, -uboot_files and -uboot_fdt require -boot_mode=uboot")
+	}
+	if err := checkInitramfs(); err != nil {
+		return err
+	}
+	var err error
+	switch *bootMode {
+	case "firmware":
+		return nil
+	case "uefi":
+		err = checkUEFI()
+	case "uboot":
+		err = checkUBoot()
+	default:
+		return fmt.Errorf("-boot_mode=%q is not one of firmware, uefi or uboot", *bootMode)
+	}
+	if err != nil {
+		return err
+	}
+	if len(dtoverlays) > 0 || *eepromImage != "" {
+		return fmt.Errorf("-dtoverlay and -eeprom_image configure the Raspberry Pi firmware, which -boot_mode=%s does not use", *bootMode)
+	}
+	if cfg.Update != "" {
+		// The installation switches between the root partitions by changing
+		// cmdline.txt, which the boot loader configuration does not follow.
+		return fmt.Errorf("-boot_mode=%s does not support -update yet, as the installation cannot switch the root partition of the boot loader configuration", *bootMode)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package packer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildJob is a gokr-packer invocation running as a child process, allowing
+// long-running frontends (e.g. gokr-packer web) to run multiple builds without
+// sharing the packer’s global flag state.
+type buildJob struct {
+	ID      string
+	Args    []string
+	Created time.Time
+
+	// Update is the URL of the gokrazy installation an update build updates,
+	// with its password redacted for display.
+	Update string
+
+	// env is passed to the child process in addition to the environment of
+	// the current process. Secrets go here instead of into Args, which are
+	// displayed.
+	env []string
+
+	// dir is a temporary directory which the child process writes its
+	// artifact to, if any.
+	dir      string
+	artifact string
+
+	mu       sync.Mutex
+	output   []byte
+	started  time.Time
+	finished time.Time
+	err      error
+}
+
+func (j *buildJob) Write(p []byte) (n int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.output = append(j.output, p...)
+	return len(p), nil
+}
+
+// tail returns the child process output starting at offset, and whether the
+// child process has exited.
+func (j *buildJob) tail(offset int) ([]byte, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if offset > len(j.output) {
+		offset = len(j.output)
+	}
+	return append([]byte(nil), j.output[offset:]...), !j.finished.IsZero()
+}
+
+func (j *buildJob) Status() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch {
+	case j.started.IsZero():
+		return "queued"
+	case j.finished.IsZero():
+		return "running"
+	case j.err != nil:
+		return "failed"
+	default:
+		return "succeeded"
+	}
+}
+
+// Artifact returns the path of the image file the build produced, or the empty
+// string if the build did not produce a (downloadable) image file.
+func (j *buildJob) Artifact() string {
+	if j.Status() != "succeeded" || j.artifact == "" {
+		return ""
+	}
+	if _, err := os.Stat(j.artifact); err != nil {
+		return ""
+	}
+	return j.artifact
+}
+
+func (j *buildJob) run() {
+	j.mu.Lock()
+	j.started = time.Now()
+	j.mu.Unlock()
+
+	err := func() error {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(j, "gokr-packer %v\n", j.Args)
+		cmd := exec.Command(exe, j.Args...)
+		// An inherited $GOKRAZY_UPDATE must not turn other builds into
+		// updates:
+		cmd.Env = append(append(os.Environ(), "GOKRAZY_UPDATE="), j.env...)
+		cmd.Stdout = j
+		cmd.Stderr = j
+		return cmd.Run()
+	}()
+	if err != nil {
+		fmt.Fprintf(j, "build failed: %v\n", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	j.err = err
+}
+
+// buildRequest describes a build in terms of the most commonly used
+// gokr-packer flags, so that frontends do not need to deal with command line
+// arguments.
+type buildRequest struct {
+	Packages        []string `json:"packages"`
+	Hostname        string   `json:"hostname,omitempty"`
+	Board           string   `json:"board,omitempty"`
+	KernelPackage   string   `json:"kernel_package,omitempty"`
+	FirmwarePackage string   `json:"firmware_package,omitempty"`
+	SerialConsole   string   `json:"serial_console,omitempty"`
+	TLS             string   `json:"tls,omitempty"`
+
+	// Output is one of image (write a full disk image of TargetStorageBytes
+	// which can be downloaded afterwards), device (overwrite Device) or update
+	// (update the gokrazy installation at Update).
+	Output             string `json:"output"`
+	TargetStorageBytes int64  `json:"target_storage_bytes,omitempty"`
+	Device             string `json:"device,omitempty"`
+	Update             string `json:"update,omitempty"`
+}
+
+// args translates the build request into gokr-packer command line arguments.
+func (br *buildRequest) args(j *buildJob) ([]string, error) {
+	var args []string
+	for _, f := range []struct {
+		name, value string
+	}{
+		{"hostname", br.Hostname},
+		{"board", br.Board},
+		{"kernel_package", br.KernelPackage},
+		{"firmware_package", br.FirmwarePackage},
+		{"serial_console", br.SerialConsole},
+		{"tls", br.TLS},
+	} {
+		if v := strings.TrimSpace(f.value); v != "" {
+			args = append(args, "-"+f.name+"="+v)
+		}
+	}
+
+	switch br.Output {
+	case "image", "":
+		if br.TargetStorageBytes <= 0 {
+			return nil, fmt.Errorf("target_storage_bytes must be specified for image output")
+		}
+		args = append(args,
+			"-overwrite="+j.imagePath(),
+			"-target_storage_bytes="+strconv.FormatInt(br.TargetStorageBytes, 10))
+		j.artifact = j.imagePath()
+	case "device":
+		dev := strings.TrimSpace(br.Device)
+		if !strings.HasPrefix(dev, "/dev/") {
+			return nil, fmt.Errorf("device %q does not start with /dev/", dev)
+		}
+		args = append(args, "-overwrite="+dev)
+	case "update":
+		update := strings.TrimSpace(br.Update)
+		if update == "" {
+			return nil, fmt.Errorf("no update URL specified")
+		}
+		// The URL contains the device password, so it is passed via the
+		// environment (the -update default) instead of the displayed Args:
+		j.env = append(j.env, "GOKRAZY_UPDATE="+update)
+		j.Update = redactPassword(update)
+	default:
+		return nil, fmt.Errorf("unknown output %q", br.Output)
+	}
+
+	if len(br.Packages) == 0 {
+		return nil, fmt.Errorf("no Go packages specified")
+	}
+	for _, pkg := range br.Packages {
+		if strings.HasPrefix(pkg, "-") {
+			return nil, fmt.Errorf("invalid Go package %q", pkg)
+		}
+	}
+	return append(args, br.Packages...), nil
+}
+
+// buildQueue runs build jobs, at most maxConcurrent at a time.
+type buildQueue struct {
+	sem chan struct{}
+
+	mu   sync.Mutex
+	seq  int
+	jobs map[string]*buildJob
+}
+
+// newBuildQueue returns a buildQueue which runs up to maxConcurrent builds at
+// the same time. Zero means no limit.
+func newBuildQueue(maxConcurrent int) *buildQueue {
+	q := &buildQueue{jobs: make(map[string]*buildJob)}
+	if maxConcurrent > 0 {
+		q.sem = make(chan struct{}, maxConcurrent)
+	}
+	return q
+}
+
+// newJob creates a build job and its temporary directory. The build is started
+// by calling start.
+func (q *buildQueue) newJob() (*buildJob, error) {
+	dir, err := ioutil.TempDir("", "gokr-packer-build")
+	if err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	j := &buildJob{
+		ID:      strconv.Itoa(q.seq),
+		Created: time.Now(),
+		dir:     dir,
+	}
+	q.jobs[j.ID] = j
+	return j, nil
+}
+
+// imagePath returns the path within the job’s temporary directory to which
+// the build should write a full disk image.
+func (j *buildJob) imagePath() string {
+	return filepath.Join(j.dir, "gokrazy.img")
+}
+
+func (q *buildQueue) start(j *buildJob, args []string) {
+	j.Args = args
+	go func() {
+		if q.sem != nil {
+			q.sem <- struct{}{}
+			defer func() { <-q.sem }()
+		}
+		log.Printf("starting build %s: %v", j.ID, args)
+		j.run()
+	}()
+}
+
+func (q *buildQueue) job(id string) *buildJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.jobs[id]
+}
+
+// list returns all jobs, most recent first.
+func (q *buildQueue) list() []*buildJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]*buildJob, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].Created.After(jobs[k].Created)
+	})
+	return jobs
+}
+
+// remove deletes a finished (or never started) job and its temporary
+// directory.
+func (q *buildQueue) remove(j *buildJob) error {
+	if st := j.Status(); j.Args != nil && (st == "queued" || st == "running") {
+		return fmt.Errorf("build %s is %s", j.ID, st)
+	}
+	q.mu.Lock()
+	delete(q.jobs, j.ID)
+	q.mu.Unlock()
+	return os.RemoveAll(j.dir)
+}
+
+// cleanup removes the temporary directories of all jobs.
+func (q *buildQueue) cleanup() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		os.RemoveAll(j.dir)
+	}
+}
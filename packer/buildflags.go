@@ -0,0 +1,135 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// buildFlags returns the go build flags for the package importPath: -tags
+// gokrazy plus the flags configured in its buildflags.txt file, e.g.
+// buildflags/github.com/gokrazy/hello/buildflags.txt. Each line is of the form
+// key=value, with the keys tags (comma-separated, in addition to gokrazy),
+// ldflags (combined with -strip_binaries), gcflags and trimpath (true or
+// false).
+func buildFlags(importPath string) ([]string, error) {
+	lines, err := readPackageConfig("buildflags", importPath)
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{"gokrazy"}
+	var flags []string
+	var ldflags string
+	var trimpath bool
+	for _, line := range lines {
+		idx := strings.IndexByte(line, '=')
+		if idx == -1 {
+			return nil, fmt.Errorf("buildflags.txt of %s: %q is not of the form key=value", importPath, line)
+		}
+		key, val := strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+		switch key {
+		case "tags":
+			for _, tag := range strings.Split(val, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					tags = append(tags, tag)
+				}
+			}
+		case "ldflags":
+			ldflags = val
+		case "gcflags":
+			flags = append(flags, "-"+key+"="+val)
+		case "trimpath":
+			var err error
+			trimpath, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("buildflags.txt of %s: trimpath: %v", importPath, err)
+			}
+			if trimpath {
+				flags = append(flags, "-trimpath")
+			}
+		default:
+			return nil, fmt.Errorf("buildflags.txt of %s: unknown key %q (one of tags, ldflags, gcflags or trimpath)", importPath, key)
+		}
+	}
+	if ldflags = stripLdflags(ldflags); ldflags != "" {
+		flags = append(flags, "-ldflags="+ldflags)
+	}
+	if reproducible() && !trimpath {
+		// Binaries must not contain paths of the build machine:
+		flags = append(flags, "-trimpath")
+	}
+	return append([]string{"-tags", strings.Join(tags, ",")}, flags...), nil
+}
+
+// defaultBuildFlags returns the build flags of packages without buildflags.txt
+// file.
+func defaultBuildFlags() []string {
+	flags := []string{"-tags", "gokrazy"}
+	if ldflags := stripLdflags(""); ldflags != "" {
+		flags = append(flags, "-ldflags="+ldflags)
+	}
+	if reproducible() {
+		flags = append(flags, "-trimpath")
+	}
+	return flags
+}
+
+// haveBuildFlags returns whether any buildflags.txt files can exist, so that
+// package patterns only need to be expanded if per-package flags are used.
+func haveBuildFlags() bool {
+	st, err := os.Stat("buildflags")
+	return err == nil && st.IsDir()
+}
+
+// importPaths returns the import paths of the packages matched by the
+// specified package paths or patterns (e.g. ./... or relative directories).
+func importPaths(ctx context.Context, paths []string) ([]string, error) {
+	var buf bytes.Buffer
+	cmd := exec.CommandContext(ctx, "go", append([]string{"list", "-f", "{{ .ImportPath }}"}, paths...)...)
+	cmd.Env = env
+	cmd.Stdout = &buf
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return strings.Fields(buf.String()), nil
+}
+
+// buildGroup is a set of packages which are compiled with the same flags.
+type buildGroup struct {
+	flags []string
+	pkgs  []string
+}
+
+// groupByBuildFlags groups pkgs by their build flags (see buildFlags), in the
+// order in which the packages are specified.
+func groupByBuildFlags(ctx context.Context, pkgs []string) ([]buildGroup, error) {
+	if !haveBuildFlags() {
+		return []buildGroup{{flags: defaultBuildFlags(), pkgs: pkgs}}, nil
+	}
+	paths, err := importPaths(ctx, pkgs)
+	if err != nil {
+		return nil, err
+	}
+	var groups []buildGroup
+	idx := make(map[string]int)
+	for _, pkg := range paths {
+		flags, err := buildFlags(pkg)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.Join(flags, "\x00")
+		i, ok := idx[key]
+		if !ok {
+			i = len(groups)
+			idx[key] = i
+			groups = append(groups, buildGroup{flags: flags})
+		}
+		groups[i].pkgs = append(groups[i].pkgs, pkg)
+	}
+	return groups, nil
+}
@@ -0,0 +1,319 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// initRuntimePkg implements the init process. The generated init only
+// contains the configuration of the installation and calls its Main function.
+const initRuntimePkg = "github.com/gokrazy/tools/gokrazyinit"
+
+const initTmplContents = `
+package main
+
+import (
+{{- if .UsesTime }}
+	"time"
+
+{{ end }}
+	"github.com/gokrazy/tools/gokrazyinit"
+)
+
+// buildTimestamp can be overridden by specifying e.g.
+// -ldflags "-X main.buildTimestamp=foo" when building.
+var buildTimestamp = {{ printf "%#v" .BuildTimestamp }}
+
+func main() {
+	gokrazyinit.Main(&gokrazyinit.Config{
+		BuildTimestamp: buildTimestamp,
+		Programs: []string{
+{{- range .Services }}
+{{- if ne .Path "/gokrazy/init" }}
+			{{ printf "%#v" .Path }},
+{{- end }}
+{{- end }}
+		},
+		Services: map[string]gokrazyinit.ServiceConfig{
+{{- range .Services }}
+{{- if .Config }}
+			{{ printf "%#v" .Path }}: {{ printf "%#v" .Config }},
+{{- end }}
+{{- end }}
+		},
+		PermMode:         {{ printf "%#v" .PermMode }},
+		PermFS:           {{ printf "%#v" .PermFS }},
+		PermMountOptions: {{ printf "%#v" .PermMountOptions }},
+{{- with .PermTrimInterval }}
+		PermTrimInterval: {{ . }},
+{{- end }}
+{{- with .PermPersist }}
+		PermPersist: []gokrazyinit.PersistMount{
+{{- range . }}
+			{Dir: {{ printf "%#v" .Dir }}, Upper: {{ printf "%#v" .Upper }}, Work: {{ printf "%#v" .Work }}},
+{{- end }}
+		},
+{{- end }}
+{{- if .PermLUKS }}
+		PermLUKS:    true,
+		PermKeyFile: {{ printf "%#v" .PermKeyFile }},
+		PermDiscard: {{ .PermDiscard }},
+{{- end }}
+		RootOverlay: {{ printf "%#v" .RootOverlay }},
+{{- with .FirstBoot }}
+		FirstBoot: {{ printf "%#v" . }},
+{{- end }}
+{{- if .FirstBootPayload }}
+		FirstBootPayload:    {{ printf "%#v" .FirstBootPayload }},
+		FirstBootPayloadDir: {{ printf "%#v" .FirstBootPayloadDir }},
+{{- end }}
+{{- with .FirstBootManifest }}
+		FirstBootManifest: {{ printf "%#v" . }},
+{{- end }}
+{{- if .Sealed }}
+		Sealed:    true,
+		SealMagic: {{ printf "%#v" .SealMagic }},
+{{- end }}
+		StaticNetwork: {{ .StaticNetwork }},
+		WiFi:          {{ .WiFi }},
+{{- if .TLSOnPerm }}
+		TLSOnPerm:  true,
+		TLSBootDir: {{ printf "%#v" .TLSBootDir }},
+		TLSPermDir: {{ printf "%#v" .TLSPermDir }},
+{{- end }}
+	})
+}
+`
+
+var initTmpl = template.Must(template.New("").Parse(initTmplContents))
+
+// buildTimestamp identifies the build. It is embedded into the generated init
+// and advertised via mDNS. logic sets it at the start of each build.
+var buildTimestamp string
+
+// initService is a program which the generated init supervises.
+type initService struct {
+	Path string
+
+	// ImportPath is empty for files which were not built from a Go package.
+	ImportPath string
+
+	// Config is nil if the program does not need any configuration applied.
+	Config *serviceConfig
+}
+
+func initServices(prefix string, root *fileInfo) ([]initService, error) {
+	var result []initService
+	for _, ent := range root.dirents {
+		if prefix == "/" && ent.filename == "firstboot" {
+			continue // run once by runFirstBoot, not supervised
+		}
+		if ent.fromHost != "" { // regular file
+			svc := initService{
+				Path:       filepath.Join(prefix, root.filename, ent.filename),
+				ImportPath: ent.importPath,
+			}
+			if ent.importPath != "" {
+				cfg, err := loadServiceConfig(ent.importPath)
+				if err != nil {
+					return nil, err
+				}
+				if !cfg.empty() {
+					svc.Config = cfg
+				}
+			}
+			result = append(result, svc)
+		} else { // subdir
+			services, err := initServices(filepath.Join(prefix, root.filename), ent)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, services...)
+		}
+	}
+	return result, nil
+}
+
+func permTrimIntervalExpr() string {
+	if *permTrimInterval <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d * time.Second", int64(permTrimInterval.Seconds()))
+}
+
+// renderInit returns the (formatted) source code of the init process which
+// supervises all programs in root.
+func renderInit(root *fileInfo) ([]byte, error) {
+	services, err := supervisedServices(root)
+	if err != nil {
+		return nil, err
+	}
+	// Durations are written as multiples of e.g. time.Second:
+	usesTime := *permTrimInterval > 0
+	for _, svc := range services {
+		if svc.Config == nil {
+			continue
+		}
+		if svc.Config.scheduled() || svc.Config.supervised() || len(svc.Config.After) > 0 {
+			usesTime = true
+		}
+		if svc.Config.Log == "perm" && *permMode != "rw" {
+			return nil, fmt.Errorf("%s is configured to write logs to /perm, which is not writable with -perm=%s", svc.Path, *permMode)
+		}
+	}
+
+	persist, err := permPersistMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	payloadHash, err := firstBootPayloadHash()
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest string
+	if *firstBootManifest != "" {
+		manifest = firstBootManifestPath
+	}
+
+	var buf bytes.Buffer
+	if err := initTmpl.Execute(&buf, struct {
+		Services       []initService
+		BuildTimestamp string
+		UsesTime       bool
+		PermMode       string
+		PermFS         string
+
+		PermMountOptions string
+		// PermTrimInterval is a Go expression of type time.Duration, or empty.
+		PermTrimInterval string
+		PermPersist      []permPersistMount
+
+		RootOverlay string
+		FirstBoot   []string
+
+		// FirstBootPayload is the hash of the -firstboot_payload, or empty.
+		FirstBootPayload    string
+		FirstBootPayloadDir string
+		// FirstBootManifest is the path of the -firstboot_manifest, or empty.
+		FirstBootManifest string
+
+		Sealed    bool
+		SealMagic string
+
+		PermLUKS    bool
+		PermKeyFile string
+		PermDiscard bool
+
+		StaticNetwork bool
+		WiFi          bool
+
+		TLSOnPerm  bool
+		TLSBootDir string
+		TLSPermDir string
+	}{
+		Services:       services,
+		BuildTimestamp: buildTimestamp,
+		UsesTime:       usesTime,
+		PermMode:       *permMode,
+		PermFS:         *permFS,
+
+		PermMountOptions: permMountOptions(),
+		PermTrimInterval: permTrimIntervalExpr(),
+		PermPersist:      persist,
+
+		RootOverlay: *rootOverlay,
+		FirstBoot:   firstBootPaths(root),
+
+		FirstBootPayload:    payloadHash,
+		FirstBootPayloadDir: firstBootPayloadDir,
+		FirstBootManifest:   manifest,
+
+		Sealed:    *sealedSecrets != "",
+		SealMagic: sealMagic,
+
+		PermLUKS:    *permLUKS,
+		PermKeyFile: strings.TrimPrefix(permKeyPath, "/"),
+		PermDiscard: *permDiscard || *permTrimInterval > 0,
+
+		StaticNetwork: *staticIP != "" || *dnsServers != "",
+		WiFi:          *wifiSSID != "" && *permMode == "rw",
+
+		TLSOnPerm:  *tlsLocation == "perm",
+		TLSBootDir: strings.TrimPrefix(tlsBootDir, "/"),
+		TLSPermDir: tlsPermDir,
+	}); err != nil {
+		return nil, err
+	}
+
+	return format.Source(buf.Bytes())
+}
+
+func dumpInit(path string, root *fileInfo) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	formatted, err := renderInit(root)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(formatted); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func buildInit(ctx context.Context, root *fileInfo) (tmpdir string, err error) {
+	tmpdir, err = ioutil.TempDir("", "gokr-packer")
+	if err != nil {
+		return "", err
+	}
+
+	code, err := os.Create(filepath.Join(tmpdir, "init.go"))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(code.Name())
+
+	formatted, err := renderInit(root)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := code.Write(formatted); err != nil {
+		return "", err
+	}
+
+	if err := code.Close(); err != nil {
+		return "", err
+	}
+
+	args := []string{"build", "-o", filepath.Join(tmpdir, "init")}
+	if ldflags := stripLdflags(""); ldflags != "" {
+		args = append(args, "-ldflags="+ldflags)
+	}
+	if reproducible() {
+		args = append(args, "-trimpath") // do not embed tmpdir
+	}
+	cmd := exec.CommandContext(ctx, "go", append(args, code.Name())...)
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return tmpdir, nil
+}
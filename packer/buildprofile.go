@@ -0,0 +1,135 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	profileBuild = flag.Bool("profile_build",
+		false,
+		"record the wall time, CPU time (of gokr-packer and the processes it starts) and bytes processed per build stage and print a breakdown. Compiles packages one at a time to attribute compile times to packages")
+
+	profileBuildPprof = flag.String("profile_build_pprof",
+		"",
+		"if non-empty, write a CPU profile (pprof format) of gokr-packer itself (not of the compiler) to this file")
+)
+
+// buildStage is a measured part of a build, e.g. writing the root file
+// system.
+type buildStage struct {
+	name  string
+	start time.Time
+	cpu0  time.Duration
+
+	finished bool
+	wall     time.Duration
+	cpu      time.Duration
+	bytes    int64 // or -1 if not applicable
+}
+
+// buildStages contains the stages of the current build in order.
+var buildStages []*buildStage
+
+func timevalDuration(tv syscall.Timeval) time.Duration {
+	return time.Duration(tv.Nano())
+}
+
+// cpuTime returns the CPU time consumed by gokr-packer and its terminated
+// child processes so far.
+func cpuTime() time.Duration {
+	var total time.Duration
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var ru syscall.Rusage
+		if err := syscall.Getrusage(who, &ru); err != nil {
+			continue
+		}
+		total += timevalDuration(ru.Utime) + timevalDuration(ru.Stime)
+	}
+	return total
+}
+
+// startStage starts measuring the named stage, which ends with done.
+func startStage(name string) *buildStage {
+	s := &buildStage{
+		name:  name,
+		start: time.Now(),
+		cpu0:  cpuTime(),
+		bytes: -1,
+	}
+	buildStages = append(buildStages, s)
+	return s
+}
+
+func (s *buildStage) done() {
+	s.wall = time.Since(s.start)
+	s.cpu = cpuTime() - s.cpu0
+	s.finished = true
+}
+
+// countingReader counts the bytes read from the underlying reader into a
+// buildStage.
+type countingReader struct {
+	io.Reader
+	stage *buildStage
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	if cr.stage.bytes < 0 {
+		cr.stage.bytes = 0
+	}
+	cr.stage.bytes += int64(n)
+	return n, err
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n < 0:
+		return "-"
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MiB", float64(n)/1024/1024)
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KiB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// printBuildProfile prints the breakdown of the build stages to stderr.
+func printBuildProfile(total time.Duration) {
+	tw := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(os.Stderr, "\nbuild profile:\n")
+	fmt.Fprintf(tw, "wall\tshare\tcpu\tbytes\t\tstage\n")
+	for _, s := range buildStages {
+		name := s.name
+		if !s.finished { // the build failed in this stage
+			s.done()
+			name += " (incomplete)"
+		}
+		var share float64
+		if total > 0 {
+			share = 100 * float64(s.wall) / float64(total)
+		}
+		fmt.Fprintf(tw, "%v\t%.1f%%\t%v\t%s\t\t%s\n",
+			s.wall.Round(time.Millisecond),
+			share,
+			s.cpu.Round(time.Millisecond),
+			formatBytes(s.bytes),
+			name)
+	}
+	fmt.Fprintf(tw, "%v\t\t%v\t\t\ttotal\n", total.Round(time.Millisecond), cpuTime().Round(time.Millisecond))
+	tw.Flush()
+}
+
+// stageBytesWriter counts the bytes written into a buildStage.
+type stageBytesWriter buildStage
+
+func (w *stageBytesWriter) Write(p []byte) (int, error) {
+	w.bytes += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,104 @@
+package packer
+
+import (
+	"context"
+	"time"
+
+	buildpb "github.com/gokrazy/tools/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// buildService implements the gRPC BuildService of proto/build.proto on top
+// of the same buildQueue as the daemon REST API.
+type buildService struct {
+	q *buildQueue
+}
+
+func timestampProto(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+// statusProto is the BuildService equivalent of statusJSON.
+func (j *buildJob) statusProto() *buildpb.Build {
+	bs := j.statusJSON()
+	return &buildpb.Build{
+		Id:       bs.ID,
+		Status:   bs.Status,
+		Args:     bs.Args,
+		Update:   bs.Update,
+		Created:  timestamppb.New(bs.Created),
+		Started:  timestampProto(bs.Started),
+		Finished: timestampProto(bs.Finished),
+		Error:    bs.Error,
+		LogUrl:   bs.LogURL,
+		ImageUrl: bs.ImageURL,
+	}
+}
+
+func (s *buildService) job(id string) (*buildJob, error) {
+	j := s.q.job(id)
+	if j == nil {
+		return nil, status.Errorf(codes.NotFound, "build %q not found", id)
+	}
+	return j, nil
+}
+
+func (s *buildService) StartBuild(ctx context.Context, req *buildpb.BuildRequest) (*buildpb.Build, error) {
+	br := buildRequest{
+		Packages:           req.GetPackages(),
+		Hostname:           req.GetHostname(),
+		Board:              req.GetBoard(),
+		KernelPackage:      req.GetKernelPackage(),
+		FirmwarePackage:    req.GetFirmwarePackage(),
+		SerialConsole:      req.GetSerialConsole(),
+		TLS:                req.GetTls(),
+		Output:             req.GetOutput(),
+		TargetStorageBytes: req.GetTargetStorageBytes(),
+		Update:             req.GetUpdate(),
+	}
+	if br.Output == "device" {
+		return nil, status.Error(codes.InvalidArgument, "device output is not available in daemon mode")
+	}
+	j, err := s.q.newJob()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	args, err := br.args(j)
+	if err != nil {
+		s.q.remove(j)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	s.q.start(j, args)
+	return j.statusProto(), nil
+}
+
+func (s *buildService) GetBuild(ctx context.Context, req *buildpb.GetBuildRequest) (*buildpb.Build, error) {
+	j, err := s.job(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return j.statusProto(), nil
+}
+
+func (s *buildService) StreamBuild(req *buildpb.StreamBuildRequest, stream buildpb.BuildService_StreamBuildServer) error {
+	j, err := s.job(req.GetId())
+	if err != nil {
+		return err
+	}
+	err = followBuildOutput(stream.Context(), j, func(line string) error {
+		return stream.Send(&buildpb.BuildEvent{
+			Event: &buildpb.BuildEvent_Log{Log: line},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return stream.Send(&buildpb.BuildEvent{
+		Event: &buildpb.BuildEvent_Build{Build: j.statusProto()},
+	})
+}
@@ -0,0 +1,790 @@
+package packer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var fromBundle = flag.String("from_bundle",
+	"",
+	"build exclusively from the inputs stored in the specified bundle (created with gokr-packer bundle), without network access. The packages and flags are taken from the bundle; flags specified on the command line (e.g. -overwrite) take precedence")
+
+// bundleManifest describes the contents of a bundle. It is stored as
+// manifest.json at the root of the bundle, next to:
+//
+//	go/        the Go toolchain (GOROOT)
+//	modcache/  module zips and go.mod files (a GOPROXY file:// tree)
+//	module/    the main module, i.e. the directory containing go.mod
+//	replace/N  directories which modules are replaced with
+//	files/     host files which flags refer to
+type bundleManifest struct {
+	GoVersion string
+	GOFLAGS   string
+	Dir       string // working directory, relative to module/
+	Packages  []string
+	Flags     []bundleFlag
+	Replace   []bundleReplace
+}
+
+type bundleFlag struct {
+	Name  string
+	Value string // $BUNDLE refers to the extracted bundle
+}
+
+type bundleReplace struct {
+	Old string // module path, optionally followed by @version
+	Dir string // relative to the bundle
+}
+
+// bundlePlaceholder refers to the extracted bundle in flag values.
+const bundlePlaceholder = "$BUNDLE"
+
+// unbundledFlags are not stored in bundles, as they depend on the machine
+// which the bundle is built on.
+var unbundledFlags = map[string]bool{
+	"profile":      true, // the loaded flags are stored
+	"save_profile": true,
+	"from_bundle":  true,
+	"update":       true,
+	"sudo":         true,
+	"dry_run":      true,
+}
+
+// bundleMain writes a bundle of all inputs of a build, so that the same image
+// can be built on a machine without network access using -from_bundle.
+func bundleMain(args []string) error {
+	fset := packerFlagSet("bundle")
+	output := fset.String("o",
+		"",
+		"path of the bundle (.tar.gz) to create")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer bundle [-flags] -o <bundle.tar.gz> <package> [<package>...]\n\nAll gokr-packer flags (except for the output flags such as -overwrite) are stored in the bundle.\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if *output == "" {
+		fset.Usage()
+		os.Exit(2)
+	}
+	// Mark the flags as set in the packer flag set, so that -profile and
+	// -kernel work like in a build:
+	var setErr error
+	fset.Visit(func(f *flag.Flag) {
+		if flag.Lookup(f.Name) == nil || setErr != nil {
+			return
+		}
+		setErr = flag.Set(f.Name, f.Value.String())
+	})
+	if setErr != nil {
+		return setErr
+	}
+	if err := applyConfig(); err != nil {
+		return err
+	}
+	if err := applyProfile(); err != nil {
+		return err
+	}
+	cfg := flagConfig()
+	if err := selectKernelFlavor(cfg); err != nil {
+		return err
+	}
+	if err := applyTargetArch(cfg); err != nil {
+		return err
+	}
+	gokrazyPkgs = strings.Split(*gokrazyPkgList, ",")
+
+	packages := fset.Args()
+	if len(packages) == 0 {
+		packages = cfg.Packages // from the config file
+	}
+	if len(packages) == 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	if err := checkNetworkFlags(packages); err != nil {
+		return err
+	}
+	// -kernel_source and -firmware_source artifacts are not Go modules and
+	// are fetched (or taken from the cache) when building from the bundle:
+	pkgs := goPackages(append(append(append(buildPackages(packages), kernelPackages(cfg)...), firmwarePackages(cfg)...), ubootPackages()...))
+	if err := resolvePackages(context.Background(), pkgs); err != nil {
+		return err
+	}
+
+	gomod, err := goEnvValue("GOMOD")
+	if err != nil {
+		return err
+	}
+	if gomod == "" || gomod == os.DevNull {
+		return fmt.Errorf("bundle requires a go.mod file in the current directory (or a parent directory)")
+	}
+	moduleRoot := filepath.Dir(gomod)
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Rel(moduleRoot, wd)
+	if err != nil {
+		return err
+	}
+	version, err := exec.Command("go", "version").Output()
+	if err != nil {
+		return err
+	}
+	manifest := bundleManifest{
+		GoVersion: strings.TrimSpace(string(version)),
+		GOFLAGS:   os.Getenv("GOFLAGS"),
+		Dir:       filepath.ToSlash(dir),
+		Packages:  packages,
+	}
+
+	outputPath, err := filepath.Abs(*output)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that an interrupted bundle does not
+	// replace a previous, complete one.
+	f, err := ioutil.TempFile(filepath.Dir(outputPath), filepath.Base(outputPath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	gz := gzip.NewWriter(bufw)
+	bw := &bundleWriter{
+		tw:    tar.NewWriter(gz),
+		added: make(map[string]bool),
+		skip:  map[string]bool{outputPath: true, f.Name(): true},
+	}
+
+	log.Printf("bundling modules")
+	if err := bundleModules(bw, moduleRoot, pkgs); err != nil {
+		return err
+	}
+
+	log.Printf("bundling main module %s", moduleRoot)
+	if err := bw.addTree("module", moduleRoot); err != nil {
+		return err
+	}
+	if manifest.Replace, err = bundleReplacements(bw, moduleRoot); err != nil {
+		return err
+	}
+	if manifest.Flags, err = bundleFlags(bw, moduleRoot); err != nil {
+		return err
+	}
+
+	goroot, err := goEnvValue("GOROOT")
+	if err != nil {
+		return err
+	}
+	log.Printf("bundling Go toolchain %s", goroot)
+	if err := bw.addTree("go", goroot); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := bw.addBytes("manifest.json", append(b, '\n')); err != nil {
+		return err
+	}
+	if err := bw.tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), outputPath); err != nil {
+		return err
+	}
+	log.Printf("wrote bundle %s (%d files), build it using -from_bundle=%s", outputPath, len(bw.added), *output)
+	return nil
+}
+
+// goEnvValue returns the value of the go env variable name.
+func goEnvValue(name string) (string, error) {
+	cmd := exec.Command("go", "env", name)
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// escapeModulePath escapes upper case letters in module paths and versions
+// like the module cache (e.g. github.com/!burnt!sushi).
+func escapeModulePath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if 'A' <= r && r <= 'Z' {
+			b.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// bundleModules adds the module zips of all modules providing pkgs (or their
+// dependencies) and the go.mod files of all modules in the module graph to
+// modcache/.
+func bundleModules(bw *bundleWriter, moduleRoot string, pkgs []string) error {
+	cmd := exec.Command("go", append([]string{"list", "-deps", "-f", "{{ with .Module }}{{ if not .Main }}{{ .Path }}\t{{ .Version }}{{ with .Replace }}\t{{ .Path }}\t{{ .Version }}{{ end }}{{ end }}{{ end }}"}, pkgs...)...)
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	modules := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\t")
+		switch len(fields) {
+		case 2:
+			modules[fields[0]+"@"+fields[1]] = true
+		case 4:
+			if fields[3] == "" {
+				continue // replaced with a directory, see bundleReplacements
+			}
+			modules[fields[2]+"@"+fields[3]] = true
+		}
+	}
+	sorted := make([]string, 0, len(modules))
+	for m := range modules {
+		sorted = append(sorted, m)
+	}
+	sort.Strings(sorted)
+	for _, m := range sorted {
+		cmd := exec.Command("go", "mod", "download", "-json", m)
+		cmd.Env = env
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		var download struct {
+			Path, Version    string
+			Error            string
+			Info, GoMod, Zip string
+		}
+		if jerr := json.Unmarshal(out, &download); jerr == nil && download.Error != "" {
+			return fmt.Errorf("go mod download %s: %s", m, download.Error)
+		}
+		if err != nil {
+			return fmt.Errorf("go mod download %s: %v", m, err)
+		}
+		prefix := "modcache/" + escapeModulePath(download.Path) + "/@v/" + escapeModulePath(download.Version)
+		for ext, path := range map[string]string{".info": download.Info, ".mod": download.GoMod, ".zip": download.Zip} {
+			if err := bw.addFile(prefix+ext, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The go tool reads the go.mod files of all modules in the module graph
+	// (for minimal version selection), even of those which do not provide
+	// packages:
+	cmd = exec.Command("go", "mod", "graph")
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	out, err = cmd.Output()
+	if err != nil {
+		return err
+	}
+	modcache, err := goEnvValue("GOMODCACHE")
+	if err != nil {
+		return err
+	}
+	replaces, err := goModReplaces(moduleRoot)
+	if err != nil {
+		return err
+	}
+	replaced := func(path, version string) bool {
+		for _, r := range replaces {
+			if r.Old.Path == path && (r.Old.Version == "" || r.Old.Version == version) {
+				return true // the go.mod file of the replacement is used
+			}
+		}
+		return false
+	}
+	for _, m := range strings.Fields(string(out)) {
+		idx := strings.LastIndexByte(m, '@')
+		if idx == -1 {
+			continue // main module
+		}
+		path, version := m[:idx], m[idx+1:]
+		if path == "go" || path == "toolchain" || replaced(path, version) {
+			continue
+		}
+		escaped := escapeModulePath(path) + "/@v/" + escapeModulePath(version)
+		for _, ext := range []string{".info", ".mod"} {
+			name := "modcache/" + escaped + ext
+			if bw.added[name] {
+				continue
+			}
+			src := filepath.Join(modcache, "cache", "download", filepath.FromSlash(escaped)+ext)
+			if _, err := os.Stat(src); ext == ".info" && os.IsNotExist(err) {
+				continue // only needed for version queries
+			}
+			if err := bw.addFile(name, src); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// goModReplace is a replace directive of a go.mod file.
+type goModReplace struct {
+	Old, New struct{ Path, Version string }
+}
+
+func goModReplaces(moduleRoot string) ([]goModReplace, error) {
+	cmd := exec.Command("go", "mod", "edit", "-json")
+	cmd.Dir = moduleRoot
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	var gomod struct {
+		Replace []goModReplace
+	}
+	if err := json.Unmarshal(out, &gomod); err != nil {
+		return nil, err
+	}
+	return gomod.Replace, nil
+}
+
+// bundleReplacements adds the directories outside of the main module which
+// modules are replaced with (in go.mod) to replace/.
+func bundleReplacements(bw *bundleWriter, moduleRoot string) ([]bundleReplace, error) {
+	goModReplaces, err := goModReplaces(moduleRoot)
+	if err != nil {
+		return nil, err
+	}
+	var replaces []bundleReplace
+	for _, r := range goModReplaces {
+		if r.New.Version != "" {
+			continue // replaced with a module, see bundleModules
+		}
+		dir := r.New.Path
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(moduleRoot, dir)
+		}
+		if rel, err := filepath.Rel(moduleRoot, dir); err == nil && !strings.HasPrefix(rel, "..") {
+			continue // part of the main module
+		}
+		old := r.Old.Path
+		if r.Old.Version != "" {
+			old += "@" + r.Old.Version
+		}
+		name := "replace/" + strconv.Itoa(len(replaces))
+		log.Printf("bundling %s (replacing %s)", dir, old)
+		if err := bw.addTree(name, dir); err != nil {
+			return nil, err
+		}
+		replaces = append(replaces, bundleReplace{Old: old, Dir: name})
+	}
+	return replaces, nil
+}
+
+// bundleFlags returns all explicitly set flags (except for unbundledFlags and
+// outputFlags). Host files which flags refer to are added to files/ (or
+// referred to within module/), and the flag values are changed accordingly.
+func bundleFlags(bw *bundleWriter, moduleRoot string) ([]bundleFlag, error) {
+	set := explicitFlags()
+	names := make([]string, 0, len(set))
+	for name := range set {
+		if unbundledFlags[name] || outputFlags[name] {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var flags []bundleFlag
+	for _, name := range names {
+		values := strings.Split(flag.Lookup(name).Value.String(), ",")
+		for i, value := range values {
+			// Only consider values which look like paths, not e.g. a
+			// -hostname which happens to match a file name:
+			if !strings.Contains(value, string(os.PathSeparator)) {
+				continue
+			}
+			path, err := filepath.Abs(value)
+			if err != nil {
+				continue
+			}
+			st, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if rel, err := filepath.Rel(moduleRoot, path); err == nil && !strings.HasPrefix(rel, "..") {
+				values[i] = bundlePlaceholder + "/module/" + filepath.ToSlash(rel)
+				continue
+			}
+			dest := "files/" + name + "/" + strconv.Itoa(i) + "/" + filepath.Base(path)
+			if st.IsDir() {
+				err = bw.addTree(dest, path)
+			} else {
+				err = bw.addFile(dest, path)
+			}
+			if err != nil {
+				return nil, err
+			}
+			values[i] = bundlePlaceholder + "/" + dest
+		}
+		flags = append(flags, bundleFlag{Name: name, Value: strings.Join(values, ",")})
+	}
+	return flags, nil
+}
+
+// bundleWriter writes the files of a bundle to a tar archive.
+type bundleWriter struct {
+	tw    *tar.Writer
+	added map[string]bool
+	skip  map[string]bool // absolute paths, e.g. of the bundle itself
+}
+
+func (bw *bundleWriter) addBytes(name string, b []byte) error {
+	if err := bw.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(b)),
+	}); err != nil {
+		return err
+	}
+	bw.added[name] = true
+	_, err := bw.tw.Write(b)
+	return err
+}
+
+// addFile adds the regular file or symlink path as name.
+func (bw *bundleWriter) addFile(name, path string) error {
+	if bw.added[name] {
+		return nil
+	}
+	st, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	var link string
+	if st.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	} else if !st.Mode().IsRegular() {
+		return nil // e.g. a socket
+	}
+	hdr, err := tar.FileInfoHeader(st, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.Uid, hdr.Gid = 0, 0
+	if err := bw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	bw.added[name] = true
+	if link != "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(bw.tw, f, hdr.Size); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// addTree adds the files in dir (recursively) below name, skipping version
+// control directories and nested modules.
+func (bw *bundleWriter) addTree(name, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if bw.skip[path] {
+			return nil
+		}
+		if info.IsDir() && path != dir {
+			if base := info.Name(); base == ".git" || base == ".hg" || base == ".svn" {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil && name == "module" {
+				return filepath.SkipDir // nested module
+			}
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return bw.addFile(name+"/"+filepath.ToSlash(rel), path)
+	})
+}
+
+// extractBundle extracts the bundle fn into dir. Symlinks are created after
+// all files, so that no file is written through a symlink, and must resolve to
+// a path within dir.
+func extractBundle(fn, dir string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	tr := tar.NewReader(gz)
+	var symlinks []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if filepath.IsAbs(name) || name != filepath.Clean(name) || strings.HasPrefix(name, "..") {
+			return fmt.Errorf("%s: invalid file name %q", fn, hdr.Name)
+		}
+		dest := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(hdr.Mode)&os.ModePerm|0200)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+			if err := os.Chtimes(dest, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// Symlinks must not point outside of the bundle:
+			target := filepath.Join(filepath.Dir(name), filepath.FromSlash(hdr.Linkname))
+			if filepath.IsAbs(hdr.Linkname) || strings.HasPrefix(target, "..") {
+				return fmt.Errorf("%s: symlink %s points outside of the bundle", fn, hdr.Name)
+			}
+			symlinks = append(symlinks, hdr)
+		default:
+			return fmt.Errorf("%s: %s: unsupported file type %c", fn, hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	for _, hdr := range symlinks {
+		dest := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.Symlink(hdr.Linkname, dest); err != nil {
+			return err
+		}
+	}
+	// The targets of symlinks can contain other symlinks (e.g. a -> . and
+	// b -> a/..), so their check above is not sufficient:
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	for _, hdr := range symlinks {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(dir, filepath.FromSlash(hdr.Name)))
+		if os.IsNotExist(err) {
+			continue // dangling, nothing is written through it
+		}
+		if err != nil {
+			return fmt.Errorf("%s: symlink %s: %v", fn, hdr.Name, err)
+		}
+		if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s: symlink %s points outside of the bundle", fn, hdr.Name)
+		}
+	}
+	return nil
+}
+
+// useBundle extracts the -from_bundle bundle and configures the build to use
+// only its contents: its flags and packages, its Go toolchain and its modules
+// (via GOPROXY). The returned function removes the extracted bundle and
+// restores the working directory and environment.
+func useBundle(fn string) (cleanup func(), _ error) {
+	if flag.NArg() > 0 {
+		return nil, fmt.Errorf("-from_bundle: the packages are taken from the bundle, but %v were specified", flag.Args())
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "gokr-packer-bundle")
+	if err != nil {
+		return nil, err
+	}
+	prevEnv := make(map[string]*string)
+	cleanup = func() {
+		if err := os.Chdir(wd); err != nil {
+			log.Print(err)
+		}
+		for key, value := range prevEnv {
+			if value == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *value)
+			}
+		}
+		env = goEnv(flagConfig())
+		// The module cache is read-only:
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(path, 0755)
+			}
+			return nil
+		})
+		os.RemoveAll(dir)
+	}
+	log.Printf("extracting bundle %s to %s", fn, dir)
+	if err := extractBundle(fn, dir); err != nil {
+		cleanup()
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	var manifest bundleManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("%s: manifest.json: %v", fn, err)
+	}
+
+	// Paths specified on the command line (e.g. -overwrite) are relative to
+	// the current directory, but the build runs in the bundled module:
+	set := explicitFlags()
+	for name := range set {
+		f := flag.Lookup(name)
+		values := strings.Split(f.Value.String(), ",")
+		for i, value := range values {
+			if value == "" || value == "-" || filepath.IsAbs(value) {
+				continue
+			}
+			if _, err := os.Stat(value); !outputFlags[name] && (err != nil || !strings.Contains(value, string(os.PathSeparator))) {
+				continue
+			}
+			var err error
+			if values[i], err = filepath.Abs(value); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+		if err := f.Value.Set(strings.Join(values, ",")); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	for _, bf := range manifest.Flags {
+		if set[bf.Name] {
+			continue // the command line takes precedence
+		}
+		if flag.Lookup(bf.Name) == nil {
+			cleanup()
+			return nil, fmt.Errorf("%s: unknown flag -%s (the bundle was created by a different gokr-packer version)", fn, bf.Name)
+		}
+		if err := flag.Set(bf.Name, strings.ReplaceAll(bf.Value, bundlePlaceholder, dir)); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("%s: -%s: %v", fn, bf.Name, err)
+		}
+	}
+	flag.CommandLine.Parse(append([]string{"--"}, manifest.Packages...))
+
+	goroot := filepath.Join(dir, "go")
+	for key, value := range map[string]string{
+		"GOROOT":      goroot,
+		"PATH":        filepath.Join(goroot, "bin") + string(os.PathListSeparator) + os.Getenv("PATH"),
+		"GOPATH":      filepath.Join(dir, "gopath"),
+		"GOMODCACHE":  filepath.Join(dir, "gopath", "pkg", "mod"),
+		"GOPROXY":     "file://" + filepath.ToSlash(filepath.Join(dir, "modcache")),
+		"GOFLAGS":     manifest.GOFLAGS,
+		"GOSUMDB":     "off", // go.sum is part of the bundle
+		"GONOPROXY":   "",
+		"GONOSUMDB":   "",
+		"GOPRIVATE":   "",
+		"GOTOOLCHAIN": "local",
+		"GOWORK":      "off",
+	} {
+		if prev, ok := os.LookupEnv(key); ok {
+			prevEnv[key] = &prev
+		} else {
+			prevEnv[key] = nil
+		}
+		if err := os.Setenv(key, value); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	env = goEnv(flagConfig())
+
+	moduleRoot := filepath.Join(dir, "module")
+	for _, r := range manifest.Replace {
+		cmd := exec.Command("go", "mod", "edit", "-replace="+r.Old+"="+filepath.Join(dir, filepath.FromSlash(r.Dir)))
+		cmd.Dir = moduleRoot
+		cmd.Env = env
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	if err := os.Chdir(filepath.Join(moduleRoot, filepath.FromSlash(manifest.Dir))); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	version, err := exec.Command("go", "version").Output()
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if got := string(bytes.TrimSpace(version)); got != manifest.GoVersion {
+		cleanup()
+		return nil, fmt.Errorf("%s: bundled Go toolchain reports %q, expected %q", fn, got, manifest.GoVersion)
+	}
+	log.Printf("building %v from bundle (%s)", manifest.Packages, manifest.GoVersion)
+	return cleanup, nil
+}
@@ -0,0 +1,136 @@
+package packer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type bundleEntry struct {
+	name, contents, linkname string
+}
+
+// writeTestBundle writes a bundle with the specified entries to fn. Entries
+// with a linkname are symlinks.
+func writeTestBundle(t *testing.T, fn string, entries []bundleEntry) {
+	t.Helper()
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(e.contents)),
+		}
+		if e.linkname != "" {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.linkname
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractBundle(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gokr-packer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	fn := filepath.Join(tmp, "ok.tar.gz")
+	writeTestBundle(t, fn, []bundleEntry{
+		{name: "module/link", linkname: "sub/file"},
+		{name: "module/sub/file", contents: "contents"},
+	})
+	dir := filepath.Join(tmp, "ok")
+	if err := extractBundle(fn, dir); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "module", "link")); err != nil || string(b) != "contents" {
+		t.Errorf("module/link: got %q, %v, want %q", b, err, "contents")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		entries []bundleEntry
+	}{
+		{"absolute", []bundleEntry{{name: "link", linkname: tmp}}},
+		{"parent", []bundleEntry{{name: "a/link", linkname: "../.."}}},
+		{"chain", []bundleEntry{
+			{name: "b", linkname: "a/.."},
+			{name: "a", linkname: "."},
+		}},
+		{"file through symlink", []bundleEntry{
+			{name: "a", linkname: "."},
+			{name: "b", linkname: "a/.."},
+			{name: "b/escaped", contents: "contents"},
+		}},
+	} {
+		fn := filepath.Join(tmp, tt.name+".tar.gz")
+		writeTestBundle(t, fn, tt.entries)
+		dir := filepath.Join(tmp, tt.name)
+		if err := extractBundle(fn, dir); err == nil {
+			t.Errorf("%s: extractBundle: unexpectedly succeeded", tt.name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside of the bundle: %v", err)
+	}
+}
+
+func TestUseBundleCleanup(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gokr-packer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("GOPROXY", os.Getenv("GOPROXY"))
+	os.Setenv("GOPROXY", "https://proxy.example")
+
+	// The bundle lacks the Go toolchain, so useBundle fails after switching to
+	// the bundled module and environment:
+	manifest, err := json.Marshal(&bundleManifest{GoVersion: "go0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(tmp, "bundle.tar.gz")
+	writeTestBundle(t, fn, []bundleEntry{
+		{name: "manifest.json", contents: string(manifest)},
+		{name: "module/go.mod", contents: "module example.com/bundled\n"},
+	})
+	if _, err := useBundle(fn); err == nil {
+		t.Fatalf("useBundle: unexpectedly succeeded")
+	}
+	if got, err := os.Getwd(); err != nil || got != wd {
+		t.Errorf("working directory: got %q, %v, want %q", got, err, wd)
+	}
+	if got, want := os.Getenv("GOPROXY"), "https://proxy.example"; got != want {
+		t.Errorf("GOPROXY: got %q, want %q", got, want)
+	}
+}
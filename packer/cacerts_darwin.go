@@ -1,4 +1,4 @@
-package main
+package packer
 
 // FIXME this should be replaced with the logic from go1.8/src/crypto/x509/root_darwin.go
 
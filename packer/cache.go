@@ -0,0 +1,273 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	cacheDirFlag = flag.String("cache_dir",
+		"",
+		"directory in which gokr-packer keeps state between builds: the downloaded -kernel_source and -firmware_source artifacts (sources/) and the root file systems of -rootfs_cache (rootfs/). Empty means gokrazy in the user cache directory (e.g. ~/.cache/gokrazy)")
+
+	cacheMaxSize = flag.String("cache_max_size",
+		"5G",
+		"maximum size (with K, M or G suffix) of -cache_dir. After each build, the least recently used entries are removed until the cache fits, see gokr-packer cache gc. Empty means no limit")
+)
+
+// cacheGCGrace is how long cache entries are kept after they were last used
+// (or, for incomplete entries, created), as a concurrent build might be
+// using them.
+const cacheGCGrace = 10 * time.Minute
+
+// cacheAreas are the subdirectories of cacheDir, see listCache.
+var cacheAreas = []string{"sources", "rootfs"}
+
+// cacheDir returns -cache_dir, or gokrazy in the user cache directory.
+func cacheDir() (string, error) {
+	if *cacheDirFlag != "" {
+		return *cacheDirFlag, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gokrazy"), nil
+}
+
+// checkCacheFlags verifies the -cache_max_size flag.
+func checkCacheFlags() error {
+	if *cacheMaxSize == "" {
+		return nil
+	}
+	if _, err := parseSize(*cacheMaxSize); err != nil {
+		return fmt.Errorf("-cache_max_size: %v", err)
+	}
+	return nil
+}
+
+// cacheEntry is a unit of the cache which is used and removed as a whole,
+// e.g. an extracted artifact or a root file system with its timestamp.
+type cacheEntry struct {
+	area  string // one of cacheAreas
+	name  string
+	paths []string
+	size  int64
+	used  time.Time
+
+	// incomplete marks the leftovers of an interrupted download or build.
+	incomplete bool
+}
+
+// diskUsage returns the total size of the files at path (recursively) and
+// its modification time.
+func diskUsage(path string) (size int64, mtime time.Time, _ error) {
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == path {
+			mtime = fi.ModTime()
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, mtime, err
+}
+
+// listCache returns the entries of the cache in dir, least recently used
+// first.
+func listCache(dir string) ([]*cacheEntry, error) {
+	var entries []*cacheEntry
+	for _, area := range cacheAreas {
+		fis, err := ioutil.ReadDir(filepath.Join(dir, area))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		byName := make(map[string]*cacheEntry)
+		for _, fi := range fis {
+			name := fi.Name()
+			incomplete := false
+			switch area {
+			case "sources":
+				// <digest>, or tmp-* while downloading (see artifactDir)
+				incomplete = strings.HasPrefix(name, "tmp-")
+			case "rootfs":
+				// <hash>.squashfs and <hash>.timestamp, or <hash>.<random>
+				// while storing (see storeCachedRoot)
+				if idx := strings.IndexByte(name, '.'); idx > -1 {
+					ext := name[idx:]
+					incomplete = ext != ".squashfs" && ext != ".timestamp"
+					if !incomplete {
+						name = name[:idx]
+					}
+				}
+			}
+			p := filepath.Join(dir, area, fi.Name())
+			size, mtime, err := diskUsage(p)
+			if err != nil {
+				return nil, err
+			}
+			e, ok := byName[name]
+			if !ok {
+				e = &cacheEntry{area: area, name: name, incomplete: incomplete}
+				byName[name] = e
+				entries = append(entries, e)
+			}
+			e.paths = append(e.paths, p)
+			e.size += size
+			// copyCachedRoot marks the .squashfs file as most recently used:
+			if e.used.IsZero() || strings.HasSuffix(p, ".squashfs") {
+				e.used = mtime
+			}
+		}
+		if area == "rootfs" {
+			for _, e := range byName {
+				// A root file system is complete once its timestamp is written:
+				e.incomplete = e.incomplete || len(e.paths) != 2
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+	return entries, nil
+}
+
+// gcCache removes the incomplete entries and the entries unused for longer
+// than maxAge (if non-zero) from the cache in dir, then the least recently
+// used entries until the cache does not exceed maxSize bytes (if non-zero).
+// Entries used within cacheGCGrace are kept.
+func gcCache(dir string, maxSize int64, maxAge time.Duration) (removed []*cacheEntry, total int64, _ error) {
+	entries, err := listCache(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, e := range entries {
+		total += e.size
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if now.Sub(e.used) < cacheGCGrace {
+			continue
+		}
+		if !e.incomplete &&
+			(maxAge == 0 || now.Sub(e.used) <= maxAge) &&
+			(maxSize == 0 || total <= maxSize) {
+			continue
+		}
+		for _, p := range e.paths {
+			if err := os.RemoveAll(p); err != nil {
+				return removed, total, err
+			}
+		}
+		removed = append(removed, e)
+		total -= e.size
+	}
+	return removed, total, nil
+}
+
+// gcCacheAfterBuild removes the least recently used cache entries if the cache
+// exceeds -cache_max_size. Errors are only logged, as the build succeeded.
+func gcCacheAfterBuild() {
+	if *cacheMaxSize == "" {
+		return
+	}
+	maxSize, err := parseSize(*cacheMaxSize)
+	if err != nil || maxSize == 0 {
+		return
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return
+	}
+	removed, total, err := gcCache(dir, maxSize, 0)
+	if err != nil {
+		log.Printf("-cache_max_size: %v", err)
+		return
+	}
+	if len(removed) > 0 {
+		log.Printf("removed %d least recently used entries from %s, which now takes up %s (-cache_max_size=%s)", len(removed), dir, formatBytes(total), *cacheMaxSize)
+	}
+}
+
+func cacheMain(args []string) error {
+	fset := flag.NewFlagSet("cache", flag.ExitOnError)
+	for _, name := range []string{"cache_dir", "cache_max_size"} {
+		f := flag.Lookup(name)
+		fset.Var(f.Value, f.Name, f.Usage)
+	}
+	maxAge := fset.Duration("max_age",
+		0,
+		"gc: also remove entries which were not used for longer than this duration (e.g. 720h). 0 means no limit")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer cache list|gc [-flags]\n\nLists the entries of the cache directory, or removes incomplete and least recently used entries (gc) until the cache fits -cache_max_size.\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	if len(args) < 1 || (args[0] != "list" && args[0] != "gc") {
+		fset.Usage()
+		os.Exit(2)
+	}
+	fset.Parse(args[1:])
+	if fset.NArg() > 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	if err := checkCacheFlags(); err != nil {
+		return err
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "list" {
+		entries, err := listCache(dir)
+		if err != nil {
+			return err
+		}
+		var total int64
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "last used\tsize\tentry\n")
+		for _, e := range entries {
+			name := e.area + "/" + e.name
+			if e.incomplete {
+				name += " (incomplete)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", e.used.Format("2006-01-02 15:04"), formatBytes(e.size), name)
+			total += e.size
+		}
+		tw.Flush()
+		fmt.Printf("\n%d entries, %s in %s\n", len(entries), formatBytes(total), dir)
+		return nil
+	}
+
+	var maxSize int64
+	if *cacheMaxSize != "" {
+		if maxSize, err = parseSize(*cacheMaxSize); err != nil {
+			return err
+		}
+	}
+	removed, total, err := gcCache(dir, maxSize, *maxAge)
+	for _, e := range removed {
+		fmt.Printf("removed %s/%s (%s)\n", e.area, e.name, formatBytes(e.size))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s now takes up %s\n", dir, formatBytes(total))
+	return nil
+}
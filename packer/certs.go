@@ -0,0 +1,314 @@
+package packer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+)
+
+var (
+	tlsCA = flag.String("tls_ca",
+		"",
+		"CA certificate and private key (-tls_ca=<certificate path>,<private key path>, PEM) with which the certificate of -tls=self-signed is signed instead of being self-signed, so that clients which trust the CA trust each device. The CA certificate is included in the root file system as /etc/ssl/gokrazy-ca.pem")
+
+	tlsLocation = flag.String("tls_location",
+		"rootfs",
+		"where the device stores the -tls certificate and private key: rootfs (in /etc/ssl of the root file system) or perm (in /perm/gokrazy/tls, copied from the boot partition by init, so that the root file system does not contain the private key). perm requires -perm=rw")
+)
+
+const (
+	// tlsBootDir contains the -tls certificate and private key on the boot
+	// file system with -tls_location=perm, from which init copies them to
+	// tlsPermDir.
+	tlsBootDir = "/gokrazy-tls"
+	tlsPermDir = "/perm/gokrazy/tls"
+)
+
+// checkTLSFlags verifies the -tls_ca and -tls_location flags.
+func checkTLSFlags(cfg *Config) error {
+	if *tlsCA != "" && cfg.TLS != "self-signed" {
+		return fmt.Errorf("-tls_ca requires -tls=self-signed")
+	}
+	switch *tlsLocation {
+	case "rootfs":
+	case "perm":
+		if cfg.TLS == "" {
+			return fmt.Errorf("-tls_location=perm requires -tls")
+		}
+		if *permMode != "rw" {
+			return fmt.Errorf("-tls_location=perm requires -perm=rw")
+		}
+	default:
+		return fmt.Errorf("-tls_location=%q is not one of rootfs or perm", *tlsLocation)
+	}
+	return nil
+}
+
+// readTLSCA returns the -tls_ca certificate and private key, or nil if -tls_ca
+// is empty.
+func readTLSCA() (*x509.Certificate, crypto.Signer, error) {
+	if *tlsCA == "" {
+		return nil, nil, nil
+	}
+	parts := strings.Split(*tlsCA, ",")
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("-tls_ca=%q is not of the form <certificate path>,<private key path>", *tlsCA)
+	}
+	ca, err := getCertificateFromFile(parts[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("-tls_ca: %v", err)
+	}
+	if !ca.IsCA {
+		return nil, nil, fmt.Errorf("-tls_ca: %s is not a CA certificate", parts[0])
+	}
+	b, err := ioutil.ReadFile(parts[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("-tls_ca: %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, nil, fmt.Errorf("-tls_ca: %s: no PEM data found", parts[1])
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("-tls_ca: %s: %v", parts[1], err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("-tls_ca: %s: unsupported private key type %T", parts[1], key)
+	}
+	return ca, signer, nil
+}
+
+// addTLSFiles adds the -tls certificate and private key (or, with
+// -tls_location=perm, symlinks to their location on the permanent data
+// partition) and the -tls_ca certificate to the /etc/ssl directory ssl.
+func addTLSFiles(ssl *fileInfo, certPath, keyPath string) {
+	if *tlsLocation == "perm" {
+		ssl.dirents = append(ssl.dirents, &fileInfo{
+			filename:    "gokrazy-web.pem",
+			symlinkDest: tlsPermDir + "/cert.pem",
+		})
+		ssl.dirents = append(ssl.dirents, &fileInfo{
+			filename:    "gokrazy-web.key.pem",
+			symlinkDest: tlsPermDir + "/key.pem",
+		})
+	} else {
+		ssl.dirents = append(ssl.dirents, &fileInfo{
+			filename: "gokrazy-web.pem",
+			fromHost: certPath,
+		})
+		ssl.dirents = append(ssl.dirents, &fileInfo{
+			filename: "gokrazy-web.key.pem",
+			fromHost: keyPath,
+		})
+	}
+	if *tlsCA != "" {
+		ssl.dirents = append(ssl.dirents, &fileInfo{
+			filename: "gokrazy-ca.pem",
+			fromHost: strings.Split(*tlsCA, ",")[0],
+		})
+	}
+}
+
+// writeTLSFiles writes the -tls certificate and private key to the boot file
+// system fw for -tls_location=perm.
+func writeTLSFiles(cfg *Config, fw bootFSWriter) error {
+	certPath, keyPath, err := getCertificate(cfg)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(fw, tlsBootDir+"/cert.pem", certPath); err != nil {
+		return err
+	}
+	return copyFile(fw, tlsBootDir+"/key.pem", keyPath)
+}
+
+// generateAndSignCert generates a certificate for hostname, signed by ca
+// (using caKey), or self-signed if ca is nil.
+func generateAndSignCert(hostname string, ca *x509.Certificate, caKey crypto.Signer) ([]byte, *rsa.PrivateKey, error) {
+	notBefore := time.Now()
+	notAfter := notBefore.Add(2 * 365 * 24 * time.Hour)
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"gokrazy"},
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname},
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub := &priv.PublicKey
+	parent, signer := &template, crypto.Signer(priv)
+	if ca != nil {
+		if notAfter.After(ca.NotAfter) {
+			template.NotAfter = ca.NotAfter
+		}
+		parent, signer = ca, caKey
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, pub, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return derBytes, priv, err
+}
+
+func generateAndStoreSelfSignedCertificate(hostname, hostConfigPath, certPath, keyPath string, ca *x509.Certificate, caKey crypto.Signer) error {
+	if ca != nil {
+		fmt.Printf("Generating new certificate signed by %s...\n", ca.Subject)
+	} else {
+		fmt.Println("Generating new self-signed certificate...")
+	}
+	// Generate
+	if err := os.MkdirAll(string(hostConfigPath), 0755); err != nil {
+		return err
+	}
+	cert, priv, err := generateAndSignCert(hostname, ca, caKey)
+	if err != nil {
+		return err
+	}
+
+	// Write Certificate
+	certOut, err := os.OpenFile(certPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: cert}); err != nil {
+		return err
+	}
+	if ca != nil {
+		// Serve the full chain:
+		if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}); err != nil {
+			return err
+		}
+	}
+	if err := certOut.Close(); err != nil {
+		return err
+	}
+
+	// Write Key
+	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(keyOut, &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}); err != nil {
+		//TODO: Cleanup?
+		return err
+	}
+	if err := keyOut.Close(); err != nil {
+		//TODO: Cleanup?
+		return err
+	}
+	return nil
+}
+
+func getCertificate(cfg *Config) (string, string, error) {
+	hostConfigPath := config.HostnameSpecific(cfg.Hostname)
+	var certPath, keyPath string
+	switch cfg.TLS {
+	case "self-signed":
+		certPath = filepath.Join(string(hostConfigPath), "cert.pem")
+		keyPath = filepath.Join(string(hostConfigPath), "key.pem")
+		gen := false
+		exist := true
+		if _, err := os.Stat(certPath); os.IsNotExist(err) {
+			gen = true
+			exist = false
+		}
+		if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+			gen = true
+			exist = false
+		}
+		ca, caKey, err := readTLSCA()
+		if err != nil {
+			return "", "", err
+		}
+		if exist {
+			// TODO: Check validity dates of existing certificate
+			if ca != nil {
+				cert, err := getCertificateFromFile(certPath)
+				if err != nil {
+					return "", "", err
+				}
+				if err := cert.CheckSignatureFrom(ca); err != nil {
+					return "", "", fmt.Errorf("%s is not signed by the -tls_ca certificate (%v). Remove it and %s to generate a new certificate", certPath, err, keyPath)
+				}
+			}
+		}
+		if gen {
+			if err := generateAndStoreSelfSignedCertificate(cfg.Hostname, string(hostConfigPath), certPath, keyPath, ca, caKey); err != nil {
+				return "", "", err
+			}
+		}
+	case "":
+		return "", "", nil
+	default:
+		parts := strings.Split(cfg.TLS, ",")
+		certPath = parts[0]
+		if len(parts) > 1 {
+			keyPath = parts[1]
+		} else {
+			return "", "", fmt.Errorf("no private key supplied")
+		}
+		// TODO: Check validity
+	}
+	return certPath, keyPath, nil
+}
+
+func getCertificateFromFile(certPath string) (*x509.Certificate, error) {
+	reader, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(reader)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func getCertificateFingerprintSHA1(certificate *x509.Certificate) [sha1.Size]byte {
+	return sha1.Sum(certificate.Raw)
+}
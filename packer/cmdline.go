@@ -0,0 +1,122 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// cmdlineParamList is the value of the repeatable -cmdline_append and
+// -cmdline_remove flags: kernel parameters, each value possibly containing
+// multiple (space-separated) parameters.
+type cmdlineParamList []string
+
+func (l *cmdlineParamList) String() string { return strings.Join(*l, " ") }
+
+func (l *cmdlineParamList) Set(value string) error {
+	params, err := splitCmdline(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, params...)
+	return nil
+}
+
+var (
+	cmdlineAppend cmdlineParamList
+	cmdlineRemove cmdlineParamList
+)
+
+func init() {
+	flag.Var(&cmdlineAppend, "cmdline_append",
+		"kernel parameters to add to cmdline.txt, e.g. \"cgroup_enable=memory swapaccount=1\". Can be specified multiple times. A parameter replaces an existing parameter of the same name (except for console=, of which the kernel accepts multiple)")
+	flag.Var(&cmdlineRemove, "cmdline_remove",
+		"kernel parameter to remove from cmdline.txt, e.g. quiet. A name (e.g. console) removes all parameters of that name, name=value only matching parameters. Can be specified multiple times. Applied before -cmdline_append")
+}
+
+// splitCmdline splits the kernel command line cmdline into parameters,
+// keeping double-quoted values (e.g. dyndbg="file drivers/usb/* +p") intact,
+// like the kernel does.
+func splitCmdline(cmdline string) ([]string, error) {
+	var (
+		params []string
+		cur    strings.Builder
+		quoted bool
+	)
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			cur.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if cur.Len() > 0 {
+				params = append(params, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in kernel parameters %q", cmdline)
+	}
+	if cur.Len() > 0 {
+		params = append(params, cur.String())
+	}
+	return params, nil
+}
+
+// cmdlineParamName returns the name of the kernel parameter param, i.e. the
+// part before the first =.
+func cmdlineParamName(param string) string {
+	if idx := strings.IndexByte(param, '='); idx > -1 {
+		return param[:idx]
+	}
+	return param
+}
+
+// repeatableCmdlineParams may be specified multiple times on the kernel
+// command line, so -cmdline_append does not replace them.
+var repeatableCmdlineParams = map[string]bool{
+	"console": true,
+}
+
+// applyCmdlineEdits applies -cmdline_remove and -cmdline_append to cmdline.
+func applyCmdlineEdits(cmdline string) (string, error) {
+	if len(cmdlineRemove) == 0 && len(cmdlineAppend) == 0 {
+		return cmdline, nil
+	}
+	trimmed := strings.TrimRight(cmdline, " \n")
+	suffix := cmdline[len(trimmed):]
+	params, err := splitCmdline(trimmed)
+	if err != nil {
+		return "", err
+	}
+	without := func(drop func(string) bool) []string {
+		var result []string
+		for _, p := range params {
+			if !drop(p) {
+				result = append(result, p)
+			}
+		}
+		return result
+	}
+	for _, remove := range cmdlineRemove {
+		params = without(func(p string) bool {
+			if strings.Contains(remove, "=") {
+				return p == remove
+			}
+			return cmdlineParamName(p) == remove
+		})
+	}
+	for _, add := range cmdlineAppend {
+		name := cmdlineParamName(add)
+		if repeatableCmdlineParams[name] {
+			params = without(func(p string) bool { return p == add })
+		} else {
+			params = without(func(p string) bool { return cmdlineParamName(p) == name })
+		}
+		params = append(params, add)
+	}
+	return strings.Join(params, " ") + suffix, nil
+}
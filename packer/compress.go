@@ -0,0 +1,116 @@
+package packer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var compressImage = flag.String("compress",
+	"",
+	"if non-empty, additionally write a compressed copy of the -overwrite image file to <file>.gz, <file>.xz or <file>.zst: gz, xz (requires the xz command) or zst (requires the zstd command). All record the uncompressed size for flashing tools (gz only up to 4 GiB)")
+
+// imageCompressors contains the commands which compress the image file given
+// as argument to stdout, for the -compress values other than gz (which
+// gokr-packer writes itself). Given the file, they record its size.
+var imageCompressors = map[string][]string{
+	"xz":  {"xz", "-c", "-T0"},
+	"zst": {"zstd", "-q", "-c", "-T0"},
+}
+
+func checkCompress(cfg *Config) error {
+	if *compressImage == "" {
+		return nil
+	}
+	if cfg.Image == "" || cfg.Image == "-" {
+		return fmt.Errorf("-compress requires -overwrite=<file> (to compress a streamed image, pipe it into a compressor)")
+	}
+	if *compressImage == "gz" {
+		return nil
+	}
+	args, ok := imageCompressors[*compressImage]
+	if !ok {
+		return fmt.Errorf("-compress=%q is not one of gz, xz or zst", *compressImage)
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return fmt.Errorf("-compress=%s: %v", *compressImage, err)
+	}
+	return nil
+}
+
+// compressedImagePath returns the path of the -compress copy of the image file
+// fn.
+func compressedImagePath(fn string) string {
+	return fn + "." + *compressImage
+}
+
+// writeCompressedImage writes the raw image src compressed (-compress) to
+// dest.
+func writeCompressedImage(dest, src string) error {
+	stage := startStage("compress image (" + *compressImage + ")")
+	defer stage.done()
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	stage.bytes = st.Size()
+
+	f, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+
+	if *compressImage == "gz" {
+		bufw := bufio.NewWriterSize(f, 1*MB)
+		zw := gzip.NewWriter(bufw)
+		zw.Name = filepath.Base(src)
+		zw.ModTime = imageTime()
+		if _, err := io.Copy(zw, bufio.NewReaderSize(in, 1*MB)); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if err := bufw.Flush(); err != nil {
+			return err
+		}
+	} else {
+		args := imageCompressors[*compressImage]
+		cmd := exec.Command(args[0], append(args[1:], src)...)
+		cmd.Stdout = f
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	compressed, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), dest); err != nil {
+		return err
+	}
+	log.Printf("wrote %s (%s, %s uncompressed)", dest, formatBytes(compressed), formatBytes(st.Size()))
+	return nil
+}
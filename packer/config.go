@@ -0,0 +1,368 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultConfigFile is the config file which gokr-packer config init creates
+// by default.
+const defaultConfigFile = "gokrazy.toml"
+
+var configFile = flag.String("config",
+	"",
+	"path of a config file (gokrazy.toml) to load packages and flag values from, see gokr-packer config init. Flags and packages specified on the command line take precedence")
+
+// configEntry is a key = value assignment of a config file.
+type configEntry struct {
+	line  int
+	key   string
+	value string   // for strings, booleans and numbers
+	list  []string // for arrays
+	array bool
+}
+
+// configParser parses the subset of TOML which gokrazy.toml files use:
+// key = value assignments of strings, booleans, numbers and arrays thereof,
+// and comments.
+type configParser struct {
+	fn   string
+	s    string
+	pos  int
+	line int
+}
+
+func (p *configParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", p.fn, p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *configParser) eof() bool { return p.pos >= len(p.s) }
+
+func (p *configParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// skip skips spaces and comments, and newlines if newlines is true.
+func (p *configParser) skip(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// scalar parses a string, boolean or number.
+func (p *configParser) scalar() (string, error) {
+	switch p.peek() {
+	case '"':
+		// Basic strings use (mostly) the same escape sequences as Go:
+		end := p.pos + 1
+		for ; end < len(p.s) && p.s[end] != '"'; end++ {
+			if p.s[end] == '\\' {
+				end++
+			}
+			if end < len(p.s) && p.s[end] == '\n' {
+				return "", p.errorf("unterminated string")
+			}
+		}
+		if end >= len(p.s) {
+			return "", p.errorf("unterminated string")
+		}
+		value, err := strconv.Unquote(p.s[p.pos : end+1])
+		if err != nil {
+			return "", p.errorf("invalid string %s", p.s[p.pos:end+1])
+		}
+		p.pos = end + 1
+		return value, nil
+
+	case '\'':
+		// Literal strings do not support escape sequences:
+		end := strings.IndexAny(p.s[p.pos+1:], "'\n")
+		if end == -1 || p.s[p.pos+1+end] != '\'' {
+			return "", p.errorf("unterminated string")
+		}
+		value := p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return value, nil
+	}
+	start := p.pos
+	for !p.eof() && (isBareKeyChar(p.peek()) || p.peek() == '.' || p.peek() == '+') {
+		p.pos++
+	}
+	value := p.s[start:p.pos]
+	if value == "true" || value == "false" {
+		return value, nil
+	}
+	if _, err := strconv.ParseFloat(strings.Replace(value, "_", "", -1), 64); err != nil {
+		return "", p.errorf("invalid value %q (strings must be quoted)", value)
+	}
+	return strings.Replace(value, "_", "", -1), nil
+}
+
+func (p *configParser) entry() (configEntry, error) {
+	e := configEntry{line: p.line}
+	if p.peek() == '[' {
+		return e, p.errorf("tables are not supported")
+	}
+	if p.peek() == '"' || p.peek() == '\'' {
+		key, err := p.scalar()
+		if err != nil {
+			return e, err
+		}
+		e.key = key
+	} else {
+		start := p.pos
+		for !p.eof() && isBareKeyChar(p.peek()) {
+			p.pos++
+		}
+		e.key = p.s[start:p.pos]
+	}
+	if e.key == "" {
+		return e, p.errorf("expected key = value")
+	}
+	p.skip(false)
+	if p.peek() != '=' {
+		return e, p.errorf("expected = after key %q", e.key)
+	}
+	p.pos++
+	p.skip(false)
+	if p.peek() == '[' {
+		e.array = true
+		p.pos++
+		for {
+			p.skip(true)
+			if p.peek() == ']' {
+				p.pos++
+				break
+			}
+			if p.eof() {
+				return e, p.errorf("unterminated array")
+			}
+			value, err := p.scalar()
+			if err != nil {
+				return e, err
+			}
+			e.list = append(e.list, value)
+			p.skip(true)
+			if p.peek() == ',' {
+				p.pos++
+			} else if p.peek() != ']' {
+				return e, p.errorf("expected , or ] in array %q", e.key)
+			}
+		}
+	} else {
+		value, err := p.scalar()
+		if err != nil {
+			return e, err
+		}
+		e.value = value
+	}
+	p.skip(false)
+	if !p.eof() && p.peek() != '\n' {
+		rest := p.s[p.pos:]
+		if idx := strings.IndexByte(rest, '\n'); idx > -1 {
+			rest = rest[:idx]
+		}
+		return e, p.errorf("unexpected %q after the value of %q", rest, e.key)
+	}
+	return e, nil
+}
+
+func parseConfig(fn string, b []byte) ([]configEntry, error) {
+	p := &configParser{fn: fn, s: string(b), line: 1}
+	var entries []configEntry
+	seen := make(map[string]bool)
+	for {
+		p.skip(true)
+		if p.eof() {
+			return entries, nil
+		}
+		e, err := p.entry()
+		if err != nil {
+			return nil, err
+		}
+		if seen[e.key] {
+			return nil, fmt.Errorf("%s:%d: duplicate key %q", fn, e.line, e.key)
+		}
+		seen[e.key] = true
+		entries = append(entries, e)
+	}
+}
+
+// applyConfig sets the flags stored in the -config file, unless they were
+// specified on the command line. No config file is loaded implicitly, so that
+// builds do not depend on their working directory (e.g. child builds of
+// gokr-packer web or daemon). Keys are flag names (arrays are joined with commas for flags which
+// take comma-separated lists), plus packages, the packages to install if none
+// were specified on the command line.
+func applyConfig() error {
+	fn := *configFile
+	if fn == "" {
+		return nil
+	}
+	if *fromBundle != "" {
+		return fmt.Errorf("-config cannot be used with -from_bundle, which contains all flags and packages of the build")
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	entries, err := parseConfig(fn, b)
+	if err != nil {
+		return err
+	}
+	log.Printf("loading config file %s", fn)
+	set := explicitFlags()
+	for _, e := range entries {
+		value := e.value
+		if e.array {
+			value = strings.Join(e.list, ",")
+		}
+		if e.key == "packages" {
+			if !e.array {
+				return fmt.Errorf("%s:%d: packages must be an array, e.g. packages = [\"github.com/gokrazy/hello\"]", fn, e.line)
+			}
+			if flag.NArg() == 0 {
+				flag.CommandLine.Parse(append([]string{"--"}, e.list...))
+			}
+			continue
+		}
+		if e.key == "config" || e.key == "save_profile" || e.key == "from_bundle" {
+			return fmt.Errorf("%s:%d: -%s cannot be set in a config file", fn, e.line, e.key)
+		}
+		if flag.Lookup(e.key) == nil {
+			return fmt.Errorf("%s:%d: unknown flag -%s", fn, e.line, e.key)
+		}
+		if set[e.key] {
+			continue // the command line takes precedence
+		}
+		if e.array {
+			switch flag.Lookup(e.key).Value.(type) {
+			case *dtoverlayList, *configTxtList:
+				value = strings.Join(e.list, ";") // parameters contain commas
+			case *cmdlineParamList:
+				value = strings.Join(e.list, " ") // e.g. console=ttyS0,115200
+			}
+		}
+		if err := flag.Set(e.key, value); err != nil {
+			return fmt.Errorf("%s:%d: -%s: %v", fn, e.line, e.key, err)
+		}
+	}
+	return nil
+}
+
+// configInitFlags are included (commented out, with their default value) in
+// the config files created by gokr-packer config init, unless specified.
+var configInitFlags = []string{
+	"init_pkg",
+	"kernel_package",
+	"firmware_package",
+	"serial_console",
+	"overwrite",
+	"target_storage_bytes",
+	"overwrite_boot",
+	"overwrite_root",
+	"update",
+}
+
+// configValue formats the flag value for a config file: booleans and numbers
+// unquoted, everything else (including durations) as a string.
+func configValue(f *flag.Flag, value string) string {
+	if g, ok := f.Value.(flag.Getter); ok {
+		switch g.Get().(type) {
+		case bool, int, int64, uint, uint64, float64:
+			return value
+		}
+	}
+	return strconv.Quote(value)
+}
+
+func configMain(args []string) error {
+	fset := packerFlagSet("config init")
+	output := fset.String("o",
+		defaultConfigFile,
+		"path of the config file to create")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer config init [-flags] [<package>...]\n\nCreates a config file containing the specified flags and packages.\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	if len(args) < 1 || args[0] != "init" {
+		fset.Usage()
+		os.Exit(2)
+	}
+	fset.Parse(args[1:])
+	if _, err := os.Stat(*output); err == nil {
+		return fmt.Errorf("%s already exists, not overwriting", *output)
+	}
+
+	pkgs := fset.Args()
+	if len(pkgs) == 0 {
+		pkgs = []string{"github.com/gokrazy/hello"}
+	}
+	set := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var names []string
+	for name := range set {
+		switch name {
+		case "o", "config", "save_profile", "from_bundle", "hostname":
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# gokr-packer config file. Keys are gokr-packer flag names; flags and\n")
+	fmt.Fprintf(&b, "# packages specified on the command line take precedence.\n\n")
+	fmt.Fprintf(&b, "hostname = %s\n\n", strconv.Quote(*hostname))
+	fmt.Fprintf(&b, "packages = [\n")
+	for _, pkg := range pkgs {
+		fmt.Fprintf(&b, "  %s,\n", strconv.Quote(pkg))
+	}
+	fmt.Fprintf(&b, "]\n")
+	if len(names) > 0 {
+		fmt.Fprintf(&b, "\n")
+	}
+	for _, name := range names {
+		f := fset.Lookup(name)
+		fmt.Fprintf(&b, "%s = %s\n", name, configValue(f, f.Value.String()))
+	}
+	fmt.Fprintf(&b, "\n# Defaults of commonly used flags, remove the # to change them:\n")
+	for _, name := range configInitFlags {
+		if set[name] {
+			continue
+		}
+		f := fset.Lookup(name)
+		fmt.Fprintf(&b, "# %s = %s\n", name, configValue(f, f.DefValue))
+	}
+	// Like profiles, config files may contain passwords (e.g. in -update
+	// URLs):
+	if err := ioutil.WriteFile(*output, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	log.Printf("wrote %s, build using gokr-packer (in this directory) or gokr-packer -config=%s", *output, *output)
+	return nil
+}
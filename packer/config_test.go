@@ -0,0 +1,44 @@
+package packer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-packer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(defaultConfigFile, []byte("hostname = \"fromconfig\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(h, c string) { *hostname, *configFile = h, c }(*hostname, *configFile)
+
+	// gokrazy.toml in the current directory is not loaded implicitly:
+	if err := applyConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *hostname, "gokrazy"; got != want {
+		t.Errorf("without -config: hostname: got %q, want %q", got, want)
+	}
+
+	*configFile = filepath.Join(dir, defaultConfigFile)
+	if err := applyConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *hostname, "fromconfig"; got != want {
+		t.Errorf("with -config: hostname: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,178 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// configTxtSetting is a config.txt key set by -config_txt, optionally within a
+// conditional section (e.g. pi4).
+type configTxtSetting struct {
+	section string // empty for [all]
+	key     string
+	value   string // empty removes the key
+}
+
+func (s configTxtSetting) String() string {
+	str := s.key + "=" + s.value
+	if s.section != "" {
+		str = "[" + s.section + "]" + str
+	}
+	return str
+}
+
+// configTxtList is the value of the repeatable -config_txt flag.
+type configTxtList []configTxtSetting
+
+func (l *configTxtList) String() string {
+	settings := make([]string, len(*l))
+	for idx, s := range *l {
+		settings[idx] = s.String()
+	}
+	return strings.Join(settings, ";")
+}
+
+func (l *configTxtList) Set(value string) error {
+	for _, setting := range strings.Split(value, ";") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		var s configTxtSetting
+		if strings.HasPrefix(setting, "[") {
+			end := strings.IndexByte(setting, ']')
+			if end == -1 {
+				return fmt.Errorf("invalid config.txt setting %q: unterminated section", setting)
+			}
+			s.section = strings.TrimSpace(setting[1:end])
+			setting = setting[end+1:]
+			if strings.EqualFold(s.section, "all") {
+				s.section = ""
+			}
+		}
+		idx := strings.IndexByte(setting, '=')
+		if idx < 1 {
+			return fmt.Errorf("invalid config.txt setting %q, expected [<section>]<key>=<value>", setting)
+		}
+		s.key = strings.TrimSpace(setting[:idx])
+		s.value = strings.TrimSpace(setting[idx+1:])
+		if strings.ContainsAny(s.key, " \t\n#[]") || strings.ContainsAny(s.value, "\n") {
+			return fmt.Errorf("invalid config.txt setting %q", setting)
+		}
+		*l = append(*l, s)
+	}
+	return nil
+}
+
+var configTxt configTxtList
+
+func init() {
+	flag.Var(&configTxt, "config_txt",
+		"setting for the Raspberry Pi config.txt as <key>=<value>, optionally within a conditional section, e.g. gpu_mem=16 or [pi4]arm_boost=1. Can be specified multiple times (or separated by ;). Replaces the key within the section of the kernel package’s config.txt (an empty value removes it), or adds it")
+}
+
+// repeatableConfigTxtKeys may occur multiple times in config.txt, so
+// -config_txt adds them instead of replacing them.
+var repeatableConfigTxtKeys = map[string]bool{
+	"dtoverlay": true,
+	"dtparam":   true,
+}
+
+// configTxtSections returns the conditional section (lower case, "all"
+// outside of any section) of each line of config.txt.
+func configTxtSections(lines []string) []string {
+	sections := make([]string, len(lines))
+	current := "all"
+	for idx, line := range lines {
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			current = strings.ToLower(strings.TrimSpace(trimmed[1 : len(trimmed)-1]))
+		}
+		sections[idx] = current
+	}
+	return sections
+}
+
+// configTxtKey returns the key of the config.txt line, or "" for comments,
+// section headers and blank lines.
+func configTxtKey(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "[") {
+		return ""
+	}
+	if idx := strings.IndexByte(trimmed, '='); idx > -1 {
+		return strings.TrimSpace(trimmed[:idx])
+	}
+	return ""
+}
+
+// editConfigTxt applies the -config_txt settings to config. Settings without
+// a section are placed before the first conditional section, settings for new
+// sections are appended, followed by [all] so that subsequent lines apply to
+// all models again.
+func editConfigTxt(config string, settings configTxtList) string {
+	if len(settings) == 0 {
+		return config
+	}
+	var lines []string
+	if trimmed := strings.TrimRight(config, "\n"); trimmed != "" {
+		lines = strings.Split(trimmed, "\n")
+	}
+	for _, s := range settings {
+		section := strings.ToLower(s.section)
+		if section == "" {
+			section = "all"
+		}
+		sections := configTxtSections(lines)
+		line := s.key + "=" + s.value
+
+		if !repeatableConfigTxtKeys[s.key] || s.value == "" {
+			replaced := false
+			var edited []string
+			for idx, l := range lines {
+				if sections[idx] != section || configTxtKey(l) != s.key {
+					edited = append(edited, l)
+					continue
+				}
+				if !replaced && s.value != "" {
+					edited = append(edited, line)
+				}
+				replaced = true
+			}
+			lines = edited
+			if replaced || s.value == "" {
+				continue
+			}
+			sections = configTxtSections(lines)
+		}
+
+		// Insert after the last line of the (last block of the) section:
+		insert := -1
+		for idx := range lines {
+			if sections[idx] == section && (idx+1 == len(lines) || sections[idx+1] != section || isConfigTxtHeader(lines[idx+1])) {
+				insert = idx + 1
+			}
+		}
+		if section == "all" {
+			// Lines before the first conditional section are unconditional:
+			insert = len(lines)
+			for idx, l := range lines {
+				if isConfigTxtHeader(l) {
+					insert = idx
+					break
+				}
+			}
+		}
+		if insert == -1 {
+			lines = append(lines, "["+s.section+"]", line, "[all]")
+			continue
+		}
+		lines = append(lines[:insert], append([]string{line}, lines[insert:]...)...)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func isConfigTxtHeader(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]")
+}
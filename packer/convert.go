@@ -0,0 +1,273 @@
+package packer
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// convertMain rewrites the partition table of an existing gokrazy image
+// between MBR and GPT (e.g. when moving an image from a Raspberry Pi to UEFI
+// hardware). The contents of all partitions are retained, the PARTUUIDs are
+// derived from the existing ones and the root= references in cmdline.txt are
+// updated accordingly.
+func convertMain(args []string) error {
+	fset := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := fset.String("to",
+		"",
+		"partition table type to convert the image to: gpt or mbr")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer convert -to=<gpt|mbr> <image>\n\nThe image is modified in place.\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	path := parseSingleArg(fset, args)
+	switch *to {
+	case "gpt":
+		return convertToGPT(path)
+	case "mbr":
+		return convertToMBR(path)
+	}
+	fset.Usage()
+	os.Exit(2)
+	return nil
+}
+
+// gptPartitionNames are the GPT partition names of the gokrazy partitions.
+var gptPartitionNames = []string{"boot", "root2", "root3", "perm"}
+
+var (
+	mbrPartUUIDRe = regexp.MustCompile(`PARTUUID=([0-9a-fA-F]{8})-([0-9]{2})\b`)
+	gptPartUUIDRe = regexp.MustCompile(`PARTUUID=` + gptPartUUIDPrefix + `([0-9a-f]{8})00([0-9a-f]{2})\b`)
+	gptDiskGUIDRe = regexp.MustCompile(`^` + gptPartUUIDPrefix + `([0-9a-f]{8})0000$`)
+)
+
+func convertToGPT(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sector := make([]byte, 512)
+	if _, err := f.ReadAt(sector, 0); err != nil {
+		return err
+	}
+	parts, err := readPartitionTable(sector)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if parts[0].Type == 0xee {
+		return fmt.Errorf("%s already uses a GPT", path)
+	}
+	partuuid := binary.LittleEndian.Uint32(sector[440:])
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	sectors := uint64(st.Size() / 512)
+	var gptParts []gptPartition
+	var end uint64
+	for i, p := range parts {
+		if p.Size == 0 {
+			gptParts = append(gptParts, gptPartition{})
+			continue
+		}
+		if p.Start < 1+gptSectors {
+			return fmt.Errorf("partition %d starts at sector %d, leaving no room for the GPT", i+1, p.Start)
+		}
+		typ := guidLinuxFilesystem
+		switch p.Type {
+		case 0x06, 0x0b, 0x0c, 0x0e, EFISystem: // FAT
+			typ = guidEFISystem
+		}
+		var attrs uint64
+		if p.Status == active {
+			attrs |= gptAttrLegacyBIOSBootable
+		}
+		gptParts = append(gptParts, gptPartition{
+			TypeGUID: typ,
+			GUID:     gptPartUUID(partuuid, i+1),
+			FirstLBA: uint64(p.Start),
+			LastLBA:  uint64(p.Start) + uint64(p.Size) - 1,
+			Attrs:    attrs,
+			Name:     gptPartitionNames[i],
+		})
+		if e := uint64(p.Start) + uint64(p.Size); e > end {
+			end = e
+		}
+	}
+
+	if err := patchCmdline(f, int64(parts[0].Start)*512, func(cmdline string) string {
+		return mbrPartUUIDRe.ReplaceAllStringFunc(cmdline, func(m string) string {
+			sub := mbrPartUUIDRe.FindStringSubmatch(m)
+			uuid, _ := strconv.ParseUint(sub[1], 16, 32)
+			part, _ := strconv.Atoi(sub[2])
+			return "PARTUUID=" + gptPartUUID(uint32(uuid), part)
+		})
+	}); err != nil {
+		return err
+	}
+
+	// The backup GPT is stored in the last sectors of the device, which the
+	// last (typically the permanent data) partition usually extends to.
+	if end+gptSectors > sectors {
+		if !st.Mode().IsRegular() {
+			return fmt.Errorf("the last partition ends at sector %d, leaving no room for the backup GPT", end)
+		}
+		grow := (end + gptSectors - sectors + 2047) &^ 2047 // 1 MB aligned
+		log.Printf("growing %s by %d bytes for the backup GPT", path, grow*512)
+		sectors += grow
+		if err := f.Truncate(int64(sectors) * 512); err != nil {
+			return err
+		}
+	}
+
+	primary, backup, err := gptTables(gptPartUUID(partuuid, 0), gptParts, sectors)
+	if err != nil {
+		return err
+	}
+
+	protectiveMBR(sector, sectors)
+
+	if _, err := f.WriteAt(primary, 512); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(backup, int64(sectors-gptSectors)*512); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(sector, 0); err != nil {
+		return err
+	}
+	log.Printf("converted %s to GPT (disk GUID %s)", path, gptPartUUID(partuuid, 0))
+	return f.Close()
+}
+
+func convertToMBR(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sector := make([]byte, 512)
+	if _, err := f.ReadAt(sector, 0); err != nil {
+		return err
+	}
+	parts, err := readPartitionTable(sector)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if parts[0].Type != 0xee {
+		return fmt.Errorf("%s does not use a GPT", path)
+	}
+	diskGUID, gptParts, err := readGPT(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(gptParts) > 4 {
+		return fmt.Errorf("%s: %d partitions do not fit into an MBR (at most 4)", path, len(gptParts))
+	}
+	if len(gptParts) == 0 || gptParts[0].TypeGUID == "" {
+		return fmt.Errorf("%s: no boot partition found", path)
+	}
+
+	partuuid := binary.LittleEndian.Uint32(sector[440:])
+	if m := gptDiskGUIDRe.FindStringSubmatch(diskGUID); m != nil {
+		uuid, _ := strconv.ParseUint(m[1], 16, 32)
+		partuuid = uint32(uuid)
+	}
+	if partuuid == 0 {
+		return fmt.Errorf("%s: MBR disk signature not set, cannot derive PARTUUIDs", path)
+	}
+
+	for i := 446; i < 510; i++ {
+		sector[i] = 0
+	}
+	binary.LittleEndian.PutUint32(sector[440:], partuuid)
+	for i, p := range gptParts {
+		if p.TypeGUID == "" {
+			continue
+		}
+		if p.LastLBA >= 0xffffffff {
+			return fmt.Errorf("partition %d ends at sector %d, beyond the reach of an MBR", i+1, p.LastLBA)
+		}
+		status, typ := inactive, Linux
+		if p.Attrs&gptAttrLegacyBIOSBootable != 0 {
+			status = active
+		}
+		if p.TypeGUID == guidEFISystem {
+			typ = FAT
+		}
+		e := sector[446+16*i:]
+		e[0] = status
+		copy(e[1:], invalidCHS[:])
+		e[4] = typ
+		copy(e[5:], invalidCHS[:])
+		binary.LittleEndian.PutUint32(e[8:], uint32(p.FirstLBA))
+		binary.LittleEndian.PutUint32(e[12:], uint32(p.LastLBA-p.FirstLBA+1))
+	}
+
+	if err := patchCmdline(f, int64(gptParts[0].FirstLBA)*512, func(cmdline string) string {
+		return gptPartUUIDRe.ReplaceAllString(cmdline, "PARTUUID=${1}-${2}")
+	}); err != nil {
+		return err
+	}
+
+	// Remove the primary and backup GPT so that tools do not pick them up:
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zero := make([]byte, gptSectors*512)
+	if _, err := f.WriteAt(zero, 512); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(zero, st.Size()-int64(len(zero))); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(sector, 0); err != nil {
+		return err
+	}
+	log.Printf("converted %s to MBR (PARTUUID %08x)", path, partuuid)
+	return f.Close()
+}
+
+// patchCmdline rewrites cmdline.txt in the FAT16 or FAT32 boot file system at
+// offset off of f using edit. The new contents must fit into the clusters
+// already allocated to the file, which is typically the case as cmdline.txt is
+// much smaller than a cluster.
+func patchCmdline(f *os.File, off int64, edit func(string) string) error {
+	v, err := readFATVolume(f, off)
+	if err != nil {
+		return fmt.Errorf("boot partition: %v", err)
+	}
+	entry, err := v.lookup("CMDLINE TXT")
+	if err != nil {
+		return err
+	}
+	size := int64(entry.size)
+	capacity := (size + v.clusterSize - 1) / v.clusterSize * v.clusterSize
+	fileOffset := v.clusterOffset(entry.firstCluster)
+
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, fileOffset); err != nil {
+		return err
+	}
+	cmdline := edit(string(b))
+	if int64(len(cmdline)) > capacity {
+		return fmt.Errorf("new cmdline.txt (%d bytes) does not fit into its %d bytes", len(cmdline), capacity)
+	}
+	log.Printf("new cmdline.txt: %s", cmdline)
+	padded := make([]byte, capacity)
+	copy(padded, cmdline)
+	if _, err := f.WriteAt(padded, fileOffset); err != nil {
+		return err
+	}
+	var newSize [4]byte
+	binary.LittleEndian.PutUint32(newSize[:], uint32(len(cmdline)))
+	_, err = f.WriteAt(newSize[:], entry.offset+28)
+	return err
+}
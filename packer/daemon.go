@@ -0,0 +1,255 @@
+package packer
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	buildpb "github.com/gokrazy/tools/proto"
+	"google.golang.org/grpc"
+)
+
+// buildStatus is the JSON representation of a build job in the daemon API.
+type buildStatus struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"`
+	Args     []string   `json:"args"`
+	Update   string     `json:"update,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	LogURL   string     `json:"log_url"`
+	ImageURL string     `json:"image_url,omitempty"`
+}
+
+func (j *buildJob) statusJSON() buildStatus {
+	bs := buildStatus{
+		ID:      j.ID,
+		Status:  j.Status(),
+		Args:    j.Args,
+		Update:  j.Update,
+		Created: j.Created,
+		LogURL:  "/builds/" + j.ID + "/log",
+	}
+	if j.Artifact() != "" {
+		bs.ImageURL = "/builds/" + j.ID + "/image"
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.started.IsZero() {
+		started := j.started
+		bs.Started = &started
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		bs.Finished = &finished
+	}
+	if j.err != nil {
+		bs.Error = j.err.Error()
+	}
+	return bs
+}
+
+// buildEvent is the JSON representation of the BuildEvent message in
+// proto/build.proto.
+type buildEvent struct {
+	Log   *string      `json:"log,omitempty"`
+	Build *buildStatus `json:"build,omitempty"`
+}
+
+// followBuildOutput calls line for each line of the build output (without
+// trailing newline), until the build has finished (returning nil) or ctx is
+// done.
+func followBuildOutput(ctx context.Context, j *buildJob, line func(string) error) error {
+	var (
+		offset    int
+		remainder string
+	)
+	for {
+		b, done := j.tail(offset)
+		offset += len(b)
+		lines := strings.Split(remainder+string(b), "\n")
+		remainder = lines[len(lines)-1]
+		if done && remainder != "" {
+			lines = append(lines, "")
+		}
+		for _, l := range lines[:len(lines)-1] {
+			if err := line(l); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// streamBuildEvents writes the build output as newline-delimited JSON
+// buildEvents (one per line of output), followed by the final build status.
+func streamBuildEvents(w http.ResponseWriter, r *http.Request, j *buildJob) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	err := followBuildOutput(r.Context(), j, func(line string) error {
+		if err := enc.Encode(buildEvent{Log: &line}); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	bs := j.statusJSON()
+	enc.Encode(buildEvent{Build: &bs})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+func jsonError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func daemonMain(args []string) error {
+	fset := flag.NewFlagSet("daemon", flag.ExitOnError)
+	listen := fset.String("listen",
+		"localhost:8081",
+		"[host]:port to serve the REST API on. The API is not authenticated, so only listen on trusted networks (or behind an authenticating proxy)")
+	grpcListen := fset.String("grpc_listen",
+		"",
+		"[host]:port to serve the gRPC BuildService (see proto/build.proto) on, in addition to the REST API. Like the REST API, it is not authenticated. Empty means no gRPC service")
+	maxConcurrent := fset.Int("max_concurrent",
+		2,
+		"maximum number of builds to run at the same time. Further builds are queued")
+	fset.Parse(args)
+
+	q := newBuildQueue(*maxConcurrent)
+	defer q.cleanup()
+
+	errc := make(chan error, 2)
+	if *grpcListen != "" {
+		ln, err := net.Listen("tcp", *grpcListen)
+		if err != nil {
+			return err
+		}
+		srv := grpc.NewServer()
+		buildpb.RegisterBuildServiceServer(srv, &buildService{q: q})
+		log.Printf("serving gRPC BuildService on %s", ln.Addr())
+		go func() { errc <- srv.Serve(ln) }()
+	}
+
+	log.Printf("serving REST API on http://%s/builds (up to %d concurrent builds)", *listen, *maxConcurrent)
+	go func() { errc <- http.ListenAndServe(*listen, daemonHandler(q)) }()
+	return <-errc
+}
+
+// daemonHandler serves the REST API for the builds of q.
+func daemonHandler(q *buildQueue) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/builds", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			jobs := q.list()
+			statuses := make([]buildStatus, 0, len(jobs))
+			for _, j := range jobs {
+				statuses = append(statuses, j.statusJSON())
+			}
+			writeJSON(w, http.StatusOK, statuses)
+
+		case http.MethodPost:
+			var br buildRequest
+			if err := json.NewDecoder(r.Body).Decode(&br); err != nil {
+				jsonError(w, http.StatusBadRequest, err)
+				return
+			}
+			if br.Output == "device" {
+				jsonError(w, http.StatusBadRequest, fmt.Errorf("device output is not available in daemon mode"))
+				return
+			}
+			j, err := q.newJob()
+			if err != nil {
+				jsonError(w, http.StatusInternalServerError, err)
+				return
+			}
+			args, err := br.args(j)
+			if err != nil {
+				q.remove(j)
+				jsonError(w, http.StatusBadRequest, err)
+				return
+			}
+			q.start(j, args)
+			w.Header().Set("Location", "/builds/"+j.ID)
+			writeJSON(w, http.StatusAccepted, j.statusJSON())
+
+		default:
+			jsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("expected GET or POST"))
+		}
+	})
+
+	mux.HandleFunc("/builds/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/builds/"), "/")
+		j := q.job(parts[0])
+		if j == nil {
+			jsonError(w, http.StatusNotFound, fmt.Errorf("build %q not found", parts[0]))
+			return
+		}
+		switch strings.Join(parts[1:], "/") {
+		case "":
+			switch r.Method {
+			case http.MethodGet:
+				writeJSON(w, http.StatusOK, j.statusJSON())
+			case http.MethodDelete:
+				if err := q.remove(j); err != nil {
+					jsonError(w, http.StatusConflict, err)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				jsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("expected GET or DELETE"))
+			}
+
+		case "log":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			streamBuildLog(w, r, j)
+
+		case "events":
+			streamBuildEvents(w, r, j)
+
+		case "image":
+			fn := j.Artifact()
+			if fn == "" {
+				jsonError(w, http.StatusNotFound, fmt.Errorf("build %s did not produce an image (status %s)", j.ID, j.Status()))
+				return
+			}
+			w.Header().Set("Content-Disposition", `attachment; filename="gokrazy-`+j.ID+`.img"`)
+			http.ServeFile(w, r, fn)
+
+		default:
+			jsonError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		}
+	})
+
+	return mux
+}
@@ -0,0 +1,430 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// A delta (written by gokr-packer diff) describes a new file (e.g. an image or
+// a root file system) in terms of an old one. It is gzip-compressed and
+// consists of a deltaHeader, followed by operations (an op byte and a big
+// endian uint32 count), which produce the new file in order:
+//
+//	deltaOpCopy: followed by the (uint64) index of the first of count
+//	             consecutive deltaBlockSize blocks of the old file to copy
+//	deltaOpData: followed by count bytes of data
+//	deltaOpZero: count deltaBlockSize blocks of zeros
+//
+// and deltaOpEnd. Like rsync, the blocks of the old file are found at any
+// offset of the new file (using a rolling checksum), as the contents of
+// squashfs file systems move when files before them change.
+const (
+	deltaMagic     = "gokrazy-delta-1\n"
+	deltaBlockSize = 4096
+
+	deltaOpEnd  = 0
+	deltaOpCopy = 1
+	deltaOpData = 2
+	deltaOpZero = 3
+)
+
+type deltaHeader struct {
+	Magic            [16]byte
+	BlockSize        uint32
+	OldSize, NewSize uint64
+	OldSum, NewSum   [sha256.Size]byte
+}
+
+// diffMain writes the delta between two files, or applies one with -apply.
+func diffMain(args []string) error {
+	fset := flag.NewFlagSet("diff", flag.ExitOnError)
+	output := fset.String("o",
+		"",
+		"path of the delta (or, with -apply, of the new file) to create")
+	apply := fset.Bool("apply",
+		false,
+		"apply the delta to the old file, creating the new file")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer diff <old> <new> -o <delta>\n       gokr-packer diff -apply <old> <delta> -o <new>\n\nThe files are images or file systems (e.g. -overwrite_root files).\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	files := parseArgs(fset, args, 2)
+	if *output == "" {
+		fset.Usage()
+		os.Exit(2)
+	}
+	if *apply {
+		return applyDelta(*output, files[0], files[1])
+	}
+	return writeDelta(*output, files[0], files[1])
+}
+
+// deltaFile opens fn and returns its size and SHA256 sum.
+func deltaFile(fn string) (f *os.File, size int64, sum [sha256.Size]byte, err error) {
+	f, err = os.Open(fn)
+	if err != nil {
+		return nil, 0, sum, err
+	}
+	h := sha256.New()
+	if size, err = io.Copy(h, f); err != nil {
+		f.Close()
+		return nil, 0, sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return f, size, sum, nil
+}
+
+// rollingSum is the weak checksum of a block which rsync uses, without the
+// modulo (the sums of deltaBlockSize bytes fit into 32 bits). It can be
+// updated when moving the block by one byte. a is 0 only for blocks of zeros.
+type rollingSum struct{ a, b uint32 }
+
+func newRollingSum(block []byte) rollingSum {
+	var s rollingSum
+	for i, c := range block {
+		s.a += uint32(c)
+		s.b += uint32(len(block)-i) * uint32(c)
+	}
+	return s
+}
+
+func (s *rollingSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - deltaBlockSize*uint32(out)
+}
+
+func (s rollingSum) key() uint64 { return uint64(s.a)<<32 | uint64(s.b) }
+
+// deltaWriter writes the operations of a delta, combining consecutive blocks
+// into one operation.
+type deltaWriter struct {
+	w     io.Writer
+	op    byte
+	count uint32
+	first uint64 // of deltaOpCopy
+	data  bytes.Buffer
+
+	blocks map[byte]int64 // for the summary
+}
+
+func (dw *deltaWriter) flush() error {
+	if dw.op == deltaOpData {
+		dw.count = uint32(dw.data.Len())
+	}
+	if dw.count == 0 {
+		return nil
+	}
+	if err := binary.Write(dw.w, binary.BigEndian, dw.op); err != nil {
+		return err
+	}
+	if err := binary.Write(dw.w, binary.BigEndian, dw.count); err != nil {
+		return err
+	}
+	dw.blocks[dw.op] += int64(dw.count)
+	switch dw.op {
+	case deltaOpCopy:
+		if err := binary.Write(dw.w, binary.BigEndian, dw.first); err != nil {
+			return err
+		}
+	case deltaOpData:
+		if _, err := dw.data.WriteTo(dw.w); err != nil {
+			return err
+		}
+	}
+	dw.count = 0
+	return nil
+}
+
+// block adds a block, which is either a copy of the old block idx
+// (deltaOpCopy) or zeros (deltaOpZero).
+func (dw *deltaWriter) block(op byte, idx uint64) error {
+	if dw.op != op || (op == deltaOpCopy && dw.first+uint64(dw.count) != idx) || dw.count == 1<<31 {
+		if err := dw.flush(); err != nil {
+			return err
+		}
+		dw.op, dw.first = op, idx
+	}
+	dw.count++
+	return nil
+}
+
+// literal adds data which is not found in the old file.
+func (dw *deltaWriter) literal(b []byte) error {
+	if dw.op != deltaOpData || dw.data.Len() >= 1*MB {
+		if err := dw.flush(); err != nil {
+			return err
+		}
+		dw.op = deltaOpData
+	}
+	dw.data.Write(b)
+	return nil
+}
+
+// writeDelta writes the delta from oldfn to newfn to dest.
+func writeDelta(dest, oldfn, newfn string) error {
+	stage := startStage("write delta")
+	defer stage.done()
+	hdr := deltaHeader{BlockSize: deltaBlockSize}
+	copy(hdr.Magic[:], deltaMagic)
+	oldf, oldSize, oldSum, err := deltaFile(oldfn)
+	if err != nil {
+		return err
+	}
+	defer oldf.Close()
+	newf, newSize, newSum, err := deltaFile(newfn)
+	if err != nil {
+		return err
+	}
+	defer newf.Close()
+	hdr.OldSize, hdr.NewSize = uint64(oldSize), uint64(newSize)
+	hdr.OldSum, hdr.NewSum = oldSum, newSum
+
+	// Index the (complete, non-zero) blocks of the old file by their weak
+	// checksum. tags allows for skipping most map lookups:
+	var tags [1 << 16]bool
+	index := make(map[uint64][]uint64)
+	block := make([]byte, deltaBlockSize)
+	r := bufio.NewReaderSize(io.NewSectionReader(oldf, 0, oldSize), 1*MB)
+	for idx := uint64(0); ; idx++ {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		sum := newRollingSum(block)
+		if sum.a == 0 {
+			continue
+		}
+		tags[uint16(sum.a^sum.b)] = true
+		index[sum.key()] = append(index[sum.key()], idx)
+	}
+	// match returns the index of the old block with the contents of b.
+	old := make([]byte, deltaBlockSize)
+	match := func(sum rollingSum, b []byte) (uint64, bool, error) {
+		if !tags[uint16(sum.a^sum.b)] {
+			return 0, false, nil
+		}
+		for _, idx := range index[sum.key()] {
+			if _, err := oldf.ReadAt(old, int64(idx)*deltaBlockSize); err != nil {
+				return 0, false, err
+			}
+			if bytes.Equal(old, b) {
+				return idx, true, nil
+			}
+		}
+		return 0, false, nil
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	bufw := bufio.NewWriterSize(f, 1*MB)
+	zw := gzip.NewWriter(bufw)
+	if err := binary.Write(zw, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	dw := &deltaWriter{w: zw, blocks: make(map[byte]int64)}
+
+	// Move a block-sized window over the new file, which is read into buf:
+	var (
+		buf   = make([]byte, 0, 4*MB)
+		pos   int // of the window in buf
+		eof   bool
+		fresh = true // whether sum needs to be computed
+		sum   rollingSum
+	)
+	nr := io.NewSectionReader(newf, 0, newSize)
+	for {
+		if len(buf)-pos <= deltaBlockSize && !eof {
+			n := copy(buf[:cap(buf)], buf[pos:])
+			buf, pos = buf[:n], 0
+			m, err := io.ReadFull(nr, buf[n:cap(buf)])
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+			buf = buf[:n+m]
+			stage.bytes += int64(m)
+		}
+		if len(buf)-pos < deltaBlockSize {
+			if err := dw.literal(buf[pos:]); err != nil {
+				return err
+			}
+			break
+		}
+		window := buf[pos : pos+deltaBlockSize]
+		if fresh {
+			sum, fresh = newRollingSum(window), false
+		}
+		if sum.a == 0 {
+			if err := dw.block(deltaOpZero, 0); err != nil {
+				return err
+			}
+			pos, fresh = pos+deltaBlockSize, true
+			continue
+		}
+		idx, ok, err := match(sum, window)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := dw.block(deltaOpCopy, idx); err != nil {
+				return err
+			}
+			pos, fresh = pos+deltaBlockSize, true
+			continue
+		}
+		if err := dw.literal(buf[pos : pos+1]); err != nil {
+			return err
+		}
+		if pos+deltaBlockSize < len(buf) {
+			sum.roll(buf[pos], buf[pos+deltaBlockSize])
+		} else {
+			fresh = true // at the end of buf
+		}
+		pos++
+	}
+	if err := dw.flush(); err != nil {
+		return err
+	}
+	if err := binary.Write(zw, binary.BigEndian, byte(deltaOpEnd)); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), dest); err != nil {
+		return err
+	}
+	log.Printf("wrote %s (%s for %s: %d blocks copied, %d blocks of zeros, %s of new data)", dest, formatBytes(size), formatBytes(newSize), dw.blocks[deltaOpCopy], dw.blocks[deltaOpZero], formatBytes(dw.blocks[deltaOpData]))
+	return nil
+}
+
+// applyDelta writes the new file of the delta deltafn to dest, using the old
+// file oldfn.
+func applyDelta(dest, oldfn, deltafn string) error {
+	stage := startStage("apply delta")
+	defer stage.done()
+	oldf, oldSize, oldSum, err := deltaFile(oldfn)
+	if err != nil {
+		return err
+	}
+	defer oldf.Close()
+	df, err := os.Open(deltafn)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(df))
+	if err != nil {
+		return fmt.Errorf("%s: %v", deltafn, err)
+	}
+	r := bufio.NewReader(zr)
+	var hdr deltaHeader
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return fmt.Errorf("%s: %v", deltafn, err)
+	}
+	if string(hdr.Magic[:]) != deltaMagic || hdr.BlockSize != deltaBlockSize {
+		return fmt.Errorf("%s is not a gokr-packer delta", deltafn)
+	}
+	if uint64(oldSize) != hdr.OldSize || oldSum != hdr.OldSum {
+		return fmt.Errorf("%s is not the old file of %s (sha256 %x, expected %x)", oldfn, deltafn, oldSum, hdr.OldSum)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	bufw := bufio.NewWriterSize(f, 1*MB)
+	h := sha256.New()
+	stage.bytes = 0
+	w := io.MultiWriter(bufw, h, (*stageBytesWriter)(stage))
+	zeros := make([]byte, deltaBlockSize)
+	for {
+		var op byte
+		if err := binary.Read(r, binary.BigEndian, &op); err != nil {
+			return fmt.Errorf("%s: %v", deltafn, err)
+		}
+		if op == deltaOpEnd {
+			break
+		}
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return fmt.Errorf("%s: %v", deltafn, err)
+		}
+		switch op {
+		case deltaOpCopy:
+			var first uint64
+			if err := binary.Read(r, binary.BigEndian, &first); err != nil {
+				return fmt.Errorf("%s: %v", deltafn, err)
+			}
+			n := int64(count) * deltaBlockSize
+			if copied, err := io.Copy(w, io.NewSectionReader(oldf, int64(first)*deltaBlockSize, n)); err != nil {
+				return err
+			} else if copied != n {
+				return fmt.Errorf("%s: copying blocks beyond the end of %s", deltafn, oldfn)
+			}
+		case deltaOpData:
+			if _, err := io.CopyN(w, r, int64(count)); err != nil {
+				return fmt.Errorf("%s: %v", deltafn, err)
+			}
+		case deltaOpZero:
+			for i := uint32(0); i < count; i++ {
+				if _, err := w.Write(zeros); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("%s: unknown operation %d", deltafn, op)
+		}
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	var newSum [sha256.Size]byte
+	copy(newSum[:], h.Sum(nil))
+	if uint64(stage.bytes) != hdr.NewSize || newSum != hdr.NewSum {
+		return fmt.Errorf("%s: the new file does not match its sha256 sum %x", deltafn, hdr.NewSum)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), dest); err != nil {
+		return err
+	}
+	log.Printf("wrote %s (%s)", dest, formatBytes(stage.bytes))
+	return nil
+}
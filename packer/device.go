@@ -0,0 +1,124 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/gokrazy/internal/httpclient"
+	"github.com/gokrazy/internal/updater"
+)
+
+// deviceURL returns the URL of the gokrazy installation specified via
+// cfg.Update for subcommands which talk to a running device. Like when
+// packing, the special value "yes" uses the stored password and cfg.Hostname.
+func deviceURL(cfg *Config) (string, error) {
+	switch cfg.Update {
+	case "":
+		return "", fmt.Errorf("-update is required")
+	case "yes":
+		pw, err := ensurePasswordFileExists(cfg.Hostname, "")
+		if err != nil {
+			return "", err
+		}
+		schema := "http"
+		if cfg.TLS != "" {
+			schema = "https"
+		}
+		return schema + "://gokrazy:" + pw + "@" + cfg.Hostname + "/", nil
+	}
+	return cfg.Update, nil
+}
+
+// redactPassword returns rawurl with the password (if any) replaced by xxxxx,
+// so that the URL can be logged or displayed.
+func redactPassword(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// connectHost returns an updater for the gokrazy installation on host, using
+// the stored password unless -update specifies a URL.
+func connectHost(host string) (*updater.Updater, error) {
+	cfg := flagConfig()
+	cfg.Hostname = host
+	if cfg.Update == "" {
+		cfg.Update = "yes"
+	}
+	rawurl, err := deviceURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return connectDevice(cfg, rawurl)
+}
+
+// connectDevice returns an updater for the gokrazy installation at rawurl,
+// switching to https if the installation offers it (see cfg.TLS).
+func connectDevice(cfg *Config, rawurl string) (*updater.Updater, error) {
+	baseUrl, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	updaterObj, foundMatchingCertificate, err := httpclient.GetUpdaterByTLSFlag(&cfg.TLS, baseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("getting http client by tls flag: %v", err)
+	}
+	remoteScheme, err := httpclient.GetRemoteScheme(baseUrl)
+	if remoteScheme == "https" {
+		baseUrl.Scheme = "https"
+	}
+
+	if baseUrl.Scheme != "https" && foundMatchingCertificate {
+		fmt.Printf("\n")
+		fmt.Printf("!!!WARNING!!! Possible SSL-Stripping detected!\n")
+		fmt.Printf("Found certificate for hostname in your client configuration but the host does not offer https!\n")
+		fmt.Printf("\n")
+		if !*tlsInsecure {
+			return nil, fmt.Errorf("update canceled: TLS certificate found, but negotiating a TLS connection with the target failed")
+		}
+		fmt.Printf("Proceeding anyway as requested (-insecure).\n")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	baseUrl.Path = "/"
+	return updaterObj, nil
+}
+
+// deviceDo sends an HTTP request to the path (relative to the base URL) of
+// the gokrazy installation and returns the response body.
+func deviceDo(updaterObj *updater.Updater, method, path, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, updaterObj.BaseUrl.String()+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := updaterObj.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s %s: %w (is the gokrazy installation up to date?)", method, path, updater.ErrUpdateHandlerNotImplemented)
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("%s %s: unexpected HTTP status code: got %d, want %d (body %q)", method, path, got, want, string(b))
+	}
+	return b, nil
+}
@@ -0,0 +1,110 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var deviceNodes = flag.String("device_nodes",
+	"",
+	"comma-separated list of device nodes and FIFOs to create in the root file system, like mknod(1), each of the form <path>:<type>:<major>:<minor>[:<mode>] with type c (character device), b (block device) or p (FIFO, major and minor 0) and an octal mode (default 0600), e.g. /dev/console:c:5:1,/dev/ttyS0:c:4:64:0660")
+
+// deviceNode is a character device, block device or FIFO in the root file
+// system.
+type deviceNode struct {
+	typ          byte // 'c', 'b' or 'p'
+	major, minor uint32
+	mode         os.FileMode // permission bits
+}
+
+func (d *deviceNode) String() string {
+	return fmt.Sprintf("%c %d:%d %#o", d.typ, d.major, d.minor, d.mode)
+}
+
+// rdev returns the device number as stored in SquashFS inodes (the Linux
+// encoding which supports 12 bit major and 20 bit minor numbers).
+func (d *deviceNode) rdev() uint32 {
+	return d.minor&0xff | d.major<<8 | (d.minor&^0xff)<<12
+}
+
+func newDeviceNode(typ byte, major, minor uint32, mode os.FileMode) (*deviceNode, error) {
+	switch typ {
+	case 'c', 'b':
+		if major > 0xfff || minor > 0xfffff {
+			return nil, fmt.Errorf("device number %d:%d out of range (12 bit major, 20 bit minor)", major, minor)
+		}
+	case 'p':
+		if major != 0 || minor != 0 {
+			return nil, fmt.Errorf("FIFOs have no device number")
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %q, expected c, b or p", typ)
+	}
+	return &deviceNode{typ: typ, major: major, minor: minor, mode: mode & os.ModePerm}, nil
+}
+
+// parseDeviceNode parses a -device_nodes entry into its path and node.
+func parseDeviceNode(entry string) (string, *deviceNode, error) {
+	parts := strings.Split(entry, ":")
+	if len(parts) != 4 && len(parts) != 5 {
+		return "", nil, fmt.Errorf("%q: expected <path>:<type>:<major>:<minor>[:<mode>]", entry)
+	}
+	path := parts[0]
+	if !strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") || strings.Contains(path, "//") {
+		return "", nil, fmt.Errorf("%q: %q is not an absolute file path", entry, path)
+	}
+	if len(parts[1]) != 1 {
+		return "", nil, fmt.Errorf("%q: unknown type %q, expected c, b or p", entry, parts[1])
+	}
+	var nums [2]uint32
+	for i, s := range parts[2:4] {
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return "", nil, fmt.Errorf("%q: invalid device number %q", entry, s)
+		}
+		nums[i] = uint32(n)
+	}
+	mode := os.FileMode(0600)
+	if len(parts) == 5 {
+		m, err := strconv.ParseUint(parts[4], 8, 32)
+		if err != nil || m&^uint64(os.ModePerm) != 0 {
+			return "", nil, fmt.Errorf("%q: invalid mode %q, expected octal permission bits (e.g. 0660)", entry, parts[4])
+		}
+		mode = os.FileMode(m)
+	}
+	d, err := newDeviceNode(parts[1][0], nums[0], nums[1], mode)
+	if err != nil {
+		return "", nil, fmt.Errorf("%q: %v", entry, err)
+	}
+	return path, d, nil
+}
+
+// addDeviceNodes adds the -device_nodes to root, creating their directories
+// as required. Existing files cannot be replaced.
+func addDeviceNodes(root *fileInfo) error {
+	if *deviceNodes == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(*deviceNodes, ",") {
+		path, d, err := parseDeviceNode(entry)
+		if err != nil {
+			return fmt.Errorf("-device_nodes: %v", err)
+		}
+		idx := strings.LastIndexByte(path, '/')
+		dir, err := root.mkdirAll(path[:idx])
+		if err != nil {
+			return fmt.Errorf("-device_nodes: %s: %v", path, err)
+		}
+		name := path[idx+1:]
+		for _, ent := range dir.dirents {
+			if ent.filename == name {
+				return fmt.Errorf("-device_nodes: %s conflicts with an existing file in the root file system", path)
+			}
+		}
+		dir.dirents = append(dir.dirents, &fileInfo{filename: name, device: d})
+	}
+	return nil
+}
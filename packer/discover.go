@@ -0,0 +1,57 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// discoverMain lists the gokrazy installations in the local network which
+// advertise themselves via mDNS.
+func discoverMain(args []string) error {
+	fset := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fset.Duration("timeout",
+		2*time.Second,
+		"how long to wait for responses")
+	service := fset.String("service",
+		"_gokrazy._tcp",
+		"DNS-SD service type to browse for")
+	quiet := fset.Bool("q",
+		false,
+		"only print host names (one per line), e.g. for use with -hostname and -update=yes")
+	fset.Parse(args)
+
+	services, err := mdnsBrowse(*service, *timeout)
+	if err != nil {
+		return err
+	}
+
+	if *quiet {
+		for _, svc := range services {
+			fmt.Println(svc.hostname())
+		}
+		return nil
+	}
+
+	if len(services) == 0 {
+		fmt.Fprintf(os.Stderr, "no gokrazy installations found within %v\n", *timeout)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "HOSTNAME\tADDRESSES\tVERSION\n")
+	for _, svc := range services {
+		addrs := make([]string, len(svc.Addrs))
+		for idx, ip := range svc.Addrs {
+			addrs[idx] = ip.String()
+		}
+		version := svc.TXT["version"]
+		if version == "" {
+			version = "unknown"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", svc.hostname(), strings.Join(addrs, ","), version)
+	}
+	return tw.Flush()
+}
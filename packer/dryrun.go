@@ -0,0 +1,123 @@
+package packer
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var dryRun = flag.Bool("dry_run",
+	false,
+	"resolve the packages, kernel and firmware and print the files which would be written to the boot and root file systems (with their sizes in bytes), without building binaries or writing any output. Binaries are listed with their Go package instead of a size")
+
+// planWriter is a bootFSWriter which records the files (and their sizes)
+// instead of writing a file system.
+type planWriter struct {
+	files []*plannedFile
+}
+
+type plannedFile struct {
+	path string
+	size int64
+}
+
+func (f *plannedFile) Write(p []byte) (int, error) {
+	f.size += int64(len(p))
+	return len(p), nil
+}
+
+func (pw *planWriter) File(path string, modTime time.Time) (io.Writer, error) {
+	f := &plannedFile{path: path}
+	pw.files = append(pw.files, f)
+	return f, nil
+}
+
+func (pw *planWriter) Flush() error { return nil }
+
+// printPlan prints the contents of the boot and root file systems of a
+// -dry_run to w, one file per line: size (- for directories, symlinks, hard
+// links, device nodes, FIFOs and binaries which are not yet built) and path.
+func printPlan(ctx context.Context, cfg *Config, w io.Writer, root *fileInfo, partuuid uint32) error {
+	var pw planWriter
+	if err := writeBootFiles(ctx, cfg, &pw, partuuid, true); err != nil {
+		return err
+	}
+	sort.Slice(pw.files, func(i, j int) bool {
+		return pw.files[i].path < pw.files[j].path
+	})
+	var total int64
+	fmt.Fprintf(w, "boot file system (%s, %s partition):\n", *bootFS, formatBytes(int64(layout.bootSectors)*512))
+	for _, f := range pw.files {
+		fmt.Fprintf(w, "%12d  %s\n", f.size, f.path)
+		total += f.size
+	}
+	fmt.Fprintf(w, "%12d  total\n", total)
+
+	fmt.Fprintf(w, "root file system (squashfs, %s partition):\n", formatBytes(int64(layout.rootSectors)*512))
+	return printPlanDir(w, root, "")
+}
+
+func printPlanDir(w io.Writer, dir *fileInfo, prefix string) error {
+	dirents := append([]*fileInfo(nil), dir.dirents...)
+	sort.Slice(dirents, func(i, j int) bool {
+		return dirents[i].filename < dirents[j].filename
+	})
+	for _, ent := range dirents {
+		path := prefix + "/" + ent.filename
+		attrs := formatFileAttrs(ent.uid, ent.gid, ent.xattrs)
+		switch {
+		case ent.importPath != "":
+			fmt.Fprintf(w, "%12s  %s  (go package %s)%s\n", "-", path, ent.importPath, attrs)
+		case ent.fromHost != "":
+			st, err := os.Stat(ent.fromHost)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%12d  %s%s\n", st.Size(), path, attrs)
+		case ent.fromLiteral != "":
+			fmt.Fprintf(w, "%12d  %s%s\n", len(ent.fromLiteral), path, attrs)
+		case ent.symlinkDest != "":
+			fmt.Fprintf(w, "%12s  %s -> %s%s\n", "-", path, ent.symlinkDest, attrs)
+		case ent.hardlinkTarget != "":
+			fmt.Fprintf(w, "%12s  %s (hard link to %s)\n", "-", path, ent.hardlinkTarget)
+		case ent.device != nil:
+			fmt.Fprintf(w, "%12s  %s (%s)%s\n", "-", path, ent.device, attrs)
+		default:
+			fmt.Fprintf(w, "%12s  %s/%s\n", "-", path, attrs)
+			if err := printPlanDir(w, ent, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// formatFileAttrs returns the owner and group (unless root) and the xattrs
+// (capabilities by name) of a file, for appending to a listing.
+func formatFileAttrs(uid, gid uint32, xattrs map[string][]byte) string {
+	var attrs []string
+	if uid != 0 || gid != 0 {
+		attrs = append(attrs, fmt.Sprintf("owner %d:%d", uid, gid))
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "security.capability" {
+			attrs = append(attrs, "capabilities "+capabilityNames(xattrs[name]))
+		} else {
+			attrs = append(attrs, "xattr "+name)
+		}
+	}
+	if len(attrs) == 0 {
+		return ""
+	}
+	return "  (" + strings.Join(attrs, ", ") + ")"
+}
@@ -0,0 +1,106 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dtoverlayList is the value of the repeatable -dtoverlay flag. Overlay
+// parameters are separated by commas (like in config.txt), so multiple
+// overlays within one value (e.g. in profiles) are separated by semicolons.
+type dtoverlayList []string
+
+func (l *dtoverlayList) String() string { return strings.Join(*l, ";") }
+
+func (l *dtoverlayList) Set(value string) error {
+	for _, overlay := range strings.Split(value, ";") {
+		if overlay == "" {
+			continue
+		}
+		if strings.ContainsAny(overlay, " \t\n") {
+			return fmt.Errorf("invalid device tree overlay %q", overlay)
+		}
+		*l = append(*l, overlay)
+	}
+	return nil
+}
+
+var dtoverlays dtoverlayList
+
+func init() {
+	flag.Var(&dtoverlays, "dtoverlay",
+		"device tree overlay to enable on the Raspberry Pi, with optional parameters as in config.txt (e.g. i2c-rtc,ds3231). Can be specified multiple times. The overlay (<name>.dtbo from the overlays directory of the kernel or firmware packages, or a path to a .dtbo file) is copied to /overlays/ on the boot partition and a dtoverlay= line is appended to config.txt")
+}
+
+// dtoverlayName splits a -dtoverlay value into the overlay (a name or a
+// path to a .dtbo file) and its parameters (including the leading comma).
+func dtoverlayName(overlay string) (name, params string) {
+	if idx := strings.IndexByte(overlay, ','); idx > -1 {
+		return overlay[:idx], overlay[idx:]
+	}
+	return overlay, ""
+}
+
+// findDtoverlays returns the .dtbo file of each -dtoverlay, keyed by the
+// overlay name, looking in the overlays directory of dirs (the kernel and
+// firmware package directories).
+func findDtoverlays(dirs []string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, overlay := range dtoverlays {
+		name, _ := dtoverlayName(overlay)
+		if strings.HasSuffix(name, ".dtbo") {
+			if _, err := os.Stat(name); err != nil {
+				return nil, fmt.Errorf("-dtoverlay: %v", err)
+			}
+			files[strings.TrimSuffix(filepath.Base(name), ".dtbo")] = name
+			continue
+		}
+		if strings.ContainsAny(name, "/\\") {
+			return nil, fmt.Errorf("-dtoverlay=%s: expected an overlay name or a path to a .dtbo file", overlay)
+		}
+		var candidates []string
+		seen := make(map[string]bool)
+		for _, dir := range dirs {
+			fn := filepath.Join(dir, "overlays", name+".dtbo")
+			if seen[fn] {
+				continue
+			}
+			seen[fn] = true
+			if _, err := os.Stat(fn); err == nil {
+				files[name] = fn
+				break
+			}
+			candidates = append(candidates, fn)
+		}
+		if files[name] == "" {
+			return nil, fmt.Errorf("-dtoverlay=%s: overlay not found in any of: %s", overlay, strings.Join(candidates, ", "))
+		}
+	}
+	return files, nil
+}
+
+// writeDtoverlays copies the -dtoverlay overlays to /overlays/ and returns
+// the dtoverlay= lines to append to config.txt.
+func writeDtoverlays(fw bootFSWriter, prefix string, dirs []string) (string, error) {
+	files, err := findDtoverlays(dirs)
+	if err != nil {
+		return "", err
+	}
+	var lines strings.Builder
+	copied := make(map[string]bool)
+	for _, overlay := range dtoverlays {
+		name, params := dtoverlayName(overlay)
+		name = strings.TrimSuffix(filepath.Base(name), ".dtbo")
+		if !copied[name] {
+			if err := copyFile(fw, prefix+"/overlays/"+name+".dtbo", files[name]); err != nil {
+				return "", err
+			}
+			copied[name] = true
+		}
+		fmt.Fprintf(&lines, "dtoverlay=%s%s\n", name, params)
+	}
+	return lines.String(), nil
+}
@@ -0,0 +1,297 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	eepromImage = flag.String("eeprom_image",
+		"",
+		"Raspberry Pi 4/5 only: path of a bootloader EEPROM image (pieeprom-<date>.bin from https://github.com/raspberrypi/rpi-eeprom) to configure and place on the boot partition, so that the bootloader is updated (and configured) when booting. Leave empty to not touch the EEPROM")
+
+	eepromRecovery = flag.String("eeprom_recovery",
+		"",
+		"path of the recovery.bin which flashes the -eeprom_image. Defaults to the recovery.bin next to the -eeprom_image, or the first one in the -firmware_package packages")
+
+	eepromBootOrder = flag.String("eeprom_boot_order",
+		"",
+		"comma-separated list of boot modes for the BOOT_ORDER bootloader setting, tried in order: sd, network, rpiboot, usb, bcm-usb, nvme, http, stop or restart (retry from the start), e.g. nvme,usb,sd,restart. Empty keeps the -eeprom_image default")
+
+	eepromConfig = flag.String("eeprom_config",
+		"",
+		"path of a file containing additional bootloader configuration (KEY=value lines, e.g. NET_BOOT_MAX_RETRIES=5), which override the -eeprom_image defaults")
+)
+
+// eepromFiles are the boot partition files which update the EEPROM.
+var eepromFiles = map[string]bool{
+	"pieeprom.upd": true,
+	"pieeprom.sig": true,
+	"recovery.bin": true,
+}
+
+// bootModes maps -eeprom_boot_order names to BOOT_ORDER digits, see
+// https://www.raspberrypi.com/documentation/computers/raspberry-pi.html#BOOT_ORDER
+var bootModes = map[string]byte{
+	"sd":      0x1,
+	"network": 0x2,
+	"rpiboot": 0x3,
+	"usb":     0x4,
+	"bcm-usb": 0x5,
+	"nvme":    0x6,
+	"http":    0x7,
+	"stop":    0xe,
+	"restart": 0xf,
+}
+
+// bootOrder returns the BOOT_ORDER value for -eeprom_boot_order, e.g. 0xf146
+// for nvme,usb,sd,restart (the bootloader starts with the lowest digit).
+func bootOrder(modes string) (string, error) {
+	names := strings.Split(modes, ",")
+	if len(names) > 8 {
+		return "", fmt.Errorf("-eeprom_boot_order: at most 8 boot modes are supported, got %d", len(names))
+	}
+	var digits []string
+	for _, name := range names {
+		mode, ok := bootModes[strings.TrimSpace(name)]
+		if !ok {
+			return "", fmt.Errorf("-eeprom_boot_order: unknown boot mode %q", name)
+		}
+		digits = append([]string{fmt.Sprintf("%x", mode)}, digits...)
+	}
+	return "0x" + strings.Join(digits, ""), nil
+}
+
+// The constants below describe the EEPROM image format, as implemented by
+// rpi-eeprom-config: the image consists of sections, each of which starts
+// with a magic number and a length (big endian). File sections (e.g. the
+// bootconf.txt configuration) additionally contain a file name.
+const (
+	eepromMagic      = 0x55aaf00f
+	eepromMagicMask  = 0xfffff00f
+	eepromFileMagic  = 0x55aaf11f
+	eepromPadMagic   = 0x55aafeef
+	eepromFileHdrLen = 20
+	eepromNameLen    = 12
+
+	// eepromEraseAlign is the size of the bootloader’s scratch page at the end
+	// of the image.
+	eepromEraseAlign = 4096
+)
+
+type eepromSection struct {
+	magic    uint32
+	offset   int
+	length   int
+	filename string
+}
+
+func eepromSections(b []byte) ([]eepromSection, error) {
+	var sections []eepromSection
+	for off := 0; off+8 <= len(b); {
+		magic := binary.BigEndian.Uint32(b[off:])
+		length := int(binary.BigEndian.Uint32(b[off+4:]))
+		if magic == 0 || magic == 0xffffffff {
+			break // end of image
+		}
+		if magic&eepromMagicMask != eepromMagic {
+			return nil, fmt.Errorf("corrupt EEPROM image: unexpected magic %08x at offset %d", magic, off)
+		}
+		s := eepromSection{magic: magic, offset: off, length: length}
+		if magic == eepromFileMagic {
+			if off+4+eepromFileHdrLen > len(b) || length < eepromNameLen+4 {
+				return nil, fmt.Errorf("corrupt EEPROM image: truncated file section at offset %d", off)
+			}
+			s.filename = strings.TrimRight(string(b[off+8:off+eepromFileHdrLen]), "\x00")
+		}
+		sections = append(sections, s)
+		off = (off + 8 + length + 7) &^ 7
+	}
+	return sections, nil
+}
+
+// eepromFile returns the contents of the file name in the EEPROM image b.
+func eepromFile(b []byte, name string) ([]byte, error) {
+	sections, err := eepromSections(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sections {
+		if s.magic == eepromFileMagic && s.filename == name {
+			start := s.offset + 4 + eepromFileHdrLen
+			end := start + s.length - eepromNameLen - 4
+			if end > len(b) {
+				return nil, fmt.Errorf("corrupt EEPROM image: %s exceeds the image", name)
+			}
+			return b[start:end], nil
+		}
+	}
+	return nil, fmt.Errorf("EEPROM image does not contain %s", name)
+}
+
+// setEEPROMFile replaces the contents of the file name in the EEPROM image b
+// (in place), like rpi-eeprom-config --config.
+func setEEPROMFile(b []byte, name string, content []byte) error {
+	sections, err := eepromSections(b)
+	if err != nil {
+		return err
+	}
+	for i, s := range sections {
+		if s.magic != eepromFileMagic || s.filename != name {
+			continue
+		}
+		last := i == len(sections)-1
+		// The contents may grow up to the next section which is not padding:
+		next := len(b) - eepromEraseAlign
+		for _, s := range sections[i+1:] {
+			if s.magic != eepromPadMagic {
+				next = s.offset
+				break
+			}
+		}
+		if s.offset+len(content)+eepromFileHdrLen > next {
+			return fmt.Errorf("%s: %d bytes do not fit into the EEPROM image", name, len(content))
+		}
+		binary.BigEndian.PutUint32(b[s.offset+4:], uint32(len(content)+eepromNameLen+4))
+		pad := s.offset + 4 + eepromFileHdrLen
+		pad += copy(b[pad:], content)
+		// Erase the remainder of the previous contents:
+		for ; pad%8 != 0; pad++ {
+			b[pad] = 0xff
+		}
+		n := next - pad
+		if n > 8 && !last {
+			n -= 8
+			binary.BigEndian.PutUint32(b[pad:], eepromPadMagic)
+			binary.BigEndian.PutUint32(b[pad+4:], uint32(n))
+			pad += 8
+		}
+		for ; n > 0; n-- {
+			b[pad] = 0xff
+			pad++
+		}
+		return nil
+	}
+	return fmt.Errorf("EEPROM image does not contain %s", name)
+}
+
+// eepromSettings returns the bootloader settings to apply, in order.
+func eepromSettings() ([][2]string, error) {
+	var settings [][2]string
+	if *eepromConfig != "" {
+		f, err := os.Open(*eepromConfig)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			idx := strings.IndexByte(line, '=')
+			if idx == -1 {
+				return nil, fmt.Errorf("%s: %q is not of the form KEY=value (conditional sections are not supported)", *eepromConfig, line)
+			}
+			settings = append(settings, [2]string{strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if *eepromBootOrder != "" {
+		order, err := bootOrder(*eepromBootOrder)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, [2]string{"BOOT_ORDER", order})
+	}
+	return settings, nil
+}
+
+// mergeBootConf applies settings to the bootloader configuration conf:
+// existing settings are replaced, new settings are appended.
+func mergeBootConf(conf string, settings [][2]string) string {
+	lines := strings.Split(strings.TrimRight(conf, "\n"), "\n")
+	for _, setting := range settings {
+		key, val := setting[0], setting[1]
+		found := false
+		for idx, line := range lines {
+			if strings.HasPrefix(strings.TrimSpace(line), key+"=") {
+				lines[idx] = key + "=" + val
+				found = true
+			}
+		}
+		if !found {
+			lines = append(lines, key+"="+val)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// writeEEPROMUpdate places the configured -eeprom_image (pieeprom.upd and
+// pieeprom.sig) and recovery.bin onto the boot partition.
+func writeEEPROMUpdate(fw bootFSWriter, firmwareDirs []string) error {
+	b, err := ioutil.ReadFile(*eepromImage)
+	if err != nil {
+		return err
+	}
+	settings, err := eepromSettings()
+	if err != nil {
+		return err
+	}
+	if len(settings) > 0 {
+		conf, err := eepromFile(b, "bootconf.txt")
+		if err != nil {
+			return fmt.Errorf("%s: %v", *eepromImage, err)
+		}
+		if err := setEEPROMFile(b, "bootconf.txt", []byte(mergeBootConf(string(conf), settings))); err != nil {
+			return fmt.Errorf("%s: %v", *eepromImage, err)
+		}
+	}
+
+	recovery := *eepromRecovery
+	if recovery == "" {
+		candidates := append([]string{filepath.Dir(*eepromImage)}, firmwareDirs...)
+		for _, dir := range candidates {
+			recovery = filepath.Join(dir, "recovery.bin")
+			if _, err := os.Stat(recovery); err == nil {
+				break
+			}
+		}
+	}
+	if _, err := os.Stat(recovery); err != nil {
+		return fmt.Errorf("-eeprom_image requires recovery.bin, specify -eeprom_recovery: %v", err)
+	}
+	if err := copyFile(fw, "/recovery.bin", recovery); err != nil {
+		return err
+	}
+
+	now := imageTime()
+	w, err := fw.File("/pieeprom.upd", now)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	// The bootloader verifies the update using the signature file:
+	var sig bytes.Buffer
+	fmt.Fprintf(&sig, "%x\n", sha256.Sum256(b))
+	fmt.Fprintf(&sig, "ts: %d\n", now.Unix())
+	w, err = fw.File("/pieeprom.sig", now)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sig.Bytes())
+	return err
+}
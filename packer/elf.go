@@ -0,0 +1,214 @@
+package packer
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// elfMachines maps GOARCH values to the corresponding ELF machine.
+var elfMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"mips":    elf.EM_MIPS,
+	"mipsle":  elf.EM_MIPS,
+	"ppc64le": elf.EM_PPC64,
+	"riscv64": elf.EM_RISCV,
+	"s390x":   elf.EM_S390,
+}
+
+// targetGOARCH returns the GOARCH which binaries are built for.
+func targetGOARCH() string {
+	var goarch string
+	for _, e := range env {
+		if strings.HasPrefix(e, "GOARCH=") {
+			goarch = strings.TrimPrefix(e, "GOARCH=") // the last one wins
+		}
+	}
+	return goarch
+}
+
+// elfLittleEndian contains the GOARCH values whose ELF binaries are little
+// endian, distinguishing e.g. mips from mipsle, which share their machine.
+var elfLittleEndian = map[string]bool{
+	"386":     true,
+	"amd64":   true,
+	"arm":     true,
+	"arm64":   true,
+	"mipsle":  true,
+	"ppc64le": true,
+	"riscv64": true,
+}
+
+// elfMultiarch maps GOARCH values to the Debian multiarch directory name, in
+// which distributions install shared libraries (e.g. /lib/x86_64-linux-gnu).
+var elfMultiarch = map[string]string{
+	"386":   "i386-linux-gnu",
+	"amd64": "x86_64-linux-gnu",
+	"arm":   "arm-linux-gnueabihf",
+	"arm64": "aarch64-linux-gnu",
+}
+
+// checkBinary verifies that the binary at path (built from importPath) can be
+// started on the target, i.e. that it is a statically linked ELF executable
+// for the target architecture. Otherwise, the program would silently fail to
+// start on the gokrazy installation.
+func checkBinary(path, importPath string) error {
+	return checkBinaryIn(nil, path, importPath)
+}
+
+// checkBinaryIn is like checkBinary, but accepts dynamically linked binaries
+// whose program interpreter and (directly) required shared libraries are
+// included in root (e.g. via -extrafiles), if root is non-nil.
+func checkBinaryIn(root *fileInfo, path, importPath string) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s: %s is not an ELF binary (%v), is GOOS set to something other than linux?", importPath, path, err)
+	}
+	defer f.Close()
+
+	if f.OSABI != elf.ELFOSABI_NONE && f.OSABI != elf.ELFOSABI_LINUX {
+		return fmt.Errorf("%s: %s was built for %v, but gokrazy runs Linux. Build with GOOS=linux", importPath, path, f.OSABI)
+	}
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return fmt.Errorf("%s: %s is not an executable (ELF type %v)", importPath, path, f.Type)
+	}
+	goarch := targetGOARCH()
+	if want, ok := elfMachines[goarch]; ok && f.Machine != want {
+		return fmt.Errorf("%s: %s was built for %v, but the target architecture is GOARCH=%s (%v)", importPath, path, f.Machine, goarch, want)
+	}
+	if _, ok := elfMachines[goarch]; ok && (f.ByteOrder == binary.LittleEndian) != elfLittleEndian[goarch] {
+		return fmt.Errorf("%s: %s is %v, which does not match the target architecture GOARCH=%s", importPath, path, f.ByteOrder, goarch)
+	}
+
+	var interp string
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		b := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(b, 0); err != nil {
+			return err
+		}
+		interp = strings.TrimRight(string(b), "\x00")
+	}
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return err
+	}
+	if interp == "" && len(libs) == 0 {
+		return nil // statically linked
+	}
+	if root == nil {
+		if interp != "" {
+			return fmt.Errorf("%s: %s is dynamically linked (program interpreter %s), but gokrazy contains no dynamic linker or C libraries. Check whether the build uses cgo or -ldflags=-linkmode=external", importPath, path, interp)
+		}
+		return fmt.Errorf("%s: %s depends on shared libraries %v, which are not available on gokrazy", importPath, path, libs)
+	}
+
+	var missing []string
+	if interp != "" && root.lookupFile(interp) == nil {
+		missing = append(missing, interp+" (program interpreter)")
+	}
+	var dirs []string
+	for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+		paths, _ := f.DynString(tag)
+		for _, p := range paths {
+			dirs = append(dirs, strings.Split(p, ":")...)
+		}
+	}
+	dirs = append(dirs, "/lib", "/usr/lib", "/lib64", "/usr/lib64")
+	if ma, ok := elfMultiarch[goarch]; ok {
+		dirs = append(dirs, "/lib/"+ma, "/usr/lib/"+ma)
+	}
+libs:
+	for _, lib := range libs {
+		for _, dir := range dirs {
+			if root.lookupFile(filepath.Join(dir, lib)) != nil {
+				continue libs
+			}
+		}
+		missing = append(missing, lib)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s: %s is dynamically linked, but the root file system does not contain %s. Build with CGO_ENABLED=0 (and without -ldflags=-linkmode=external), or include the dynamic linker and libraries via -extrafiles", importPath, path, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkBinaries runs checkBinaryIn on all binaries (built from Go packages or
+// -prebuilt_binary) in /gokrazy and /user of root, reporting all incompatible
+// binaries at once.
+func checkBinaries(root *fileInfo) error {
+	var errs []string
+	for _, dir := range root.dirents {
+		if dir.filename != "gokrazy" && dir.filename != "user" {
+			continue
+		}
+		for _, ent := range dir.dirents {
+			if ent.fromHost == "" {
+				continue
+			}
+			if ent.importPath != "" && *dryRun {
+				continue // not built
+			}
+			name := ent.importPath
+			if name == "" {
+				name = "-prebuilt_binary"
+				if dir.filename == "gokrazy" {
+					name = "init"
+				}
+			}
+			if err := checkBinaryIn(root, ent.fromHost, name); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("incompatible binaries:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// lookupFile returns the file at the absolute path p within the tree fi,
+// following symbolic links (e.g. /lib/ld-linux-aarch64.so.1 or /lib ->
+// usr/lib), or nil.
+func (fi *fileInfo) lookupFile(p string) *fileInfo {
+	names := strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/")
+	cur := fi
+	hops := 0
+	for i := 0; i < len(names); i++ {
+		if names[i] == "" {
+			continue // the root directory
+		}
+		var next *fileInfo
+		for _, ent := range cur.dirents {
+			if ent.filename == names[i] {
+				next = ent
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		if next.symlinkDest == "" {
+			cur = next
+			continue
+		}
+		if hops++; hops > 40 { // like the Linux limit
+			return nil
+		}
+		target := next.symlinkDest
+		if !path.IsAbs(target) {
+			target = path.Join("/", strings.Join(names[:i], "/"), target)
+		}
+		rest := path.Join(append([]string{target}, names[i+1:]...)...)
+		names = strings.Split(strings.Trim(path.Clean(rest), "/"), "/")
+		cur, i = fi, -1
+	}
+	return cur
+}
@@ -0,0 +1,413 @@
+package packer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	ext4BlockSize      = 4096
+	ext4BlocksPerGroup = 8 * ext4BlockSize // one block bitmap block per group
+	ext4InodeSize      = 256
+	ext4InodeRatio     = 16384 // bytes per inode, like mke2fs
+	ext4DescSize       = 32
+	ext4ExtraIsize     = 32
+
+	ext4RootIno      = 2
+	ext4JournalIno   = 8
+	ext4LostFoundIno = 11 // the first non-reserved inode
+
+	// lost+found is preallocated (like mke2fs does), so that e2fsck does not
+	// need to allocate blocks when reconnecting files.
+	ext4LostFoundBlocks = 4
+
+	ext4FeatureCompatHasJournal   = 0x4
+	ext4FeatureCompatDirIndex     = 0x20
+	ext4FeatureIncompatFiletype   = 0x2
+	ext4FeatureIncompatExtents    = 0x40
+	ext4FeatureROCompatSparse     = 0x1
+	ext4FeatureROCompatLargeFile  = 0x2
+	ext4FeatureROCompatGdtCsum    = 0x10
+	ext4FeatureROCompatDirNlink   = 0x20
+	ext4FeatureROCompatExtraIsize = 0x40
+
+	ext4BgInodeUninit = 0x1
+	ext4BgBlockUninit = 0x2
+	ext4BgInodeZeroed = 0x4
+
+	ext4ExtentsFl = 0x80000
+)
+
+// ext4JournalBlocks returns the journal size for a file system of the
+// specified number of blocks, like mke2fs (capped at 64 MB so that the
+// journal fits into the first block group).
+func ext4JournalBlocks(blocks int64) int64 {
+	switch {
+	case blocks < 2048:
+		return 0 // too small for a journal
+	case blocks < 32768:
+		return 1024
+	case blocks < 256*1024:
+		return 4096
+	case blocks < 512*1024:
+		return 8192
+	}
+	return 16384
+}
+
+// ext4HasSuper returns whether block group g contains a backup of the
+// superblock and group descriptors (sparse_super: groups 0, 1 and powers of
+// 3, 5 and 7).
+func ext4HasSuper(g int64) bool {
+	if g <= 1 {
+		return true
+	}
+	for _, base := range []int64{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+// crc16 is the CRC16 (polynomial 0x8005, reflected) of the Linux kernel, which
+// ext4 uses for group descriptor checksums (uninit_bg).
+func crc16(crc uint16, b []byte) uint16 {
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func setBits(b []byte, from, to int64) {
+	for i := from; i < to; i++ {
+		b[i/8] |= 1 << uint(i%8)
+	}
+}
+
+// writeExt4 creates an empty ext4 file system (with a journal, if large
+// enough) of size bytes at offset off of w, like mke2fs(8) with default
+// options. Only the first block group is initialized (uninit_bg), so very
+// little data needs to be written even for large partitions. If zeroed is
+// true, the space is known to contain only zeros (e.g. a freshly truncated
+// image file), so that the inode tables can be marked as zeroed and the journal
+// does not need to be cleared.
+func writeExt4(cfg *Config, w io.WriterAt, off, size int64, zeroed bool) error {
+	blocks := size / ext4BlockSize
+	groups := (blocks + ext4BlocksPerGroup - 1) / ext4BlocksPerGroup
+	inodes := blocks * ext4BlockSize / ext4InodeRatio
+	if inodes < 16*groups {
+		inodes = 16 * groups
+	}
+	// Inodes per group, a multiple of the inodes per inode table block:
+	const inodesPerBlock = ext4BlockSize / ext4InodeSize
+	ipg := ((inodes+groups-1)/groups + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+	if ipg > 8*ext4BlockSize {
+		ipg = 8 * ext4BlockSize
+	}
+	itableBlocks := ipg / inodesPerBlock
+	gdtBlocks := (groups*ext4DescSize + ext4BlockSize - 1) / ext4BlockSize
+	overhead := func(g int64) int64 {
+		n := 2 + itableBlocks // block and inode bitmap, inode table
+		if ext4HasSuper(g) {
+			n += 1 + gdtBlocks
+		}
+		return n
+	}
+	// Like mke2fs, leave out a last block group which is too small to be
+	// useful:
+	if last := groups - 1; last > 0 && blocks-last*ext4BlocksPerGroup < overhead(last)+50 {
+		groups--
+		blocks = groups * ext4BlocksPerGroup
+	}
+	groupBlocks := func(g int64) int64 {
+		if g == groups-1 {
+			return blocks - g*ext4BlocksPerGroup
+		}
+		return ext4BlocksPerGroup
+	}
+
+	journalBlocks := ext4JournalBlocks(blocks)
+	// The first group holds the root directory, lost+found and the journal:
+	dirBlock := overhead(0)
+	lostFoundBlock := dirBlock + 1
+	journalBlock := lostFoundBlock + ext4LostFoundBlocks
+	used0 := journalBlock + journalBlocks
+	if used0 > groupBlocks(0) {
+		return fmt.Errorf("%d bytes are too small for an ext4 file system", size)
+	}
+
+	var uuid, hashSeed [16]byte
+	if err := imageRandom(cfg, uuid[:], "ext4 uuid"); err != nil {
+		return err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40 // version 4
+	uuid[8] = uuid[8]&0x3f | 0x80 // variant 10
+	if err := imageRandom(cfg, hashSeed[:], "ext4 hash seed"); err != nil {
+		return err
+	}
+	now := uint32(imageTime().Unix())
+
+	writeAt := func(b []byte, block int64) error {
+		_, err := w.WriteAt(b, off+block*ext4BlockSize)
+		return err
+	}
+
+	// Group descriptors:
+	gdt := make([]byte, gdtBlocks*ext4BlockSize)
+	var freeBlocks int64
+	for g := int64(0); g < groups; g++ {
+		start := g * ext4BlocksPerGroup
+		meta := start
+		if ext4HasSuper(g) {
+			meta += 1 + gdtBlocks
+		}
+		used := overhead(g)
+		var flags, usedInodes, usedDirs uint16
+		if g == 0 {
+			used = used0
+			usedInodes = ext4LostFoundIno
+			usedDirs = 2
+		} else {
+			flags |= ext4BgInodeUninit
+			if g != groups-1 {
+				flags |= ext4BgBlockUninit
+			}
+		}
+		if zeroed {
+			flags |= ext4BgInodeZeroed
+		}
+		free := groupBlocks(g) - used
+		freeBlocks += free
+		d := gdt[g*ext4DescSize:]
+		binary.LittleEndian.PutUint32(d[0x0:], uint32(meta))   // block bitmap
+		binary.LittleEndian.PutUint32(d[0x4:], uint32(meta+1)) // inode bitmap
+		binary.LittleEndian.PutUint32(d[0x8:], uint32(meta+2)) // inode table
+		binary.LittleEndian.PutUint16(d[0xC:], uint16(free))
+		binary.LittleEndian.PutUint16(d[0xE:], uint16(ipg)-usedInodes)
+		binary.LittleEndian.PutUint16(d[0x10:], usedDirs)
+		binary.LittleEndian.PutUint16(d[0x12:], flags)
+		binary.LittleEndian.PutUint16(d[0x1C:], uint16(ipg)-usedInodes) // itable unused
+		var le [4]byte
+		binary.LittleEndian.PutUint32(le[:], uint32(g))
+		csum := crc16(crc16(crc16(0xFFFF, uuid[:]), le[:]), d[:0x1E])
+		binary.LittleEndian.PutUint16(d[0x1E:], csum)
+
+		// Bitmaps of the initialized block groups:
+		if flags&ext4BgBlockUninit == 0 {
+			bitmap := make([]byte, ext4BlockSize)
+			setBits(bitmap, 0, used)
+			setBits(bitmap, groupBlocks(g), ext4BlocksPerGroup) // beyond the end
+			if err := writeAt(bitmap, meta); err != nil {
+				return err
+			}
+		}
+		if flags&ext4BgInodeUninit == 0 {
+			bitmap := make([]byte, ext4BlockSize)
+			setBits(bitmap, 0, int64(usedInodes))
+			setBits(bitmap, ipg, 8*ext4BlockSize) // padding
+			if err := writeAt(bitmap, meta+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Inodes: the first inode table block holds all reserved inodes.
+	inode := func(b []byte, mode uint16, links uint16, size int64, block, n int64) {
+		binary.LittleEndian.PutUint16(b[0x0:], mode)
+		binary.LittleEndian.PutUint32(b[0x4:], uint32(size))
+		binary.LittleEndian.PutUint32(b[0x8:], now)  // atime
+		binary.LittleEndian.PutUint32(b[0xC:], now)  // ctime
+		binary.LittleEndian.PutUint32(b[0x10:], now) // mtime
+		binary.LittleEndian.PutUint16(b[0x1A:], links)
+		binary.LittleEndian.PutUint32(b[0x1C:], uint32(n*ext4BlockSize/512))
+		binary.LittleEndian.PutUint32(b[0x20:], ext4ExtentsFl)
+		// Extent tree with a single extent in i_block:
+		binary.LittleEndian.PutUint16(b[0x28:], 0xF30A) // magic
+		binary.LittleEndian.PutUint16(b[0x2A:], 1)      // entries
+		binary.LittleEndian.PutUint16(b[0x2C:], 4)      // max entries
+		binary.LittleEndian.PutUint16(b[0x2E:], 0)      // depth
+		binary.LittleEndian.PutUint32(b[0x34:], 0)      // first logical block
+		binary.LittleEndian.PutUint16(b[0x38:], uint16(n))
+		binary.LittleEndian.PutUint32(b[0x3C:], uint32(block))
+		binary.LittleEndian.PutUint32(b[0x6C:], uint32(size>>32))
+		binary.LittleEndian.PutUint16(b[0x80:], ext4ExtraIsize)
+	}
+	itable := make([]byte, ext4BlockSize)
+	at := func(ino int) []byte { return itable[(ino-1)*ext4InodeSize : ino*ext4InodeSize] }
+	inode(at(ext4RootIno), 040755, 3, ext4BlockSize, dirBlock, 1)
+	inode(at(ext4LostFoundIno), 040700, 2, ext4LostFoundBlocks*ext4BlockSize, lostFoundBlock, ext4LostFoundBlocks)
+	if journalBlocks > 0 {
+		inode(at(ext4JournalIno), 0100600, 1, journalBlocks*ext4BlockSize, journalBlock, journalBlocks)
+	}
+	if err := writeAt(itable, overhead(0)-itableBlocks); err != nil {
+		return err
+	}
+
+	// Directories:
+	dirent := func(b []byte, ino uint32, recLen uint16, name string) []byte {
+		binary.LittleEndian.PutUint32(b[0:], ino)
+		binary.LittleEndian.PutUint16(b[4:], recLen)
+		b[6] = byte(len(name))
+		if ino != 0 {
+			b[7] = 2 // directory
+		}
+		copy(b[8:], name)
+		return b[recLen:]
+	}
+	root := make([]byte, ext4BlockSize)
+	rest := dirent(root, ext4RootIno, 12, ".")
+	rest = dirent(rest, ext4RootIno, 12, "..")
+	dirent(rest, ext4LostFoundIno, ext4BlockSize-24, "lost+found")
+	if err := writeAt(root, dirBlock); err != nil {
+		return err
+	}
+	lostFound := make([]byte, ext4LostFoundBlocks*ext4BlockSize)
+	rest = dirent(lostFound, ext4LostFoundIno, 12, ".")
+	dirent(rest, ext4RootIno, ext4BlockSize-12, "..")
+	for i := 1; i < ext4LostFoundBlocks; i++ {
+		dirent(lostFound[i*ext4BlockSize:], 0, ext4BlockSize, "") // empty
+	}
+	if err := writeAt(lostFound, lostFoundBlock); err != nil {
+		return err
+	}
+
+	// Journal (jbd2, big endian), empty and clean:
+	if journalBlocks > 0 {
+		if !zeroed {
+			zeros := make([]byte, 1*MB)
+			for b := int64(1); b < journalBlocks; b += int64(len(zeros)) / ext4BlockSize {
+				n := (journalBlocks - b) * ext4BlockSize
+				if n > int64(len(zeros)) {
+					n = int64(len(zeros))
+				}
+				if err := writeAt(zeros[:n], journalBlock+b); err != nil {
+					return err
+				}
+			}
+		}
+		jsb := make([]byte, ext4BlockSize)
+		binary.BigEndian.PutUint32(jsb[0x0:], 0xC03B3998) // magic
+		binary.BigEndian.PutUint32(jsb[0x4:], 4)          // superblock v2
+		binary.BigEndian.PutUint32(jsb[0xC:], ext4BlockSize)
+		binary.BigEndian.PutUint32(jsb[0x10:], uint32(journalBlocks))
+		binary.BigEndian.PutUint32(jsb[0x14:], 1) // first log block
+		binary.BigEndian.PutUint32(jsb[0x18:], 1) // first expected sequence
+		copy(jsb[0x30:], uuid[:])
+		binary.BigEndian.PutUint32(jsb[0x40:], 1) // users
+		if err := writeAt(jsb, journalBlock); err != nil {
+			return err
+		}
+	}
+
+	// Superblock (and its backups):
+	sb := make([]byte, 1024)
+	le32 := func(pos int, v uint32) { binary.LittleEndian.PutUint32(sb[pos:], v) }
+	le16 := func(pos int, v uint16) { binary.LittleEndian.PutUint16(sb[pos:], v) }
+	le32(0x0, uint32(ipg*groups))
+	le32(0x4, uint32(blocks))
+	le32(0x8, 0) // no blocks reserved for root
+	le32(0xC, uint32(freeBlocks))
+	le32(0x10, uint32(ipg*groups-ext4LostFoundIno))
+	le32(0x14, 0) // first data block
+	le32(0x18, 2) // log2(block size) - 10
+	le32(0x1C, 2) // log2(cluster size) - 10
+	le32(0x20, ext4BlocksPerGroup)
+	le32(0x24, ext4BlocksPerGroup) // clusters per group
+	le32(0x28, uint32(ipg))
+	le32(0x30, now)    // write time
+	le16(0x36, 0xFFFF) // no check after a maximum mount count
+	le16(0x38, 0xEF53) // magic
+	le16(0x3A, 1)      // state: clean
+	le16(0x3C, 1)      // errors: continue
+	le32(0x40, now)    // last check
+	le32(0x4C, 1)      // dynamic revision
+	le32(0x54, ext4LostFoundIno)
+	le16(0x58, ext4InodeSize)
+	compat := uint32(ext4FeatureCompatDirIndex)
+	if journalBlocks > 0 {
+		compat |= ext4FeatureCompatHasJournal
+	}
+	le32(0x5C, compat)
+	le32(0x60, ext4FeatureIncompatFiletype|ext4FeatureIncompatExtents)
+	le32(0x64, ext4FeatureROCompatSparse|ext4FeatureROCompatLargeFile|ext4FeatureROCompatGdtCsum|ext4FeatureROCompatDirNlink|ext4FeatureROCompatExtraIsize)
+	copy(sb[0x68:], uuid[:])
+	copy(sb[0x78:], "perm") // volume name
+	if journalBlocks > 0 {
+		le32(0xE0, ext4JournalIno)
+		// Backup of the journal inode’s i_block and size:
+		copy(sb[0x10C:], at(ext4JournalIno)[0x28:0x28+60])
+		le32(0x10C+15*4, 0)
+		le32(0x10C+16*4, uint32(journalBlocks*ext4BlockSize))
+		sb[0xFD] = 1 // journal backup type: s_jnl_blocks
+	}
+	copy(sb[0xEC:], hashSeed[:])
+	sb[0xFC] = 1     // default hash version: half MD4
+	le32(0x108, now) // mkfs time
+	le16(0x15C, ext4ExtraIsize)
+	le16(0x15E, ext4ExtraIsize)
+	le32(0x160, 0x2) // unsigned directory hash, as on arm64
+
+	for g := int64(0); g < groups; g++ {
+		if !ext4HasSuper(g) {
+			continue
+		}
+		le16(0x5A, uint16(g))
+		start := g * ext4BlocksPerGroup
+		if g == 0 {
+			// The first 1024 bytes are left for boot code:
+			if _, err := w.WriteAt(sb, off+1024); err != nil {
+				return err
+			}
+		} else if err := writeAt(sb, start); err != nil {
+			return err
+		}
+		if err := writeAt(gdt, start+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkfsPerm creates a LUKS2 volume (-perm_luks) and/or an ext4 file system
+// (-perm_mkfs, within the volume) on the permanent data partition of the
+// partitioned device or image f.
+func mkfsPerm(cfg *Config, f interface {
+	io.ReaderAt
+	io.WriterAt
+}, zeroed bool) error {
+	parts, err := imagePartitions(f)
+	if err != nil {
+		return err
+	}
+	if len(parts) < 4 || parts[3].size == 0 {
+		return fmt.Errorf("permanent data partition not found")
+	}
+	perm := parts[3]
+	var w io.WriterAt = f
+	if *permLUKS {
+		if w, err = formatPermLUKS(cfg, f, perm.start, perm.size); err != nil {
+			return err
+		}
+		perm.start, perm.size = 0, perm.size-luks2DataOffset
+		zeroed = false // zeros are not zeros once decrypted
+	}
+	if !*permMkfs {
+		return nil
+	}
+	stage := startStage("create ext4 file system on permanent data partition")
+	defer stage.done()
+	return writeExt4(cfg, w, perm.start, perm.size, zeroed)
+}
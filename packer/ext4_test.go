@@ -0,0 +1,121 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExt4(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		size   int64
+		zeroed bool
+	}{
+		{"no-journal", 4 << 20, true},
+		{"single-group", 64 << 20, true},
+		{"not-zeroed", 64 << 20, false},
+		{"multiple-groups", 1 << 30, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "gokr-packer-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			fn := filepath.Join(dir, "perm.img")
+			f, err := os.Create(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if tt.zeroed {
+				if err := f.Truncate(tt.size); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				// Leftovers of a previous file system must not matter:
+				garbage := make([]byte, tt.size)
+				rand.New(rand.NewSource(1)).Read(garbage)
+				if _, err := f.Write(garbage); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writeExt4(&Config{}, f, 0, tt.size, tt.zeroed); err != nil {
+				t.Fatal(err)
+			}
+
+			sb := make([]byte, 1024)
+			if _, err := f.ReadAt(sb, 1024); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := binary.LittleEndian.Uint16(sb[56:]), uint16(0xEF53); got != want {
+				t.Fatalf("superblock magic: got %#x, want %#x", got, want)
+			}
+			if got, want := int64(binary.LittleEndian.Uint32(sb[4:])), tt.size/ext4BlockSize; got != want {
+				t.Errorf("blocks: got %d, want %d", got, want)
+			}
+
+			checkExt4(t, fn)
+		})
+	}
+}
+
+// TestExt4Offset verifies that writeExt4 only writes within the partition.
+func TestExt4Offset(t *testing.T) {
+	const (
+		off  = 1 << 20
+		size = 16 << 20
+	)
+	img := make([]byte, off+size+off)
+	for i := range img {
+		img[i] = 0xAA
+	}
+	w := &byteWriterAt{img}
+	if err := writeExt4(&Config{}, w, off, size, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]int{{0, off}, {off + size, len(img)}} {
+		if !bytes.Equal(img[r[0]:r[1]], bytes.Repeat([]byte{0xAA}, r[1]-r[0])) {
+			t.Errorf("writeExt4 wrote outside of [%d, %d)", off, off+size)
+		}
+	}
+	dir, err := ioutil.TempDir("", "gokr-packer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "perm.img")
+	if err := ioutil.WriteFile(fn, img[off:off+size], 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkExt4(t, fn)
+}
+
+// checkExt4 checks the file system in fn using e2fsck(8), if installed.
+func checkExt4(t *testing.T, fn string) {
+	t.Helper()
+	if _, err := exec.LookPath("e2fsck"); err != nil {
+		t.Skip("e2fsck not found in $PATH")
+	}
+	out, err := exec.Command("e2fsck", "-fn", fn).CombinedOutput()
+	if err != nil {
+		t.Fatalf("e2fsck -fn %s: %v\n%s", fn, err, out)
+	}
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		return
+	}
+	out, err = exec.Command("debugfs", "-R", "ls -l /", fn).CombinedOutput()
+	if err != nil {
+		t.Fatalf("debugfs: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "lost+found") {
+		t.Errorf("lost+found not found in the root directory:\n%s", out)
+	}
+}
@@ -0,0 +1,996 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+var (
+	bootFSClusterSize = flag.Int("boot_fs_cluster_size",
+		fat32SectorSize,
+		"cluster size in bytes (a power of two from 512 to 32768) of the -boot_fs=fat32 file system. Larger clusters result in a smaller file allocation table, but FAT32 requires at least 65525 clusters, so the boot partition (-boot_size) must hold 65525 clusters")
+
+	bootFSLabel = flag.String("boot_fs_label",
+		"",
+		"volume label (up to 11 characters, e.g. BOOT) of the boot file system, for tools which identify the boot partition by its label")
+)
+
+// bootFSWriter is implemented by the writers for the boot file system:
+// fatWriter and planWriter (-dry_run).
+type bootFSWriter interface {
+	// File creates a file, which can be written to until the next call to
+	// File or Flush.
+	File(path string, modTime time.Time) (io.Writer, error)
+
+	// Flush writes the file system.
+	Flush() error
+}
+
+const (
+	fat32SectorSize = 512
+
+	// fat32MaxClusterSize is the largest cluster size which all FAT
+	// implementations support.
+	fat32MaxClusterSize = 32768
+
+	// fat32MinClusters is the smallest number of clusters which identifies a
+	// FAT file system as FAT32 (65525), plus a safety margin for
+	// implementations with off-by-one errors.
+	fat32MinClusters = 65525 + 16
+
+	fat32ReservedSectors = 32
+	fat32EndOfChain      = 0x0FFFFFFF
+
+	// fat16ClusterSize is the size of a FAT16 cluster (4 sectors), like
+	// github.com/gokrazy/internal/fat.Writer, which gokr-packer used before.
+	fat16ClusterSize = 4 * fat32SectorSize
+
+	// fat16MinClusters is the smallest number of clusters which identifies a
+	// FAT file system as FAT16 (4085), plus a safety margin, and
+	// fat16MaxClusters the largest.
+	fat16MinClusters = 4085 + 16
+	fat16MaxClusters = 65524
+
+	// fat32HiddenSectors is the start of the boot partition, see
+	// writePartitionTable.
+	fat32HiddenSectors = bootStartSector
+)
+
+// fatEntry is a file or directory of a fatWriter.
+type fatEntry struct {
+	name         string
+	modTime      time.Time
+	size         uint32
+	firstCluster uint32
+
+	dir     bool
+	entries []*fatEntry
+	parent  *fatEntry
+}
+
+// fatWriter writes a FAT16 or FAT32 file system with VFAT long file names, so
+// that file names which do not fit 8.3 (e.g. overlays/vc4-kms-v3d.dtbo) are
+// retained. It writes the file data to a temporary file until Flush is called,
+// because the position of the data area depends on the size of the file
+// allocation table.
+type fatWriter struct {
+	w           io.Writer
+	dataTmp     *os.File
+	fat16       bool
+	clusterSize int
+	label       string // empty for no volume label
+
+	// fat contains the file allocation table entries for all clusters
+	// written so far, starting with the two reserved entries.
+	fat []uint32
+
+	root    *fatEntry
+	pending *fatWriterFile
+}
+
+// newFAT32Writer returns a fatWriter for FAT32 with clusters of clusterSize
+// bytes and the volume label label (if not empty), see checkBootFSFlags.
+func newFAT32Writer(w io.Writer, clusterSize int, label string) (*fatWriter, error) {
+	return newFATWriter(w, false, clusterSize, label)
+}
+
+// newFAT16Writer returns a fatWriter for FAT16 with the volume label label (if
+// not empty).
+func newFAT16Writer(w io.Writer, label string) (*fatWriter, error) {
+	return newFATWriter(w, true, fat16ClusterSize, label)
+}
+
+func newFATWriter(w io.Writer, fat16 bool, clusterSize int, label string) (*fatWriter, error) {
+	f, err := ioutil.TempFile("", "gokr-packer-fat")
+	if err != nil {
+		return nil, err
+	}
+	return &fatWriter{
+		w:           w,
+		dataTmp:     f,
+		fat16:       fat16,
+		clusterSize: clusterSize,
+		label:       label,
+		fat: []uint32{
+			0x0FFFFFF8, // media descriptor (hard disk)
+			0x0FFFFFFF, // clean shutdown, no errors
+		},
+		root: &fatEntry{dir: true},
+	}, nil
+}
+
+// fatVolumeLabel returns label as stored in the boot sector and the volume
+// label directory entry: upper case, padded with spaces to 11 bytes.
+func fatVolumeLabel(label string) string {
+	if label == "" {
+		return ""
+	}
+	return fmt.Sprintf("%-11s", strings.ToUpper(label))
+}
+
+// checkBootFSFlags verifies -boot_fs_label, and -boot_fs_cluster_size against
+// -boot_fs and the size of the boot partition.
+func checkBootFSFlags() error {
+	cs := *bootFSClusterSize
+	if cs < fat32SectorSize || cs > fat32MaxClusterSize || cs&(cs-1) != 0 {
+		return fmt.Errorf("-boot_fs_cluster_size=%d is not a power of two from %d to %d", cs, fat32SectorSize, fat32MaxClusterSize)
+	}
+	if label := *bootFSLabel; label != "" {
+		if len(label) > 11 {
+			return fmt.Errorf("-boot_fs_label=%q exceeds 11 characters", label)
+		}
+		for _, r := range label {
+			if r < 0x20 || r > 0x7e || strings.ContainsRune(`"*+,./:;<=>?[\]|`, r) {
+				return fmt.Errorf("-boot_fs_label=%q contains %q, which is not allowed in FAT volume labels", label, r)
+			}
+		}
+	}
+	if *bootFS != "fat32" {
+		if cs != fat32SectorSize {
+			return fmt.Errorf("-boot_fs_cluster_size requires -boot_fs=fat32")
+		}
+		return nil
+	}
+	l, err := parsePartitionLayout()
+	if err != nil {
+		return err
+	}
+	if min := fat32MinBytes(cs); uint64(min) > l.bootSectors*512 {
+		return fmt.Errorf("-boot_fs_cluster_size=%d requires a boot partition of at least %s (FAT32 requires %d clusters), see -boot_size", cs, formatBytes(min), fat32MinClusters)
+	}
+	return nil
+}
+
+// fat32MinBytes returns the size of the smallest FAT32 file system with
+// clusters of clusterSize bytes.
+func fat32MinBytes(clusterSize int) int64 {
+	fatSectors := ((fat32MinClusters+2)*4 + fat32SectorSize - 1) / fat32SectorSize
+	return int64(fat32ReservedSectors+fatSectors)*fat32SectorSize + int64(fat32MinClusters)*int64(clusterSize)
+}
+
+func (fw *fatWriter) nextCluster() uint32 { return uint32(len(fw.fat)) }
+
+// allocate appends a cluster chain of n clusters to the FAT and returns its
+// first cluster.
+func (fw *fatWriter) allocate(n int) uint32 {
+	first := fw.nextCluster()
+	for i := 1; i < n; i++ {
+		fw.fat = append(fw.fat, fw.nextCluster()+1)
+	}
+	fw.fat = append(fw.fat, fat32EndOfChain)
+	return first
+}
+
+func (fw *fatWriter) dir(path string) (*fatEntry, error) {
+	cur := fw.root
+	for _, component := range strings.Split(path, "/") {
+		if component == "" || component == "." {
+			continue
+		}
+		var next *fatEntry
+		for _, ent := range cur.entries {
+			if strings.EqualFold(ent.name, component) {
+				next = ent
+			}
+		}
+		if next == nil {
+			next = &fatEntry{name: component, dir: true, parent: cur}
+			cur.entries = append(cur.entries, next)
+		}
+		if !next.dir {
+			return nil, fmt.Errorf("path %q invalid: component %q identifies a file", path, component)
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// fatWriterFile is a file being written to a fatWriter.
+type fatWriterFile struct {
+	fw    *fatWriter
+	entry *fatEntry
+	count int64
+}
+
+func (ff *fatWriterFile) Write(p []byte) (int, error) {
+	if ff.count+int64(len(p)) > 0xFFFFFFFF {
+		return 0, fmt.Errorf("%s: files on FAT are limited to 4 GB", ff.entry.name)
+	}
+	n, err := ff.fw.dataTmp.Write(p)
+	ff.count += int64(n)
+	return n, err
+}
+
+func (ff *fatWriterFile) close() error {
+	ff.entry.size = uint32(ff.count)
+	if ff.count == 0 {
+		return nil // empty files have no clusters
+	}
+	clusterSize := int64(ff.fw.clusterSize)
+	clusters := int((ff.count + clusterSize - 1) / clusterSize)
+	if pad := int64(clusters)*clusterSize - ff.count; pad > 0 {
+		if _, err := ff.fw.dataTmp.Write(make([]byte, pad)); err != nil {
+			return err
+		}
+	}
+	ff.entry.firstCluster = ff.fw.allocate(clusters)
+	return nil
+}
+
+// File creates a file with the specified path and modTime. The returned
+// io.Writer stays valid until the next call to File or Flush.
+func (fw *fatWriter) File(path string, modTime time.Time) (io.Writer, error) {
+	if fw.pending != nil {
+		if err := fw.pending.close(); err != nil {
+			return nil, err
+		}
+		fw.pending = nil
+	}
+	dir, err := fw.dir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	for _, ent := range dir.entries {
+		if strings.EqualFold(ent.name, name) {
+			return nil, fmt.Errorf("%s: file already exists", path)
+		}
+	}
+	ent := &fatEntry{name: name, modTime: modTime.UTC(), parent: dir}
+	dir.entries = append(dir.entries, ent)
+	fw.pending = &fatWriterFile{fw: fw, entry: ent}
+	return fw.pending, nil
+}
+
+// fatShortName returns the 8.3 name (11 bytes, padded with spaces) for name,
+// generating a numeric tail if name does not fit or conflicts with a name in
+// seen. With keepCase, names which fit are stored in their case instead of
+// upper case, like github.com/gokrazy/internal/fat.Writer did: older gokrazy
+// FAT readers only look for lower case names (e.g. cmdline.txt).
+func fatShortName(name string, seen map[string]bool, keepCase bool) string {
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, r := range s {
+			switch {
+			case r == ' ' || r == '.':
+				// dropped
+			case r > 0x7f || strings.ContainsRune(`"*+,/:;<=>?[\]|`, r):
+				b.WriteByte('_')
+			default:
+				b.WriteRune(r)
+			}
+		}
+		return b.String()
+	}
+	base, ext := strings.TrimLeft(name, "."), ""
+	if idx := strings.LastIndexByte(base, '.'); idx > -1 {
+		base, ext = base[:idx], base[idx+1:]
+	}
+	primary, extension := clean(base), clean(ext)
+	lossy := primary != base || extension != ext || len(primary) > 8 || len(extension) > 3
+	if lossy || !keepCase {
+		primary, extension = strings.ToUpper(primary), strings.ToUpper(extension)
+	}
+	if len(primary) > 8 {
+		primary = primary[:8]
+	}
+	if len(extension) > 3 {
+		extension = extension[:3]
+	}
+	pad := func(s string, n int) string { return s + strings.Repeat(" ", n-len(s)) }
+	short := pad(primary, 8) + pad(extension, 3)
+	// Short names are compared case-insensitively:
+	if !lossy && !seen[strings.ToUpper(short)] {
+		seen[strings.ToUpper(short)] = true
+		return short
+	}
+	primary = strings.ToUpper(primary)
+	for n := 1; n <= 999999; n++ {
+		tail := "~" + strconv.Itoa(n)
+		p := primary
+		if len(p)+len(tail) > 8 {
+			p = p[:8-len(tail)]
+		}
+		candidate := pad(p+tail, 8) + pad(strings.ToUpper(extension), 3)
+		if !seen[candidate] {
+			seen[candidate] = true
+			return candidate
+		}
+	}
+	return short // unreachable in practice: directories are small
+}
+
+func fatTime(t time.Time) uint16 {
+	return uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+}
+
+func fatDate(t time.Time) uint16 {
+	if t.Year() < 1980 {
+		return 1<<5 | 1 // 1980-01-01
+	}
+	return uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+}
+
+// longNameEntries returns the number of long file name entries for name.
+func longNameEntries(name string) int {
+	return (len(utf16.Encode([]rune(name))) + 12) / 13
+}
+
+// dirClusters returns the number of clusters which directory d occupies.
+func (fw *fatWriter) dirClusters(d *fatEntry) int {
+	n := 0
+	if d.parent != nil {
+		n += 2 // . and ..
+	} else if fw.label != "" {
+		n++ // volume label
+	}
+	for _, ent := range d.entries {
+		n += 1 + longNameEntries(ent.name)
+	}
+	clusters := (n*32 + fw.clusterSize - 1) / fw.clusterSize
+	if clusters == 0 {
+		clusters = 1
+	}
+	return clusters
+}
+
+func writeShortEntry(w io.Writer, short string, attr uint8, modTime time.Time, firstCluster, size uint32) error {
+	var ent [32]byte
+	copy(ent[:11], short)
+	ent[11] = attr
+	binary.LittleEndian.PutUint16(ent[14:], fatTime(modTime)) // creation
+	binary.LittleEndian.PutUint16(ent[16:], fatDate(modTime))
+	binary.LittleEndian.PutUint16(ent[18:], fatDate(modTime)) // last access
+	binary.LittleEndian.PutUint16(ent[20:], uint16(firstCluster>>16))
+	binary.LittleEndian.PutUint16(ent[22:], fatTime(modTime)) // last write
+	binary.LittleEndian.PutUint16(ent[24:], fatDate(modTime))
+	binary.LittleEndian.PutUint16(ent[26:], uint16(firstCluster))
+	binary.LittleEndian.PutUint32(ent[28:], size)
+	_, err := w.Write(ent[:])
+	return err
+}
+
+func (fw *fatWriter) writeDirEntries(w io.Writer, d *fatEntry) error {
+	if d.parent != nil {
+		if err := writeShortEntry(w, ".          ", 0x10, d.modTime, d.firstCluster, 0); err != nil {
+			return err
+		}
+		parentCluster := d.parent.firstCluster
+		if d.parent.parent == nil {
+			parentCluster = 0 // the root directory is referred to as cluster 0
+		}
+		if err := writeShortEntry(w, "..         ", 0x10, d.modTime, parentCluster, 0); err != nil {
+			return err
+		}
+	} else if fw.label != "" {
+		if err := writeShortEntry(w, fw.label, 0x08, d.modTime, 0, 0); err != nil {
+			return err
+		}
+	}
+	seen := make(map[string]bool)
+	for _, ent := range d.entries {
+		short := fatShortName(ent.name, seen, fw.fat16)
+		var checksum uint8
+		for _, ch := range []byte(short) {
+			checksum = (((checksum & 1) << 7) | ((checksum & 0xFE) >> 1)) + ch
+		}
+
+		// Long file name entries, in reverse order:
+		name := utf16.Encode([]rune(ent.name))
+		chunks := longNameEntries(ent.name)
+		padded := make([]uint16, chunks*13)
+		for i := range padded {
+			padded[i] = 0xFFFF
+		}
+		copy(padded, name)
+		if len(name) < len(padded) {
+			padded[len(name)] = 0 // terminator
+		}
+		for i := chunks - 1; i >= 0; i-- {
+			var lfn [32]byte
+			lfn[0] = byte(i + 1)
+			if i == chunks-1 {
+				lfn[0] |= 0x40 // last long entry
+			}
+			chars := padded[i*13 : (i+1)*13]
+			for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				binary.LittleEndian.PutUint16(lfn[off:], chars[j])
+			}
+			lfn[11] = 0x0f // long file name
+			lfn[13] = checksum
+			if _, err := w.Write(lfn[:]); err != nil {
+				return err
+			}
+		}
+
+		attr := uint8(0x01) // read-only
+		if ent.dir {
+			attr = 0x10
+		}
+		if err := writeShortEntry(w, short, attr, ent.modTime, ent.firstCluster, ent.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes the file system image. The fatWriter must not be used after
+// calling Flush.
+func (fw *fatWriter) Flush() error {
+	defer os.Remove(fw.dataTmp.Name())
+	defer fw.dataTmp.Close()
+	if fw.pending != nil {
+		if err := fw.pending.close(); err != nil {
+			return err
+		}
+		fw.pending = nil
+	}
+
+	// Allocate all directories (including the root directory, which is a
+	// regular cluster chain on FAT32, but a fixed area on FAT16) before writing
+	// them, so that their entries can refer to the clusters of their
+	// subdirectories:
+	var dirs []*fatEntry
+	queue := []*fatEntry{fw.root}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		if d != fw.root || !fw.fat16 {
+			d.firstCluster = fw.allocate(fw.dirClusters(d))
+			dirs = append(dirs, d)
+		}
+		for _, ent := range d.entries {
+			if ent.dir {
+				queue = append(queue, ent)
+			}
+		}
+	}
+	for _, d := range dirs {
+		var buf bytes.Buffer
+		if err := fw.writeDirEntries(&buf, d); err != nil {
+			return err
+		}
+		buf.Write(make([]byte, fw.dirClusters(d)*fw.clusterSize-buf.Len()))
+		if _, err := fw.dataTmp.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	used := len(fw.fat) - 2
+	if fw.fat16 {
+		return fw.flushFAT16(used)
+	}
+	clusters := used
+	if clusters < fat32MinClusters {
+		clusters = fat32MinClusters
+	}
+	fatSectors := ((clusters+2)*4 + fat32SectorSize - 1) / fat32SectorSize
+	totalSectors := fat32ReservedSectors + fatSectors + clusters*fw.clusterSize/fat32SectorSize
+
+	// Reserved area: boot sector, FSInfo sector and their backups.
+	var bs [fat32SectorSize]byte
+	copy(bs[0:], []byte{0xEB, 0x58, 0x90}) // jump code
+	copy(bs[3:], "gokrazy!")               // OEM
+	binary.LittleEndian.PutUint16(bs[11:], fat32SectorSize)
+	bs[13] = uint8(fw.clusterSize / fat32SectorSize)
+	binary.LittleEndian.PutUint16(bs[14:], fat32ReservedSectors)
+	bs[16] = 1                                 // one copy of the FAT
+	bs[21] = 0xF8                              // media descriptor: hard disk
+	binary.LittleEndian.PutUint16(bs[24:], 32) // (only for boot code) sectors per track
+	binary.LittleEndian.PutUint16(bs[26:], 4)  // (only for boot code) heads
+	binary.LittleEndian.PutUint32(bs[28:], fat32HiddenSectors)
+	binary.LittleEndian.PutUint32(bs[32:], uint32(totalSectors))
+	binary.LittleEndian.PutUint32(bs[36:], uint32(fatSectors))
+	binary.LittleEndian.PutUint32(bs[44:], fw.root.firstCluster)
+	binary.LittleEndian.PutUint16(bs[48:], 1) // FSInfo sector
+	binary.LittleEndian.PutUint16(bs[50:], 6) // backup boot sector
+	bs[64] = 0x80                             // (only for boot code) drive number
+	bs[66] = 0x29                             // extended boot signature
+	binary.LittleEndian.PutUint32(bs[67:], 0xf3f37b84)
+	if fw.label != "" {
+		copy(bs[71:], fw.label)
+	} else {
+		copy(bs[71:], "gokrazy    ")
+	}
+	copy(bs[82:], "FAT32   ")
+	bs[510], bs[511] = 0x55, 0xAA
+
+	var fsinfo [fat32SectorSize]byte
+	binary.LittleEndian.PutUint32(fsinfo[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(fsinfo[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(fsinfo[488:], uint32(clusters-used)) // free clusters
+	binary.LittleEndian.PutUint32(fsinfo[492:], uint32(used+2))        // next free cluster
+	binary.LittleEndian.PutUint32(fsinfo[508:], 0xAA550000)
+
+	reserved := make([]byte, fat32ReservedSectors*fat32SectorSize)
+	copy(reserved[0*fat32SectorSize:], bs[:])
+	copy(reserved[1*fat32SectorSize:], fsinfo[:])
+	copy(reserved[6*fat32SectorSize:], bs[:])
+	copy(reserved[7*fat32SectorSize:], fsinfo[:])
+	if _, err := fw.w.Write(reserved); err != nil {
+		return err
+	}
+
+	table := make([]byte, fatSectors*fat32SectorSize)
+	for i, entry := range fw.fat {
+		binary.LittleEndian.PutUint32(table[i*4:], entry)
+	}
+	if _, err := fw.w.Write(table); err != nil {
+		return err
+	}
+
+	if _, err := fw.dataTmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw.w, fw.dataTmp); err != nil {
+		return err
+	}
+	// Unused clusters, up to the minimum size of a FAT32 file system:
+	_, err := io.CopyN(fw.w, zeroReader{}, int64(clusters-used)*int64(fw.clusterSize))
+	return err
+}
+
+// flushFAT16 writes the reserved area, the file allocation table and the root
+// directory of a FAT16 file system with used clusters, followed by the data
+// area.
+func (fw *fatWriter) flushFAT16(used int) error {
+	if used > fat16MaxClusters {
+		return fmt.Errorf("boot file system exceeds the FAT16 limit of %s, use -boot_fs=fat32", formatBytes(int64(fat16MaxClusters)*int64(fw.clusterSize)))
+	}
+	clusters := used
+	if clusters < fat16MinClusters {
+		clusters = fat16MinClusters
+	}
+	fatSectors := ((clusters+2)*2 + fat32SectorSize - 1) / fat32SectorSize
+	// Only the boot sector is needed, but the number of reserved sectors must
+	// be aligned to clusters (at least on the Raspberry Pi 3):
+	reservedSectors := fw.clusterSize / fat32SectorSize
+
+	var root bytes.Buffer
+	if err := fw.writeDirEntries(&root, fw.root); err != nil {
+		return err
+	}
+	rootSectors := (root.Len() + fat32SectorSize - 1) / fat32SectorSize
+	if rootSectors == 0 {
+		rootSectors = 1
+	}
+	root.Write(make([]byte, rootSectors*fat32SectorSize-root.Len()))
+	totalSectors := reservedSectors + fatSectors + rootSectors + clusters*fw.clusterSize/fat32SectorSize
+
+	var bs [fat32SectorSize]byte
+	copy(bs[0:], []byte{0xEB, 0x3C, 0x90}) // jump code
+	copy(bs[3:], "gokrazy!")               // OEM
+	binary.LittleEndian.PutUint16(bs[11:], fat32SectorSize)
+	bs[13] = uint8(fw.clusterSize / fat32SectorSize)
+	binary.LittleEndian.PutUint16(bs[14:], uint16(reservedSectors))
+	bs[16] = 1 // one copy of the FAT
+	binary.LittleEndian.PutUint16(bs[17:], uint16(rootSectors*fat32SectorSize/32))
+	bs[21] = 0xF8 // media descriptor: hard disk
+	binary.LittleEndian.PutUint16(bs[22:], uint16(fatSectors))
+	binary.LittleEndian.PutUint16(bs[24:], 32) // (only for boot code) sectors per track
+	binary.LittleEndian.PutUint16(bs[26:], 4)  // (only for boot code) heads
+	binary.LittleEndian.PutUint32(bs[28:], fat32HiddenSectors)
+	binary.LittleEndian.PutUint32(bs[32:], uint32(totalSectors))
+	bs[36] = 0x80 // (only for boot code) drive number
+	bs[38] = 0x29 // extended boot signature
+	binary.LittleEndian.PutUint32(bs[39:], 0xf3f37b84)
+	if fw.label != "" {
+		copy(bs[43:], fw.label)
+	} else {
+		copy(bs[43:], "gokrazy    ")
+	}
+	copy(bs[54:], "FAT16   ")
+	bs[510], bs[511] = 0x55, 0xAA
+
+	reserved := make([]byte, reservedSectors*fat32SectorSize)
+	copy(reserved, bs[:])
+	if _, err := fw.w.Write(reserved); err != nil {
+		return err
+	}
+
+	// The FAT32 values of the reserved entries and end of chain markers
+	// (0x0FFFFFF8, 0x0FFFFFFF) truncate to their FAT16 values:
+	table := make([]byte, fatSectors*fat32SectorSize)
+	for i, entry := range fw.fat {
+		binary.LittleEndian.PutUint16(table[i*2:], uint16(entry))
+	}
+	if _, err := fw.w.Write(table); err != nil {
+		return err
+	}
+	if _, err := fw.w.Write(root.Bytes()); err != nil {
+		return err
+	}
+
+	if _, err := fw.dataTmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw.w, fw.dataTmp); err != nil {
+		return err
+	}
+	// Unused clusters, up to the minimum size of a FAT16 file system:
+	_, err := io.CopyN(fw.w, zeroReader{}, int64(clusters-used)*int64(fw.clusterSize))
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// fatVolume describes the layout of an existing FAT16 or FAT32 file system.
+type fatVolume struct {
+	r   io.ReaderAt
+	off int64 // of the boot sector
+
+	clusterSize int64
+	fatOffset   int64
+	dataOffset  int64
+	fat32       bool
+
+	// rootOffset and rootSize locate the fixed-size root directory of FAT16.
+	rootOffset, rootSize int64
+
+	// rootCluster is the first cluster of the root directory of FAT32.
+	rootCluster uint32
+}
+
+func readFATVolume(r io.ReaderAt, off int64) (*fatVolume, error) {
+	bs := make([]byte, 512)
+	if _, err := r.ReadAt(bs, off); err != nil {
+		return nil, err
+	}
+	var (
+		sectorSize        = int64(binary.LittleEndian.Uint16(bs[11:]))
+		sectorsPerCluster = int64(bs[13])
+		reservedSectors   = int64(binary.LittleEndian.Uint16(bs[14:]))
+		fats              = int64(bs[16])
+		rootDirEntries    = int64(binary.LittleEndian.Uint16(bs[17:]))
+		fatSectors        = int64(binary.LittleEndian.Uint16(bs[22:]))
+	)
+	if sectorSize == 0 || sectorsPerCluster == 0 || bs[510] != 0x55 || bs[511] != 0xAA {
+		return nil, fmt.Errorf("no FAT file system found")
+	}
+	v := &fatVolume{
+		r:           r,
+		off:         off,
+		clusterSize: sectorsPerCluster * sectorSize,
+		fatOffset:   off + reservedSectors*sectorSize,
+	}
+	if fatSectors == 0 { // FAT32
+		v.fat32 = true
+		fatSectors = int64(binary.LittleEndian.Uint32(bs[36:]))
+		v.rootCluster = binary.LittleEndian.Uint32(bs[44:])
+		v.dataOffset = v.fatOffset + fats*fatSectors*sectorSize
+		return v, nil
+	}
+	v.rootOffset = v.fatOffset + fats*fatSectors*sectorSize
+	v.rootSize = rootDirEntries * 32
+	v.dataOffset = v.rootOffset + (v.rootSize+sectorSize-1)/sectorSize*sectorSize
+	return v, nil
+}
+
+func (v *fatVolume) clusterOffset(cluster uint32) int64 {
+	return v.dataOffset + int64(cluster-2)*v.clusterSize
+}
+
+// fatDirent is a short directory entry of a fatVolume.
+type fatDirent struct {
+	shortName    string // 11 bytes, as stored
+	attr         uint8
+	firstCluster uint32
+	size         uint32
+	offset       int64 // of the directory entry
+}
+
+// rootDir returns the short entries of the root directory (skipping long
+// file name and deleted entries).
+func (v *fatVolume) rootDir() ([]fatDirent, error) {
+	extents, err := v.dirExtents(0)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fatDirent
+	for _, e := range extents {
+		b := make([]byte, e.len)
+		if _, err := v.r.ReadAt(b, e.off); err != nil {
+			return nil, err
+		}
+		for i := int64(0); i+32 <= e.len; i += 32 {
+			entry := b[i : i+32]
+			if entry[0] == 0 {
+				return entries, nil // end of directory
+			}
+			if entry[0] == 0xe5 || entry[11] == 0x0f {
+				continue // deleted or long file name
+			}
+			d := fatDirent{
+				shortName:    string(entry[:11]),
+				attr:         entry[11],
+				firstCluster: uint32(binary.LittleEndian.Uint16(entry[26:])),
+				size:         binary.LittleEndian.Uint32(entry[28:]),
+				offset:       e.off + i,
+			}
+			if v.fat32 {
+				d.firstCluster |= uint32(binary.LittleEndian.Uint16(entry[20:])) << 16
+			}
+			entries = append(entries, d)
+		}
+	}
+	return entries, nil
+}
+
+// volumeLabel returns the volume label directory entry of the root directory
+// (11 bytes, as stored), or "" if there is none.
+func (v *fatVolume) volumeLabel() (string, error) {
+	entries, err := v.rootDir()
+	if err != nil {
+		return "", err
+	}
+	for _, d := range entries {
+		if d.attr&0x08 != 0 && d.attr&0x10 == 0 {
+			return d.shortName, nil
+		}
+	}
+	return "", nil
+}
+
+// fatExtent is a contiguous part of a directory or file.
+type fatExtent struct{ off, len int64 }
+
+// next returns the cluster following cluster in its chain, or 0 if cluster is
+// the last one.
+func (v *fatVolume) next(cluster uint32) (uint32, error) {
+	if v.fat32 {
+		var b [4]byte
+		if _, err := v.r.ReadAt(b[:], v.fatOffset+int64(cluster)*4); err != nil {
+			return 0, err
+		}
+		next := binary.LittleEndian.Uint32(b[:]) & 0x0FFFFFFF
+		if next >= 0x0FFFFFF8 {
+			return 0, nil
+		}
+		if next < 2 || next >= 0x0FFFFFF7 {
+			return 0, fmt.Errorf("FAT: broken cluster chain at cluster %d", cluster)
+		}
+		return next, nil
+	}
+	var b [2]byte
+	if _, err := v.r.ReadAt(b[:], v.fatOffset+int64(cluster)*2); err != nil {
+		return 0, err
+	}
+	next := uint32(binary.LittleEndian.Uint16(b[:]))
+	if next >= 0xFFF8 {
+		return 0, nil
+	}
+	if next < 2 || next >= 0xFFF7 {
+		return 0, fmt.Errorf("FAT: broken cluster chain at cluster %d", cluster)
+	}
+	return next, nil
+}
+
+// chain returns the extents of the clusters of the chain starting at first.
+func (v *fatVolume) chain(first uint32) ([]fatExtent, error) {
+	var extents []fatExtent
+	seen := make(map[uint32]bool)
+	for cluster := first; cluster != 0; {
+		if seen[cluster] {
+			return nil, fmt.Errorf("FAT: loop in the cluster chain starting at cluster %d", first)
+		}
+		seen[cluster] = true
+		extents = append(extents, fatExtent{v.clusterOffset(cluster), v.clusterSize})
+		var err error
+		if cluster, err = v.next(cluster); err != nil {
+			return nil, err
+		}
+	}
+	return extents, nil
+}
+
+// dirExtents returns the extents of the directory starting at cluster, where
+// cluster 0 refers to the root directory.
+func (v *fatVolume) dirExtents(cluster uint32) ([]fatExtent, error) {
+	if cluster != 0 {
+		return v.chain(cluster)
+	}
+	if v.fat32 {
+		return v.chain(v.rootCluster)
+	}
+	return []fatExtent{{v.rootOffset, v.rootSize}}, nil
+}
+
+// fatFile is a file or directory of a fatVolume.
+type fatFile struct {
+	name         string // long file name, or 8.3 name (e.g. README.TXT)
+	dir          bool
+	modTime      time.Time
+	firstCluster uint32
+	size         uint32
+}
+
+// readDir returns the files and directories in the directory starting at
+// cluster (0 for the root directory).
+func (v *fatVolume) readDir(cluster uint32) ([]fatFile, error) {
+	extents, err := v.dirExtents(cluster)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		files    []fatFile
+		longName []uint16
+	)
+	for _, e := range extents {
+		b := make([]byte, e.len)
+		if _, err := v.r.ReadAt(b, e.off); err != nil {
+			return nil, err
+		}
+		for i := int64(0); i+32 <= e.len; i += 32 {
+			entry := b[i : i+32]
+			if entry[0] == 0 {
+				return files, nil // end of directory
+			}
+			if entry[0] == 0xe5 {
+				longName = nil
+				continue // deleted
+			}
+			if entry[11] == 0x0f { // long file name
+				if entry[0]&0x40 != 0 { // last long entry, stored first
+					longName = nil
+				}
+				var chars []uint16
+				for _, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+					ch := binary.LittleEndian.Uint16(entry[off:])
+					if ch == 0 || ch == 0xFFFF {
+						break
+					}
+					chars = append(chars, ch)
+				}
+				longName = append(chars, longName...)
+				continue
+			}
+			name := string(utf16.Decode(longName))
+			longName = nil
+			if entry[11]&0x08 != 0 || entry[0] == '.' {
+				continue // volume label, . or ..
+			}
+			if name == "" {
+				name = strings.TrimRight(string(entry[:8]), " ")
+				if ext := strings.TrimRight(string(entry[8:11]), " "); ext != "" {
+					name += "." + ext
+				}
+			}
+			t := binary.LittleEndian.Uint16(entry[22:])
+			d := binary.LittleEndian.Uint16(entry[24:])
+			f := fatFile{
+				name:         name,
+				dir:          entry[11]&0x10 != 0,
+				modTime:      time.Date(1980+int(d>>9), time.Month(d>>5&0x0F), int(d&0x1F), int(t>>11), int(t>>5&0x3F), int(t&0x1F)*2, 0, time.UTC),
+				firstCluster: uint32(binary.LittleEndian.Uint16(entry[26:])),
+				size:         binary.LittleEndian.Uint32(entry[28:]),
+			}
+			if v.fat32 {
+				f.firstCluster |= uint32(binary.LittleEndian.Uint16(entry[20:])) << 16
+			}
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// walk calls fn for all files (not directories) of the file system, with
+// their absolute path (e.g. /overlays/README).
+func (v *fatVolume) walk(fn func(path string, f fatFile) error) error {
+	var walkDir func(dir string, cluster uint32) error
+	walkDir = func(dir string, cluster uint32) error {
+		files, err := v.readDir(cluster)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			path := dir + "/" + f.name
+			if f.dir {
+				if f.firstCluster == 0 {
+					return fmt.Errorf("FAT: directory %s refers to the root directory", path)
+				}
+				if err := walkDir(path, f.firstCluster); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fn(path, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walkDir("", 0)
+}
+
+// copyFile writes the contents of f to w.
+func (v *fatVolume) copyFile(w io.Writer, f fatFile) error {
+	if f.size == 0 {
+		return nil
+	}
+	extents, err := v.chain(f.firstCluster)
+	if err != nil {
+		return err
+	}
+	remaining := int64(f.size)
+	for _, e := range extents {
+		if remaining == 0 {
+			break
+		}
+		n := e.len
+		if n > remaining {
+			n = remaining
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(v.r, e.off, n)); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	if remaining > 0 {
+		return fmt.Errorf("FAT: cluster chain of %s is too short", f.name)
+	}
+	return nil
+}
+
+// lookup returns the root directory entry with the 8.3 name short (e.g.
+// "CMDLINE TXT"), compared case-insensitively because FAT16 file systems store
+// short names in the case of the long name (see fatShortName).
+func (v *fatVolume) lookup(short string) (fatDirent, error) {
+	entries, err := v.rootDir()
+	if err != nil {
+		return fatDirent{}, err
+	}
+	for _, d := range entries {
+		if strings.EqualFold(d.shortName, short) {
+			return d, nil
+		}
+	}
+	return fatDirent{}, fmt.Errorf("%s not found in the boot file system", strings.TrimSpace(short[:8])+"."+strings.TrimSpace(short[8:]))
+}
+
+// readSeekerAt implements io.ReaderAt for an io.ReadSeeker which is not used
+// concurrently.
+type readSeekerAt struct{ io.ReadSeeker }
+
+func (r readSeekerAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r, p)
+}
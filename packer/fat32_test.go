@@ -0,0 +1,310 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func TestFATRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	files := map[string][]byte{
+		"/cmdline.txt":                       []byte("console=tty1 root=/dev/mmcblk0p2"),
+		"/config.txt":                        []byte("enable_uart=1\n"),
+		"/empty":                             nil,
+		"/kernel.img":                        random(100000),
+		"/overlays/vc4-kms-v3d.dtbo":         random(3000),
+		"/overlays/README":                   []byte("overlays"),
+		"/Ünïcode file name with spaces.txt": []byte("long file name entries"),
+		"/longfilename1.txt":                 []byte("1"),
+		"/longfilename2.txt":                 []byte("2"),
+		"/.hidden":                           []byte("leading dot"),
+	}
+	// Enough entries for the directory to span multiple clusters:
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("/many/file number %03d.dat", i)] = []byte(fmt.Sprint(i))
+	}
+	modTime := time.Date(2020, 6, 1, 12, 34, 56, 0, time.UTC)
+
+	for _, tt := range []struct {
+		name        string
+		fat16       bool
+		clusterSize int
+		label       string
+	}{
+		{"fat16", true, fat16ClusterSize, "gokrazy"},
+		{"fat32", false, fat32SectorSize, ""},
+		{"fat32-4k", false, 4096, "boot"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			fw, err := newFATWriter(&buf, tt.fat16, tt.clusterSize, fatVolumeLabel(tt.label))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range sortedKeys(files) {
+				w, err := fw.File(path, modTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Write(files[path]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := fw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			v, err := readFATVolume(bytes.NewReader(buf.Bytes()), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := v.fat32, !tt.fat16; got != want {
+				t.Errorf("FAT32: got %v, want %v", got, want)
+			}
+			if got, want := v.clusterSize, int64(tt.clusterSize); got != want {
+				t.Errorf("cluster size: got %d, want %d", got, want)
+			}
+			label, err := v.volumeLabel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := label, fatVolumeLabel(tt.label); got != want {
+				t.Errorf("volume label: got %q, want %q", got, want)
+			}
+
+			got := readFATFiles(t, v)
+			for path, want := range files {
+				f, ok := got[path]
+				if !ok {
+					t.Errorf("%s: not found", path)
+					continue
+				}
+				if !bytes.Equal(f.data, want) {
+					t.Errorf("%s: contents differ (got %d bytes, want %d bytes)", path, len(f.data), len(want))
+				}
+				if !f.modTime.Equal(modTime) {
+					t.Errorf("%s: modification time: got %v, want %v", path, f.modTime, modTime)
+				}
+			}
+			if len(got) != len(files) {
+				t.Errorf("found %d files, want %d", len(got), len(files))
+			}
+
+			// walk and copyFile (used by inspect and patch) read the same
+			// files:
+			var walked int
+			err = v.walk(func(path string, f fatFile) error {
+				walked++
+				var b bytes.Buffer
+				if err := v.copyFile(&b, f); err != nil {
+					return err
+				}
+				if !bytes.Equal(b.Bytes(), files[path]) {
+					t.Errorf("walk: %s: contents differ (got %d bytes, want %d bytes)", path, b.Len(), len(files[path]))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if walked != len(files) {
+				t.Errorf("walk: found %d files, want %d", walked, len(files))
+			}
+
+			// The update code and the Raspberry Pi firmware find files by
+			// their 8.3 name:
+			d, err := v.lookup("CMDLINE TXT")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := d.size, uint32(len(files["/cmdline.txt"])); got != want {
+				t.Errorf("cmdline.txt: size: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestFATVolumeLabel(t *testing.T) {
+	if got := fatVolumeLabel(""); got != "" {
+		t.Errorf(`fatVolumeLabel("") = %q, want ""`, got)
+	}
+	if got, want := fatVolumeLabel("gokrazy"), "GOKRAZY    "; got != want {
+		t.Errorf("fatVolumeLabel(gokrazy) = %q, want %q", got, want)
+	}
+}
+
+func TestFATShortName(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, tt := range []struct {
+		name     string
+		keepCase bool
+		want     string
+	}{
+		{"cmdline.txt", true, "cmdline txt"},
+		{"CMDLINE.TXT", false, "CMDLIN~1TXT"}, // conflicts with cmdline.txt
+		{"longfilename1.txt", false, "LONGFI~1TXT"},
+		{"longfilename2.txt", false, "LONGFI~2TXT"},
+		{"vc4-kms-v3d.dtbo", false, "VC4-KM~1DTB"},
+		{"a b+c.txt", false, "AB_C~1  TXT"},
+	} {
+		if got := fatShortName(tt.name, seen, tt.keepCase); got != tt.want {
+			t.Errorf("fatShortName(%q, keepCase=%v) = %q, want %q", tt.name, tt.keepCase, got, tt.want)
+		}
+	}
+}
+
+// fatTestFile is a file read by readFATFiles.
+type fatTestFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// readFATFiles reads all files of the FAT file system v by their long file
+// names, independently of the packer's code for reading FAT file systems.
+func readFATFiles(t *testing.T, v *fatVolume) map[string]fatTestFile {
+	t.Helper()
+	readAt := func(n, off int64) []byte {
+		b := make([]byte, n)
+		if _, err := v.r.ReadAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	next := func(cluster uint32) (uint32, bool) {
+		if v.fat32 {
+			next := binary.LittleEndian.Uint32(readAt(4, v.fatOffset+int64(cluster)*4)) & 0x0FFFFFFF
+			return next, next < 0x0FFFFFF8
+		}
+		next := binary.LittleEndian.Uint16(readAt(2, v.fatOffset+int64(cluster)*2))
+		return uint32(next), next < 0xFFF8
+	}
+	readChain := func(cluster uint32) []byte {
+		var b []byte
+		for n := 0; cluster >= 2; n++ {
+			if n > 1<<20 {
+				t.Fatalf("FAT: loop in cluster chain")
+			}
+			b = append(b, readAt(v.clusterSize, v.clusterOffset(cluster))...)
+			var ok bool
+			if cluster, ok = next(cluster); !ok {
+				break
+			}
+		}
+		return b
+	}
+
+	files := make(map[string]fatTestFile)
+	var walk func(dir string, b []byte)
+	walk = func(dir string, b []byte) {
+		var (
+			lfn    []uint16
+			lfnSum byte
+		)
+		for i := 0; i+32 <= len(b); i += 32 {
+			e := b[i : i+32]
+			if e[0] == 0 {
+				return // end of directory
+			}
+			if e[0] == 0xe5 {
+				lfn = nil
+				continue // deleted
+			}
+			if e[11] == 0x0f {
+				seq := int(e[0] & 0x1f)
+				if e[0]&0x40 != 0 {
+					lfn = make([]uint16, 13*seq)
+					lfnSum = e[13]
+				}
+				if lfn == nil || seq < 1 || seq*13 > len(lfn) {
+					t.Fatalf("%s: invalid long file name entry sequence", dir)
+				}
+				for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+					lfn[(seq-1)*13+j] = binary.LittleEndian.Uint16(e[off:])
+				}
+				continue
+			}
+			if e[11]&0x08 != 0 {
+				continue // volume label
+			}
+			base := strings.TrimRight(string(e[:8]), " ")
+			ext := strings.TrimRight(string(e[8:11]), " ")
+			if e[12]&0x08 != 0 {
+				base = strings.ToLower(base)
+			}
+			if e[12]&0x10 != 0 {
+				ext = strings.ToLower(ext)
+			}
+			name := base
+			if ext != "" {
+				name += "." + ext
+			}
+			if lfn != nil {
+				var sum byte
+				for _, c := range e[:11] {
+					sum = (sum>>1 | sum<<7) + c
+				}
+				if sum != lfnSum {
+					t.Errorf("%s/%s: long file name checksum %#x does not match short name %q (%#x)", dir, name, lfnSum, e[:11], sum)
+				}
+				for j, c := range lfn {
+					if c == 0 {
+						lfn = lfn[:j]
+						break
+					}
+				}
+				name = string(utf16.Decode(lfn))
+				lfn = nil
+			}
+			if name == "." || name == ".." {
+				continue
+			}
+			path := dir + "/" + name
+			cluster := uint32(binary.LittleEndian.Uint16(e[26:]))
+			if v.fat32 {
+				cluster |= uint32(binary.LittleEndian.Uint16(e[20:])) << 16
+			}
+			if e[11]&0x10 != 0 {
+				walk(path, readChain(cluster))
+				continue
+			}
+			data := readChain(cluster)
+			size := binary.LittleEndian.Uint32(e[28:])
+			if int(size) > len(data) {
+				t.Fatalf("%s: size %d exceeds its clusters (%d bytes)", path, size, len(data))
+			}
+			date, tm := binary.LittleEndian.Uint16(e[24:]), binary.LittleEndian.Uint16(e[22:])
+			files[path] = fatTestFile{
+				data: data[:size],
+				modTime: time.Date(1980+int(date>>9), time.Month(date>>5&0xf), int(date&0x1f),
+					int(tm>>11), int(tm>>5&0x3f), int(tm&0x1f)*2, 0, time.UTC),
+			}
+		}
+	}
+	if v.fat32 {
+		walk("", readChain(v.rootCluster))
+	} else {
+		walk("", readAt(v.rootSize, v.rootOffset))
+	}
+	return files
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
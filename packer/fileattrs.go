@@ -0,0 +1,198 @@
+package packer
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	fileOwners = flag.String("file_owners",
+		"",
+		"comma-separated list of files or directories of the root file system and their owner and group (default root), each of the form <path>=<uid>:<gid>, e.g. /user/web=1000:1000")
+
+	fileCaps = flag.String("file_caps",
+		"",
+		"semicolon-separated list of files of the root file system and the capabilities to grant to them (permitted and effective, like setcap <capabilities>+ep), each of the form <path>=<capability>[,<capability>...], e.g. /user/web=cap_net_bind_service. Requires a kernel with CONFIG_SQUASHFS_XATTR")
+
+	extraFilesOwners = flag.Bool("extrafiles_owners",
+		false,
+		"retain the owner and group of the -extrafiles host files (e.g. of a directory extracted from an archive as root) instead of making root their owner")
+)
+
+// capabilities maps the names of Linux capabilities to their numbers, see
+// capabilities(7).
+var capabilities = map[string]uint{
+	"cap_chown":              0,
+	"cap_dac_override":       1,
+	"cap_dac_read_search":    2,
+	"cap_fowner":             3,
+	"cap_fsetid":             4,
+	"cap_kill":               5,
+	"cap_setgid":             6,
+	"cap_setuid":             7,
+	"cap_setpcap":            8,
+	"cap_linux_immutable":    9,
+	"cap_net_bind_service":   10,
+	"cap_net_broadcast":      11,
+	"cap_net_admin":          12,
+	"cap_net_raw":            13,
+	"cap_ipc_lock":           14,
+	"cap_ipc_owner":          15,
+	"cap_sys_module":         16,
+	"cap_sys_rawio":          17,
+	"cap_sys_chroot":         18,
+	"cap_sys_ptrace":         19,
+	"cap_sys_pacct":          20,
+	"cap_sys_admin":          21,
+	"cap_sys_boot":           22,
+	"cap_sys_nice":           23,
+	"cap_sys_resource":       24,
+	"cap_sys_time":           25,
+	"cap_sys_tty_config":     26,
+	"cap_mknod":              27,
+	"cap_lease":              28,
+	"cap_audit_write":        29,
+	"cap_audit_control":      30,
+	"cap_setfcap":            31,
+	"cap_mac_override":       32,
+	"cap_mac_admin":          33,
+	"cap_syslog":             34,
+	"cap_wake_alarm":         35,
+	"cap_block_suspend":      36,
+	"cap_audit_read":         37,
+	"cap_perfmon":            38,
+	"cap_bpf":                39,
+	"cap_checkpoint_restore": 40,
+}
+
+// capabilityXattr returns the security.capability xattr granting caps
+// (permitted and effective): struct vfs_cap_data, revision 2.
+func capabilityXattr(caps []string) ([]byte, error) {
+	var permitted uint64
+	for _, c := range caps {
+		n, ok := capabilities[strings.ToLower(c)]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", c)
+		}
+		permitted |= 1 << n
+	}
+	const (
+		vfsCapRevision2     = 0x02000000
+		vfsCapFlagEffective = 0x000001
+	)
+	b := make([]byte, 20)
+	binary.LittleEndian.PutUint32(b[0:], vfsCapRevision2|vfsCapFlagEffective)
+	// permitted and inheritable, for capabilities 0-31, then for 32-63:
+	binary.LittleEndian.PutUint32(b[4:], uint32(permitted))
+	binary.LittleEndian.PutUint32(b[12:], uint32(permitted>>32))
+	return b, nil
+}
+
+// capabilityNames returns the capabilities granted by the security.capability
+// xattr b, for displaying them.
+func capabilityNames(b []byte) string {
+	if len(b) < 20 {
+		return "invalid"
+	}
+	permitted := uint64(binary.LittleEndian.Uint32(b[4:])) | uint64(binary.LittleEndian.Uint32(b[12:]))<<32
+	var names []string
+	for name, n := range capabilities {
+		if permitted&(1<<n) != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// lookupFile returns the file at path (e.g. /user/web, or / for the root
+// directory) of root, or nil if it does not exist.
+func lookupFile(root *fileInfo, path string) *fileInfo {
+	fi := root
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		var next *fileInfo
+		for _, ent := range fi.dirents {
+			if ent.filename == name {
+				next = ent
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		fi = next
+	}
+	return fi
+}
+
+// applyFileAttrs sets the -file_owners and -file_caps of the files in root.
+func applyFileAttrs(root *fileInfo) error {
+	find := func(flagName, path string) (*fileInfo, error) {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("-%s: %q is not an absolute path", flagName, path)
+		}
+		fi := lookupFile(root, path)
+		if fi == nil {
+			return nil, fmt.Errorf("-%s: %s not found in the root file system", flagName, path)
+		}
+		if fi.hardlinkTarget != "" {
+			return nil, fmt.Errorf("-%s: %s is a hard link, specify its target %s instead", flagName, path, fi.hardlinkTarget)
+		}
+		return fi, nil
+	}
+	if *fileOwners != "" {
+		for _, entry := range strings.Split(*fileOwners, ",") {
+			idx := strings.LastIndexByte(entry, '=')
+			if idx == -1 {
+				return fmt.Errorf("-file_owners: %q is not of the form <path>=<uid>:<gid>", entry)
+			}
+			ids := strings.Split(entry[idx+1:], ":")
+			if len(ids) != 2 {
+				return fmt.Errorf("-file_owners: %q is not of the form <path>=<uid>:<gid>", entry)
+			}
+			uid, err := strconv.ParseUint(ids[0], 10, 32)
+			if err != nil {
+				return fmt.Errorf("-file_owners: %q: invalid uid %q", entry, ids[0])
+			}
+			gid, err := strconv.ParseUint(ids[1], 10, 32)
+			if err != nil {
+				return fmt.Errorf("-file_owners: %q: invalid gid %q", entry, ids[1])
+			}
+			fi, err := find("file_owners", entry[:idx])
+			if err != nil {
+				return err
+			}
+			fi.uid, fi.gid = uint32(uid), uint32(gid)
+		}
+	}
+	if *fileCaps != "" {
+		for _, entry := range strings.Split(*fileCaps, ";") {
+			idx := strings.LastIndexByte(entry, '=')
+			if idx == -1 {
+				return fmt.Errorf("-file_caps: %q is not of the form <path>=<capability>[,<capability>...]", entry)
+			}
+			fi, err := find("file_caps", entry[:idx])
+			if err != nil {
+				return err
+			}
+			if fi.fromHost == "" && fi.fromLiteral == "" {
+				return fmt.Errorf("-file_caps: %s is not a regular file", entry[:idx])
+			}
+			xattr, err := capabilityXattr(strings.Split(entry[idx+1:], ","))
+			if err != nil {
+				return fmt.Errorf("-file_caps: %s: %v", entry[:idx], err)
+			}
+			if fi.xattrs == nil {
+				fi.xattrs = make(map[string][]byte)
+			}
+			fi.xattrs["security.capability"] = xattr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+var (
+	firstBoot = flag.String("firstboot",
+		"",
+		"comma-separated list of Go packages or files (e.g. scripts) to run exactly once on the first boot of a device, in order (e.g. for device enrollment or key generation). Completion is recorded in /perm/firstboot/, failed programs are retried on the next boot. Requires -perm=rw")
+
+	firstBootPayload = flag.String("firstboot_payload",
+		"",
+		"directory whose contents are copied to /perm on the first boot of a device (and again after an update which changed them), e.g. per-device secrets or initial configuration. The payload is stored in the root file system in "+firstBootPayloadDir+". Requires -perm=rw")
+
+	firstBootManifest = flag.String("firstboot_manifest",
+		"",
+		"file listing commands (one per line, e.g. /user/enroll -token={{ env \"ENROLL_TOKEN\" }}) to run exactly once on the first boot of a device, after the -firstboot programs. The file is a Go text/template, rendered when packing with .Hostname, .BuildTimestamp, .Board and .TargetArch plus the env and file functions. Requires -perm=rw")
+)
+
+const (
+	// firstBootPayloadDir contains the -firstboot_payload in the root file
+	// system.
+	firstBootPayloadDir = "/etc/gokrazy/firstboot-payload"
+
+	// firstBootManifestPath is the rendered -firstboot_manifest in the root
+	// file system.
+	firstBootManifestPath = "/etc/gokrazy/firstboot.json"
+)
+
+// firstBootPkgs returns the Go packages of -firstboot, i.e. the entries which
+// are not regular files on the host.
+func firstBootPkgs() []string {
+	if *firstBoot == "" {
+		return nil
+	}
+	var pkgs []string
+	for _, entry := range strings.Split(*firstBoot, ",") {
+		if !isHostFile(entry) {
+			pkgs = append(pkgs, entry)
+		}
+	}
+	return pkgs
+}
+
+func isHostFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// isScript returns whether the file at path starts with an interpreter line
+// (#!), i.e. is not a binary.
+func isScript(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	if _, err := f.Read(magic); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(magic, []byte("#!")), nil
+}
+
+// findFirstBoot returns the /firstboot directory containing the -firstboot
+// programs in the specified order, or nil if -firstboot is empty.
+func findFirstBoot(ctx context.Context) (*fileInfo, error) {
+	if *firstBoot == "" {
+		return nil, nil
+	}
+	dir := &fileInfo{filename: "firstboot"}
+	add := func(ent *fileInfo) error {
+		for _, existing := range dir.dirents {
+			if existing.filename == ent.filename {
+				return fmt.Errorf("-firstboot: %s and %s both result in /firstboot/%s", existing.fromHost, ent.fromHost, ent.filename)
+			}
+		}
+		dir.dirents = append(dir.dirents, ent)
+		return nil
+	}
+	for _, entry := range strings.Split(*firstBoot, ",") {
+		if isHostFile(entry) {
+			if fi, err := os.Stat(entry); err == nil && fi.Mode()&0111 == 0 {
+				return nil, fmt.Errorf("-firstboot: %s is not executable", entry)
+			}
+			script, err := isScript(entry)
+			if err != nil {
+				return nil, err
+			}
+			if !script {
+				if err := checkBinary(entry, entry); err != nil {
+					return nil, err
+				}
+			}
+			if err := add(&fileInfo{
+				filename: filepath.Base(entry),
+				fromHost: entry,
+			}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		pkgs, err := mainPackages(ctx, []string{entry})
+		if err != nil {
+			return nil, err
+		}
+		if len(pkgs) == 0 {
+			return nil, fmt.Errorf("-firstboot: %s is neither a file nor a main package", entry)
+		}
+		for _, pkg := range pkgs {
+			if err := checkBinary(pkg.Target, pkg.ImportPath); err != nil {
+				return nil, err
+			}
+			if err := add(&fileInfo{
+				filename:   filepath.Base(pkg.Target),
+				importPath: pkg.ImportPath,
+				fromHost:   pkg.Target,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return dir, nil
+}
+
+// firstBootPaths returns the paths of the /firstboot programs in root.
+func firstBootPaths(root *fileInfo) []string {
+	var paths []string
+	for _, ent := range root.dirents {
+		if ent.filename != "firstboot" {
+			continue
+		}
+		for _, prog := range ent.dirents {
+			paths = append(paths, "/firstboot/"+prog.filename)
+		}
+	}
+	return paths
+}
+
+// firstBootPayloadHash returns the hash of the -firstboot_payload directory
+// (paths, modes and contents), with which the generated init detects whether
+// the payload was already copied, or "" if -firstboot_payload is empty.
+func firstBootPayloadHash() (string, error) {
+	if *firstBootPayload == "" {
+		return "", nil
+	}
+	h := sha256.New()
+	err := filepath.Walk(*firstBootPayload, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(*firstBootPayload, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %v\n", filepath.ToSlash(rel), info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\n", target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("-firstboot_payload: %v", err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:16], nil
+}
+
+// firstBootCommand is a command of the rendered -firstboot_manifest.
+type firstBootCommand struct {
+	// ID identifies the command (its hash), so that changed commands are run
+	// again.
+	ID   string   `json:"id"`
+	Args []string `json:"args"`
+}
+
+// splitCommand splits a -firstboot_manifest line into arguments at spaces,
+// except within double quotes (which are removed).
+func splitCommand(line string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inArg   bool
+		quoted  bool
+		escaped bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// renderFirstBootManifest renders the -firstboot_manifest template into the
+// JSON list of commands which the generated init runs on first boot.
+func renderFirstBootManifest(cfg *Config) (string, error) {
+	b, err := ioutil.ReadFile(*firstBootManifest)
+	if err != nil {
+		return "", err
+	}
+	funcs := template.FuncMap{
+		"env": func(key string) (string, error) {
+			value, ok := os.LookupEnv(key)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", key)
+			}
+			return value, nil
+		},
+		"file": func(path string) (string, error) {
+			b, err := ioutil.ReadFile(path)
+			return strings.TrimRight(string(b), "\n"), err
+		},
+	}
+	tmpl, err := template.New(filepath.Base(*firstBootManifest)).Funcs(funcs).Parse(string(b))
+	if err != nil {
+		return "", fmt.Errorf("-firstboot_manifest: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct {
+		Hostname       string
+		BuildTimestamp string
+		Board          string
+		TargetArch     string
+	}{
+		Hostname:       cfg.Hostname,
+		BuildTimestamp: buildTimestamp,
+		Board:          cfg.Board,
+		TargetArch:     targetGOARCH(),
+	}); err != nil {
+		return "", fmt.Errorf("-firstboot_manifest: %v", err)
+	}
+	cmds := []firstBootCommand{}
+	for idx, line := range strings.Split(buf.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitCommand(line)
+		if err != nil {
+			return "", fmt.Errorf("-firstboot_manifest: line %d: %v", idx+1, err)
+		}
+		if !filepath.IsAbs(args[0]) {
+			return "", fmt.Errorf("-firstboot_manifest: line %d: %q is not an absolute path (e.g. /user/enroll)", idx+1, args[0])
+		}
+		cmds = append(cmds, firstBootCommand{
+			ID:   fmt.Sprintf("%x", sha256.Sum256([]byte(line)))[:16],
+			Args: args,
+		})
+	}
+	out, err := json.MarshalIndent(cmds, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(out) + "\n", nil
+}
+
+// addFirstBootFiles adds the -firstboot_payload directory and the rendered
+// -firstboot_manifest to the /etc/gokrazy directory etcGokrazy.
+func addFirstBootFiles(cfg *Config, etcGokrazy *fileInfo) error {
+	if *firstBootPayload != "" {
+		st, err := os.Stat(*firstBootPayload)
+		if err != nil {
+			return fmt.Errorf("-firstboot_payload: %v", err)
+		}
+		if !st.IsDir() {
+			return fmt.Errorf("-firstboot_payload: %s is not a directory", *firstBootPayload)
+		}
+		payload := etcGokrazy.dir(filepath.Base(firstBootPayloadDir))
+		if err := addHostDir(payload, firstBootPayloadDir, *firstBootPayload, newHostCopy(false)); err != nil {
+			return fmt.Errorf("-firstboot_payload: %v", err)
+		}
+	}
+	if *firstBootManifest != "" {
+		manifest, err := renderFirstBootManifest(cfg)
+		if err != nil {
+			return err
+		}
+		etcGokrazy.dirents = append(etcGokrazy.dirents, &fileInfo{
+			filename:    filepath.Base(firstBootManifestPath),
+			fromLiteral: manifest,
+		})
+	}
+	return nil
+}
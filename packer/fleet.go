@@ -0,0 +1,237 @@
+package packer
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+)
+
+var fleetManifest = flag.String("fleet_manifest",
+	"",
+	"path of a JSON or CSV (.csv) file listing devices (hostname, static_ip, serial, output), for each of which an image is written. The programs are built once and shared by all images; the hostname, -static_ip, /etc/gokrazy/serial and the HTTP password and TLS certificate differ per device. See the README for the format")
+
+// fleetDevice is an entry of the -fleet_manifest.
+type fleetDevice struct {
+	Hostname string `json:"hostname"`
+	StaticIP string `json:"static_ip"` // overrides -static_ip if not empty
+	Serial   string `json:"serial"`    // written to /etc/gokrazy/serial
+	Output   string `json:"output"`    // defaults to <-overwrite>/<hostname>.img
+}
+
+var (
+	// fleetSerial is the serial number of the device currently being built.
+	fleetSerial string
+
+	// fleetInstalled is set once the programs were built for the first device
+	// of the -fleet_manifest, so that logic does not install them again.
+	fleetInstalled bool
+)
+
+// readFleetManifest reads the devices from the -fleet_manifest: a JSON array of
+// fleetDevice objects, or a CSV file (.csv) whose header names the columns.
+// The images of devices without output are written to the directory imageDir.
+func readFleetManifest(path, imageDir string) ([]fleetDevice, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var devices []fleetDevice
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		records, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if len(records) == 0 {
+			return nil, fmt.Errorf("%s: missing header", path)
+		}
+		columns := make(map[string]int)
+		for idx, name := range records[0] {
+			columns[strings.ToLower(strings.TrimSpace(name))] = idx
+		}
+		if _, ok := columns["hostname"]; !ok {
+			return nil, fmt.Errorf("%s: missing hostname column", path)
+		}
+		for name := range columns {
+			switch name {
+			case "hostname", "static_ip", "serial", "output":
+			default:
+				return nil, fmt.Errorf("%s: unknown column %q", path, name)
+			}
+		}
+		column := func(record []string, name string) string {
+			if idx, ok := columns[name]; ok {
+				return strings.TrimSpace(record[idx])
+			}
+			return ""
+		}
+		for _, record := range records[1:] {
+			devices = append(devices, fleetDevice{
+				Hostname: column(record, "hostname"),
+				StaticIP: column(record, "static_ip"),
+				Serial:   column(record, "serial"),
+				Output:   column(record, "output"),
+			})
+		}
+	} else {
+		dec := json.NewDecoder(strings.NewReader(string(b)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&devices); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("%s: no devices", path)
+	}
+	hostnames := make(map[string]bool)
+	outputs := make(map[string]bool)
+	for idx := range devices {
+		d := &devices[idx]
+		if d.Hostname == "" {
+			return nil, fmt.Errorf("%s: device %d has no hostname", path, idx+1)
+		}
+		if hostnames[d.Hostname] {
+			return nil, fmt.Errorf("%s: duplicate hostname %q", path, d.Hostname)
+		}
+		hostnames[d.Hostname] = true
+		if strings.ContainsAny(d.Serial, "\n") {
+			return nil, fmt.Errorf("%s: serial of %s must not contain newlines", path, d.Hostname)
+		}
+		if d.Output == "" {
+			if imageDir == "" {
+				return nil, fmt.Errorf("%s: device %s has no output, and -overwrite does not specify a directory", path, d.Hostname)
+			}
+			d.Output = filepath.Join(imageDir, d.Hostname+".img")
+		}
+		if outputs[d.Output] {
+			return nil, fmt.Errorf("%s: duplicate output %q", path, d.Output)
+		}
+		outputs[d.Output] = true
+	}
+	return devices, nil
+}
+
+// checkFleetManifest verifies the -fleet_manifest and the flags it is combined
+// with.
+func checkFleetManifest(cfg *Config) error {
+	if *fleetManifest == "" {
+		return nil
+	}
+	if cfg.Update != "" || len(overwriteBlockDevices) > 0 || cfg.Boot != "" || cfg.Root != "" || cfg.MBR != "" || *overwriteInit != "" {
+		return fmt.Errorf("-fleet_manifest writes full images and cannot be combined with -update, -overwrite_block_device, -overwrite_boot, -overwrite_root, -overwrite_mbr or -overwrite_init")
+	}
+	if cfg.Image == "-" {
+		return fmt.Errorf("-fleet_manifest cannot write to standard output (-overwrite=-)")
+	}
+	if cfg.Image != "" {
+		if st, err := os.Stat(cfg.Image); err != nil || !st.IsDir() {
+			return fmt.Errorf("-fleet_manifest requires -overwrite to be an (existing) directory, in which the images are written")
+		}
+	}
+	devices, err := readFleetManifest(*fleetManifest, cfg.Image)
+	if err != nil {
+		return err
+	}
+
+	// A static IPv4 address on eth0 removes cmd/dhcp (see checkNetworkFlags),
+	// which would change the programs shared by all devices:
+	defaultIP := *staticIP
+	defer func() { *staticIP = defaultIP }()
+	withoutDHCP := -1
+	for _, d := range devices {
+		if d.StaticIP != "" {
+			*staticIP = d.StaticIP
+		} else {
+			*staticIP = defaultIP
+		}
+		gokrazyPkgs = strings.Split(*gokrazyPkgList, ",")
+		if err := checkNetworkFlags(cfg.Packages); err != nil {
+			return fmt.Errorf("-fleet_manifest: %s: %v", d.Hostname, err)
+		}
+		removed := 0
+		if len(gokrazyPkgs) != len(strings.Split(*gokrazyPkgList, ",")) {
+			removed = 1
+		}
+		if withoutDHCP != -1 && removed != withoutDHCP {
+			return fmt.Errorf("-fleet_manifest: either all or no devices need a static IPv4 address on -static_interface=eth0, as it determines whether %s is included", dhcpPkg)
+		}
+		withoutDHCP = removed
+		addSSHPkg(cfg.Packages)
+	}
+	return nil
+}
+
+// ensureFleetPassword generates a hostname-specific HTTP password for hostname
+// unless one exists, so that the devices of a fleet do not share a password.
+func ensureFleetPassword(hostname string) error {
+	const configBaseName = "http-password.txt"
+	dir := string(config.HostnameSpecific(hostname))
+	if _, err := os.Stat(filepath.Join(dir, configBaseName)); err == nil {
+		return nil
+	}
+	pw, err := randomPassword(20)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, configBaseName), []byte(pw), 0600)
+}
+
+// addFleetDeviceFiles adds /etc/gokrazy/serial for the device currently being
+// built from the -fleet_manifest.
+func addFleetDeviceFiles(etcGokrazy *fileInfo) error {
+	if fleetSerial == "" {
+		return nil
+	}
+	etcGokrazy.dirents = append(etcGokrazy.dirents, &fileInfo{
+		filename:    "serial",
+		fromLiteral: fleetSerial + "\n",
+	})
+	return nil
+}
+
+// buildFleet writes an image for each device of the -fleet_manifest. The
+// programs are built for the first device only, all other images share them.
+func buildFleet(ctx context.Context, cfg *Config) error {
+	devices, err := readFleetManifest(*fleetManifest, cfg.Image)
+	if err != nil {
+		return err
+	}
+	defaultIP, defaultSBOM := *staticIP, *sbomFile
+	defer func() {
+		*staticIP, *sbomFile = defaultIP, defaultSBOM
+		fleetSerial, fleetInstalled = "", false
+	}()
+	for idx, d := range devices {
+		log.Printf("building image %d of %d for %s (%s)", idx+1, len(devices), d.Hostname, d.Output)
+		dcfg := *cfg
+		dcfg.Hostname = d.Hostname
+		dcfg.Image = d.Output
+		*staticIP = defaultIP
+		if d.StaticIP != "" {
+			*staticIP = d.StaticIP
+		}
+		if defaultSBOM != "" {
+			*sbomFile = d.Output + ".sbom.json"
+		}
+		fleetSerial = d.Serial
+		if err := ensureFleetPassword(d.Hostname); err != nil {
+			return fmt.Errorf("%s: %v", d.Hostname, err)
+		}
+		if err := logic(ctx, &dcfg); err != nil {
+			return fmt.Errorf("%s: %v", d.Hostname, err)
+		}
+		fleetInstalled = true
+	}
+	return nil
+}
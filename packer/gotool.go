@@ -0,0 +1,318 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var jobs = flag.Int("jobs",
+	0,
+	"maximum number of packages to compile in parallel (passed to go install as -p), and of root file system blocks to compress in parallel. 0 uses the number of CPUs (GOMAXPROCS)")
+
+var env = goEnv(&Config{})
+
+func goEnv(cfg *Config) []string {
+	goarch := targetArchSetting(cfg)
+
+	goos := "linux" // Raspberry Pi 3
+	if e := os.Getenv("GOOS"); e != "" {
+		goos = e
+	}
+
+	env := os.Environ()
+	for idx, e := range env {
+		if strings.HasPrefix(e, "CGO_ENABLED=") {
+			env[idx] = "CGO_ENABLED=0"
+		}
+	}
+	env = append(env,
+		fmt.Sprintf("GOARCH=%s", goarch),
+		fmt.Sprintf("GOOS=%s", goos),
+		"CGO_ENABLED=0")
+	if goarch == "arm" && os.Getenv("GOARM") == "" {
+		// ARMv6, so that binaries also run on the Raspberry Pi 1 and Zero:
+		env = append(env, "GOARM=6")
+	}
+	return env
+}
+
+// buildPackages returns the Go packages which are built for an image of the
+// specified packages: the gokrazy packages, args, the -firstboot packages and
+// the init package.
+func buildPackages(args []string) []string {
+	pkgs := append(append(append([]string(nil), gokrazyPkgs...), args...), firstBootPkgs()...)
+	if *initPkg != "" {
+		pkgs = append(pkgs, *initPkg)
+	} else {
+		// The generated init imports the init runtime:
+		pkgs = append(pkgs, initRuntimePkg)
+	}
+	return pkgs
+}
+
+// resolvePackages runs “go get” for incomplete packages (most likely just not
+// present).
+func resolvePackages(ctx context.Context, pkgs []string) error {
+	cmd := exec.CommandContext(ctx, "go",
+		append([]string{"list", "-e", "-f", "{{ .ImportPath }} {{ if .Incomplete }}error{{ else }}ok{{ end }}"}, pkgs...)...)
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	var incomplete []string
+	const errorSuffix = " error"
+	for _, line := range strings.Split(string(output), "\n") {
+		if !strings.HasSuffix(line, errorSuffix) {
+			continue
+		}
+		incomplete = append(incomplete, strings.TrimSuffix(line, errorSuffix))
+	}
+
+	if len(incomplete) > 0 {
+		log.Printf("getting incomplete packages %v", incomplete)
+		cmd = exec.CommandContext(ctx, "go",
+			append([]string{"get"}, incomplete...)...)
+		cmd.Env = env
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func install(ctx context.Context, cfg *Config) error {
+	pkgs := buildPackages(cfg.Packages)
+
+	incompletePkgs := append(append(append(append([]string(nil), pkgs...), kernelPackages(cfg)...), firmwarePackages(cfg)...), ubootPackages()...)
+
+	stage := startStage("resolve packages (go list, go get)")
+	if err := resolvePackages(ctx, goPackages(incompletePkgs)); err != nil {
+		return err
+	}
+	stage.done()
+	if *dryRun {
+		return nil // the binaries are listed, not built
+	}
+
+	groups, err := groupByBuildFlags(ctx, pkgs)
+	if err != nil {
+		return err
+	}
+
+	installArgs := []string{"install", "-p", strconv.Itoa(buildJobs())}
+	if *profileBuild {
+		// Install the packages one at a time to attribute compile times to
+		// packages. Shared dependencies are attributed to the first package.
+		prog := newItemProgress("compiling", "packages", int64(len(pkgs)))
+		defer prog.finish()
+		for _, g := range groups {
+			for _, pkg := range g.pkgs {
+				stage := startStage("compile " + pkg)
+				cmd := exec.CommandContext(ctx, "go", append(append(installArgs, g.flags...), pkg)...)
+				cmd.Env = env
+				cmd.Stderr = os.Stderr
+				err := cmd.Run()
+				stage.done()
+				if err != nil {
+					return err
+				}
+				prog.add(1)
+			}
+		}
+		return nil
+	}
+
+	// A single go install (per set of build flags) compiles the packages (and
+	// their dependencies) in parallel, sharing the work for common
+	// dependencies:
+	stage = startStage("compile (all packages)")
+	defer stage.done()
+	// The total number of packages (including dependencies) which need to be
+	// compiled is unknown, so the progress only counts them:
+	prog := newItemProgress("compiling", "packages", -1)
+	defer prog.finish()
+	var errs []string
+	for _, g := range groups {
+		var stderr bytes.Buffer
+		args := append(append(append(installArgs, "-v"), g.flags...), g.pkgs...)
+		cmd := exec.CommandContext(ctx, "go", args...)
+		cmd.Env = env
+		cw := &compileProgressWriter{w: &stderr, p: prog}
+		cmd.Stderr = cw
+		err := cmd.Run()
+		stderr.Write(cw.partial)
+		if err != nil {
+			errs = append(errs, compileError(g.pkgs, stderr.String(), err).Error())
+			continue
+		}
+		os.Stderr.Write(stderr.Bytes())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// importPathRe matches the lines of go install -v, which prints the import path
+// of each package it compiles.
+var importPathRe = regexp.MustCompile(`^[A-Za-z0-9_.~+/-]+$`)
+
+// compileProgressWriter counts the packages which go install -v reports in
+// p and writes all other output to w.
+type compileProgressWriter struct {
+	w       io.Writer
+	p       *progress
+	partial []byte
+}
+
+func (cw *compileProgressWriter) Write(b []byte) (int, error) {
+	cw.partial = append(cw.partial, b...)
+	for {
+		idx := bytes.IndexByte(cw.partial, '\n')
+		if idx == -1 {
+			break
+		}
+		line := cw.partial[:idx+1]
+		cw.partial = cw.partial[idx+1:]
+		if importPathRe.Match(bytes.TrimSuffix(line, []byte("\n"))) {
+			cw.p.add(1)
+			continue
+		}
+		if _, err := cw.w.Write(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func buildJobs() int {
+	if *jobs > 0 {
+		return *jobs
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// compileError prints the go install output, in which the errors of packages
+// which were compiled in parallel appear in random order, sorted by package
+// (in the order of pkgs, dependencies last), and returns an error listing all
+// packages which failed to compile.
+func compileError(pkgs []string, output string, err error) error {
+	type block struct {
+		pkg   string
+		lines string
+	}
+	var preamble string
+	var blocks []block
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			blocks = append(blocks, block{pkg: strings.TrimSpace(line[2:])})
+		}
+		if len(blocks) == 0 {
+			preamble += line
+		} else {
+			blocks[len(blocks)-1].lines += line
+		}
+	}
+	if len(blocks) == 0 {
+		os.Stderr.WriteString(output)
+		return err
+	}
+	rank := func(pkg string) int {
+		for idx, p := range pkgs {
+			if p == pkg {
+				return idx
+			}
+		}
+		return len(pkgs)
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		ri, rj := rank(blocks[i].pkg), rank(blocks[j].pkg)
+		if ri != rj {
+			return ri < rj
+		}
+		return blocks[i].pkg < blocks[j].pkg
+	})
+	os.Stderr.WriteString(preamble)
+	failed := make([]string, len(blocks))
+	for idx, b := range blocks {
+		os.Stderr.WriteString(b.lines)
+		failed[idx] = b.pkg
+	}
+	return fmt.Errorf("compiling %d package(s) failed: %s", len(blocks), strings.Join(failed, ", "))
+}
+
+// buildBinary compiles the main package pkg for the target into dest, using
+// the build flags of its buildflags.txt file (if any).
+func buildBinary(ctx context.Context, pkg, dest string) error {
+	groups, err := groupByBuildFlags(ctx, []string{pkg})
+	if err != nil {
+		return err
+	}
+	if len(groups) != 1 {
+		return fmt.Errorf("%s matches packages with different build flags, expected one main package", pkg)
+	}
+	cmd := exec.CommandContext(ctx, "go", append(append([]string{"build"}, groups[0].flags...), "-o", dest, pkg)...)
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return checkBinary(dest, pkg)
+}
+
+// mainPackage is a Go package which compiles into a binary.
+type mainPackage struct {
+	ImportPath string
+	Target     string // path of the installed binary
+}
+
+func mainPackages(ctx context.Context, paths []string) ([]mainPackage, error) {
+	// Shell out to the go tool for path matching (handling “...”)
+	var buf bytes.Buffer
+	cmd := exec.CommandContext(ctx, "go", append([]string{"list", "-f", "{{ .Name }}\t{{ .ImportPath }}\t{{ .Target }}"}, paths...)...)
+	cmd.Env = env
+	cmd.Stdout = &buf
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	result := make([]mainPackage, 0, len(lines))
+	for _, line := range lines {
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) != 3 || parts[0] != "main" {
+			continue
+		}
+		result = append(result, mainPackage{
+			ImportPath: parts[1],
+			Target:     parts[2],
+		})
+	}
+	return result, nil
+}
+
+func packageDir(ctx context.Context, pkg string) (string, error) {
+	if isArtifactSource(pkg) {
+		return artifactDir(ctx, pkg)
+	}
+	b, err := exec.CommandContext(ctx, "go", "list", "-f", "{{ .Dir }}", pkg).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
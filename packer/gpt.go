@@ -0,0 +1,215 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// gptEntries is the number of partition entries in the GPT, i.e. the
+	// entries occupy 32 sectors.
+	gptEntries   = 128
+	gptEntrySize = 128
+
+	// gptSectors is the number of sectors occupied by a GPT (header and
+	// entries) at each end of the device.
+	gptSectors = 1 + gptEntries*gptEntrySize/512
+)
+
+const (
+	// guidEFISystem and guidLinuxFilesystem are GPT partition type GUIDs.
+	guidEFISystem       = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	guidLinuxFilesystem = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+)
+
+// gptPartUUIDPrefix is the prefix of the partition GUIDs derived from a
+// PARTUUID, see gptPartUUID.
+const gptPartUUIDPrefix = "60c24cc1-f3f9-427a-8199-"
+
+// gptPartUUID returns the GPT partition GUID corresponding to the MBR-style
+// PARTUUID=<partuuid>-<partition>, so that both can be converted into each
+// other. Partition 0 is used for the disk GUID.
+func gptPartUUID(partuuid uint32, partition int) string {
+	return fmt.Sprintf("%s%08x00%02x", gptPartUUIDPrefix, partuuid, partition)
+}
+
+// guidBytes returns the on-disk (mixed-endian) representation of guid.
+func guidBytes(guid string) ([16]byte, error) {
+	var b [16]byte
+	raw, err := hex.DecodeString(strings.ReplaceAll(guid, "-", ""))
+	if err != nil || len(raw) != 16 {
+		return b, fmt.Errorf("malformed GUID %q", guid)
+	}
+	// The first three fields are stored in little endian byte order.
+	for i, j := range []int{3, 2, 1, 0, 5, 4, 7, 6} {
+		b[i] = raw[j]
+	}
+	copy(b[8:], raw[8:])
+	return b, nil
+}
+
+// guidString is the inverse of guidBytes.
+func guidString(b []byte) string {
+	var raw [16]byte
+	for i, j := range []int{3, 2, 1, 0, 5, 4, 7, 6} {
+		raw[j] = b[i]
+	}
+	copy(raw[8:], b[8:16])
+	h := hex.EncodeToString(raw[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// gptPartition is an entry of a GUID partition table. The zero value is an
+// unused entry.
+type gptPartition struct {
+	TypeGUID string
+	GUID     string
+	FirstLBA uint64
+	LastLBA  uint64 // inclusive
+	Attrs    uint64
+	Name     string
+}
+
+// gptAttrLegacyBIOSBootable marks a partition as bootable for legacy BIOS
+// boot code (like the MBR boot flag).
+const gptAttrLegacyBIOSBootable = 1 << 2
+
+// protectiveMBR replaces the partition table in the MBR sector with a single
+// protective partition covering a device of sectors sectors, retaining the
+// boot code and disk signature.
+func protectiveMBR(sector []byte, sectors uint64) {
+	for i := 446; i < 510; i++ {
+		sector[i] = 0
+	}
+	protectiveSize := sectors - 1
+	if protectiveSize > 0xffffffff {
+		protectiveSize = 0xffffffff
+	}
+	copy(sector[446:], []byte{0x00, 0x00, 0x02, 0x00, 0xee, 0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(sector[446+8:], 1)
+	binary.LittleEndian.PutUint32(sector[446+12:], uint32(protectiveSize))
+	binary.LittleEndian.PutUint16(sector[510:], signature)
+}
+
+// gptTables returns the primary GPT (to be written at LBA 1) and the backup
+// GPT (to be written at LBA sectors-gptSectors) for a device of sectors
+// sectors.
+func gptTables(diskGUID string, parts []gptPartition, sectors uint64) (primary, backup []byte, err error) {
+	if len(parts) > gptEntries {
+		return nil, nil, fmt.Errorf("too many partitions: %d > %d", len(parts), gptEntries)
+	}
+	entries := make([]byte, gptEntries*gptEntrySize)
+	for i, p := range parts {
+		if p.TypeGUID == "" {
+			continue // unused entry
+		}
+		e := entries[i*gptEntrySize:]
+		typ, err := guidBytes(p.TypeGUID)
+		if err != nil {
+			return nil, nil, err
+		}
+		guid, err := guidBytes(p.GUID)
+		if err != nil {
+			return nil, nil, err
+		}
+		copy(e[0:], typ[:])
+		copy(e[16:], guid[:])
+		binary.LittleEndian.PutUint64(e[32:], p.FirstLBA)
+		binary.LittleEndian.PutUint64(e[40:], p.LastLBA)
+		binary.LittleEndian.PutUint64(e[48:], p.Attrs)
+		for j, r := range utf16.Encode([]rune(p.Name)) {
+			if j >= 36 {
+				break
+			}
+			binary.LittleEndian.PutUint16(e[56+2*j:], r)
+		}
+	}
+	disk, err := guidBytes(diskGUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := func(current, other, entriesLBA uint64) []byte {
+		h := make([]byte, 512)
+		copy(h[0:], "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000) // revision 1.0
+		binary.LittleEndian.PutUint32(h[12:], 92)        // header size
+		binary.LittleEndian.PutUint64(h[24:], current)
+		binary.LittleEndian.PutUint64(h[32:], other)
+		binary.LittleEndian.PutUint64(h[40:], 1+gptSectors)         // first usable LBA
+		binary.LittleEndian.PutUint64(h[48:], sectors-gptSectors-1) // last usable LBA
+		copy(h[56:], disk[:])
+		binary.LittleEndian.PutUint64(h[72:], entriesLBA)
+		binary.LittleEndian.PutUint32(h[80:], gptEntries)
+		binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+		binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+		return h
+	}
+	last := sectors - 1
+	primary = append(header(1, last, 2), entries...)
+	backup = append(append([]byte{}, entries...), header(last, 1, sectors-gptSectors)...)
+	return primary, backup, nil
+}
+
+// readGPT returns the partition entries of the primary GPT of r (up to the
+// last used entry, unused entries have an empty TypeGUID), and the disk GUID.
+func readGPT(r io.ReaderAt) (diskGUID string, parts []gptPartition, err error) {
+	h := make([]byte, 512)
+	if _, err := r.ReadAt(h, 512); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(h[:8], []byte("EFI PART")) {
+		return "", nil, fmt.Errorf("no GPT found")
+	}
+	crc := binary.LittleEndian.Uint32(h[16:])
+	binary.LittleEndian.PutUint32(h[16:], 0)
+	if crc32.ChecksumIEEE(h[:92]) != crc {
+		return "", nil, fmt.Errorf("GPT header checksum mismatch")
+	}
+	entriesLBA := int64(binary.LittleEndian.Uint64(h[72:]))
+	num := binary.LittleEndian.Uint32(h[80:])
+	size := binary.LittleEndian.Uint32(h[84:])
+	if size < 128 || num > 1024 {
+		return "", nil, fmt.Errorf("unsupported GPT (%d entries of %d bytes)", num, size)
+	}
+	entries := make([]byte, num*size)
+	if _, err := r.ReadAt(entries, entriesLBA*512); err != nil {
+		return "", nil, err
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(h[88:]) {
+		return "", nil, fmt.Errorf("GPT entries checksum mismatch")
+	}
+	for i := uint32(0); i < num; i++ {
+		e := entries[i*size:]
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			parts = append(parts, gptPartition{}) // unused entry
+			continue
+		}
+		name := make([]uint16, 0, 36)
+		for j := 0; j < 36; j++ {
+			c := binary.LittleEndian.Uint16(e[56+2*j:])
+			if c == 0 {
+				break
+			}
+			name = append(name, c)
+		}
+		parts = append(parts, gptPartition{
+			TypeGUID: guidString(e[0:16]),
+			GUID:     guidString(e[16:32]),
+			FirstLBA: binary.LittleEndian.Uint64(e[32:]),
+			LastLBA:  binary.LittleEndian.Uint64(e[40:]),
+			Attrs:    binary.LittleEndian.Uint64(e[48:]),
+			Name:     string(utf16.Decode(name)),
+		})
+	}
+	for len(parts) > 0 && parts[len(parts)-1].TypeGUID == "" {
+		parts = parts[:len(parts)-1]
+	}
+	return guidString(h[56:72]), parts, nil
+}
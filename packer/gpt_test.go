@@ -0,0 +1,191 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGPTRoundTrip(t *testing.T) {
+	const sectors = 2 * 1024 * 1024 // 1 GiB
+	diskGUID := gptPartUUID(0x2e18c40c, 0)
+	parts := []gptPartition{
+		{
+			TypeGUID: guidEFISystem,
+			GUID:     gptPartUUID(0x2e18c40c, 1),
+			FirstLBA: 8192,
+			LastLBA:  8192 + 204800 - 1,
+			Attrs:    gptAttrLegacyBIOSBootable,
+			Name:     "boot",
+		},
+		{}, // unused entry
+		{
+			TypeGUID: guidLinuxFilesystem,
+			GUID:     gptPartUUID(0x2e18c40c, 3),
+			FirstLBA: 8192 + 204800,
+			LastLBA:  sectors - gptSectors - 1,
+			Name:     "perm ✓ with a name longer than the 36 UTF-16 code units",
+		},
+	}
+	primary, backup, err := gptTables(diskGUID, parts, sectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(primary), gptSectors*512; got != want {
+		t.Fatalf("primary GPT: got %d bytes, want %d", got, want)
+	}
+	if got, want := len(backup), gptSectors*512; got != want {
+		t.Fatalf("backup GPT: got %d bytes, want %d", got, want)
+	}
+
+	img := make([]byte, (1+gptSectors)*512)
+	copy(img[512:], primary)
+	gotGUID, gotParts, err := readGPT(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotGUID != diskGUID {
+		t.Errorf("disk GUID: got %s, want %s", gotGUID, diskGUID)
+	}
+	want := append([]gptPartition(nil), parts...)
+	want[2].Name = string([]rune(want[2].Name)[:36])
+	if !reflect.DeepEqual(gotParts, want) {
+		t.Errorf("partitions: got %+v, want %+v", gotParts, want)
+	}
+
+	// The backup header refers to the primary header and to its own entries,
+	// which precede it:
+	h := backup[len(backup)-512:]
+	if got, want := binary.LittleEndian.Uint64(h[24:]), uint64(sectors-1); got != want {
+		t.Errorf("backup header LBA: got %d, want %d", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint64(h[32:]), uint64(1); got != want {
+		t.Errorf("backup header: other header LBA: got %d, want %d", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint64(h[72:]), uint64(sectors-gptSectors); got != want {
+		t.Errorf("backup header: entries LBA: got %d, want %d", got, want)
+	}
+	if !bytes.Equal(backup[:len(backup)-512], primary[512:]) {
+		t.Errorf("backup entries differ from primary entries")
+	}
+	hdr := append([]byte(nil), h[:92]...)
+	binary.LittleEndian.PutUint32(hdr[16:], 0)
+	if got, want := crc32.ChecksumIEEE(hdr), binary.LittleEndian.Uint32(h[16:]); got != want {
+		t.Errorf("backup header checksum: got %x, want %x", got, want)
+	}
+}
+
+func TestGPTChecksum(t *testing.T) {
+	primary, _, err := gptTables(gptPartUUID(1, 0), []gptPartition{
+		{TypeGUID: guidLinuxFilesystem, GUID: gptPartUUID(1, 1), FirstLBA: 2048, LastLBA: 4095},
+	}, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := make([]byte, (1+gptSectors)*512)
+	copy(img[512:], primary)
+	img[2*512+32] ^= 1 // first LBA of the first entry
+	if _, _, err := readGPT(bytes.NewReader(img)); err == nil {
+		t.Fatalf("readGPT unexpectedly succeeded on corrupted entries")
+	}
+}
+
+func TestGPTPartUUID(t *testing.T) {
+	for _, partition := range []int{0, 1, 4} {
+		guid := gptPartUUID(0x2e18c40c, partition)
+		b, err := guidBytes(guid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := guidString(b[:]); got != guid {
+			t.Errorf("guidString(guidBytes(%q)) = %q", guid, got)
+		}
+	}
+}
+
+func TestWriteGPTPartitionTable(t *testing.T) {
+	defer func(perm string) { *permMode = perm }(*permMode)
+	*permMode = "dev"
+	defer func(l partitionLayout) { layout = l }(layout)
+	var err error
+	if layout, err = parsePartitionLayout(); err != nil {
+		t.Fatal(err)
+	}
+
+	const sectors = 4 * 1024 * 1024 // 2 GiB
+	img := make([]byte, sectors*512)
+	if err := writeGPTPartitionTable(&byteWriterAt{img}, sectors*512, 0x2e18c40c); err != nil {
+		t.Fatal(err)
+	}
+
+	// The protective MBR covers the whole device and keeps the disk
+	// signature, which the MBR-style PARTUUID= refers to:
+	mbr := img[:512]
+	if got, want := binary.LittleEndian.Uint32(mbr[440:]), uint32(0x2e18c40c); got != want {
+		t.Errorf("disk signature: got %#x, want %#x", got, want)
+	}
+	if got, want := mbr[446+4], byte(0xee); got != want {
+		t.Errorf("protective partition type: got %#x, want %#x", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint32(mbr[446+12:]), uint32(sectors-1); got != want {
+		t.Errorf("protective partition size: got %d, want %d", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint16(mbr[510:]), signature; got != want {
+		t.Errorf("MBR signature: got %#x, want %#x", got, want)
+	}
+
+	diskGUID, parts, err := readGPT(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := diskGUID, gptPartUUID(0x2e18c40c, 0); got != want {
+		t.Errorf("disk GUID: got %s, want %s", got, want)
+	}
+	if got, want := len(parts), 4; got != want {
+		t.Fatalf("got %d partitions, want %d", got, want)
+	}
+	for i, p := range parts {
+		if got, want := p.GUID, gptPartUUID(0x2e18c40c, i+1); got != want {
+			t.Errorf("partition %d: GUID: got %s, want %s", i+1, got, want)
+		}
+		if got, want := p.Name, gptPartitionNames[i]; got != want {
+			t.Errorf("partition %d: name: got %q, want %q", i+1, got, want)
+		}
+	}
+	if got, want := parts[0].FirstLBA, uint64(8192); got != want {
+		t.Errorf("boot partition: first LBA: got %d, want %d", got, want)
+	}
+	for i, p := range parts[1:] {
+		if p.FirstLBA != parts[i].LastLBA+1 {
+			t.Errorf("partition %d: first LBA %d does not follow partition %d (last LBA %d)", i+2, p.FirstLBA, i+1, parts[i].LastLBA)
+		}
+	}
+	if got, want := parts[1].FirstLBA-parts[0].FirstLBA, uint64(100*MB/512); got != want {
+		t.Errorf("boot partition: got %d sectors, want %d (-boot_size default)", got, want)
+	}
+	if got, want := parts[3].LastLBA, uint64(sectors-gptSectors-1); got != want {
+		t.Errorf("perm partition: last LBA: got %d, want %d", got, want)
+	}
+	if !bytes.Equal(img[(sectors-1)*512:(sectors-1)*512+8], []byte("EFI PART")) {
+		t.Errorf("no backup GPT header in the last sector")
+	}
+
+	defer func(table string) { *partitionTable = table }(*partitionTable)
+	*partitionTable = "gpt"
+	if err := writePartitionTable(&byteWriterAt{img}, 1024*1024*1024, 0); err == nil {
+		t.Errorf("writePartitionTable unexpectedly succeeded on a 1 GiB device")
+	}
+}
+
+// byteWriterAt implements io.WriterAt for a byte slice of fixed size.
+type byteWriterAt struct{ b []byte }
+
+func (w *byteWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(w.b)) {
+		return 0, os.ErrInvalid
+	}
+	return copy(w.b[off:], p), nil
+}
@@ -0,0 +1,116 @@
+package packer
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+)
+
+var (
+	hookPrePack = flag.String("hook_pre_pack",
+		"",
+		"shell command to run after building the programs and before writing the file systems. Files which the command places in $GOKRAZY_STAGING_DIR are added to the root file system (e.g. generated assets). See the README for all environment variables")
+
+	hookPostPack = flag.String("hook_post_pack",
+		"",
+		"shell command to run after writing the outputs (and before -update installs them), e.g. for vendor flashing or signing tools. The outputs are passed in $GOKRAZY_IMAGE, $GOKRAZY_BOOT, $GOKRAZY_ROOT, $GOKRAZY_MBR and $GOKRAZY_DEVICE. A failing command fails the build")
+)
+
+// hookEnv returns the environment variables describing the build, which are
+// passed to hook commands in addition to the gokr-packer environment.
+func hookEnv(cfg *Config) []string {
+	env := []string{
+		"GOKRAZY_HOSTNAME=" + cfg.Hostname,
+		"GOKRAZY_BUILD_TIMESTAMP=" + buildTimestamp,
+		"GOKRAZY_TARGET_ARCH=" + targetGOARCH(),
+		"GOKRAZY_BOARD=" + cfg.Board,
+	}
+	return append(os.Environ(), env...)
+}
+
+// runHookCommand runs the -hook_pre_pack or -hook_post_pack command with the
+// build environment plus env.
+func runHookCommand(ctx context.Context, cfg *Config, name, command string, env ...string) error {
+	log.Printf("running -%s: %s", name, command)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(hookEnv(cfg), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("-%s: %v", name, err)
+	}
+	return nil
+}
+
+// runPrePackHooks runs -hook_pre_pack and the PrePack method of cfg.Hooks with a staging directory, whose contents are then added to root. The
+// returned function removes the staging directory once the root file system
+// was written.
+func runPrePackHooks(ctx context.Context, cfg *Config, root *fileInfo) (cleanup func(), _ error) {
+	cleanup = func() {}
+	if *hookPrePack == "" && len(cfg.Hooks) == 0 {
+		return cleanup, nil
+	}
+	stage := startStage("pre-pack hooks")
+	defer stage.done()
+	staging, err := ioutil.TempDir("", "gokr-packer-staging")
+	if err != nil {
+		return cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(staging) }
+	if *hookPrePack != "" {
+		if err := runHookCommand(ctx, cfg, "hook_pre_pack", *hookPrePack, "GOKRAZY_STAGING_DIR="+staging); err != nil {
+			return cleanup, err
+		}
+	}
+	for _, h := range cfg.Hooks {
+		if err := h.PrePack(ctx, staging); err != nil {
+			return cleanup, fmt.Errorf("pre-pack hook: %v", err)
+		}
+	}
+	if err := addHostDir(root, "", staging, newHostCopy(false)); err != nil {
+		return cleanup, fmt.Errorf("pre-pack hook: %v", err)
+	}
+	return cleanup, nil
+}
+
+// runPostPackHooks runs -hook_post_pack and the PostPack method of cfg.Hooks.
+func runPostPackHooks(ctx context.Context, cfg *Config) error {
+	if *hookPostPack == "" && len(cfg.Hooks) == 0 {
+		return nil
+	}
+	stage := startStage("post-pack hooks")
+	defer stage.done()
+	artifacts := currentArtifacts(cfg)
+	if *hookPostPack != "" {
+		device := overwriteBlockDevices.String()
+		if st, err := os.Stat(cfg.Image); device == "" && cfg.Image != "-" && err == nil && st.Mode()&os.ModeDevice != 0 {
+			device = cfg.Image
+		}
+		image := artifacts.Image
+		if image == device || image == "-" {
+			image = ""
+		}
+		err := runHookCommand(ctx, cfg, "hook_post_pack", *hookPostPack,
+			"GOKRAZY_IMAGE="+image,
+			"GOKRAZY_BOOT="+artifacts.Boot,
+			"GOKRAZY_ROOT="+artifacts.Root,
+			"GOKRAZY_MBR="+artifacts.MBR,
+			"GOKRAZY_DEVICE="+device,
+			"GOKRAZY_QCOW2="+artifacts.QCOW2,
+			"GOKRAZY_COMPRESSED="+artifacts.Compressed,
+			"GOKRAZY_SBOM="+artifacts.SBOM)
+		if err != nil {
+			return err
+		}
+	}
+	for _, h := range cfg.Hooks {
+		if err := h.PostPack(ctx, artifacts); err != nil {
+			return fmt.Errorf("post-pack hook: %v", err)
+		}
+	}
+	return nil
+}
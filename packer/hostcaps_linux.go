@@ -0,0 +1,21 @@
+package packer
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// hostCapabilities returns the security.capability xattr of the host file
+// path, or nil if it has none.
+func hostCapabilities(path string) ([]byte, error) {
+	b := make([]byte, 64)
+	n, err := unix.Lgetxattr(path, "security.capability", b)
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading capabilities: %v", path, err)
+	}
+	return b[:n], nil
+}
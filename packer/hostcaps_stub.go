@@ -0,0 +1,8 @@
+// +build !linux
+
+package packer
+
+// hostCapabilities returns nil, as file capabilities are specific to Linux.
+func hostCapabilities(path string) ([]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,237 @@
+package packer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var initramfs = flag.String("initramfs",
+	"",
+	"host directory to pack into an initramfs (a gzip-compressed cpio archive, written to /initrd.gz of the boot partition and referenced by config.txt or the boot loader configuration of -boot_mode). The kernel (built with CONFIG_BLK_DEV_INITRD and CONFIG_RD_GZIP) runs its /init before mounting the root file system, e.g. for unlocking an encrypted or mounting a network root file system; /init must then mount the root file system and execute /gokrazy/init from it (see switch_root(8)). Files are owned by root; symbolic links, hard links, device nodes and FIFOs are retained")
+
+// initrdPath is the path of the -initramfs in the boot file system. Its name
+// fits into 8.3, like all files which boot loaders read.
+const initrdPath = "/initrd.gz"
+
+// checkInitramfs verifies that the boot mode can load an -initramfs.
+func checkInitramfs() error {
+	if *initramfs == "" {
+		return nil
+	}
+	if st, err := os.Stat(*initramfs); err != nil {
+		return fmt.Errorf("-initramfs: %v", err)
+	} else if !st.IsDir() {
+		return fmt.Errorf("-initramfs: %s is not a directory", *initramfs)
+	}
+	if goarch := targetGOARCH(); *bootMode == "firmware" && goarch != "arm" && goarch != "arm64" {
+		return fmt.Errorf("-initramfs: the MBR boot code cannot load an initramfs, use -boot_mode=uefi")
+	}
+	return nil
+}
+
+// initramfsConfig returns the config.txt line which makes the Raspberry Pi
+// firmware load the -initramfs after the kernel, if any.
+func initramfsConfig() string {
+	if *initramfs == "" {
+		return ""
+	}
+	return "initramfs " + strings.TrimPrefix(initrdPath, "/") + " followkernel\n"
+}
+
+// writeInitramfs packs the -initramfs host directory into dest (initrdPath,
+// or its copy for a fallback kernel) of the boot file system fw.
+func writeInitramfs(fw bootFSWriter, dest string) error {
+	root := &fileInfo{}
+	if err := addHostDir(root, "", *initramfs, newHostCopy(false)); err != nil {
+		return fmt.Errorf("-initramfs: %v", err)
+	}
+	w, err := fw.File(dest, imageTime())
+	if err != nil {
+		return err
+	}
+	// Without a name and modification time in the gzip header, the
+	// initramfs only depends on its contents:
+	zw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	cw := &cpioWriter{w: bufio.NewWriter(zw), links: make(map[string]cpioHeader), nlinks: make(map[string]uint32)}
+	countHardlinks(root, cw.nlinks)
+	if err := cw.dir(root, ""); err != nil {
+		return fmt.Errorf("-initramfs: %v", err)
+	}
+	if err := cw.trailer(); err != nil {
+		return err
+	}
+	if err := cw.w.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// countHardlinks counts the links of the hard linked files in dir
+// (recursively), keyed by the path of their target.
+func countHardlinks(dir *fileInfo, nlinks map[string]uint32) {
+	for _, ent := range dir.dirents {
+		if ent.hardlinkTarget != "" {
+			if nlinks[ent.hardlinkTarget] == 0 {
+				nlinks[ent.hardlinkTarget] = 1
+			}
+			nlinks[ent.hardlinkTarget]++
+		}
+		countHardlinks(ent, nlinks)
+	}
+}
+
+// cpioWriter writes a cpio archive in the “new” (SVR4, newc) format, which is
+// the format the kernel unpacks initramfs archives in.
+type cpioWriter struct {
+	w   *bufio.Writer
+	ino uint32
+
+	// links maps the paths of hard linked files to their header, nlinks to
+	// their number of links.
+	links  map[string]cpioHeader
+	nlinks map[string]uint32
+}
+
+// cpio mode bits, see <linux/stat.h>.
+const (
+	cpioFifo    = 0010000
+	cpioCharDev = 0020000
+	cpioDir     = 0040000
+	cpioBlkDev  = 0060000
+	cpioFile    = 0100000
+	cpioSymlink = 0120000
+)
+
+type cpioHeader struct {
+	ino, mode, uid, gid, nlink uint32
+	size                       int64
+	rdevMajor, rdevMinor       uint32
+}
+
+func (cw *cpioWriter) header(name string, hdr cpioHeader) error {
+	if hdr.size > 0xffffffff {
+		return fmt.Errorf("%s: too large for cpio (%d bytes)", name, hdr.size)
+	}
+	fmt.Fprintf(cw.w, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		hdr.ino,
+		hdr.mode,
+		hdr.uid,
+		hdr.gid,
+		hdr.nlink,
+		uint32(imageTime().Unix()),
+		uint32(hdr.size),
+		0, 0, // device of the file system
+		hdr.rdevMajor,
+		hdr.rdevMinor,
+		len(name)+1,
+		0) // checksum (only used by the 070702 format)
+	cw.w.WriteString(name)
+	cw.w.WriteByte(0)
+	// The 110 bytes header and the name are padded to a multiple of 4 bytes:
+	return cw.pad(110 + int64(len(name)) + 1)
+}
+
+func (cw *cpioWriter) pad(n int64) error {
+	_, err := cw.w.Write(make([]byte, (4-n%4)%4))
+	return err
+}
+
+func (cw *cpioWriter) dir(dir *fileInfo, prefix string) error {
+	for _, ent := range dir.dirents {
+		path := prefix + "/" + ent.filename
+		name := path[1:] // relative to the root of the initramfs
+		cw.ino++
+		hdr := cpioHeader{ino: cw.ino, uid: ent.uid, gid: ent.gid, nlink: 1}
+		switch {
+		case ent.isDir():
+			hdr.mode = cpioDir | 0755
+			hdr.nlink = 2
+			if err := cw.header(name, hdr); err != nil {
+				return err
+			}
+			if err := cw.dir(ent, path); err != nil {
+				return err
+			}
+
+		case ent.symlinkDest != "":
+			hdr.mode = cpioSymlink | 0777
+			hdr.size = int64(len(ent.symlinkDest))
+			if err := cw.header(name, hdr); err != nil {
+				return err
+			}
+			cw.w.WriteString(ent.symlinkDest)
+			if err := cw.pad(hdr.size); err != nil {
+				return err
+			}
+
+		case ent.device != nil:
+			hdr.mode = uint32(ent.device.mode)
+			switch ent.device.typ {
+			case 'c':
+				hdr.mode |= cpioCharDev
+			case 'b':
+				hdr.mode |= cpioBlkDev
+			case 'p':
+				hdr.mode |= cpioFifo
+			}
+			hdr.rdevMajor, hdr.rdevMinor = ent.device.major, ent.device.minor
+			if err := cw.header(name, hdr); err != nil {
+				return err
+			}
+
+		case ent.hardlinkTarget != "":
+			// All links share the inode number of their target, whose entry
+			// carries the contents; the kernel links the later entries to it.
+			cw.ino--
+			hdr = cw.links[ent.hardlinkTarget]
+			hdr.size = 0
+			if err := cw.header(name, hdr); err != nil {
+				return err
+			}
+
+		default:
+			st, err := os.Stat(ent.fromHost)
+			if err != nil {
+				return err
+			}
+			hdr.mode = cpioFile | uint32(st.Mode().Perm())
+			hdr.size = st.Size()
+			if n := cw.nlinks[path]; n > 0 {
+				hdr.nlink = n
+				cw.links[path] = hdr
+			}
+			if err := cw.header(name, hdr); err != nil {
+				return err
+			}
+			f, err := os.Open(ent.fromHost)
+			if err != nil {
+				return err
+			}
+			n, err := io.Copy(cw.w, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			if n != hdr.size {
+				return fmt.Errorf("%s: changed size while packing (%d instead of %d bytes)", ent.fromHost, n, hdr.size)
+			}
+			if err := cw.pad(hdr.size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// trailer terminates the archive.
+func (cw *cpioWriter) trailer() error {
+	return cw.header("TRAILER!!!", cpioHeader{nlink: 1})
+}
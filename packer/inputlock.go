@@ -0,0 +1,183 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	verifyInputs = flag.String("verify_inputs",
+		"",
+		"if non-empty, a lockfile (e.g. gokrazy-inputs.lock) with the SHA-256 hashes of all files of the -kernel_package, -firmware_package and -uboot_package packages. The build fails if any file (e.g. vmlinuz or a bootloader blob) was added, removed or changed compared to the lockfile, see -update_inputs_lock")
+
+	updateInputsLock = flag.Bool("update_inputs_lock",
+		false,
+		"with -verify_inputs, (re-)write the lockfile with the hashes of the current kernel, firmware and u-boot package files instead of verifying them")
+)
+
+// inputLockHeader starts each -verify_inputs lockfile.
+const inputLockHeader = "# gokr-packer input lockfile, see -verify_inputs and -update_inputs_lock\n"
+
+// inputLockEntry is the hash of a file of a kernel, firmware or u-boot package.
+type inputLockEntry struct {
+	pkg, file string
+}
+
+func (e inputLockEntry) String() string {
+	return e.pkg + " " + e.file
+}
+
+// inputLockPackages returns the packages whose files are verified by
+// -verify_inputs.
+func inputLockPackages(cfg *Config) []string {
+	var pkgs []string
+	for _, pkg := range append(append(kernelPackages(cfg), firmwarePackages(cfg)...), ubootPackages()...) {
+		if !containsString(pkgs, pkg) {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// currentInputHashes returns the SHA-256 hashes of all regular files
+// (recursively) of the directories of pkgs.
+func currentInputHashes(ctx context.Context, pkgs []string) (map[inputLockEntry]string, error) {
+	hashes := make(map[inputLockEntry]string)
+	for _, pkg := range pkgs {
+		dir, err := packageDir(ctx, pkg)
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			sum, err := fileSHA256(path)
+			if err != nil {
+				return err
+			}
+			hashes[inputLockEntry{pkg, filepath.ToSlash(rel)}] = sum
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// readInputLock parses the -verify_inputs lockfile fn, which contains one
+// “<package> <file> sha256:<hex>” line per file.
+func readInputLock(fn string) (map[inputLockEntry]string, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[inputLockEntry]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], "sha256:") {
+			return nil, fmt.Errorf("%s:%d: expected <package> <file> sha256:<hex>, got %q", fn, lineno, line)
+		}
+		hashes[inputLockEntry{fields[0], fields[1]}] = strings.TrimPrefix(fields[2], "sha256:")
+	}
+	return hashes, scanner.Err()
+}
+
+// writeInputLock writes hashes to the -verify_inputs lockfile fn.
+func writeInputLock(fn string, hashes map[inputLockEntry]string) error {
+	entries := make([]inputLockEntry, 0, len(hashes))
+	for e := range hashes {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].pkg != entries[j].pkg {
+			return entries[i].pkg < entries[j].pkg
+		}
+		return entries[i].file < entries[j].file
+	})
+	var buf bytes.Buffer
+	buf.WriteString(inputLockHeader)
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%s sha256:%s\n", e, hashes[e])
+	}
+	return ioutil.WriteFile(fn, buf.Bytes(), 0644)
+}
+
+// checkInputLock verifies the kernel, firmware and u-boot packages against the
+// -verify_inputs lockfile, or updates the lockfile with -update_inputs_lock.
+func checkInputLock(ctx context.Context, cfg *Config) error {
+	if *verifyInputs == "" {
+		if *updateInputsLock {
+			return fmt.Errorf("-update_inputs_lock requires -verify_inputs")
+		}
+		return nil
+	}
+	stage := startStage("verify inputs")
+	defer stage.done()
+	pkgs := inputLockPackages(cfg)
+	current, err := currentInputHashes(ctx, pkgs)
+	if err != nil {
+		return err
+	}
+	if *updateInputsLock {
+		log.Printf("writing the hashes of %d files of %s to %s", len(current), strings.Join(pkgs, ", "), *verifyInputs)
+		return writeInputLock(*verifyInputs, current)
+	}
+	locked, err := readInputLock(*verifyInputs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("-verify_inputs: %v (create it with -update_inputs_lock)", err)
+		}
+		return err
+	}
+
+	var problems []string
+	for e, sum := range current {
+		lockedSum, ok := locked[e]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: not in the lockfile", e))
+		case lockedSum != sum:
+			problems = append(problems, fmt.Sprintf("%s: SHA-256 %s, the lockfile has %s", e, sum, lockedSum))
+		}
+	}
+	for e := range locked {
+		if !containsString(pkgs, e.pkg) {
+			continue // e.g. a -uboot_package of a different -board
+		}
+		if _, ok := current[e]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: file removed", e))
+		}
+	}
+	if len(problems) == 0 {
+		log.Printf("verified %d kernel/firmware files against %s", len(current), *verifyInputs)
+		return nil
+	}
+	sort.Strings(problems)
+	for _, p := range problems {
+		log.Printf("-verify_inputs: %s", p)
+	}
+	return fmt.Errorf("-verify_inputs: %d file(s) of %s differ from the lockfile (if the changes are expected, run with -update_inputs_lock)", len(problems), strings.Join(pkgs, ", "))
+}
@@ -0,0 +1,200 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// inspectMain prints the partition table, the contents of the boot and root
+// file systems and the kernel command line and config.txt of an existing
+// gokrazy image (or device), without modifying or mounting it.
+func inspectMain(args []string) error {
+	fset := flag.NewFlagSet("inspect", flag.ExitOnError)
+	list := fset.Bool("list",
+		true,
+		"list the files of the boot and root file systems (with sizes and modification times)")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer inspect [-flags] <image>\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	image := parseSingleArg(fset, args)
+
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return inspect(os.Stdout, f, image, *list)
+}
+
+// fsType returns the type of the file system in part (e.g. squashfs), based on
+// its magic numbers.
+func fsType(r io.ReaderAt, part imagePartition) string {
+	if part.size == 0 {
+		return ""
+	}
+	b := make([]byte, 2048)
+	if _, err := r.ReadAt(b, part.start); err != nil && err != io.EOF {
+		return "unreadable"
+	}
+	switch {
+	case binary.LittleEndian.Uint32(b) == squashfsMagic:
+		return "squashfs"
+	case binary.LittleEndian.Uint16(b[1024+56:]) == 0xEF53:
+		return "ext4"
+	case binary.LittleEndian.Uint32(b[1024:]) == 0xF2F52010:
+		return "f2fs"
+	case isLUKS(b):
+		return "LUKS2"
+	}
+	if v, err := readFATVolume(io.NewSectionReader(r, part.start, part.size), 0); err == nil {
+		if v.fat32 {
+			return "FAT32"
+		}
+		return "FAT16"
+	}
+	if bytes.Equal(b, make([]byte, len(b))) {
+		return "empty"
+	}
+	return "unknown"
+}
+
+func inspect(w io.Writer, r io.ReaderAt, name string, list bool) error {
+	sector := make([]byte, 512)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		return err
+	}
+	mbrParts, err := readPartitionTable(sector)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	parts, err := imagePartitions(r)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	var gptParts []gptPartition
+	if mbrParts[0].Type == 0xee {
+		var diskGUID string
+		if diskGUID, gptParts, err = readGPT(r); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fmt.Fprintf(w, "%s: GPT partition table, disk GUID %s\n", name, diskGUID)
+	} else {
+		fmt.Fprintf(w, "%s: MBR partition table, disk identifier %08x\n", name, binary.LittleEndian.Uint32(sector[440:]))
+	}
+	if len(parts) < 3 || parts[0].size == 0 {
+		return fmt.Errorf("%s: no gokrazy partition layout found", name)
+	}
+
+	boot := io.NewSectionReader(r, parts[0].start, parts[0].size)
+	cmdline, cmdlineErr := readBootFile(boot, "cmdline.txt")
+	active := 0
+	if cmdlineErr == nil {
+		active, _ = activeRootPartition(string(cmdline), parts)
+	}
+
+	for i, p := range parts {
+		if p.size == 0 {
+			continue
+		}
+		var typ string
+		if gptParts != nil {
+			typ = "type " + gptParts[i].TypeGUID
+			if gptParts[i].Name != "" {
+				typ += fmt.Sprintf(" (%q)", gptParts[i].Name)
+			}
+		} else {
+			typ = fmt.Sprintf("type 0x%02x", mbrParts[i].Type)
+		}
+		fmt.Fprintf(w, "partition %d: start sector %d, %d sectors (%s), %s, %s", i+1, p.start/512, p.size/512, formatBytes(p.size), typ, fsType(r, p))
+		if i+1 == active {
+			fmt.Fprintf(w, ", active root")
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	v, err := readFATVolume(boot, 0)
+	if err != nil {
+		return fmt.Errorf("boot file system: %v", err)
+	}
+	if list {
+		fmt.Fprintf(w, "\nboot file system (partition 1):\n")
+		if err := v.walk(func(path string, f fatFile) error {
+			fmt.Fprintf(w, "%12d  %s  %s\n", f.size, f.modTime.Format(time.RFC3339), path)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("boot file system: %v", err)
+		}
+	}
+	if cmdlineErr != nil {
+		fmt.Fprintf(w, "\ncmdline.txt: %v\n", cmdlineErr)
+	} else {
+		fmt.Fprintf(w, "\ncmdline.txt:\n%s\n", strings.TrimRight(string(cmdline), "\n"))
+	}
+	if config, err := readBootFile(boot, "config.txt"); err == nil {
+		fmt.Fprintf(w, "\nconfig.txt:\n%s\n", strings.TrimRight(string(config), "\n"))
+	}
+
+	if !list {
+		return nil
+	}
+	for _, n := range []int{2, 3} {
+		if n > len(parts) || fsType(r, parts[n-1]) != "squashfs" {
+			continue
+		}
+		slot := "inactive"
+		if n == active {
+			slot = "active"
+		}
+		fmt.Fprintf(w, "\nroot file system (partition %d, %s):\n", n, slot)
+		sr, err := newSquashfsReader(io.NewSectionReader(r, parts[n-1].start, parts[n-1].size))
+		if err != nil {
+			return fmt.Errorf("partition %d: %v", n, err)
+		}
+		root, err := sr.root()
+		if err != nil {
+			return fmt.Errorf("partition %d: %v", n, err)
+		}
+		printSquashfsDir(w, root, "")
+	}
+	return nil
+}
+
+func printSquashfsDir(w io.Writer, dir *squashfsFile, prefix string) {
+	entries := append([]*squashfsFile(nil), dir.entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	for _, f := range entries {
+		path := prefix + "/" + f.name
+		modTime := f.modTime.UTC().Format(time.RFC3339)
+		attrs := formatFileAttrs(f.uid, f.gid, f.xattrs)
+		switch {
+		case f.dir:
+			fmt.Fprintf(w, "%s %12s  %s  %s/%s\n", f.mode|os.ModeDir, "-", modTime, path, attrs)
+			printSquashfsDir(w, f, path)
+		case f.symlinkDest != "":
+			fmt.Fprintf(w, "%s %12s  %s  %s -> %s%s\n", f.mode|os.ModeSymlink, "-", modTime, path, f.symlinkDest, attrs)
+		case f.device != nil:
+			mode := f.mode | os.ModeNamedPipe
+			number := "-"
+			if f.device.typ != 'p' {
+				mode = f.mode | os.ModeDevice
+				if f.device.typ == 'c' {
+					mode = f.mode | os.ModeCharDevice
+				}
+				number = fmt.Sprintf("%d, %d", f.device.major, f.device.minor)
+			}
+			fmt.Fprintf(w, "%s %12s  %s  %s%s\n", mode, number, modTime, path, attrs)
+		default:
+			fmt.Fprintf(w, "%s %12d  %s  %s%s\n", f.mode, f.size, modTime, path, attrs)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+var (
+	kernelFlavors = flag.String("kernel_flavors",
+		"",
+		"comma-separated list of name=package kernel flavors to select from using -kernel, e.g. stable=github.com/gokrazy/kernel,rt=example.com/kernel-rt. Typically saved in a profile (see -save_profile)")
+
+	kernelFlavor = flag.String("kernel",
+		"",
+		"name of the -kernel_flavors kernel package to use, e.g. rt. Takes precedence over -kernel_package")
+)
+
+// parseKernelFlavors parses the -kernel_flavors name=package pairs.
+func parseKernelFlavors(flavors string) (map[string]string, error) {
+	m := make(map[string]string)
+	if flavors == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(flavors, ",") {
+		idx := strings.IndexByte(pair, '=')
+		if idx == -1 {
+			return nil, fmt.Errorf("-kernel_flavors: %q is not of the form name=package", pair)
+		}
+		name, pkg := strings.TrimSpace(pair[:idx]), strings.TrimSpace(pair[idx+1:])
+		if name == "" || pkg == "" {
+			return nil, fmt.Errorf("-kernel_flavors: %q is not of the form name=package", pair)
+		}
+		if _, ok := m[name]; ok {
+			return nil, fmt.Errorf("-kernel_flavors: duplicate flavor %q", name)
+		}
+		m[name] = pkg
+	}
+	return m, nil
+}
+
+// selectKernelFlavor sets the default kernel of cfg.KernelPackage to the
+// package of the -kernel flavor, if any.
+func selectKernelFlavor(cfg *Config) error {
+	flavors, err := parseKernelFlavors(*kernelFlavors)
+	if err != nil {
+		return err
+	}
+	if *kernelFlavor == "" {
+		return nil
+	}
+	pkg, ok := flavors[*kernelFlavor]
+	if !ok {
+		names := make([]string, 0, len(flavors))
+		for name := range flavors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return fmt.Errorf("-kernel=%s: no -kernel_flavors specified", *kernelFlavor)
+		}
+		return fmt.Errorf("-kernel=%s is not one of the -kernel_flavors: %s", *kernelFlavor, strings.Join(names, ", "))
+	}
+	log.Printf("using kernel flavor %s (%s)", *kernelFlavor, pkg)
+	setDefaultKernelPackage(cfg, pkg)
+	return nil
+}
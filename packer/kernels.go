@@ -0,0 +1,183 @@
+package packer
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// kernelPackageList is the value of the repeatable -kernel_package flag: the
+// first package contains the kernel which is booted by default, the others
+// fallback kernels.
+type kernelPackageList struct {
+	primary   string
+	fallbacks []string
+
+	// set is true once the flag replaced the default package.
+	set bool
+}
+
+func (l *kernelPackageList) String() string {
+	return strings.Join(append([]string{l.primary}, l.fallbacks...), ",")
+}
+
+func (l *kernelPackageList) Set(value string) error {
+	if !l.set {
+		l.primary, l.fallbacks = "", nil
+		l.set = true
+	}
+	for _, pkg := range strings.Split(value, ",") {
+		pkg = strings.TrimSpace(pkg)
+		if pkg == "" || pkg == l.primary || containsString(l.fallbacks, pkg) {
+			continue
+		}
+		if l.primary == "" {
+			l.primary = pkg
+		} else {
+			l.fallbacks = append(l.fallbacks, pkg)
+		}
+	}
+	return nil
+}
+
+var kernelPackageFlag = kernelPackageList{primary: "github.com/gokrazy/kernel"}
+
+func init() {
+	flag.Var(&kernelPackageFlag, "kernel_package",
+		"Go package to copy vmlinuz and *.dtb from for constructing the firmware file system. Can be specified multiple times (or comma-separated): the first kernel is booted by default, the others are fallback kernels in /kernel1/, /kernel2/ etc. of the boot partition, selectable via tryboot (Raspberry Pi, one fallback kernel), the extlinux.conf menu (-boot_mode=uboot) or the systemd-boot menu (-boot_mode=uefi)")
+}
+
+// kernelPackages returns the packages of cfg.KernelPackage, starting with the
+// default kernel.
+func kernelPackages(cfg *Config) []string {
+	var pkgs []string
+	for _, pkg := range strings.Split(cfg.KernelPackage, ",") {
+		if pkg = strings.TrimSpace(pkg); pkg != "" && !containsString(pkgs, pkg) {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// kernelPackage returns the package of the kernel which is booted by default.
+func kernelPackage(cfg *Config) string {
+	if pkgs := kernelPackages(cfg); len(pkgs) > 0 {
+		return pkgs[0]
+	}
+	return ""
+}
+
+// fallbackKernelPackages returns the packages of the fallback kernels of
+// cfg.KernelPackage.
+func fallbackKernelPackages(cfg *Config) []string {
+	if pkgs := kernelPackages(cfg); len(pkgs) > 1 {
+		return pkgs[1:]
+	}
+	return nil
+}
+
+// setDefaultKernelPackage replaces the default kernel of cfg.KernelPackage
+// with pkg, keeping the fallback kernels.
+func setDefaultKernelPackage(cfg *Config, pkg string) {
+	cfg.KernelPackage = strings.Join(append([]string{pkg}, fallbackKernelPackages(cfg)...), ",")
+}
+
+// fallbackKernelDir returns the boot file system directory (e.g. /kernel1) of
+// the nth fallback kernel, starting at 1. Its name fits into 8.3.
+func fallbackKernelDir(n int) string {
+	return "/kernel" + strconv.Itoa(n)
+}
+
+// checkFallbackKernels verifies that the boot mode can select between the
+// -kernel_package kernels.
+func checkFallbackKernels(cfg *Config) error {
+	fallbacks := fallbackKernelPackages(cfg)
+	if len(fallbacks) == 0 {
+		return nil
+	}
+	if len(fallbacks) > 9 {
+		return fmt.Errorf("-kernel_package: at most 9 fallback kernels are supported, got %d", len(fallbacks))
+	}
+	if *bootMode != "firmware" {
+		return nil
+	}
+	if goarch := targetGOARCH(); goarch != "arm" && goarch != "arm64" {
+		return fmt.Errorf("-kernel_package: the MBR boot code only starts /vmlinuz, use -boot_mode=uefi for fallback kernels")
+	}
+	if len(fallbacks) > 1 {
+		return fmt.Errorf("-kernel_package: the Raspberry Pi firmware selects at most one fallback kernel (via tryboot), got %d", len(fallbacks))
+	}
+	if cfg.Update != "" {
+		// The installation switches between the root partitions by changing
+		// /cmdline.txt, which would leave the fallback kernel’s copy behind.
+		return fmt.Errorf("-kernel_package: fallback kernels do not support -update yet, as the installation cannot switch the root partition of their cmdline.txt")
+	}
+	return nil
+}
+
+// writeFallbackKernels copies the fallback kernels (vmlinuz and *.dtb) into
+// their directories of the boot file system fw. For the Raspberry Pi firmware,
+// which loads all files relative to the os_prefix of the fallback kernel, the
+// directory also receives cmdline, the -initramfs and the -dtoverlay overlays.
+func writeFallbackKernels(ctx context.Context, cfg *Config, fw bootFSWriter, firmwareDirs []string, cmdline string) error {
+	for idx, pkg := range fallbackKernelPackages(cfg) {
+		prefix := fallbackKernelDir(idx + 1)
+		kernelDir, err := packageDir(ctx, pkg)
+		if err != nil {
+			return err
+		}
+		if err := checkBoardKernel(cfg, pkg, kernelDir); err != nil {
+			return err
+		}
+		if *bootMode == "uboot" && *ubootFDT != "" {
+			if _, err := os.Stat(filepath.Join(kernelDir, *ubootFDT)); err != nil {
+				return fmt.Errorf("-uboot_fdt: %v", err)
+			}
+		}
+		for _, glob := range kernelGlobs {
+			matches, err := filepath.Glob(filepath.Join(kernelDir, glob))
+			if err != nil {
+				return err
+			}
+			for _, m := range matches {
+				if err := copyFile(fw, prefix+"/"+filepath.Base(m), m); err != nil {
+					return err
+				}
+			}
+		}
+		if *bootMode != "firmware" {
+			continue
+		}
+
+		w, err := fw.File(prefix+"/cmdline.txt", imageTime())
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(cmdline)); err != nil {
+			return err
+		}
+		if *initramfs != "" {
+			if err := writeInitramfs(fw, prefix+initrdPath); err != nil {
+				return err
+			}
+		}
+		if _, err := writeDtoverlays(fw, prefix, append([]string{kernelDir}, firmwareDirs...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fallbackKernelConfig returns the config.txt lines which boot the fallback
+// kernel when the Raspberry Pi firmware is started with the tryboot flag (e.g.
+// after reboot "0 tryboot").
+func fallbackKernelConfig(cfg *Config) string {
+	if len(fallbackKernelPackages(cfg)) == 0 {
+		return ""
+	}
+	return "[tryboot]\nos_prefix=" + strings.TrimPrefix(fallbackKernelDir(1), "/") + "/\n[all]\n"
+}
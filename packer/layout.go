@@ -0,0 +1,101 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+)
+
+var (
+	bootSizeFlag = flag.String("boot_size",
+		"100M",
+		"size of the boot partition (with K, M or G suffix, a multiple of 1M), e.g. 256M for larger kernels or firmware. Only used when partitioning (-overwrite)")
+
+	rootSizeFlag = flag.String("root_size",
+		"500M",
+		"size of each of the two root partitions (with K, M or G suffix, a multiple of 1M), e.g. 1G for big applications. Only used when partitioning (-overwrite); specify the same value when updating so that oversized root file systems are rejected")
+
+	permSizeFlag = flag.String("perm_size",
+		"",
+		"size of the permanent data partition (with K, M or G suffix, a multiple of 1M). By default, the permanent data partition takes up the remainder of the device")
+)
+
+// bootStartSector is where the boot partition starts. The boot code in the
+// MBR (see writeMBR) and the FAT32 writer rely on it.
+const bootStartSector = 8192
+
+// partitionLayout describes the partitions written by writePartitionTable, in
+// 512 byte sectors.
+type partitionLayout struct {
+	bootSectors uint64
+	rootSectors uint64
+	permSectors uint64 // or 0 for the remainder of the device
+}
+
+// layout is the partition layout of the current build, see logic.
+var layout partitionLayout
+
+func parsePartitionLayout() (partitionLayout, error) {
+	var l partitionLayout
+	for _, s := range []struct {
+		name    string
+		val     string
+		sectors *uint64
+		min     int64
+	}{
+		// FAT32 requires at least 65525 clusters (of one sector):
+		{"boot_size", *bootSizeFlag, &l.bootSectors, 34 * MB},
+		{"root_size", *rootSizeFlag, &l.rootSectors, 1 * MB},
+		{"perm_size", *permSizeFlag, &l.permSectors, 1 * MB},
+	} {
+		if s.val == "" {
+			continue
+		}
+		n, err := parseSize(s.val)
+		if err != nil {
+			return l, fmt.Errorf("-%s: %v", s.name, err)
+		}
+		if n%MB != 0 {
+			return l, fmt.Errorf("-%s=%s is not a multiple of 1M", s.name, s.val)
+		}
+		if n < s.min {
+			return l, fmt.Errorf("-%s=%s is smaller than the minimum of %dM", s.name, s.val, s.min/MB)
+		}
+		*s.sectors = uint64(n / 512)
+	}
+	if *permMode == "none" {
+		l.permSectors = 0
+	}
+	// MBR partition entries contain 32 bit sector numbers:
+	if end := l.permStart() + l.permSectors; end > 1<<32-1 {
+		return l, fmt.Errorf("partitions end at sector %d, beyond the MBR limit of 2 TiB", end)
+	}
+	return l, nil
+}
+
+// rootStart returns the first sector of root partition 2 or 3.
+func (l partitionLayout) rootStart(partition int) uint64 {
+	return bootStartSector + l.bootSectors + uint64(partition-2)*l.rootSectors
+}
+
+func (l partitionLayout) permStart() uint64 {
+	return l.rootStart(4)
+}
+
+// minBytes returns the smallest device size (in bytes) which can hold the
+// partitions, including the backup GPT if -partition_table=gpt.
+func (l partitionLayout) minBytes() uint64 {
+	sectors := l.permStart() + l.permSectors
+	if *partitionTable == "gpt" {
+		sectors += gptSectors
+	}
+	return sectors * 512
+}
+
+// permSectorsOn returns the size of the permanent data partition on a device
+// whose partitions end before sector end.
+func (l partitionLayout) permSectorsOn(end uint64) uint64 {
+	if l.permSectors != 0 {
+		return l.permSectors
+	}
+	return end - l.permStart()
+}
@@ -0,0 +1,164 @@
+package packer
+
+import (
+	"archive/zip"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var (
+	timezone = flag.String("timezone",
+		"",
+		"time zone (e.g. Europe/Berlin or UTC) of the device, written to /etc/localtime from Go’s copy of the time zone database (or /usr/share/zoneinfo of the host). Empty means the time zone of the host (its /etc/localtime)")
+
+	ntpServers = flag.String("ntp_servers",
+		"",
+		"comma-separated list of NTP servers (host names or IP addresses) to synchronize the clock with instead of the gokrazy pool. They are written to /etc/ntp.conf and passed as arguments to "+ntpPkg)
+)
+
+const ntpPkg = "github.com/gokrazy/gokrazy/cmd/ntp"
+
+// hostnameRe matches DNS host names.
+var hostnameRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*\.?$`)
+
+// checkTimeFlags verifies the -timezone and -ntp_servers flags.
+func checkTimeFlags() error {
+	if *timezone != "" {
+		if path.Clean(*timezone) != *timezone || path.IsAbs(*timezone) || strings.HasPrefix(*timezone, "..") {
+			return fmt.Errorf("-timezone=%q is not a time zone name (e.g. Europe/Berlin)", *timezone)
+		}
+		found, err := zoneinfoExists(*timezone)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("-timezone=%q: unknown time zone (not found in %s or /usr/share/zoneinfo)", *timezone, zoneinfoZip())
+		}
+	}
+	for _, server := range splitList(*ntpServers) {
+		if net.ParseIP(server) == nil && !hostnameRe.MatchString(server) {
+			return fmt.Errorf("-ntp_servers: %q is neither a host name nor an IP address", server)
+		}
+	}
+	return nil
+}
+
+// ntpArgs returns the command-line arguments with which the program built from
+// importPath is started for -ntp_servers.
+func ntpArgs(importPath string) []string {
+	if importPath != ntpPkg {
+		return nil
+	}
+	return splitList(*ntpServers)
+}
+
+// addNTPConfig adds /etc/ntp.conf, listing the -ntp_servers, to etc.
+func addNTPConfig(etc *fileInfo) {
+	if *ntpServers == "" {
+		return
+	}
+	var b strings.Builder
+	for _, server := range splitList(*ntpServers) {
+		fmt.Fprintf(&b, "server %s iburst\n", server)
+	}
+	etc.dirents = append(etc.dirents, &fileInfo{
+		filename:    "ntp.conf",
+		fromLiteral: b.String(),
+	})
+}
+
+func zoneinfoZip() string {
+	return filepath.Join(runtime.GOROOT(), "lib", "time", "zoneinfo.zip")
+}
+
+// zoneinfoExists returns whether the time zone name is contained in Go’s
+// zoneinfo.zip or in /usr/share/zoneinfo.
+func zoneinfoExists(name string) (bool, error) {
+	r, err := zip.OpenReader(zoneinfoZip())
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		defer r.Close()
+		for _, f := range r.File {
+			if f.Name == name {
+				return true, nil
+			}
+		}
+	}
+	st, err := os.Stat(filepath.Join("/usr/share/zoneinfo", name))
+	return err == nil && st.Mode().IsRegular(), nil
+}
+
+// extractZoneinfo writes the time zone name from Go’s zoneinfo.zip to tmpdir
+// and returns its path, or "" if it is not found.
+func extractZoneinfo(tmpdir, name string) (string, error) {
+	r, err := zip.OpenReader(zoneinfoZip())
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Some Go installations are missing lib/zoneinfo.zip
+			// (e.g. Debian’s).
+			return "", nil
+		}
+		return "", err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		fn := filepath.Join(tmpdir, strings.ReplaceAll(name, "/", "-"))
+		out, err := os.Create(fn)
+		if err != nil {
+			return "", err
+		}
+		defer out.Close()
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		if _, err := io.Copy(out, rc); err != nil {
+			return "", err
+		}
+		rc.Close()
+		if err := out.Close(); err != nil {
+			return "", err
+		}
+		return fn, nil
+	}
+	return "", nil
+}
+
+// hostLocaltime returns the path of the file to use as /etc/localtime: the
+// -timezone, the host’s /etc/localtime or the time zone “Factory”.
+func hostLocaltime(tmpdir string) (string, error) {
+	if *timezone != "" {
+		fn, err := extractZoneinfo(tmpdir, *timezone)
+		if err != nil || fn != "" {
+			return fn, err
+		}
+		fn = filepath.Join("/usr/share/zoneinfo", *timezone)
+		if _, err := os.Stat(fn); err != nil {
+			return "", fmt.Errorf("-timezone: %v", err)
+		}
+		return fn, nil
+	}
+
+	hostLocaltime := "/etc/localtime"
+	if _, err := os.Stat(hostLocaltime); err == nil {
+		return hostLocaltime, nil
+	}
+
+	// Fallback to time zone “Factory” from Go’s copy of zoneinfo.zip
+	return extractZoneinfo(tmpdir, "Factory")
+}
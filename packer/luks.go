@@ -0,0 +1,436 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gokrazy/internal/config"
+)
+
+var (
+	permLUKS = flag.Bool("perm_luks",
+		false,
+		"encrypt the permanent data partition: when partitioning (-overwrite), create a LUKS2 volume on it (use -perm_mkfs to also create the file system within), unlocked by a key file which is stored on the boot partition (/perm.key, see -perm_luks_keyfile). Init unlocks and mounts the volume at boot; the kernel needs CONFIG_DM_CRYPT and CONFIG_CRYPTO_XTS")
+
+	permLUKSKeyfile = flag.String("perm_luks_keyfile",
+		"",
+		"host path of the -perm_luks key file, which is generated when partitioning if it does not exist yet, and required for updates. Empty means perm.key in the -hostname specific configuration directory (e.g. ~/.config/gokrazy/hosts/<hostname>/perm.key)")
+)
+
+const (
+	// luks2HeaderSize is the size of each of the two LUKS2 headers (the binary
+	// header and the JSON area), luks2DataOffset the offset of the encrypted
+	// data, like cryptsetup(8) uses by default.
+	luks2HeaderSize = 16384
+	luks2DataOffset = 16 << 20
+
+	luks2KeySize = 64 // AES-256 in XTS mode
+	luks2Stripes = 4000
+
+	// The key file is random, so the PBKDF2 iterations do not need to slow
+	// down brute-forcing a passphrase, but they are still required:
+	luks2KeyslotIterations = 100000
+	luks2DigestIterations  = 1000
+
+	permKeySize = 64
+	permKeyPath = "/perm.key"
+)
+
+// permKeyfilePath returns the path of the -perm_luks key file on the host.
+func permKeyfilePath(cfg *Config) string {
+	if *permLUKSKeyfile != "" {
+		return *permLUKSKeyfile
+	}
+	return filepath.Join(string(config.HostnameSpecific(cfg.Hostname)), "perm.key")
+}
+
+// preparePermKey generates the -perm_luks key file when partitioning, unless
+// it already exists. Updates need the key file which the device was
+// partitioned with.
+func preparePermKey(cfg *Config, partitioning bool) error {
+	if !*permLUKS || !partitioning {
+		return nil
+	}
+	path := permKeyfilePath(cfg)
+	if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	log.Printf("generating the key file of the permanent data partition in %s (keep it to access the partition with cryptsetup open --key-file)", path)
+	key, err := randomBytes(permKeySize)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, key, 0600)
+}
+
+// readPermKey returns the contents of the -perm_luks key file.
+func readPermKey(cfg *Config) ([]byte, error) {
+	key, err := ioutil.ReadFile(permKeyfilePath(cfg))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("-perm_luks: key file %s not found, it is generated when partitioning (-overwrite)", permKeyfilePath(cfg))
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// writePermKey writes the -perm_luks key file to the boot file system fw.
+func writePermKey(cfg *Config, fw bootFSWriter) error {
+	key, err := readPermKey(cfg)
+	if err != nil {
+		if !*dryRun {
+			return err
+		}
+		key = make([]byte, permKeySize) // generated when partitioning
+	}
+	w, err := fw.File(permKeyPath, imageTime())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(key)
+	return err
+}
+
+// pbkdf2 derives a key of keyLen bytes from password (RFC 8018).
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// xtsCipher encrypts 512 byte sectors with AES in XTS mode, using the sector
+// number as tweak (aes-xts-plain64 in dm-crypt terms).
+type xtsCipher struct {
+	data, tweak cipher.Block
+}
+
+func newXTSCipher(key []byte) (*xtsCipher, error) {
+	data, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	tweak, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+	return &xtsCipher{data: data, tweak: tweak}, nil
+}
+
+// encryptSectors encrypts b (a multiple of 512 bytes) in place, starting with
+// sector number sector.
+func (c *xtsCipher) encryptSectors(b []byte, sector uint64) {
+	var t [16]byte
+	for ; len(b) > 0; b, sector = b[512:], sector+1 {
+		for i := range t {
+			t[i] = 0
+		}
+		binary.LittleEndian.PutUint64(t[:], sector)
+		c.tweak.Encrypt(t[:], t[:])
+		for blk := b[:512]; len(blk) > 0; blk = blk[16:] {
+			for i := range t {
+				blk[i] ^= t[i]
+			}
+			c.data.Encrypt(blk[:16], blk[:16])
+			for i := range t {
+				blk[i] ^= t[i]
+			}
+			// Multiply the tweak by x in GF(2^128):
+			carry := t[15] >> 7
+			for i := 15; i > 0; i-- {
+				t[i] = t[i]<<1 | t[i-1]>>7
+			}
+			t[0] = t[0]<<1 ^ carry*0x87
+		}
+	}
+}
+
+// afDiffuse is the diffusion function of the LUKS anti-forensic splitter.
+func afDiffuse(b []byte) {
+	for i := 0; i*sha256.Size < len(b); i++ {
+		h := sha256.New()
+		binary.Write(h, binary.BigEndian, uint32(i))
+		end := (i + 1) * sha256.Size
+		if end > len(b) {
+			end = len(b)
+		}
+		h.Write(b[i*sha256.Size : end])
+		copy(b[i*sha256.Size:end], h.Sum(nil))
+	}
+}
+
+// afSplit splits key into luks2Stripes stripes, all of which are required to
+// recover it (see the LUKS on-disk format specification).
+func afSplit(key []byte) ([]byte, error) {
+	out := make([]byte, len(key)*luks2Stripes)
+	if _, err := rand.Read(out[:len(key)*(luks2Stripes-1)]); err != nil {
+		return nil, err
+	}
+	d := make([]byte, len(key))
+	for i := 0; i < luks2Stripes-1; i++ {
+		for j := range d {
+			d[j] ^= out[i*len(key)+j]
+		}
+		afDiffuse(d)
+	}
+	last := out[(luks2Stripes-1)*len(key):]
+	for j := range d {
+		last[j] = d[j] ^ key[j]
+	}
+	return out, nil
+}
+
+// luks2Metadata is the JSON area of a LUKS2 header, containing one keyslot
+// (opened by the key file) for the encrypted data segment.
+type luks2Metadata struct {
+	Keyslots map[string]luks2Keyslot `json:"keyslots"`
+	Tokens   struct{}                `json:"tokens"`
+	Segments map[string]luks2Segment `json:"segments"`
+	Digests  map[string]luks2Digest  `json:"digests"`
+	Config   struct {
+		JSONSize     string `json:"json_size"`
+		KeyslotsSize string `json:"keyslots_size"`
+	} `json:"config"`
+}
+
+type luks2Keyslot struct {
+	Type    string `json:"type"`
+	KeySize int    `json:"key_size"`
+	AF      struct {
+		Type    string `json:"type"`
+		Stripes int    `json:"stripes"`
+		Hash    string `json:"hash"`
+	} `json:"af"`
+	Area struct {
+		Type       string `json:"type"`
+		Offset     string `json:"offset"`
+		Size       string `json:"size"`
+		Encryption string `json:"encryption"`
+		KeySize    int    `json:"key_size"`
+	} `json:"area"`
+	KDF struct {
+		Type       string `json:"type"`
+		Hash       string `json:"hash"`
+		Iterations int    `json:"iterations"`
+		Salt       string `json:"salt"`
+	} `json:"kdf"`
+}
+
+type luks2Segment struct {
+	Type       string `json:"type"`
+	Offset     string `json:"offset"`
+	Size       string `json:"size"`
+	IVTweak    string `json:"iv_tweak"`
+	Encryption string `json:"encryption"`
+	SectorSize int    `json:"sector_size"`
+}
+
+type luks2Digest struct {
+	Type       string   `json:"type"`
+	Keyslots   []string `json:"keyslots"`
+	Segments   []string `json:"segments"`
+	Hash       string   `json:"hash"`
+	Iterations int      `json:"iterations"`
+	Salt       string   `json:"salt"`
+	Digest     string   `json:"digest"`
+}
+
+// randomBytes returns n random bytes. Unlike imageRandom, they are never
+// derived from -source_date_epoch, as keys must be secret.
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// writeLUKS2 creates a LUKS2 volume (aes-xts-plain64, 512 byte sectors) of
+// size bytes at offset off of w, with a keyslot which passphrase (the
+// contents of the key file) opens. It returns the volume key.
+func writeLUKS2(w io.WriterAt, off, size int64, passphrase []byte) ([]byte, error) {
+	if size <= luks2DataOffset {
+		return nil, fmt.Errorf("the partition (%d bytes) is too small for LUKS2, which needs %d bytes for its headers", size, luks2DataOffset)
+	}
+	volumeKey, err := randomBytes(luks2KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	// The keyslot contains the volume key, split into stripes and encrypted
+	// with the key derived from the passphrase:
+	keyslotSalt, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	material, err := afSplit(volumeKey)
+	if err != nil {
+		return nil, err
+	}
+	material = append(material, make([]byte, (4096-len(material)%4096)%4096)...)
+	c, err := newXTSCipher(pbkdf2(sha256.New, passphrase, keyslotSalt, luks2KeyslotIterations, luks2KeySize))
+	if err != nil {
+		return nil, err
+	}
+	c.encryptSectors(material, 0)
+
+	digestSalt, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	digest := pbkdf2(sha256.New, volumeKey, digestSalt, luks2DigestIterations, sha256.Size)
+
+	var ks luks2Keyslot
+	ks.Type = "luks2"
+	ks.KeySize = luks2KeySize
+	ks.AF.Type = "luks1"
+	ks.AF.Stripes = luks2Stripes
+	ks.AF.Hash = "sha256"
+	ks.Area.Type = "raw"
+	ks.Area.Offset = strconv.Itoa(2 * luks2HeaderSize)
+	ks.Area.Size = strconv.Itoa(len(material))
+	ks.Area.Encryption = "aes-xts-plain64"
+	ks.Area.KeySize = luks2KeySize
+	ks.KDF.Type = "pbkdf2"
+	ks.KDF.Hash = "sha256"
+	ks.KDF.Iterations = luks2KeyslotIterations
+	ks.KDF.Salt = base64.StdEncoding.EncodeToString(keyslotSalt)
+	md := luks2Metadata{
+		Keyslots: map[string]luks2Keyslot{"0": ks},
+		Segments: map[string]luks2Segment{"0": {
+			Type:       "crypt",
+			Offset:     strconv.Itoa(luks2DataOffset),
+			Size:       "dynamic",
+			IVTweak:    "0",
+			Encryption: "aes-xts-plain64",
+			SectorSize: 512,
+		}},
+		Digests: map[string]luks2Digest{"0": {
+			Type:       "pbkdf2",
+			Keyslots:   []string{"0"},
+			Segments:   []string{"0"},
+			Hash:       "sha256",
+			Iterations: luks2DigestIterations,
+			Salt:       base64.StdEncoding.EncodeToString(digestSalt),
+			Digest:     base64.StdEncoding.EncodeToString(digest),
+		}},
+	}
+	md.Config.JSONSize = strconv.Itoa(luks2HeaderSize - 4096)
+	md.Config.KeyslotsSize = strconv.Itoa(luks2DataOffset - 2*luks2HeaderSize)
+	js, err := json.Marshal(&md)
+	if err != nil {
+		return nil, err
+	}
+	if len(js) >= luks2HeaderSize-4096 {
+		return nil, fmt.Errorf("BUG: LUKS2 metadata too large (%d bytes)", len(js))
+	}
+
+	uuid, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40 // version 4
+	uuid[8] = uuid[8]&0x3f | 0x80 // variant 10
+	uuidStr := fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+
+	// The primary header is followed by the secondary header, both of which
+	// consist of a binary header and the JSON area. Their checksum covers both.
+	for i, magic := range []string{"LUKS\xba\xbe", "SKUL\xba\xbe"} {
+		hdr := make([]byte, luks2HeaderSize)
+		copy(hdr[0:], magic)
+		binary.BigEndian.PutUint16(hdr[6:], 2) // version
+		binary.BigEndian.PutUint64(hdr[8:], luks2HeaderSize)
+		binary.BigEndian.PutUint64(hdr[16:], 1) // seqid
+		copy(hdr[72:], "sha256")
+		if _, err := rand.Read(hdr[104:168]); err != nil {
+			return nil, err
+		}
+		copy(hdr[168:], uuidStr)
+		binary.BigEndian.PutUint64(hdr[256:], uint64(i*luks2HeaderSize))
+		copy(hdr[4096:], js)
+		sum := sha256.Sum256(hdr)
+		copy(hdr[448:], sum[:])
+		if _, err := w.WriteAt(hdr, off+int64(i*luks2HeaderSize)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := w.WriteAt(material, off+2*luks2HeaderSize); err != nil {
+		return nil, err
+	}
+	return volumeKey, nil
+}
+
+// luksWriter is an io.WriterAt which encrypts the data (written in whole
+// sectors) of the LUKS2 volume at offset off of w.
+type luksWriter struct {
+	w   io.WriterAt
+	off int64
+	c   *xtsCipher
+}
+
+func (lw *luksWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off%512 != 0 || len(p)%512 != 0 {
+		return 0, fmt.Errorf("BUG: unaligned write of %d bytes at %d to the LUKS2 volume", len(p), off)
+	}
+	b := append([]byte(nil), p...)
+	lw.c.encryptSectors(b, uint64(off/512))
+	return lw.w.WriteAt(b, lw.off+luks2DataOffset+off)
+}
+
+// formatPermLUKS creates the -perm_luks volume of size bytes at offset off of
+// w and returns a writer for its (encrypted) contents.
+func formatPermLUKS(cfg *Config, w io.WriterAt, off, size int64) (io.WriterAt, error) {
+	key, err := readPermKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	stage := startStage("create LUKS2 volume on permanent data partition")
+	defer stage.done()
+	volumeKey, err := writeLUKS2(w, off, size, key)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newXTSCipher(volumeKey)
+	if err != nil {
+		return nil, err
+	}
+	return &luksWriter{w: w, off: off, c: c}, nil
+}
+
+// isLUKS returns whether b starts with a LUKS header.
+func isLUKS(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("LUKS\xba\xbe"))
+}
@@ -0,0 +1,183 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestLUKS2RoundTrip(t *testing.T) {
+	const (
+		off  = 1 << 20
+		size = luks2DataOffset + 1<<20
+	)
+	img := make([]byte, off+size)
+	w := &byteWriterAt{img}
+	passphrase := []byte("key file contents")
+	volumeKey, err := writeLUKS2(w, off, size, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isLUKS(img[off:]) {
+		t.Fatalf("isLUKS = false after writeLUKS2")
+	}
+
+	// Both headers must carry a valid checksum and the same metadata:
+	var md luks2Metadata
+	for i, magic := range []string{"LUKS\xba\xbe", "SKUL\xba\xbe"} {
+		hdr := append([]byte(nil), img[off+i*luks2HeaderSize:off+(i+1)*luks2HeaderSize]...)
+		if got := string(hdr[:6]); got != magic {
+			t.Fatalf("header %d: magic: got %q, want %q", i, got, magic)
+		}
+		if got, want := binary.BigEndian.Uint64(hdr[256:]), uint64(i*luks2HeaderSize); got != want {
+			t.Errorf("header %d: offset: got %d, want %d", i, got, want)
+		}
+		want := append([]byte(nil), hdr[448:448+sha256.Size]...)
+		for j := 448; j < 448+64; j++ {
+			hdr[j] = 0
+		}
+		if got := sha256.Sum256(hdr); !bytes.Equal(got[:], want) {
+			t.Errorf("header %d: checksum mismatch", i)
+		}
+		if err := json.Unmarshal(bytes.TrimRight(hdr[4096:], "\x00"), &md); err != nil {
+			t.Fatalf("header %d: %v", i, err)
+		}
+	}
+
+	if _, err := openLUKS2(img[off:], md, []byte("wrong key file")); err == nil {
+		t.Errorf("the volume unexpectedly opened with a wrong passphrase")
+	}
+	vk, err := openLUKS2(img[off:], md, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(vk, volumeKey) {
+		t.Fatalf("volume key: got %x, want %x", vk, volumeKey)
+	}
+
+	// Data written through luksWriter decrypts with the recovered key:
+	c, err := newXTSCipher(vk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 8*512)
+	rand.New(rand.NewSource(1)).Read(data)
+	lw := &luksWriter{w: w, off: off, c: c}
+	if _, err := lw.WriteAt(data, 4*512); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lw.WriteAt(data[:100], 0); err == nil {
+		t.Errorf("unaligned write unexpectedly succeeded")
+	}
+	enc := img[off+luks2DataOffset+4*512 : off+luks2DataOffset+4*512+len(data)]
+	if bytes.Equal(enc, data) {
+		t.Fatalf("data was written unencrypted")
+	}
+	dec := append([]byte(nil), enc...)
+	c.decryptSectors(dec, 4)
+	if !bytes.Equal(dec, data) {
+		t.Errorf("decrypted data differs from written data")
+	}
+}
+
+func TestLUKS2TooSmall(t *testing.T) {
+	w := &byteWriterAt{make([]byte, luks2DataOffset)}
+	if _, err := writeLUKS2(w, 0, luks2DataOffset, []byte("key")); err == nil {
+		t.Errorf("writeLUKS2 unexpectedly succeeded on a partition without room for data")
+	}
+}
+
+// TestPBKDF2 uses the PBKDF2-HMAC-SHA256 test vectors of RFC 7914.
+func TestPBKDF2(t *testing.T) {
+	for _, tt := range []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	} {
+		got := pbkdf2(sha256.New, []byte(tt.password), []byte(tt.salt), tt.iterations, 64)
+		want, err := hex.DecodeString(tt.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("pbkdf2(%q, %q, %d) = %x, want %x", tt.password, tt.salt, tt.iterations, got, want)
+		}
+	}
+}
+
+// openLUKS2 recovers the volume key from the LUKS2 volume b like init does:
+// it decrypts the keyslot, merges its anti-forensic stripes and verifies the
+// result against the digest.
+func openLUKS2(b []byte, md luks2Metadata, passphrase []byte) ([]byte, error) {
+	ks := md.Keyslots["0"]
+	salt, err := base64.StdEncoding.DecodeString(ks.KDF.Salt)
+	if err != nil {
+		return nil, err
+	}
+	areaOffset, err := strconv.Atoi(ks.Area.Offset)
+	if err != nil {
+		return nil, err
+	}
+	material := append([]byte(nil), b[areaOffset:areaOffset+(ks.KeySize*ks.AF.Stripes+511)/512*512]...)
+	c, err := newXTSCipher(pbkdf2(sha256.New, passphrase, salt, ks.KDF.Iterations, ks.Area.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	c.decryptSectors(material, 0)
+	vk := make([]byte, ks.KeySize)
+	for i := 0; i < ks.AF.Stripes; i++ {
+		for j := range vk {
+			vk[j] ^= material[i*ks.KeySize+j]
+		}
+		if i < ks.AF.Stripes-1 {
+			afDiffuse(vk)
+		}
+	}
+	d := md.Digests["0"]
+	salt, err = base64.StdEncoding.DecodeString(d.Salt)
+	if err != nil {
+		return nil, err
+	}
+	want, err := base64.StdEncoding.DecodeString(d.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pbkdf2(sha256.New, vk, salt, d.Iterations, len(want)), want) {
+		return nil, errors.New("the passphrase does not open keyslot 0")
+	}
+	return vk, nil
+}
+
+// decryptSectors is the inverse of encryptSectors.
+func (c *xtsCipher) decryptSectors(b []byte, sector uint64) {
+	var t [16]byte
+	for ; len(b) > 0; b, sector = b[512:], sector+1 {
+		t = [16]byte{}
+		binary.LittleEndian.PutUint64(t[:], sector)
+		c.tweak.Encrypt(t[:], t[:])
+		for blk := b[:512]; len(blk) > 0; blk = blk[16:] {
+			for i := range t {
+				blk[i] ^= t[i]
+			}
+			c.data.Decrypt(blk[:16], blk[:16])
+			for i := range t {
+				blk[i] ^= t[i]
+			}
+			carry := t[15] >> 7
+			for i := 15; i > 0; i-- {
+				t[i] = t[i]<<1 | t[i-1]>>7
+			}
+			t[0] = t[0]<<1 ^ carry*0x87
+		}
+	}
+}
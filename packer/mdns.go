@@ -0,0 +1,263 @@
+package packer
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// This file implements just enough of multicast DNS (RFC 6762) and DNS-based
+// service discovery (RFC 6763) to browse for gokrazy installations.
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+
+	dnsClassIN = 1
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+type dnsRecord struct {
+	name  string
+	typ   uint16
+	ttl   uint32
+	rdata []byte
+	// msg is the message the record was parsed from, required for resolving
+	// compressed names within rdata.
+	msg []byte
+	// rdataOffset is the offset of rdata within msg.
+	rdataOffset int
+}
+
+// appendDNSName appends the wire format of name to b, without compression.
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func dnsQuery(name string, qtype uint16) []byte {
+	b := make([]byte, 12) // header: ID 0, no flags, as per RFC 6762 section 18
+	binary.BigEndian.PutUint16(b[4:], 1)
+	b = appendDNSName(b, name)
+	b = append(b, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return b
+}
+
+var errDNSFormat = errors.New("malformed DNS message")
+
+// readDNSName reads a (possibly compressed) name from msg at off and returns
+// the name and the offset following it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var (
+		labels []string
+		next   = -1
+	)
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 64 {
+			return "", 0, errDNSFormat
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			off++
+			if next == -1 {
+				next = off
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xC0 == 0xC0: // compression pointer
+			if off+1 >= len(msg) {
+				return "", 0, errDNSFormat
+			}
+			if next == -1 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSFormat
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// parseDNSRecords returns the answer and additional records of msg.
+func parseDNSRecords(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < 12 {
+		return nil, errDNSFormat
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4 // type, class
+	}
+	records := make([]dnsRecord, 0, rrcount)
+	for i := 0; i < rrcount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, errDNSFormat
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlength > len(msg) {
+			return nil, errDNSFormat
+		}
+		records = append(records, dnsRecord{
+			name:        strings.ToLower(name),
+			typ:         typ,
+			ttl:         ttl,
+			rdata:       msg[off : off+rdlength],
+			msg:         msg,
+			rdataOffset: off,
+		})
+		off += rdlength
+	}
+	return records, nil
+}
+
+// mdnsService is a DNS-SD service instance, e.g. a gokrazy installation.
+type mdnsService struct {
+	Instance string
+	Host     string
+	Port     uint16
+	Addrs    []net.IP
+	TXT      map[string]string
+}
+
+// mdnsBrowse sends a DNS-SD browse query for service (e.g. _gokrazy._tcp) and
+// collects responses until timeout.
+func mdnsBrowse(service string, timeout time.Duration) ([]*mdnsService, error) {
+	// Responses to queries from a port other than 5353 are sent via unicast
+	// (RFC 6762 section 6.7), so a regular UDP socket suffices.
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ptrName := service + ".local."
+	if _, err := conn.WriteTo(dnsQuery(ptrName, dnsTypePTR), mdnsGroup); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var records []dnsRecord
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		rrs, err := parseDNSRecords(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			continue // ignore malformed responses
+		}
+		records = append(records, rrs...)
+	}
+	return servicesFromRecords(strings.ToLower(ptrName), records), nil
+}
+
+func servicesFromRecords(ptrName string, records []dnsRecord) []*mdnsService {
+	byInstance := make(map[string]*mdnsService)
+	for _, rr := range records {
+		if rr.typ != dnsTypePTR || rr.name != ptrName {
+			continue
+		}
+		instance, _, err := readDNSName(rr.msg, rr.rdataOffset)
+		if err != nil {
+			continue
+		}
+		instance = strings.ToLower(instance)
+		byInstance[instance] = &mdnsService{
+			Instance: strings.TrimSuffix(instance, "."+ptrName),
+			TXT:      make(map[string]string),
+		}
+	}
+
+	addrs := make(map[string][]net.IP)
+	for _, rr := range records {
+		switch rr.typ {
+		case dnsTypeA, dnsTypeAAAA:
+			if len(rr.rdata) == net.IPv4len || len(rr.rdata) == net.IPv6len {
+				addrs[rr.name] = append(addrs[rr.name], net.IP(rr.rdata))
+			}
+		case dnsTypeSRV:
+			svc, ok := byInstance[rr.name]
+			if !ok || len(rr.rdata) < 7 {
+				continue
+			}
+			host, _, err := readDNSName(rr.msg, rr.rdataOffset+6)
+			if err != nil {
+				continue
+			}
+			svc.Port = binary.BigEndian.Uint16(rr.rdata[4:])
+			svc.Host = strings.ToLower(host)
+		case dnsTypeTXT:
+			svc, ok := byInstance[rr.name]
+			if !ok {
+				continue
+			}
+			for b := rr.rdata; len(b) > 0 && int(b[0]) < len(b); b = b[1+int(b[0]):] {
+				kv := string(b[1 : 1+int(b[0])])
+				if idx := strings.IndexByte(kv, '='); idx > -1 {
+					svc.TXT[kv[:idx]] = kv[idx+1:]
+				} else if kv != "" {
+					svc.TXT[kv] = ""
+				}
+			}
+		}
+	}
+
+	services := make([]*mdnsService, 0, len(byInstance))
+	for _, svc := range byInstance {
+		seen := make(map[string]bool)
+		for _, ip := range addrs[svc.Host] {
+			if !seen[ip.String()] {
+				seen[ip.String()] = true
+				svc.Addrs = append(svc.Addrs, ip)
+			}
+		}
+		services = append(services, svc)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Instance < services[j].Instance
+	})
+	return services
+}
+
+// hostname returns the host name of the service without the .local suffix,
+// suitable for use with -hostname.
+func (s *mdnsService) hostname() string {
+	if s.Host == "" {
+		return s.Instance
+	}
+	return strings.TrimSuffix(s.Host, ".local.")
+}
@@ -0,0 +1,111 @@
+package packer
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var modprobeConfig = flag.String("modprobe_config",
+	"",
+	"comma-separated list of modprobe.d(5) configuration files (or directories containing *.conf files) to install into /etc/modprobe.d/, e.g. for module options or blacklists of the kernel package’s loadable modules")
+
+// modprobeCommands are the commands understood in modprobe.d(5) files.
+var modprobeCommands = map[string]bool{
+	"alias":     true,
+	"blacklist": true,
+	"install":   true,
+	"options":   true,
+	"remove":    true,
+	"softdep":   true,
+}
+
+// checkModprobeConfig verifies that fn is a well-formed modprobe.d file, so
+// that typos are reported when building instead of being silently ignored by
+// modprobe on the device.
+func checkModprobeConfig(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if !modprobeCommands[fields[0]] {
+			return fmt.Errorf("%s:%d: unknown modprobe.d command %q", fn, lineno, fields[0])
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: %s: missing module name", fn, lineno, fields[0])
+		}
+	}
+	return scanner.Err()
+}
+
+// modprobeConfigFiles returns the files specified in -modprobe_config,
+// expanding directories to the *.conf files they contain.
+func modprobeConfigFiles() ([]string, error) {
+	if *modprobeConfig == "" {
+		return nil, nil
+	}
+	var files []string
+	for _, path := range strings.Split(*modprobeConfig, ",") {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("-modprobe_config: %v", err)
+		}
+		if !fi.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		fis, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("-modprobe_config: %v", err)
+		}
+		for _, fi := range fis {
+			if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".conf") {
+				files = append(files, filepath.Join(path, fi.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// addModprobeConfig adds the -modprobe_config files to /etc/modprobe.d/.
+func addModprobeConfig(etc *fileInfo) error {
+	files, err := modprobeConfigFiles()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	modprobeD := etc.dir("modprobe.d")
+	for _, fn := range files {
+		if err := checkModprobeConfig(fn); err != nil {
+			return err
+		}
+		name := filepath.Base(fn)
+		if !strings.HasSuffix(name, ".conf") {
+			// modprobe ignores files without the .conf suffix:
+			name += ".conf"
+		}
+		for _, ent := range modprobeD.dirents {
+			if ent.filename == name {
+				return fmt.Errorf("-modprobe_config: %s: duplicate file name %s", fn, name)
+			}
+		}
+		modprobeD.dirents = append(modprobeD.dirents, &fileInfo{
+			filename: name,
+			fromHost: fn,
+		})
+	}
+	return nil
+}
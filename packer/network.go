@@ -0,0 +1,166 @@
+package packer
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+var (
+	staticIP = flag.String("static_ip",
+		"",
+		"comma-separated list of addresses in CIDR notation (e.g. 192.168.1.23/24,2001:db8::23/64) which init configures on -static_interface at boot, instead of obtaining an address via DHCP. A static IPv4 address on eth0 removes cmd/dhcp from -gokrazy_pkgs")
+
+	staticGateway = flag.String("static_gateway",
+		"",
+		"comma-separated list of default gateways (at most one IPv4 and one IPv6 address) to use with -static_ip")
+
+	staticInterface = flag.String("static_interface",
+		"eth0",
+		"network interface on which to configure -static_ip")
+
+	dnsServers = flag.String("dns",
+		"",
+		"comma-separated list of DNS servers which init writes to /etc/resolv.conf at boot. Requires a static IPv4 address (-static_ip) on eth0, as cmd/dhcp otherwise replaces them with those of its DHCP lease")
+
+	wifiSSID = flag.String("wifi_ssid",
+		"",
+		"SSID of a WPA2 WiFi network to join on first boot. Written to /etc/wifi.json (and copied to /perm/wifi.json at boot with -perm=rw), the configuration file of the github.com/gokrazy/wifi program, which must be included in the image")
+
+	wifiPSK = flag.String("wifi_psk",
+		"",
+		"pre-shared key (passphrase) of the -wifi_ssid network. Stored in plain text in the image")
+)
+
+const dhcpPkg = "github.com/gokrazy/gokrazy/cmd/dhcp"
+
+// staticNetwork is the contents of /etc/gokrazy/network.json, which the
+// generated init applies at boot.
+type staticNetwork struct {
+	Interface string   `json:"interface"`
+	Addresses []string `json:"addresses,omitempty"` // CIDR notation
+	Gateways  []string `json:"gateways,omitempty"`
+	DNS       []string `json:"dns,omitempty"`
+}
+
+// splitList returns the elements of the comma-separated list s, or nil if s is
+// empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// checkNetworkFlags verifies the static network and WiFi flags for installing
+// pkgs and removes cmd/dhcp from gokrazyPkgs if it would replace the static
+// IPv4 address.
+func checkNetworkFlags(pkgs []string) error {
+	var v4, v6 bool
+	for _, addr := range splitList(*staticIP) {
+		ip, _, err := net.ParseCIDR(addr)
+		if err != nil {
+			return fmt.Errorf("-static_ip: %v (expected e.g. 192.168.1.23/24)", err)
+		}
+		if ip.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	var gw4, gw6 int
+	for _, gw := range splitList(*staticGateway) {
+		ip := net.ParseIP(gw)
+		if ip == nil {
+			return fmt.Errorf("-static_gateway: invalid IP address %q", gw)
+		}
+		if ip.To4() != nil {
+			gw4++
+		} else {
+			gw6++
+		}
+	}
+	if gw4 > 1 || gw6 > 1 {
+		return fmt.Errorf("-static_gateway: at most one IPv4 and one IPv6 gateway can be specified")
+	}
+	if (gw4 > 0 && !v4) || (gw6 > 0 && !v6) {
+		return fmt.Errorf("-static_gateway=%s requires a -static_ip address of the same IP version", *staticGateway)
+	}
+	for _, ns := range splitList(*dnsServers) {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("-dns: invalid IP address %q", ns)
+		}
+	}
+
+	if v4 && *staticInterface == "eth0" {
+		// cmd/dhcp configures eth0 and replaces its addresses and routes:
+		var remaining []string
+		for _, pkg := range gokrazyPkgs {
+			if pkg != dhcpPkg {
+				remaining = append(remaining, pkg)
+			}
+		}
+		gokrazyPkgs = remaining
+	}
+	if *dnsServers != "" {
+		for _, pkg := range gokrazyPkgs {
+			if pkg == dhcpPkg {
+				return fmt.Errorf("-dns requires a static IPv4 address on eth0 (-static_ip), as %s replaces the DNS servers with those of its DHCP lease", dhcpPkg)
+			}
+		}
+	}
+
+	if (*wifiSSID == "") != (*wifiPSK == "") {
+		return fmt.Errorf("-wifi_ssid and -wifi_psk must be specified together")
+	}
+	if *wifiSSID != "" {
+		if n := len(*wifiPSK); n < 8 || n > 63 {
+			return fmt.Errorf("-wifi_psk must be a WPA2 passphrase of 8 to 63 characters, got %d", n)
+		}
+		var found bool
+		for _, pkg := range pkgs {
+			found = found || pkg == "github.com/gokrazy/wifi"
+		}
+		if !found {
+			log.Printf("warning: -wifi_ssid is specified, but github.com/gokrazy/wifi is not among the packages to install, so the device will not join %q", *wifiSSID)
+		}
+	}
+	return nil
+}
+
+// addNetworkConfig adds /etc/gokrazy/network.json (-static_ip, -dns) and
+// /etc/wifi.json (-wifi_ssid) to etc, if specified.
+func addNetworkConfig(etc *fileInfo) error {
+	if *staticIP != "" || *dnsServers != "" {
+		b, err := json.MarshalIndent(&staticNetwork{
+			Interface: *staticInterface,
+			Addresses: splitList(*staticIP),
+			Gateways:  splitList(*staticGateway),
+			DNS:       splitList(*dnsServers),
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		etc.dir("gokrazy").dirents = append(etc.dir("gokrazy").dirents, &fileInfo{
+			filename:    "network.json",
+			fromLiteral: string(b) + "\n",
+		})
+	}
+	if *wifiSSID != "" {
+		b, err := json.Marshal(struct {
+			SSID string `json:"ssid"`
+			PSK  string `json:"psk"`
+		}{*wifiSSID, *wifiPSK})
+		if err != nil {
+			return err
+		}
+		etc.dirents = append(etc.dirents, &fileInfo{
+			filename:    "wifi.json",
+			fromLiteral: string(b) + "\n",
+		})
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	active   = byte(0x80)
+	inactive = byte(0x00)
+
+	// invalidCHS results in using the sector values instead
+	invalidCHS = [3]byte{0xFE, 0xFF, 0xFF}
+
+	FAT       = byte(0xc)
+	EFISystem = byte(0xef)
+	Linux     = byte(0x83)
+	SquashFS  = Linux // SquashFS does not have a dedicated type
+
+	signature = uint16(0xAA55)
+)
+
+var partitionTable = flag.String("partition_table",
+	"mbr",
+	"partition table to write when partitioning (-overwrite): mbr, or gpt (with a protective MBR) for UEFI-based boards and x86 PCs which do not understand MBR partition tables. Also determines the root=PARTUUID= form in cmdline.txt, so specify the same value when updating")
+
+// writePartitionTable writes the partition table for a device of devsize
+// bytes to w.
+func writePartitionTable(w io.WriterAt, devsize uint64, partuuid uint32) error {
+	if min := layout.minBytes(); devsize < min {
+		return fmt.Errorf("device too small: %d bytes, the partitions (see -boot_size, -root_size and -perm_size) require %d bytes", devsize, min)
+	}
+	if *partitionTable == "gpt" {
+		return writeGPTPartitionTable(w, devsize, partuuid)
+	}
+	var buf bytes.Buffer
+	if err := writeMBRPartitionTable(&buf, devsize); err != nil {
+		return err
+	}
+	_, err := w.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+// writeGPTPartitionTable writes a protective MBR and the primary and backup
+// GPT for the same partitions as writeMBRPartitionTable, except that the last
+// partition ends before the backup GPT.
+func writeGPTPartitionTable(w io.WriterAt, devsize uint64, partuuid uint32) error {
+	sectors := devsize / 512
+	parts := []gptPartition{
+		{
+			TypeGUID: guidEFISystem,
+			FirstLBA: bootStartSector,
+			LastLBA:  layout.rootStart(2) - 1,
+			Attrs:    gptAttrLegacyBIOSBootable, // like the boot flag in the MBR
+		},
+		{
+			TypeGUID: guidLinuxFilesystem,
+			FirstLBA: layout.rootStart(2),
+			LastLBA:  layout.rootStart(3) - 1,
+		},
+		{
+			TypeGUID: guidLinuxFilesystem,
+			FirstLBA: layout.rootStart(3),
+			LastLBA:  layout.permStart() - 1,
+		},
+	}
+	if *permMode != "none" {
+		parts = append(parts, gptPartition{
+			TypeGUID: guidLinuxFilesystem,
+			FirstLBA: layout.permStart(),
+			LastLBA:  layout.permStart() + layout.permSectorsOn(sectors-gptSectors) - 1,
+		})
+	}
+	for i := range parts {
+		parts[i].GUID = gptPartUUID(partuuid, i+1)
+		parts[i].Name = gptPartitionNames[i]
+	}
+	primary, backup, err := gptTables(gptPartUUID(partuuid, 0), parts, sectors)
+	if err != nil {
+		return err
+	}
+	sector := make([]byte, 512)
+	binary.LittleEndian.PutUint32(sector[440:], partuuid)
+	protectiveMBR(sector, sectors)
+	if _, err := w.WriteAt(sector, 0); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(primary, 512); err != nil {
+		return err
+	}
+	_, err = w.WriteAt(backup, int64(sectors-gptSectors)*512)
+	return err
+}
+
+// bootPartitionType returns the MBR partition type of the boot partition.
+func bootPartitionType() byte {
+	if *bootMode == "uefi" {
+		return EFISystem
+	}
+	return FAT
+}
+
+func writeMBRPartitionTable(w io.Writer, devsize uint64) error {
+	// partition 4 holds the permanent data partition (unless -perm=none)
+	var perm interface{} = [16]byte{} // unused partition table entry
+	if *permMode != "none" {
+		perm = []interface{}{
+			inactive,
+			invalidCHS,
+			Linux,
+			invalidCHS,
+			uint32(layout.permStart()), // start after partition 3
+			uint32(layout.permSectorsOn(devsize / 512)), // -perm_size or the remainder
+		}
+	}
+
+	for _, v := range []interface{}{
+		[446]byte{}, // boot code
+
+		// partition 1
+		active,
+		invalidCHS,
+		bootPartitionType(),
+		invalidCHS,
+		uint32(bootStartSector),    // start at 8192 sectors
+		uint32(layout.bootSectors), // -boot_size
+
+		// partition 2
+		inactive,
+		invalidCHS,
+		SquashFS,
+		invalidCHS,
+		uint32(layout.rootStart(2)), // start after partition 1
+		uint32(layout.rootSectors),  // -root_size
+
+		// partition 3
+		inactive,
+		invalidCHS,
+		SquashFS,
+		invalidCHS,
+		uint32(layout.rootStart(3)), // start after partition 2
+		uint32(layout.rootSectors),  // -root_size
+
+		perm,
+
+		signature,
+	} {
+		if vs, ok := v.([]interface{}); ok {
+			for _, v := range vs {
+				if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mbrPartition is an entry of an MBR partition table.
+type mbrPartition struct {
+	Status byte
+	Type   byte
+	Start  uint32 // in sectors
+	Size   uint32 // in sectors
+}
+
+// readPartitionTable returns the 4 primary partitions of the MBR in sector.
+func readPartitionTable(sector []byte) ([4]mbrPartition, error) {
+	var parts [4]mbrPartition
+	if len(sector) < 512 || binary.LittleEndian.Uint16(sector[510:]) != signature {
+		return parts, fmt.Errorf("no MBR partition table found")
+	}
+	for i := range parts {
+		entry := sector[446+16*i:]
+		parts[i] = mbrPartition{
+			Status: entry[0],
+			Type:   entry[4],
+			Start:  binary.LittleEndian.Uint32(entry[8:]),
+			Size:   binary.LittleEndian.Uint32(entry[12:]),
+		}
+	}
+	return parts, nil
+}
+
+func partitionDevice(o *os.File, path string, partuuid uint32) error {
+	devsize, err := deviceSize(uintptr(o.Fd()))
+	if err != nil {
+		return err
+	}
+	log.Printf("device holds %d bytes", devsize)
+	if devsize == 0 {
+		return fmt.Errorf("path %s does not seem to be a device", path)
+	}
+
+	if err := writePartitionTable(o, devsize, partuuid); err != nil {
+		return err
+	}
+
+	// Make Linux re-read the partition table. Sequence of system calls like in fdisk(8).
+	unix.Sync()
+
+	if err := rereadPartitions(uintptr(o.Fd())); err != nil {
+		log.Printf("Re-reading partition table failed: %v. Remember to unplug and re-plug the SD card before creating a file system for persistent data, if desired.", err)
+	}
+
+	if err := o.Sync(); err != nil {
+		return err
+	}
+
+	unix.Sync()
+	return nil
+}
+
+func mustUnixConn(fd uintptr) *net.UnixConn {
+	fc, err := net.FileConn(os.NewFile(fd, ""))
+	if err != nil {
+		panic(err)
+	}
+	return fc.(*net.UnixConn)
+}
+
+func sudoPartition(path string, partuuid uint32) (*os.File, error) {
+	return sudoOpen(path, func(path string) (*os.File, error) {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		return f, partitionDevice(f, path, partuuid)
+	})
+}
+
+// sudoOpen opens path using open in a child process running as root (via
+// sudo), which passes the file descriptor back to this process.
+func sudoOpen(path string, open func(path string) (*os.File, error)) (*os.File, error) {
+	if fd, err := strconv.Atoi(os.Getenv("GOKR_PACKER_FD")); err == nil {
+		// child process
+		conn := mustUnixConn(uintptr(fd))
+		f, err := open(path)
+		if err != nil {
+			return nil, err
+		}
+		_, _, err = conn.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), nil)
+		return nil, err
+	}
+
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(pair[0]) // used in the parent process
+
+	// Use absolute path because $PATH might not be the same when using sudo:
+	if exe, err := os.Executable(); err == nil {
+		os.Args[0] = exe
+	}
+
+	cmd := exec.Command("sudo", append([]string{"--preserve-env"}, os.Args...)...)
+	// We cannot use cmd.ExtraFiles with sudo, as sudo closes all file
+	// descriptors but stdin, stdout and stderr.
+	cmd.Env = []string{"GOKR_PACKER_FD=1", "GOKR_PACKER_DEVICE=" + path}
+	cmd.Stdout = os.NewFile(uintptr(pair[1]), "")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	// receive file descriptor
+	conn := mustUnixConn(uintptr(pair[0]))
+	// 32 bytes as per
+	// https://github.com/golang/go/blob/21d2e15ee1bed44a7a1b8f775aff4a57cae9533a/src/syscall/syscall_unix_test.go#L177
+	oob := make([]byte, 32)
+	_, oobn, flags, _, err := conn.ReadMsgUnix(nil, oob)
+	if err != nil {
+		return nil, err
+	}
+	if flags != 0 || oobn <= 0 {
+		return nil, fmt.Errorf("ReadMsgUnix: flags != 0 || oobn <= 0")
+	}
+
+	// file descriptors are now open in this process
+	scm, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if got, want := len(scm), 1; got != want {
+		return nil, fmt.Errorf("SCM message: got %d, want %d", got, want)
+	}
+
+	fds, err := syscall.ParseUnixRights(&scm[0])
+	if err != nil {
+		return nil, err
+	}
+	if got, want := len(fds), 1; got != want {
+		return nil, fmt.Errorf("ParseUnixRights: got %d fds, want %d fds", got, want)
+	}
+
+	return os.NewFile(uintptr(fds[0]), ""), nil
+}
+
+func partition(cfg *Config, path string, partuuid uint32) (*os.File, error) {
+	if cfg.sudo == "always" {
+		return sudoPartition(path, partuuid)
+	}
+	o, err := os.Create(path)
+	if err != nil {
+		pe, ok := err.(*os.PathError)
+		if ok && pe.Err == syscall.EACCES && cfg.sudo == "auto" {
+			// permission denied
+			log.Printf("Using sudo to gain permission to format %s", path)
+			log.Printf("If you prefer, cancel and use: sudo setfacl -m u:${USER}:rw %s", path)
+			return sudoPartition(path, partuuid)
+		}
+		if ok && pe.Err == syscall.EROFS {
+			log.Printf("%s read-only; check if you have a physical write-protect switch on your SD card?", path)
+			return nil, err
+		}
+		return nil, err
+	}
+	return o, partitionDevice(o, path, partuuid)
+}
@@ -0,0 +1,159 @@
+package packer
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+)
+
+var (
+	httpPasswordFile = flag.String("http_password_file",
+		"",
+		"file containing the password of the web interface (user gokrazy) to include in the image, e.g. exported from a password manager. Once the image was written (or the device updated), it replaces the password stored for -hostname")
+
+	newHTTPPassword = flag.Bool("new_http_password",
+		false,
+		"include a new random password for the web interface in the image instead of the one stored for -hostname, e.g. to rotate it. Once the image was written (or the device updated), it replaces the stored password")
+
+	httpPasswordOut = flag.String("http_password_out",
+		"",
+		"file to write the password of the web interface to (mode 0600), e.g. for provisioning scripts. The password is stored in ~/.config/gokrazy/hosts/<hostname>/http-password.txt in any case")
+)
+
+// checkPasswordFlags verifies the -http_password_file, -new_http_password and
+// -http_password_out flags.
+func checkPasswordFlags() error {
+	if *httpPasswordFile != "" && *newHTTPPassword {
+		return fmt.Errorf("-http_password_file and -new_http_password cannot be combined")
+	}
+	if *fleetManifest != "" && (*httpPasswordFile != "" || *httpPasswordOut != "") {
+		return fmt.Errorf("-fleet_manifest uses a password per device (stored in ~/.config/gokrazy/hosts/<hostname>/http-password.txt) and cannot be combined with -http_password_file or -http_password_out")
+	}
+	if *httpPasswordFile != "" {
+		if _, err := readPasswordFile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPasswordFile returns the password in -http_password_file.
+func readPasswordFile() (string, error) {
+	b, err := ioutil.ReadFile(*httpPasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("-http_password_file: %v", err)
+	}
+	pw := strings.TrimSpace(string(b))
+	if pw == "" {
+		return "", fmt.Errorf("-http_password_file: %s is empty", *httpPasswordFile)
+	}
+	// The password is used in URLs (http://gokrazy:<password>@<hostname>/):
+	for _, r := range pw {
+		if r <= ' ' || r > '~' || strings.ContainsRune(":@/?#%", r) {
+			return "", fmt.Errorf("-http_password_file: the password must only contain printable ASCII characters other than space and :@/?#%%")
+		}
+	}
+	return pw, nil
+}
+
+// imagePassword returns the password of the web interface to include in the
+// image: the contents of -http_password_file, a new random password
+// (-new_http_password) or the stored password pw.
+func imagePassword(pw string) (string, error) {
+	switch {
+	case *httpPasswordFile != "":
+		return readPasswordFile()
+	case *newHTTPPassword:
+		return randomPassword(20)
+	}
+	return pw, nil
+}
+
+// storePassword stores pw as the password of hostname, replacing the previous
+// password, and writes it to -http_password_out.
+func storePassword(hostname, pw string) error {
+	const configBaseName = "http-password.txt"
+	dir := string(config.HostnameSpecific(hostname))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, configBaseName), []byte(pw), 0600); err != nil {
+		return err
+	}
+	if *httpPasswordOut != "" {
+		return ioutil.WriteFile(*httpPasswordOut, []byte(pw), 0600)
+	}
+	return nil
+}
+
+func randomChar() (byte, error) {
+	charset := "abcdefghijklmnopqrstuvwxyz" +
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
+		"0123456789"
+
+	bn, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+	if err != nil {
+		return 0, err
+	}
+	n := byte(bn.Int64())
+	return charset[n], nil
+}
+
+func randomPassword(n int) (string, error) {
+	pw := make([]byte, n)
+	for i := 0; i < n; i++ {
+		c, err := randomChar()
+		if err != nil {
+			return "", err
+		}
+		pw[i] = c
+	}
+	return string(pw), nil
+}
+
+func homedir() (string, error) {
+	if u, err := user.Current(); err == nil {
+		return u.HomeDir, nil
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return home, nil
+	}
+	return "", errors.New("$HOME is unset and user.Current failed")
+}
+
+func ensurePasswordFileExists(hostname, defaultPassword string) (password string, err error) {
+	const configBaseName = "http-password.txt"
+	if pwb, err := config.HostnameSpecific(hostname).ReadFile(configBaseName); err == nil {
+		return pwb, nil
+	}
+
+	pw := defaultPassword
+	if pw == "" {
+		pw, err = randomPassword(20)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(config.Gokrazy(), 0700); err != nil {
+		return "", err
+	}
+
+	// Save the password without a trailing \n so that xclip can be used to
+	// copy&paste the password into a browser:
+	//   % xclip < ~/.config/gokrazy/http-password.txt
+	if err := ioutil.WriteFile(filepath.Join(config.Gokrazy(), configBaseName), []byte(pw), 0600); err != nil {
+		return "", err
+	}
+
+	return pw, nil
+}
@@ -0,0 +1,517 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gokrazy/internal/mbr"
+	"github.com/gokrazy/internal/squashfs"
+)
+
+// patchMain replaces or adds files in the root and/or boot file system of an
+// existing gokrazy image, e.g. for hotfixing a single program in a golden
+// image without building all packages. Only the file systems containing
+// patched files are rewritten.
+func patchMain(args []string) error {
+	fset := flag.NewFlagSet("patch", flag.ExitOnError)
+	rootFiles := fset.String("root",
+		"",
+		"comma-separated list of <path>=<host file> pairs to replace or add in the (active) root file system, e.g. /user/hello=./hello")
+	bootFiles := fset.String("boot",
+		"",
+		"comma-separated list of <path>=<host file> pairs to replace or add in the boot file system, e.g. /config.txt=./config.txt")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer patch [-root=<path>=<file>,...] [-boot=<path>=<file>,...] <image>\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	image := parseSingleArg(fset, args)
+	rootPatches, err := parsePatches("-root", *rootFiles)
+	if err != nil {
+		return err
+	}
+	bootPatches, err := parsePatches("-boot", *bootFiles)
+	if err != nil {
+		return err
+	}
+	if len(rootPatches) == 0 && len(bootPatches) == 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	for _, p := range rootPatches {
+		if err := checkPatchBinary(p); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	parts, err := imagePartitions(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", image, err)
+	}
+	if len(parts) < 3 || parts[0].size == 0 {
+		return fmt.Errorf("%s: no gokrazy partition layout found", image)
+	}
+	boot := parts[0]
+
+	// Build the new file systems before writing anything, so that errors do
+	// not leave the image partially patched.
+	var newBoot *os.File
+	if len(bootPatches) > 0 {
+		if newBoot, err = patchBoot(f, boot, bootPatches); err != nil {
+			return err
+		}
+		defer os.Remove(newBoot.Name())
+		defer newBoot.Close()
+	}
+	var (
+		newRoot *os.File
+		root    imagePartition
+	)
+	if len(rootPatches) > 0 {
+		// The (possibly patched) cmdline.txt specifies the active root
+		// partition:
+		var bootFS io.ReaderAt = io.NewSectionReader(f, boot.start, boot.size)
+		if newBoot != nil {
+			bootFS = newBoot
+		}
+		cmdline, err := readBootFile(bootFS, "cmdline.txt")
+		if err != nil {
+			return err
+		}
+		n, err := activeRootPartition(string(cmdline), parts)
+		if err != nil {
+			return err
+		}
+		root = parts[n-1]
+		log.Printf("patching root file system in partition %d", n)
+		if newRoot, err = patchRoot(f, root, rootPatches); err != nil {
+			return err
+		}
+		defer os.Remove(newRoot.Name())
+		defer newRoot.Close()
+	}
+
+	if newBoot != nil {
+		if err := writePartitionContents(f, boot, newBoot); err != nil {
+			return err
+		}
+		if err := fixupMBR(f, boot); err != nil {
+			return err
+		}
+	}
+	if newRoot != nil {
+		if err := writePartitionContents(f, root, newRoot); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("patched %s", image)
+	return nil
+}
+
+// filePatch replaces or adds a file in a file system of an image.
+type filePatch struct {
+	path     string // absolute, e.g. /user/hello
+	hostPath string
+}
+
+// parsePatches parses a comma-separated list of <path>=<host file> pairs.
+func parsePatches(flagName, value string) ([]filePatch, error) {
+	var patches []filePatch
+	if value == "" {
+		return nil, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		idx := strings.IndexByte(pair, '=')
+		if idx == -1 {
+			return nil, fmt.Errorf("%s: %q is not of the form <path>=<host file>", flagName, pair)
+		}
+		p := filePatch{path: "/" + strings.Trim(pair[:idx], "/"), hostPath: pair[idx+1:]}
+		if p.path == "/" || strings.Contains(p.path, "//") {
+			return nil, fmt.Errorf("%s: invalid path %q", flagName, pair[:idx])
+		}
+		for _, component := range strings.Split(p.path[1:], "/") {
+			if component == "." || component == ".." {
+				return nil, fmt.Errorf("%s: invalid path %q", flagName, pair[:idx])
+			}
+		}
+		st, err := os.Stat(p.hostPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", flagName, err)
+		}
+		if !st.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s: %s is not a regular file", flagName, p.hostPath)
+		}
+		patches = append(patches, p)
+	}
+	return patches, nil
+}
+
+// checkPatchBinary verifies that a program which replaces a binary in the root
+// file system can be started on the target (see checkBinary).
+func checkPatchBinary(p filePatch) error {
+	f, err := os.Open(p.hostPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, []byte("\x7fELF")) {
+		return nil // not a program
+	}
+	return checkBinary(p.hostPath, p.path)
+}
+
+// imagePartition locates a partition within an image.
+type imagePartition struct {
+	start, size int64 // in bytes
+	guid        string
+}
+
+// imagePartitions returns the partitions of the image (the MBR entries or the
+// GPT entries, if the MBR is a protective MBR), where index i holds partition
+// i+1.
+func imagePartitions(r io.ReaderAt) ([]imagePartition, error) {
+	sector := make([]byte, 512)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		return nil, err
+	}
+	mbrParts, err := readPartitionTable(sector)
+	if err != nil {
+		return nil, err
+	}
+	var parts []imagePartition
+	if mbrParts[0].Type == 0xee { // protective MBR
+		_, gptParts, err := readGPT(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range gptParts {
+			if p.TypeGUID == "" {
+				parts = append(parts, imagePartition{})
+				continue
+			}
+			parts = append(parts, imagePartition{
+				start: int64(p.FirstLBA) * 512,
+				size:  int64(p.LastLBA-p.FirstLBA+1) * 512,
+				guid:  p.GUID,
+			})
+		}
+		return parts, nil
+	}
+	for _, p := range mbrParts {
+		parts = append(parts, imagePartition{
+			start: int64(p.Start) * 512,
+			size:  int64(p.Size) * 512,
+		})
+	}
+	return parts, nil
+}
+
+// readBootFile returns the contents of the root directory file name of the boot
+// file system.
+func readBootFile(r io.ReaderAt, name string) ([]byte, error) {
+	v, err := readFATVolume(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	files, err := v.readDir(0)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !f.dir && strings.EqualFold(f.name, name) {
+			var buf bytes.Buffer
+			if err := v.copyFile(&buf, f); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}
+	}
+	return nil, fmt.Errorf("%s not found in the boot file system", name)
+}
+
+var (
+	rootPartUUIDRe = regexp.MustCompile(`^PARTUUID=[0-9a-fA-F]{8}-([0-9a-fA-F]{2})$`)
+	rootDeviceRe   = regexp.MustCompile(`^/dev/[a-z0-9]*[a-z](?:p)?([0-9]+)$`)
+)
+
+// activeRootPartition returns the number of the root partition which the
+// root= parameter of cmdline refers to.
+func activeRootPartition(cmdline string, parts []imagePartition) (int, error) {
+	var root string
+	for _, param := range strings.Fields(cmdline) {
+		if strings.HasPrefix(param, "root=") {
+			root = strings.TrimPrefix(param, "root=")
+		}
+	}
+	n := 0
+	switch {
+	case root == "":
+		return 0, fmt.Errorf("cmdline.txt does not contain a root= parameter")
+	case rootPartUUIDRe.MatchString(root):
+		i, _ := strconv.ParseInt(rootPartUUIDRe.FindStringSubmatch(root)[1], 16, 0)
+		n = int(i)
+	case strings.HasPrefix(root, "PARTUUID="):
+		guid := strings.TrimPrefix(root, "PARTUUID=")
+		for i, p := range parts {
+			if p.guid != "" && strings.EqualFold(p.guid, guid) {
+				n = i + 1
+			}
+		}
+	case rootDeviceRe.MatchString(root):
+		n, _ = strconv.Atoi(rootDeviceRe.FindStringSubmatch(root)[1])
+	}
+	if n != 2 && n != 3 {
+		return 0, fmt.Errorf("root=%s does not refer to a root partition (2 or 3) of the image", root)
+	}
+	if n > len(parts) || parts[n-1].size == 0 {
+		return 0, fmt.Errorf("root=%s: partition %d not found", root, n)
+	}
+	return n, nil
+}
+
+// patchRoot writes the root file system in part with patches applied to a
+// temporary file.
+func patchRoot(f io.ReaderAt, part imagePartition, patches []filePatch) (*os.File, error) {
+	sr, err := newSquashfsReader(io.NewSectionReader(f, part.start, part.size))
+	if err != nil {
+		return nil, err
+	}
+	root, err := sr.root()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range patches {
+		components := strings.Split(p.path[1:], "/")
+		dir := root
+		for _, component := range components[:len(components)-1] {
+			var next *squashfsFile
+			for _, ent := range dir.entries {
+				if ent.name == component {
+					next = ent
+				}
+			}
+			if next == nil {
+				next = &squashfsFile{name: component, mode: 0755, modTime: imageTime(), dir: true}
+				dir.entries = append(dir.entries, next)
+			}
+			if !next.dir {
+				return nil, fmt.Errorf("-root: %s: %s is not a directory", p.path, component)
+			}
+			dir = next
+		}
+		name := components[len(components)-1]
+		patched := &squashfsFile{name: name, fromHost: p.hostPath}
+		replaced := false
+		for i, ent := range dir.entries {
+			if ent.name != name {
+				continue
+			}
+			if ent.dir {
+				return nil, fmt.Errorf("-root: %s is a directory", p.path)
+			}
+			// Keep the owner, group and xattrs (e.g. capabilities):
+			patched.uid, patched.gid, patched.xattrs = ent.uid, ent.gid, ent.xattrs
+			dir.entries[i] = patched
+			replaced = true
+		}
+		if !replaced {
+			dir.entries = append(dir.entries, patched)
+		}
+	}
+
+	tmp, err := ioutil.TempFile("", "gokr-packer-patch-root")
+	if err != nil {
+		return nil, err
+	}
+	fw, err := squashfs.NewWriter(tmp, imageTime())
+	if err != nil {
+		return nil, err
+	}
+	fixups := make(map[string]*fileInfo)
+	if err := writeSquashfsFile(fw.Root, sr, root, "", make(map[uint32]string), fixups); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := fixupSquashfs(tmp, fixups); err != nil {
+		return nil, err
+	}
+	if err := addSquashfsExportTable(tmp); err != nil {
+		return nil, err
+	}
+	// Keep the compression of the image:
+	if err := recompressSquashfs(tmp, squashfsCompressionName(sr.sb.Compression)); err != nil {
+		return nil, err
+	}
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size > part.size {
+		return nil, fmt.Errorf("patched root file system (%d bytes) exceeds the %d bytes root partition", size, part.size)
+	}
+	return tmp, nil
+}
+
+// writeSquashfsFile writes f (copied from sr, or from the host for patched
+// files) at path to dir. If f is the root directory, dir is the root directory.
+// Hard links are retained: links maps inode numbers to the path of their first
+// file. Hard links, device nodes, FIFOs and files with an owner, group or
+// xattrs are recorded in fixups (see writeFileInfo).
+func writeSquashfsFile(dir *squashfs.Directory, sr *squashfsReader, f *squashfsFile, path string, links map[uint32]string, fixups map[string]*fileInfo) error {
+	if f.uid != 0 || f.gid != 0 || len(f.xattrs) > 0 {
+		fixups[path] = &fileInfo{filename: f.name, uid: f.uid, gid: f.gid, xattrs: f.xattrs}
+	}
+	switch {
+	case f.fromHost != "":
+		return copyFileSquash(dir, f.name, f.fromHost)
+	case f.symlinkDest != "":
+		return dir.Symlink(f.symlinkDest, f.name, f.modTime, f.mode)
+	case f.device != nil:
+		fixups[path] = &fileInfo{filename: f.name, device: f.device, uid: f.uid, gid: f.gid, xattrs: f.xattrs}
+		return writeSquashfsPlaceholder(dir, f.name, f.modTime)
+	case !f.dir && f.inode != 0 && links[f.inode] != "":
+		fixups[path] = &fileInfo{filename: f.name, hardlinkTarget: links[f.inode]}
+		return writeSquashfsPlaceholder(dir, f.name, f.modTime)
+	case !f.dir:
+		if f.inode != 0 {
+			links[f.inode] = path
+		}
+		w, err := dir.File(f.name, f.modTime, f.mode)
+		if err != nil {
+			return err
+		}
+		if err := sr.copyFile(w, f); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+	d := dir
+	if f.name != "" { // not the root directory
+		d = dir.Directory(f.name, f.modTime)
+	}
+	sort.Slice(f.entries, func(i, j int) bool {
+		return f.entries[i].name < f.entries[j].name
+	})
+	for _, ent := range f.entries {
+		if err := writeSquashfsFile(d, sr, ent, path+"/"+ent.name, links, fixups); err != nil {
+			return err
+		}
+	}
+	return d.Flush()
+}
+
+// patchBoot writes the boot file system in part with patches applied to a
+// temporary file, using the same FAT type.
+func patchBoot(f io.ReaderAt, part imagePartition, patches []filePatch) (*os.File, error) {
+	v, err := readFATVolume(f, part.start)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "gokr-packer-patch-boot")
+	if err != nil {
+		return nil, err
+	}
+	bufw := bufio.NewWriter(tmp)
+	// Keep the volume label (and cluster size) of the patched image:
+	label, err := v.volumeLabel()
+	if err != nil {
+		return nil, err
+	}
+	var fw *fatWriter
+	if v.fat32 {
+		fw, err = newFAT32Writer(bufw, int(v.clusterSize), label)
+	} else {
+		fw, err = newFAT16Writer(bufw, label)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// FAT file names are case-insensitive
+	patched := make(map[string]bool)
+	for _, p := range patches {
+		patched[strings.ToLower(p.path)] = true
+	}
+	if err := v.walk(func(path string, ff fatFile) error {
+		if patched[strings.ToLower(path)] {
+			return nil
+		}
+		w, err := fw.File(path, ff.modTime)
+		if err != nil {
+			return err
+		}
+		return v.copyFile(w, ff)
+	}); err != nil {
+		return nil, err
+	}
+	for _, p := range patches {
+		if err := copyFile(fw, p.path, p.hostPath); err != nil {
+			return nil, fmt.Errorf("-boot: %s: %v", p.path, err)
+		}
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := bufw.Flush(); err != nil {
+		return nil, err
+	}
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size > part.size {
+		return nil, fmt.Errorf("patched boot file system (%d bytes) exceeds the %d bytes boot partition", size, part.size)
+	}
+	return tmp, nil
+}
+
+// writePartitionContents copies the file system in fs to the start of part.
+func writePartitionContents(f *os.File, part imagePartition, fs *os.File) error {
+	if _, err := fs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Seek(part.start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(f, fs)
+	return err
+}
+
+// fixupMBR updates the locations of the kernel and its command line in the
+// gokrazy MBR boot code (if present), as patching the boot file system moves
+// files.
+func fixupMBR(f *os.File, boot imagePartition) error {
+	sector := make([]byte, 512)
+	if _, err := f.ReadAt(sector, 0); err != nil {
+		return err
+	}
+	code := mbr.Configure(0, 0, 0)
+	if !bytes.Equal(sector[:432], code[:432]) {
+		return nil // no gokrazy MBR boot code, e.g. a Raspberry Pi image
+	}
+	if boot.start != bootStartSector*512 {
+		return fmt.Errorf("boot partition starts at sector %d, not %d", boot.start/512, bootStartSector)
+	}
+	partuuid := binary.LittleEndian.Uint32(sector[440:])
+	return writeMBR(io.NewSectionReader(f, boot.start, boot.size), f, partuuid)
+}
@@ -0,0 +1,107 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// permConfig is stored in /etc/gokrazy/perm.json and describes the permanent
+// data partition, e.g. for creating its file system on first boot.
+type permConfig struct {
+	// Mode is rw or ro, see -perm.
+	Mode string `json:"mode"`
+
+	// FS is the file system type (ext4 or f2fs), see -perm_fs.
+	FS string `json:"fs"`
+
+	// Encryption is luks2 if the file system is within a LUKS2 volume, which
+	// the key file /perm.key of the boot partition unlocks, see -perm_luks.
+	Encryption string `json:"encryption,omitempty"`
+
+	// MountOptions are passed when mounting the file system, see
+	// -perm_discard.
+	MountOptions string `json:"mount_options,omitempty"`
+
+	// TrimInterval is how often unused blocks are discarded, see
+	// -perm_trim_interval. Empty means never.
+	TrimInterval string `json:"trim_interval,omitempty"`
+
+	// Persist lists the overlay mounts for directories whose changes are kept
+	// on the permanent data partition, see -perm_persist.
+	Persist []permPersistMount `json:"persist,omitempty"`
+}
+
+// permPersistMount describes an overlay mount which stores changes to a
+// directory of the root file system on the permanent data partition.
+type permPersistMount struct {
+	Dir   string `json:"dir"`
+	Upper string `json:"upper"`
+	Work  string `json:"work"`
+}
+
+// permPersistMounts returns the overlay mounts for the directories specified
+// in -perm_persist.
+func permPersistMounts() ([]permPersistMount, error) {
+	if *permPersist == "" {
+		return nil, nil
+	}
+	var mounts []permPersistMount
+	seen := make(map[string]bool)
+	for _, dir := range strings.Split(*permPersist, ",") {
+		if !path.IsAbs(dir) {
+			return nil, fmt.Errorf("%q is not an absolute path", dir)
+		}
+		dir = path.Clean(dir)
+		switch strings.Split(dir, "/")[1] {
+		case "", "dev", "gokrazy", "perm", "proc", "sys", "tmp":
+			return nil, fmt.Errorf("%s cannot be persisted", dir)
+		}
+		if seen[dir] {
+			return nil, fmt.Errorf("%s specified more than once", dir)
+		}
+		seen[dir] = true
+		base := filepath.Join("/perm/persist", dir)
+		mounts = append(mounts, permPersistMount{
+			Dir:   dir,
+			Upper: filepath.Join(base, "upper"),
+			Work:  filepath.Join(base, "work"),
+		})
+	}
+	return mounts, nil
+}
+
+// permMountOptions returns the mount options (data argument of mount(2)) for
+// the permanent data partition.
+func permMountOptions() string {
+	if *permDiscard {
+		return "discard"
+	}
+	return ""
+}
+
+func permPartitionConfig() (string, error) {
+	cfg := permConfig{
+		Mode:         *permMode,
+		FS:           *permFS,
+		MountOptions: permMountOptions(),
+	}
+	if *permLUKS {
+		cfg.Encryption = "luks2"
+	}
+	if *permTrimInterval > 0 {
+		cfg.TrimInterval = permTrimInterval.String()
+	}
+	persist, err := permPersistMounts()
+	if err != nil {
+		return "", err
+	}
+	cfg.Persist = persist
+	b, err := json.MarshalIndent(&cfg, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
@@ -0,0 +1,76 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// prebuiltBinaryList is the value of the repeatable -prebuilt_binary flag.
+type prebuiltBinaryList []string
+
+func (l *prebuiltBinaryList) String() string { return strings.Join(*l, ",") }
+
+func (l *prebuiltBinaryList) Set(value string) error {
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" && !containsString(*l, path) {
+			*l = append(*l, path)
+		}
+	}
+	return nil
+}
+
+var prebuiltBinaries prebuiltBinaryList
+
+func init() {
+	flag.Var(&prebuiltBinaries, "prebuilt_binary",
+		"path of a statically linked binary built elsewhere (e.g. by Bazel or a cross-compile farm), which is placed in /user (named like the file) and supervised like the programs built from the Go packages, without running go build for it. Can be specified multiple times (or comma-separated). The binary must be an ELF executable for the target architecture")
+}
+
+// checkPrebuiltBinaries verifies that the -prebuilt_binary files exist, are
+// executable and have distinct names.
+func checkPrebuiltBinaries() error {
+	names := make(map[string]string)
+	for _, path := range prebuiltBinaries {
+		st, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("-prebuilt_binary: %v", err)
+		}
+		if !st.Mode().IsRegular() {
+			return fmt.Errorf("-prebuilt_binary: %s is not a regular file", path)
+		}
+		if st.Mode()&0111 == 0 {
+			return fmt.Errorf("-prebuilt_binary: %s is not executable (chmod +x)", path)
+		}
+		name := filepath.Base(path)
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("-prebuilt_binary: %s and %s would both be placed at /user/%s", other, path, name)
+		}
+		names[name] = path
+	}
+	return nil
+}
+
+// addPrebuiltBinaries adds the -prebuilt_binary files to user, which contains
+// the programs built from the Go packages.
+func addPrebuiltBinaries(user *fileInfo) error {
+	for _, path := range prebuiltBinaries {
+		name := filepath.Base(path)
+		for _, ent := range user.dirents {
+			if ent.filename == name {
+				return fmt.Errorf("-prebuilt_binary %s: /user/%s is already built from %s", path, name, ent.importPath)
+			}
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		user.dirents = append(user.dirents, &fileInfo{
+			filename: name,
+			fromHost: abs,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package packer
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+)
+
+var (
+	profile = flag.String("profile",
+		"",
+		"name of a flag profile (saved with -save_profile) to load flag values from. Flags specified on the command line take precedence")
+
+	saveProfile = flag.String("save_profile",
+		"",
+		"save all flags specified on the command line (and loaded via -profile) as a profile with this name, e.g. -save_profile=pi4-dev")
+)
+
+var profileNameRe = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// profilePath returns the path of the named profile, typically
+// ~/.config/gokrazy/profiles/<name>.flags.
+func profilePath(name string) (string, error) {
+	if !profileNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid profile name %q: only letters, digits, dots, dashes and underscores are allowed", name)
+	}
+	return filepath.Join(config.Gokrazy(), "profiles", name+".flags"), nil
+}
+
+// explicitFlags returns the names of the flags which were set on the command
+// line (or by applyProfile).
+func explicitFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// applyProfile sets the flags stored in the -profile file, unless they were
+// specified on the command line. Each line of a profile is of the form
+// <flag>=<value>.
+func applyProfile() error {
+	if *profile == "" {
+		return nil
+	}
+	fn, err := profilePath(*profile)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("profile %q not found (create it using -save_profile=%s)", *profile, *profile)
+		}
+		return err
+	}
+	defer f.Close()
+	set := explicitFlags()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.IndexByte(line, '=')
+		if idx == -1 {
+			return fmt.Errorf("%s: malformed line %q, expected <flag>=<value>", fn, line)
+		}
+		name, value := line[:idx], line[idx+1:]
+		if name == "profile" || name == "save_profile" {
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag -%s", fn, name)
+		}
+		if set[name] {
+			continue // the command line takes precedence
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: -%s: %v", fn, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// saveProfileFlags stores all explicitly set flags as the -save_profile
+// profile.
+func saveProfileFlags() (string, error) {
+	fn, err := profilePath(*saveProfile)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for name := range explicitFlags() {
+		if name == "profile" || name == "save_profile" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	fmt.Fprintf(&b, "# gokr-packer flag profile, use with -profile=%s\n", *saveProfile)
+	for _, name := range names {
+		value := flag.Lookup(name).Value.String()
+		if strings.ContainsAny(value, "\n") {
+			return "", fmt.Errorf("-%s: values containing newlines cannot be saved in a profile", name)
+		}
+		fmt.Fprintf(&b, "%s=%s\n", name, value)
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return "", err
+	}
+	// Profiles may contain passwords (e.g. in -update URLs):
+	return fn, ioutil.WriteFile(fn, []byte(b.String()), 0600)
+}
@@ -0,0 +1,71 @@
+package packer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// programFiles returns the command-line flags (flags/<importPath>/flags.txt,
+// one per line, between those of sshFlags and ntpArgs) and the environment
+// variables (env/<importPath>/env.txt, KEY=value lines) of the program built
+// from importPath.
+func programFiles(importPath string) (flags, env []string, _ error) {
+	flags, err := readPackageConfig("flags", importPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Flags of flags.txt take precedence; positional arguments come last:
+	flags = append(append(sshFlags(importPath), flags...), ntpArgs(importPath)...)
+	env, err = readPackageConfig("env", importPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, line := range env {
+		idx := strings.IndexByte(line, '=')
+		if idx < 1 || !envKeyRe.MatchString(line[:idx]) {
+			return nil, nil, fmt.Errorf("env of %s: %q is not of the form KEY=value", importPath, line)
+		}
+	}
+	return flags, env, nil
+}
+
+// addProgramFiles adds /etc/gokrazy/<program>/flags and env for the programs
+// in /gokrazy and /user of root which have flags.txt or env.txt files. The
+// generated init reads them when starting the program, see
+// serviceConfig.Files.
+func addProgramFiles(root, etcGokrazy *fileInfo) error {
+	for _, dir := range []string{"gokrazy", "user"} {
+		for _, ent := range root.mustFindDirent(dir).dirents {
+			if ent.importPath == "" || (dir == "gokrazy" && ent.filename == "init") {
+				continue // not started by the generated init
+			}
+			flags, env, err := programFiles(ent.importPath)
+			if err != nil {
+				return err
+			}
+			if len(flags) == 0 && len(env) == 0 {
+				continue
+			}
+			for _, existing := range etcGokrazy.dirents {
+				if existing.filename == ent.filename {
+					return fmt.Errorf("flags and env of %s: /etc/gokrazy/%s already exists", ent.importPath, ent.filename)
+				}
+			}
+			files := &fileInfo{filename: ent.filename}
+			if len(flags) > 0 {
+				files.dirents = append(files.dirents, &fileInfo{
+					filename:    "flags",
+					fromLiteral: strings.Join(flags, "\n") + "\n",
+				})
+			}
+			if len(env) > 0 {
+				files.dirents = append(files.dirents, &fileInfo{
+					filename:    "env",
+					fromLiteral: strings.Join(env, "\n") + "\n",
+				})
+			}
+			etcGokrazy.dirents = append(etcGokrazy.dirents, files)
+		}
+	}
+	return nil
+}
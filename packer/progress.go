@@ -0,0 +1,188 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var progressFlag = flag.String("progress",
+	"auto",
+	"how to report the progress of compiling packages, writing the root file system, flashing devices and updating: bar (a progress bar with throughput and ETA on standard error), log (a log message every 10 seconds), none, or auto (bar on terminals, log otherwise and with -format=json)")
+
+func checkProgress() error {
+	switch *progressFlag {
+	case "auto", "bar", "log", "none":
+		return nil
+	}
+	return fmt.Errorf("-progress=%q is not one of auto, bar, log or none", *progressFlag)
+}
+
+// progressMode returns the -progress mode, with auto resolved.
+func progressMode() string {
+	if *progressFlag != "auto" {
+		return *progressFlag
+	}
+	if *reportFormat == "json" {
+		return "log"
+	}
+	if st, err := os.Stderr.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 {
+		return "bar"
+	}
+	return "log"
+}
+
+// progress reports the progress of a long-running operation of total units
+// (bytes, or items such as packages), see -progress.
+type progress struct {
+	name  string
+	unit  string // empty for bytes
+	total int64  // or -1 if unknown
+	mode  string
+
+	mu      sync.Mutex
+	n       int64
+	start   time.Time
+	last    time.Time
+	printed bool
+	done    bool
+}
+
+// newProgress starts reporting the progress of the named operation of total
+// bytes (or -1 if unknown).
+func newProgress(name string, total int64) *progress {
+	now := time.Now()
+	return &progress{name: name, total: total, mode: progressMode(), start: now, last: now}
+}
+
+// newItemProgress is like newProgress, but counts items of the specified unit
+// (e.g. packages) instead of bytes.
+func newItemProgress(name, unit string, total int64) *progress {
+	p := newProgress(name, total)
+	p.unit = unit
+	return p
+}
+
+func (p *progress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.n += n
+	interval := time.Second
+	if p.mode == "log" {
+		interval = 10 * time.Second
+	}
+	if now := time.Now(); !p.done && now.Sub(p.last) >= interval {
+		p.last = now
+		p.print()
+	}
+}
+
+// Write counts len(b) bytes, so that a progress can be used with
+// io.TeeReader or io.MultiWriter.
+func (p *progress) Write(b []byte) (int, error) {
+	p.add(int64(len(b)))
+	return len(b), nil
+}
+
+// finish prints the final progress, if any progress was printed before (i.e.
+// the operation took long enough).
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.done = true
+	if p.printed {
+		p.print()
+	}
+}
+
+func (p *progress) format(n int64) string {
+	if p.unit == "" {
+		return formatBytes(n)
+	}
+	return fmt.Sprintf("%d %s", n, p.unit)
+}
+
+func (p *progress) print() {
+	if p.mode == "none" {
+		return
+	}
+	p.printed = true
+	msg := p.name + ": "
+	if p.total > 0 {
+		pct := p.n * 100 / p.total
+		if pct > 100 {
+			pct = 100
+		}
+		if p.mode == "bar" {
+			const width = 20
+			msg += "[" + strings.Repeat("#", int(pct*width/100)) + strings.Repeat(".", width-int(pct*width/100)) + "] "
+		}
+		msg += fmt.Sprintf("%d%% (%s of %s)", pct, p.format(p.n), p.format(p.total))
+	} else {
+		msg += p.format(p.n)
+	}
+	elapsed := time.Since(p.start)
+	if secs := elapsed.Seconds(); secs > 0 && p.n > 0 {
+		rate := float64(p.n) / secs
+		if p.unit == "" {
+			msg += fmt.Sprintf(", %s/s", formatBytes(int64(rate)))
+		}
+		if !p.done && p.total > p.n {
+			eta := time.Duration(float64(p.total-p.n) / rate * float64(time.Second))
+			msg += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+		} else if p.done {
+			msg += fmt.Sprintf(", took %v", elapsed.Round(100*time.Millisecond))
+		}
+	}
+	if p.mode == "log" {
+		log.Print(msg)
+		return
+	}
+	msg = "\r" + msg + "\033[K" // clear the rest of the line
+	if p.done {
+		msg += "\n"
+	}
+	fmt.Fprint(os.Stderr, msg)
+}
+
+// progressReader reports the progress of reading from the underlying reader.
+type progressReader struct {
+	io.Reader
+	p *progress
+}
+
+// newProgressReader returns a progressReader for the named operation, whose
+// total is the remaining size of r (if known).
+func newProgressReader(name string, r io.Reader) *progressReader {
+	total := int64(-1)
+	switch r := r.(type) {
+	case *os.File:
+		st, err := r.Stat()
+		off, err2 := r.Seek(0, io.SeekCurrent)
+		if err == nil && err2 == nil && st.Mode().IsRegular() {
+			total = st.Size() - off
+		}
+	case *io.LimitedReader:
+		total = r.N
+	case *io.SectionReader:
+		total = r.Size()
+	}
+	return &progressReader{Reader: r, p: newProgress(name, total)}
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.Reader.Read(b)
+	pr.p.add(int64(n))
+	if err == io.EOF {
+		pr.p.finish()
+	}
+	return n, err
+}
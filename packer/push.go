@@ -0,0 +1,114 @@
+package packer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/updater"
+)
+
+// pushMain compiles a single package and uploads only the resulting binary to
+// the running gokrazy installation, which then restarts the service with the
+// new binary (until the next reboot). This skips creating and transferring
+// file system images, which is much faster when iterating on a program.
+func pushMain(args []string) error {
+	fset := packerFlagSet("push")
+	servicePath := fset.String("path",
+		"",
+		"path of the service whose binary to replace (default /user/<binary name>)")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer push -update=<url|yes> [-path=/user/<binary>] <go-package>\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	cfg := flagConfig()
+	env = goEnv(cfg) // for -target_arch
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	pkg := fset.Arg(0)
+
+	ctx := context.Background()
+	mainPkgs, err := mainPackages(ctx, []string{pkg})
+	if err != nil {
+		return err
+	}
+	if len(mainPkgs) != 1 {
+		return fmt.Errorf("%s is not a single main package", pkg)
+	}
+	name := filepath.Base(mainPkgs[0].Target)
+	if *servicePath == "" {
+		*servicePath = "/user/" + name
+	}
+
+	rawurl, err := deviceURL(cfg)
+	if err != nil {
+		return err
+	}
+	updaterObj, err := connectDevice(cfg, rawurl)
+	if err != nil {
+		return err
+	}
+
+	if err := pushProgram(ctx, updaterObj, pkg, name, *servicePath); err != nil {
+		return err
+	}
+	log.Printf("pushed, %s is now running the new binary (until the next reboot)", *servicePath)
+	return nil
+}
+
+// pushProgram compiles the main package pkg, uploads the binary under the
+// specified name and restarts the service at servicePath with it.
+func pushProgram(ctx context.Context, updaterObj *updater.Updater, pkg, name, servicePath string) error {
+	tmpdir, err := ioutil.TempDir("", "gokr-packer")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	bin := filepath.Join(tmpdir, name)
+	log.Printf("building %s", pkg)
+	if err := buildBinary(ctx, pkg, bin); err != nil {
+		return err
+	}
+
+	if err := uploadTemp(updaterObj, name, bin); err != nil {
+		return err
+	}
+
+	log.Printf("restarting %s with the uploaded binary", servicePath)
+	form := url.Values{
+		"path":      []string{servicePath},
+		"diversion": []string{name},
+	}
+	if _, err := deviceDo(updaterObj, http.MethodPost, "divert", "application/x-www-form-urlencoded", strings.NewReader(form.Encode())); err != nil {
+		return fmt.Errorf("diverting %s: %v", servicePath, err)
+	}
+	return nil
+}
+
+// uploadTemp uploads the file at path to the temporary (tmpfs) upload
+// directory of the gokrazy installation, under the specified name.
+func uploadTemp(updaterObj *updater.Updater, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	log.Printf("uploading %s (%d bytes)", name, st.Size())
+	if _, err := deviceDo(updaterObj, http.MethodPut, "uploadtemp/"+name, "application/octet-stream", f); err != nil {
+		return fmt.Errorf("uploading %s: %v", name, err)
+	}
+	return nil
+}
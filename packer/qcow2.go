@@ -0,0 +1,199 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var outputFormat = flag.String("output_format",
+	"raw",
+	"format of the -overwrite image file: raw, or qcow2 to additionally write <file>.qcow2 (a sparse copy of the raw image, e.g. for testing in QEMU)")
+
+const (
+	qcow2ClusterBits = 16
+	qcow2ClusterSize = 1 << qcow2ClusterBits
+
+	// qcow2L2Entries is the number of clusters an L2 table refers to.
+	qcow2L2Entries = qcow2ClusterSize / 8
+
+	// qcow2RefcountEntries is the number of clusters a refcount block
+	// describes (16 bit refcounts).
+	qcow2RefcountEntries = qcow2ClusterSize / 2
+
+	// qcow2Copied marks L1 and L2 entries of clusters with a refcount of 1.
+	qcow2Copied = 1 << 63
+)
+
+// qcow2Header is the header of a version 3 qcow2 image, see
+// https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	IncompatibleFeatures  uint64
+	CompatibleFeatures    uint64
+	AutoclearFeatures     uint64
+	RefcountOrder         uint32
+	HeaderLength          uint32
+}
+
+func divRoundUp(n, d int64) int64 { return (n + d - 1) / d }
+
+// writeQCOW2 writes the raw image src as a qcow2 image to dest. Clusters
+// which only contain zeros are not allocated.
+//
+// The metadata is stored at the start of the image: the header, the L1 table,
+// the refcount table and blocks and the L2 tables (all of them, so that their
+// position is known before the data clusters are written).
+func writeQCOW2(dest, src string) error {
+	stage := startStage("write qcow2 image")
+	defer stage.done()
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size := st.Size()
+
+	virtualClusters := divRoundUp(size, qcow2ClusterSize)
+	l2Tables := divRoundUp(virtualClusters, qcow2L2Entries)
+	l1Clusters := divRoundUp(l2Tables*8, qcow2ClusterSize)
+	// The refcount blocks must cover all clusters of the image, including
+	// the refcount blocks themselves:
+	var refcountBlocks, refcountTableClusters, metaClusters int64
+	for {
+		metaClusters = 1 + l1Clusters + refcountTableClusters + refcountBlocks + l2Tables
+		blocks := divRoundUp(metaClusters+virtualClusters, qcow2RefcountEntries)
+		tableClusters := divRoundUp(blocks*8, qcow2ClusterSize)
+		if blocks == refcountBlocks && tableClusters == refcountTableClusters {
+			break
+		}
+		refcountBlocks, refcountTableClusters = blocks, tableClusters
+	}
+	var (
+		l1Offset             = int64(qcow2ClusterSize)
+		refcountTableOffset  = l1Offset + l1Clusters*qcow2ClusterSize
+		refcountBlocksOffset = refcountTableOffset + refcountTableClusters*qcow2ClusterSize
+		l2Offset             = refcountBlocksOffset + refcountBlocks*qcow2ClusterSize
+		dataOffset           = l2Offset + l2Tables*qcow2ClusterSize
+	)
+
+	f, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if _, err := f.Seek(dataOffset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Copy the non-zero clusters:
+	l2 := make([]uint64, l2Tables*qcow2L2Entries)
+	next := dataOffset
+	bufw := bufio.NewWriterSize(f, 1*MB)
+	r := bufio.NewReaderSize(in, 1*MB)
+	zero := make([]byte, qcow2ClusterSize)
+	cluster := make([]byte, qcow2ClusterSize)
+	for i := int64(0); i < virtualClusters; i++ {
+		n, err := io.ReadFull(r, cluster)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// The last cluster may extend beyond the end of the image:
+		for j := n; j < len(cluster); j++ {
+			cluster[j] = 0
+		}
+		stage.bytes += int64(n)
+		if bytes.Equal(cluster, zero) {
+			continue
+		}
+		if _, err := bufw.Write(cluster); err != nil {
+			return err
+		}
+		l2[i] = uint64(next) | qcow2Copied
+		next += qcow2ClusterSize
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	allocated := next / qcow2ClusterSize
+
+	// Write the metadata:
+	var meta bytes.Buffer
+	hdr := qcow2Header{
+		Magic:                 0x514649fb, // QFI\xfb
+		Version:               3,
+		ClusterBits:           qcow2ClusterBits,
+		Size:                  uint64(size),
+		L1Size:                uint32(l2Tables),
+		L1TableOffset:         uint64(l1Offset),
+		RefcountTableOffset:   uint64(refcountTableOffset),
+		RefcountTableClusters: uint32(refcountTableClusters),
+		RefcountOrder:         4, // 16 bit refcounts
+		HeaderLength:          104,
+	}
+	if err := binary.Write(&meta, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	meta.Write(make([]byte, l1Offset-int64(meta.Len()))) // incl. the end of header extensions
+
+	l1 := make([]uint64, l1Clusters*qcow2ClusterSize/8)
+	for i := int64(0); i < l2Tables; i++ {
+		l1[i] = uint64(l2Offset+i*qcow2ClusterSize) | qcow2Copied
+	}
+	binary.Write(&meta, binary.BigEndian, l1)
+
+	refcountTable := make([]uint64, refcountTableClusters*qcow2ClusterSize/8)
+	for i := int64(0); i < refcountBlocks; i++ {
+		refcountTable[i] = uint64(refcountBlocksOffset + i*qcow2ClusterSize)
+	}
+	binary.Write(&meta, binary.BigEndian, refcountTable)
+
+	refcounts := make([]uint16, refcountBlocks*qcow2RefcountEntries)
+	for i := int64(0); i < allocated; i++ {
+		refcounts[i] = 1
+	}
+	binary.Write(&meta, binary.BigEndian, refcounts)
+
+	binary.Write(&meta, binary.BigEndian, l2)
+	if int64(meta.Len()) != dataOffset {
+		return fmt.Errorf("BUG: qcow2 metadata is %d bytes, expected %d", meta.Len(), dataOffset)
+	}
+	if _, err := f.WriteAt(meta.Bytes(), 0); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), dest); err != nil {
+		return err
+	}
+	log.Printf("wrote %s (%d of %d clusters allocated)", dest, allocated-metaClusters, virtualClusters)
+	return nil
+}
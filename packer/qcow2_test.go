@@ -0,0 +1,108 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQCOW2RoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-packer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// More than one L2 table, with data in the first and last (partial)
+	// cluster and at an L2 table boundary:
+	const size = qcow2L2Entries*qcow2ClusterSize + 3*qcow2ClusterSize + 1234
+	raw := filepath.Join(dir, "disk.img")
+	f, err := os.Create(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{
+		0,
+		5*qcow2ClusterSize + 17,
+		qcow2L2Entries*qcow2ClusterSize - 1,
+		size - 1,
+	} {
+		if _, err := f.WriteAt([]byte{0x47}, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	qcow2 := raw + ".qcow2"
+	if err := writeQCOW2(qcow2, raw); err != nil {
+		t.Fatal(err)
+	}
+	img, err := ioutil.ReadFile(qcow2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hdr qcow2Header
+	if err := binary.Read(bytes.NewReader(img), binary.BigEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Magic != 0x514649fb || hdr.Version != 3 {
+		t.Fatalf("not a qcow2 version 3 image: magic %#x, version %d", hdr.Magic, hdr.Version)
+	}
+	if got, want := hdr.Size, uint64(size); got != want {
+		t.Errorf("virtual size: got %d, want %d", got, want)
+	}
+	if got, want := hdr.L1Size, uint32(2); got != want {
+		t.Errorf("L1 size: got %d, want %d", got, want)
+	}
+
+	const offsetMask = 0x00fffffffffffe00
+	be := binary.BigEndian
+	// Every cluster of the image file is referenced exactly once:
+	refcount := func(off uint64) uint16 {
+		cluster := off / qcow2ClusterSize
+		block := be.Uint64(img[hdr.RefcountTableOffset+cluster/qcow2RefcountEntries*8:])
+		if block == 0 {
+			return 0
+		}
+		return be.Uint16(img[block+cluster%qcow2RefcountEntries*2:])
+	}
+	for off := uint64(0); off < uint64(len(img)); off += qcow2ClusterSize {
+		if got := refcount(off); got != 1 {
+			t.Errorf("refcount of cluster at %d: got %d, want 1", off, got)
+		}
+	}
+
+	got := make([]byte, size)
+	var allocated int
+	for i := uint64(0); i < uint64(hdr.L1Size); i++ {
+		l2 := be.Uint64(img[hdr.L1TableOffset+i*8:]) & offsetMask
+		for j := uint64(0); j < qcow2L2Entries; j++ {
+			entry := be.Uint64(img[l2+j*8:])
+			if entry == 0 {
+				continue
+			}
+			if entry&qcow2Copied == 0 {
+				t.Errorf("L2 entry %d/%d: COPIED flag not set", i, j)
+			}
+			allocated++
+			off := entry & offsetMask
+			copy(got[(i*qcow2L2Entries+j)*qcow2ClusterSize:], img[off:off+qcow2ClusterSize])
+		}
+	}
+	if got, want := allocated, 4; got != want {
+		t.Errorf("allocated data clusters: got %d, want %d", got, want)
+	}
+	want, err := ioutil.ReadFile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("qcow2 image contents differ from the raw image")
+	}
+}
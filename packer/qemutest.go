@@ -0,0 +1,381 @@
+package packer
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	qemuTest = flag.Bool("qemu_test",
+		false,
+		"after writing the -overwrite image file, boot it in QEMU (qemu-system-aarch64, qemu-system-x86_64 or qemu-system-riscv64, plus qemu-img) with a machine type matching -board and fail the build unless it comes up within -qemu_test_timeout. The image itself is not modified")
+
+	qemuTestWait = flag.String("qemu_test_wait",
+		"",
+		"with -qemu_test, the serial console output (a substring of a line) which indicates a successful boot, e.g. \"gokrazy build timestamp\". Empty waits for the gokrazy web interface to respond via the emulated network instead")
+
+	qemuTestTimeout = flag.Duration("qemu_test_timeout",
+		3*time.Minute,
+		"how long -qemu_test waits for the image to boot")
+
+	qemuTestBIOS = flag.String("qemu_test_bios",
+		"",
+		"UEFI firmware (OVMF) for booting -boot_mode=uefi images of -target_arch=amd64 with -qemu_test. Empty searches the usual locations of Linux distributions")
+)
+
+// qemuMachine describes how to boot an image in QEMU.
+type qemuMachine struct {
+	binary string
+	args   []string
+
+	// kernel is true for booting the kernel of the boot file system directly,
+	// with the device tree dtb (if non-empty) and cmdline.txt. Otherwise, the
+	// emulated firmware boots the disk.
+	kernel bool
+	dtb    string
+
+	// sd is true if the disk is an SD card, whose size QEMU requires to be a
+	// power of 2.
+	sd bool
+
+	// drive contains the -drive options for attaching the disk.
+	drive string
+
+	// nic contains the -nic options for user mode networking, or is empty if
+	// the machine has no network QEMU can emulate.
+	nic string
+
+	// firmware contains the boot file system files which the emulated
+	// machine does not use, but the hardware needs for booting.
+	firmware []string
+}
+
+// ovmfPaths are the locations of the OVMF UEFI firmware in Linux
+// distributions.
+var ovmfPaths = []string{
+	"/usr/share/ovmf/OVMF.fd",
+	"/usr/share/OVMF/OVMF_CODE.fd",
+	"/usr/share/edk2/ovmf/OVMF_CODE.fd",
+	"/usr/share/qemu/OVMF.fd",
+}
+
+// qemuTestMachine returns the QEMU machine which emulates the cfg.Board (or
+// -target_arch) and -boot_mode of the image.
+func qemuTestMachine(cfg *Config) (qemuMachine, error) {
+	b := selectedBoard(cfg)
+	switch b.KernelArch {
+	case "x86":
+		m := qemuMachine{
+			binary: "qemu-system-x86_64",
+			args:   []string{"-M", "pc", "-m", "1G"},
+			drive:  "if=virtio",
+			nic:    "model=virtio-net-pci",
+		}
+		if *bootMode == "uefi" {
+			bios := *qemuTestBIOS
+			if bios == "" {
+				for _, fn := range ovmfPaths {
+					if _, err := os.Stat(fn); err == nil {
+						bios = fn
+						break
+					}
+				}
+			}
+			if bios == "" {
+				return m, fmt.Errorf("-qemu_test: UEFI firmware not found in %s, specify -qemu_test_bios", strings.Join(ovmfPaths, ", "))
+			}
+			m.args = append(m.args, "-bios", bios)
+		}
+		return m, nil
+
+	case "riscv64":
+		return qemuMachine{
+			binary: "qemu-system-riscv64",
+			args:   []string{"-M", "virt", "-m", "1G"},
+			kernel: true,
+			drive:  "if=virtio",
+			nic:    "model=virtio-net-pci",
+		}, nil
+	}
+
+	if *bootMode != "firmware" {
+		// u-boot and UEFI boot the kernel with a generic device tree:
+		return qemuMachine{
+			binary: "qemu-system-aarch64",
+			args:   []string{"-M", "virt", "-cpu", "cortex-a72", "-m", "1G"},
+			kernel: true,
+			drive:  "if=virtio",
+			nic:    "model=virtio-net-pci",
+		}, nil
+	}
+	var m qemuMachine
+	switch cfg.Board {
+	case "", "rpi3":
+		m = qemuMachine{
+			args:     []string{"-M", "raspi3b", "-m", "1G"},
+			nic:      "model=usb-net",
+			firmware: []string{"bootcode.bin", "start.elf", "fixup.dat", "config.txt"},
+		}
+	case "rpi4":
+		// QEMU does not emulate the Ethernet controller or USB of the
+		// Raspberry Pi 4:
+		m = qemuMachine{
+			args:     []string{"-M", "raspi4b", "-m", "2G"},
+			firmware: []string{"start4.elf", "fixup4.dat", "config.txt"},
+		}
+	default:
+		return m, fmt.Errorf("-qemu_test: QEMU cannot emulate -board=%s", cfg.Board)
+	}
+	m.binary = "qemu-system-aarch64"
+	m.kernel = true
+	m.dtb = b.DTB
+	if m.dtb == "" {
+		m.dtb = boards["rpi3"].DTB
+	}
+	m.sd = true
+	m.drive = "if=sd"
+	return m, nil
+}
+
+// checkQEMUTest verifies that -qemu_test can boot the image.
+func checkQEMUTest(cfg *Config) error {
+	if !*qemuTest {
+		return nil
+	}
+	if cfg.Image == "" || cfg.Image == "-" {
+		return fmt.Errorf("-qemu_test requires -overwrite=<file>")
+	}
+	m, err := qemuTestMachine(cfg)
+	if err != nil {
+		return err
+	}
+	if *qemuTestWait == "" && m.nic == "" {
+		return fmt.Errorf("-qemu_test: the emulated -board=%s has no network, specify -qemu_test_wait", cfg.Board)
+	}
+	if *qemuTestWait != "" && serialConsoleSetting(cfg) == "disabled" {
+		return fmt.Errorf("-qemu_test_wait requires a -serial_console")
+	}
+	for _, cmd := range []string{m.binary, "qemu-img"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			return fmt.Errorf("-qemu_test: %v", err)
+		}
+	}
+	return nil
+}
+
+// extractBootFile copies the root directory file name of the boot file system
+// of the image img to dir.
+func extractBootFile(img *os.File, dir, name string) (string, error) {
+	b, err := readBootFileOf(img, name)
+	if err != nil {
+		return "", err
+	}
+	fn := filepath.Join(dir, name)
+	return fn, ioutil.WriteFile(fn, b, 0644)
+}
+
+// freeLocalPort returns a TCP port on localhost which is currently unused.
+func freeLocalPort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// runQEMUTest boots the image file fn in QEMU (-qemu_test) and returns an
+// error unless it boots successfully within -qemu_test_timeout.
+func runQEMUTest(cfg *Config, fn string) error {
+	stage := startStage("boot image in QEMU")
+	defer stage.done()
+	m, err := qemuTestMachine(cfg)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return err
+	}
+	img, err := os.Open(abs)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	st, err := img.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := ioutil.TempDir("", "gokr-packer")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Boot a copy-on-write overlay, so that the image is not modified (e.g.
+	// by -perm_mkfs on first boot):
+	size := st.Size()
+	if m.sd {
+		for pow := int64(1); ; pow <<= 1 {
+			if pow >= size {
+				size = pow
+				break
+			}
+		}
+	}
+	disk := filepath.Join(tmpdir, "disk.qcow2")
+	qemuImg := exec.Command("qemu-img", "create", "-q", "-f", "qcow2", "-F", "raw", "-b", abs, disk, strconv.FormatInt(size, 10))
+	qemuImg.Stderr = os.Stderr
+	if err := qemuImg.Run(); err != nil {
+		return fmt.Errorf("%v: %v", qemuImg.Args, err)
+	}
+
+	for _, name := range m.firmware {
+		if _, err := readBootFileOf(img, name); err != nil {
+			return fmt.Errorf("-qemu_test: the image would not boot on the hardware: %v", err)
+		}
+	}
+
+	args := append([]string{}, m.args...)
+	args = append(args,
+		"-display", "none",
+		"-monitor", "none",
+		"-no-reboot",
+		"-drive", "file="+disk+",format=qcow2,"+m.drive)
+	if m.kernel {
+		vmlinuz, err := extractBootFile(img, tmpdir, "vmlinuz")
+		if err != nil {
+			return err
+		}
+		cmdline, err := readBootFileOf(img, "cmdline.txt")
+		if err != nil {
+			return err
+		}
+		args = append(args, "-kernel", vmlinuz, "-append", strings.TrimSpace(string(cmdline)))
+		if m.dtb != "" {
+			dtb, err := extractBootFile(img, tmpdir, m.dtb)
+			if err != nil {
+				return err
+			}
+			args = append(args, "-dtb", dtb)
+		}
+		if *initramfs != "" {
+			initrd, err := extractBootFile(img, tmpdir, strings.TrimPrefix(initrdPath, "/"))
+			if err != nil {
+				return err
+			}
+			args = append(args, "-initrd", initrd)
+		}
+	}
+	if m.sd && strings.HasPrefix(serialConsoleSetting(cfg), "ttyS") {
+		// The mini UART is the second serial port of the Raspberry Pi:
+		args = append(args, "-serial", "null")
+	}
+	args = append(args, "-serial", "stdio")
+	var port int
+	if m.nic != "" {
+		if port, err = freeLocalPort(); err != nil {
+			return err
+		}
+		args = append(args, "-nic", fmt.Sprintf("user,%s,hostfwd=tcp:127.0.0.1:%d-:80", m.nic, port))
+	}
+
+	cmd := exec.Command(m.binary, args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	log.Printf("booting %s in QEMU: %v", fn, cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// The last lines of the serial console are printed if the boot fails:
+	const keep = 40
+	var (
+		console   []string
+		consoleCh = make(chan string)
+		exited    = make(chan struct{})
+	)
+	go func() {
+		defer close(exited)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			consoleCh <- strings.TrimRight(scanner.Text(), "\r")
+		}
+	}()
+	failed := func(reason string) error {
+		return fmt.Errorf("-qemu_test: %s, last serial console output:\n%s", reason, strings.Join(console, "\n"))
+	}
+
+	timeout := time.After(*qemuTestTimeout)
+	poll := time.NewTicker(2 * time.Second)
+	defer poll.Stop()
+	client := &http.Client{Timeout: 2 * time.Second}
+	for {
+		select {
+		case line := <-consoleCh:
+			if console = append(console, line); len(console) > keep {
+				console = console[1:]
+			}
+			if *qemuTestWait != "" && strings.Contains(line, *qemuTestWait) {
+				log.Printf("-qemu_test: image booted (%q on the serial console)", *qemuTestWait)
+				return nil
+			}
+			if strings.Contains(line, "Kernel panic") {
+				return failed("kernel panic")
+			}
+
+		case <-poll.C:
+			if *qemuTestWait != "" {
+				continue
+			}
+			// Any response (typically 401 Unauthorized) means that the
+			// gokrazy web interface is up:
+			resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+			if err != nil {
+				continue
+			}
+			resp.Body.Close()
+			log.Printf("-qemu_test: image booted (web interface responded with %s)", resp.Status)
+			return nil
+
+		case <-exited:
+			return failed("QEMU exited before the image booted")
+
+		case <-timeout:
+			return failed(fmt.Sprintf("image did not boot within %v", *qemuTestTimeout))
+		}
+	}
+}
+
+// readBootFileOf returns the contents of the root directory file name of the
+// boot file system of the image img.
+func readBootFileOf(img *os.File, name string) ([]byte, error) {
+	parts, err := imagePartitions(img)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 || parts[0].size == 0 {
+		return nil, fmt.Errorf("no boot partition found")
+	}
+	return readBootFile(io.NewSectionReader(img, parts[0].start, parts[0].size), name)
+}
@@ -0,0 +1,236 @@
+package packer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var reportFormat = flag.String("format",
+	"text",
+	"output format: text, or json to write log messages as JSON lines (with time, source and msg) to standard error and a JSON build report (artifacts, partitions, PARTUUID, binaries with SHA-256 hashes, build stages and duration) to standard output")
+
+// buildResult records details of the current build for the -format=json
+// report, see logic.
+var buildResult struct {
+	root     *fileInfo
+	partuuid uint32
+}
+
+// jsonLogWriter writes the lines of the log package (with the log.Lshortfile
+// flag) as JSON objects.
+type jsonLogWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// logSourceRe matches the file:line prefix of log.Lshortfile.
+var logSourceRe = regexp.MustCompile(`^([^ :]+\.go:[0-9]+): `)
+
+type jsonLogEntry struct {
+	Time   string `json:"time"`
+	Source string `json:"source,omitempty"`
+	Msg    string `json:"msg"`
+}
+
+func newJSONLogWriter(w io.Writer) *jsonLogWriter {
+	return &jsonLogWriter{enc: json.NewEncoder(w)}
+}
+
+func (jw *jsonLogWriter) Write(p []byte) (int, error) {
+	line := string(p)
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+	}
+	entry := jsonLogEntry{
+		Time: time.Now().UTC().Format(time.RFC3339Nano),
+		Msg:  line,
+	}
+	if m := logSourceRe.FindStringSubmatch(line); m != nil {
+		entry.Source = m[1]
+		entry.Msg = line[len(m[0]):]
+	}
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	if err := jw.enc.Encode(&entry); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// captureStdout redirects messages printed to standard output (e.g. the
+// instructions after writing an image, or the output of child processes) into
+// jw as JSON log entries, until the returned function is called.
+func captureStdout(jw *jsonLogWriter) (restore func(), _ error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				jw.Write([]byte(line))
+			}
+		}
+		io.Copy(ioutil.Discard, r) // lines exceeding the scanner buffer
+	}()
+	return func() {
+		os.Stdout = stdout
+		w.Close()
+		<-done
+		r.Close()
+	}, nil
+}
+
+type reportPartition struct {
+	Number      int    `json:"number"`
+	Name        string `json:"name"`
+	StartSector uint64 `json:"start_sector"`
+	// Sectors is omitted for a permanent data partition which takes up the
+	// remainder of a device of unknown size.
+	Sectors  uint64 `json:"sectors,omitempty"`
+	PartUUID string `json:"partuuid"`
+}
+
+type reportBinary struct {
+	Path       string `json:"path"`
+	ImportPath string `json:"import_path,omitempty"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+}
+
+type reportStage struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+	Bytes   int64   `json:"bytes,omitempty"`
+}
+
+type buildReport struct {
+	Success         bool              `json:"success"`
+	Error           string            `json:"error,omitempty"`
+	BuildTimestamp  string            `json:"build_timestamp,omitempty"`
+	Hostname        string            `json:"hostname"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	Artifacts       *Artifacts        `json:"artifacts"`
+	PartUUID        string            `json:"partuuid,omitempty"`
+	Partitions      []reportPartition `json:"partitions,omitempty"`
+	Binaries        []reportBinary    `json:"binaries,omitempty"`
+	Stages          []reportStage     `json:"stages,omitempty"`
+}
+
+// reportPartitions returns the partitions written to an image or device.
+func reportPartitions(cfg *Config, partuuid uint32) []reportPartition {
+	var permSectors uint64
+	if cfg.TargetStorageBytes > 0 {
+		end := cfg.TargetStorageBytes / 512
+		if *partitionTable == "gpt" {
+			end -= gptSectors
+		}
+		permSectors = layout.permSectorsOn(end)
+	} else {
+		permSectors = layout.permSectors
+	}
+	parts := []reportPartition{
+		{1, "boot", bootStartSector, layout.bootSectors, ""},
+		{2, "root a", layout.rootStart(2), layout.rootSectors, ""},
+		{3, "root b", layout.rootStart(3), layout.rootSectors, ""},
+	}
+	if *permMode != "none" {
+		parts = append(parts, reportPartition{4, "perm", layout.permStart(), permSectors, ""})
+	}
+	for i := range parts {
+		parts[i].PartUUID = rootPartUUID(partuuid, parts[i].Number)
+	}
+	return parts
+}
+
+// reportBinaries returns the files of root which were built from Go packages.
+func reportBinaries(dir string, root *fileInfo) ([]reportBinary, error) {
+	var binaries []reportBinary
+	for _, ent := range root.dirents {
+		p := path.Join(dir, ent.filename)
+		if len(ent.dirents) > 0 {
+			sub, err := reportBinaries(p, ent)
+			if err != nil {
+				return nil, err
+			}
+			binaries = append(binaries, sub...)
+			continue
+		}
+		if ent.fromHost == "" || (ent.importPath == "" && p != "/gokrazy/init") {
+			continue
+		}
+		f, err := os.Open(ent.fromHost)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		binaries = append(binaries, reportBinary{
+			Path:       p,
+			ImportPath: ent.importPath,
+			Size:       n,
+			SHA256:     fmt.Sprintf("%x", h.Sum(nil)),
+		})
+	}
+	return binaries, nil
+}
+
+// writeBuildReport writes the -format=json build report of the build of cfg
+// which took duration and failed with buildErr (if non-nil) to w.
+func writeBuildReport(w io.Writer, cfg *Config, duration time.Duration, buildErr error) error {
+	report := buildReport{
+		Success:         buildErr == nil,
+		BuildTimestamp:  buildTimestamp,
+		Hostname:        cfg.Hostname,
+		DurationSeconds: duration.Seconds(),
+		Artifacts:       currentArtifacts(cfg),
+	}
+	if buildErr != nil {
+		report.Error = buildErr.Error()
+	}
+	if partuuid := buildResult.partuuid; partuuid != 0 {
+		report.PartUUID = fmt.Sprintf("%08x", partuuid)
+		if cfg.Image != "" || len(overwriteBlockDevices) > 0 {
+			report.Partitions = reportPartitions(cfg, partuuid)
+		}
+	}
+	if root := buildResult.root; root != nil && buildErr == nil {
+		binaries, err := reportBinaries("/", root)
+		if err != nil {
+			return err
+		}
+		report.Binaries = binaries
+	}
+	for _, s := range buildStages {
+		if !s.finished {
+			continue
+		}
+		rs := reportStage{Name: s.name, Seconds: s.wall.Seconds()}
+		if s.bytes > 0 {
+			rs.Bytes = s.bytes
+		}
+		report.Stages = append(report.Stages, rs)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&report)
+}
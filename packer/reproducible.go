@@ -0,0 +1,63 @@
+package packer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+var sourceDateEpoch = flag.String("source_date_epoch",
+	os.Getenv("SOURCE_DATE_EPOCH"),
+	"Unix timestamp (default $SOURCE_DATE_EPOCH) to use for all timestamps in the image (the build timestamp, file modification times are clamped to it) instead of the current time. Random values (e.g. the ext4 file system UUID of -perm_mkfs) are derived from it and binaries are built with -trimpath, so that builds from identical inputs produce byte-identical images")
+
+// checkSourceDateEpoch verifies that -source_date_epoch, if specified, is a
+// Unix timestamp.
+func checkSourceDateEpoch() error {
+	if *sourceDateEpoch == "" {
+		return nil
+	}
+	if _, err := strconv.ParseInt(*sourceDateEpoch, 10, 64); err != nil {
+		return fmt.Errorf("-source_date_epoch=%q is not a Unix timestamp (seconds since 1970-01-01)", *sourceDateEpoch)
+	}
+	return nil
+}
+
+// reproducible returns whether -source_date_epoch is specified.
+func reproducible() bool { return *sourceDateEpoch != "" }
+
+// imageTime returns the time to use for timestamps in the image:
+// -source_date_epoch, or the current time.
+func imageTime() time.Time {
+	if sec, err := strconv.ParseInt(*sourceDateEpoch, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC()
+	}
+	return time.Now()
+}
+
+// fileTime returns the modification time to use in the image for a host file
+// which was modified at mtime: mtime, but not later than -source_date_epoch
+// (files are usually modified when checking out or downloading sources).
+func fileTime(mtime time.Time) time.Time {
+	if t := imageTime(); reproducible() && mtime.After(t) {
+		return t
+	}
+	return mtime
+}
+
+// imageRandom fills b with random bytes or, with -source_date_epoch, with
+// bytes derived from -source_date_epoch, -hostname and purpose.
+func imageRandom(cfg *Config, b []byte, purpose string) error {
+	if !reproducible() {
+		_, err := rand.Read(b)
+		return err
+	}
+	for i := 0; i < len(b); i += sha256.Size {
+		h := sha256.Sum256([]byte(fmt.Sprintf("gokrazy %s %s %s %d", purpose, *sourceDateEpoch, cfg.Hostname, i)))
+		copy(b[i:], h[:])
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var rootfsCache = flag.Bool("rootfs_cache",
+	true,
+	"reuse the root file system of a previous build (stored in rootfs/ of -cache_dir, e.g. ~/.cache/gokrazy/rootfs) if the files of the root file system are unchanged, skipping the SquashFS generation. The build timestamp of the previous build is kept, as it is contained in the root file system")
+
+// rootfsCacheEntries is the number of root file systems which are kept in the
+// cache, so that switching back and forth between a few configurations does
+// not result in rebuilds.
+const rootfsCacheEntries = 3
+
+func rootfsCacheDir() (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "rootfs"), nil
+}
+
+// rootfsHash returns the hash of everything the SquashFS image of root is
+// built from: gokr-packer itself, the file system tree (without the build
+// timestamp, see fileInfo.inputs), -rootfs_compression, -rootfs_dedup,
+// -rootfs_fragments and -source_date_epoch.
+func rootfsHash(root *fileInfo) (string, error) {
+	ih := &inputHasher{h: sha256.New()}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if err := ih.file("gokr-packer", exe); err != nil {
+		return "", err
+	}
+	ih.field("flag rootfs_compression", *rootfsCompression)
+	ih.field("flag rootfs_dedup", fmt.Sprint(*rootfsDedup))
+	ih.field("flag rootfs_fragments", fmt.Sprint(*rootfsFragments))
+	ih.field("flag source_date_epoch", *sourceDateEpoch) // file times
+	if err := ih.tree("", root); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", ih.h.Sum(nil)), nil
+}
+
+// copyCachedRoot copies the cached root file system with the specified hash
+// to f, if any, and adopts its build timestamp.
+func copyCachedRoot(f io.Writer, hash string) (bool, error) {
+	dir, err := rootfsCacheDir()
+	if err != nil {
+		return false, nil
+	}
+	fn := filepath.Join(dir, hash+".squashfs")
+	ts, err := ioutil.ReadFile(filepath.Join(dir, hash+".timestamp"))
+	if err != nil {
+		return false, nil // not cached (or incomplete)
+	}
+	in, err := os.Open(fn)
+	if err != nil {
+		return false, nil
+	}
+	defer in.Close()
+	stage := startStage("copy cached root file system")
+	defer stage.done()
+	if _, err := io.Copy(f, &countingReader{in, stage}); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	os.Chtimes(fn, now, now) // most recently used
+	buildTimestamp = strings.TrimSpace(string(ts))
+	log.Printf("root file system unchanged, reusing %s (build timestamp %s)", fn, buildTimestamp)
+	return true, nil
+}
+
+// storeCachedRoot stores the root file system in r (of size bytes) in the
+// cache, replacing the least recently used entry if the cache is full.
+func storeCachedRoot(r io.Reader, size int64, hash string) error {
+	dir, err := rootfsCacheDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// The timestamp marks the entry as complete, so it is written last:
+	if err := os.Remove(filepath.Join(dir, hash+".timestamp")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, hash+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.CopyN(f, r, size); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, hash+".squashfs")); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, hash+".timestamp"), []byte(buildTimestamp+"\n"), 0600); err != nil {
+		return err
+	}
+	return pruneRootfsCache(dir)
+}
+
+// pruneRootfsCache removes all but the rootfsCacheEntries most recently used
+// root file systems.
+func pruneRootfsCache(dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var entries []os.FileInfo
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".squashfs") {
+			entries = append(entries, fi)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().After(entries[j].ModTime())
+	})
+	for idx, fi := range entries {
+		if idx < rootfsCacheEntries {
+			continue
+		}
+		hash := strings.TrimSuffix(fi.Name(), ".squashfs")
+		for _, fn := range []string{hash + ".timestamp", fi.Name()} {
+			if err := os.Remove(filepath.Join(dir, fn)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
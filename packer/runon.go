@@ -0,0 +1,94 @@
+package packer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// runOnMain compiles a package, uploads it to a running gokrazy installation,
+// runs it there (once, i.e. unsupervised) and streams its output back. The
+// uploaded binary is removed afterwards.
+func runOnMain(args []string) error {
+	fset := packerFlagSet("run-on")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer run-on [-flags] <host> <go-package> [-- <args>…]\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	env = goEnv(flagConfig()) // for -target_arch
+	if fset.NArg() < 2 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	host, pkg, runArgs := fset.Arg(0), fset.Arg(1), fset.Args()[2:]
+	if len(runArgs) > 0 && runArgs[0] == "--" {
+		runArgs = runArgs[1:]
+	}
+
+	updaterObj, err := connectHost(host)
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := ioutil.TempDir("", "gokr-packer")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	name := "run-" + filepath.Base(strings.TrimSuffix(pkg, "/..."))
+	bin := filepath.Join(tmpdir, name)
+	log.Printf("building %s", pkg)
+	if err := buildBinary(context.Background(), pkg, bin); err != nil {
+		return err
+	}
+
+	if err := uploadTemp(updaterObj, name, bin); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := deviceDo(updaterObj, http.MethodDelete, "uploadtemp/"+name, "", nil); err != nil {
+			log.Printf("cleaning up %s: %v", name, err)
+		}
+	}()
+
+	form := url.Values{
+		"name": []string{name},
+		"arg":  runArgs,
+	}
+	req, err := http.NewRequest(http.MethodPost, updaterObj.BaseUrl.String()+"runtemp", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := updaterObj.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("runtemp: unexpected HTTP status code: got %d, want %d (body %q)", got, want, string(body))
+	}
+	// The response body is the combined stdout and stderr of the program, its
+	// exit status is sent as HTTP trailer once the program exited.
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return err
+	}
+	status, err := strconv.Atoi(resp.Trailer.Get("X-Gokrazy-Exit-Status"))
+	if err != nil {
+		return fmt.Errorf("connection closed before %s exited", pkg)
+	}
+	if status != 0 {
+		return fmt.Errorf("%s exited with status %d", pkg, status)
+	}
+	return nil
+}
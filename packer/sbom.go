@@ -0,0 +1,426 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	sbomFile = flag.String("sbom",
+		"",
+		"path of a Software Bill of Materials (CycloneDX JSON, e.g. /tmp/full.img.sbom.json) to write after the image, listing the programs of the image with the Go modules (versions and go.sum hashes) they were built from, and the kernel and firmware packages")
+
+	sbomEmbed = flag.Bool("sbom_embed",
+		false,
+		"include the Software Bill of Materials (see -sbom) in the root file system as /etc/sbom.json")
+)
+
+// CycloneDX 1.4 JSON, see https://cyclonedx.org/docs/1.4/json/
+type cdxBOM struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp,omitempty"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	BOMRef     string        `json:"bom-ref"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	PURL       string        `json:"purl,omitempty"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+// goModule is a module which a binary or package was built from.
+type goModule struct {
+	path, version, sum string
+	replaces           string // path@version of the replaced module, if any
+}
+
+// purl returns the package URL of the package pkg (empty for the module
+// itself) in module m, or the empty string if m has no version (e.g. the main
+// module or a directory replacement).
+func (m goModule) purl(pkg string) string {
+	if m.version == "" || m.version == "(devel)" {
+		return ""
+	}
+	purl := "pkg:golang/" + m.path + "@" + m.version
+	if sub := strings.TrimPrefix(pkg, m.path+"/"); pkg != "" && sub != pkg {
+		purl += "#" + sub
+	}
+	return purl
+}
+
+func (m goModule) component() cdxComponent {
+	c := cdxComponent{
+		Type:    "library",
+		BOMRef:  m.purl(""),
+		Name:    m.path,
+		Version: m.version,
+		PURL:    m.purl(""),
+	}
+	if c.BOMRef == "" {
+		c.BOMRef = "module:" + m.path + "@" + m.version
+	}
+	if m.sum != "" {
+		c.Properties = append(c.Properties, cdxProperty{"gokrazy:go_sum", m.sum})
+	}
+	if m.replaces != "" {
+		c.Properties = append(c.Properties, cdxProperty{"gokrazy:replaces", m.replaces})
+	}
+	return c
+}
+
+// goBinary is the build information of a Go binary, see go version -m.
+type goBinary struct {
+	goVersion string
+	pkg       string
+	main      goModule
+	deps      []goModule
+}
+
+// readBuildInfo returns the build information of the Go binaries fns.
+func readBuildInfo(ctx context.Context, fns []string) (map[string]*goBinary, error) {
+	cmd := exec.CommandContext(ctx, "go", append([]string{"version", "-m"}, fns...)...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go version -m: %v", err)
+	}
+	infos := make(map[string]*goBinary)
+	var bin *goBinary
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, "\t") {
+			idx := strings.LastIndex(line, ": ")
+			if idx == -1 {
+				continue
+			}
+			bin = &goBinary{goVersion: line[idx+2:]}
+			infos[line[:idx]] = bin
+			continue
+		}
+		fields := strings.Split(strings.TrimPrefix(line, "\t"), "\t")
+		if bin == nil || len(fields) < 2 {
+			continue
+		}
+		m := goModule{path: fields[1]}
+		if len(fields) > 2 {
+			m.version = fields[2]
+		}
+		if len(fields) > 3 {
+			m.sum = fields[3]
+		}
+		switch fields[0] {
+		case "path":
+			bin.pkg = fields[1]
+		case "mod":
+			bin.main = m
+		case "dep":
+			bin.deps = append(bin.deps, m)
+		case "=>":
+			if len(bin.deps) > 0 {
+				replaced := &bin.deps[len(bin.deps)-1]
+				m.replaces = replaced.path + "@" + replaced.version
+				*replaced = m
+			}
+		}
+	}
+	return infos, nil
+}
+
+// packageModules returns the modules providing the packages pkgs, by import
+// path.
+func packageModules(ctx context.Context, pkgs []string) (map[string]goModule, error) {
+	cmd := exec.CommandContext(ctx, "go", append([]string{"list", "-f", "{{ .ImportPath }}{{ with .Module }}\t{{ .Path }}\t{{ .Version }}\t{{ .Sum }}{{ with .Replace }}\t{{ .Path }}\t{{ .Version }}\t{{ .Sum }}{{ end }}{{ end }}"}, pkgs...)...)
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	modules := make(map[string]goModule)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\t")
+		for len(fields) < 4 {
+			fields = append(fields, "")
+		}
+		m := goModule{path: fields[1], version: fields[2], sum: fields[3]}
+		if len(fields) == 7 {
+			m = goModule{
+				path:     fields[4],
+				version:  fields[5],
+				sum:      fields[6],
+				replaces: fields[1] + "@" + fields[2],
+			}
+		}
+		modules[fields[0]] = m
+	}
+	return modules, nil
+}
+
+func fileSHA256(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// generateSBOM returns the Software Bill of Materials of the image with the
+// root file system root (whose binaries must be installed). The timestamp is
+// set when writing the SBOM, see -sbom.
+func generateSBOM(ctx context.Context, cfg *Config, root *fileInfo) (*cdxBOM, error) {
+	// Collect the Go binaries of the root file system, e.g. /gokrazy/init and
+	// /user/hello:
+	var paths, fns []string
+	generated := make(map[string]bool)
+	var walk func(dir string, fi *fileInfo)
+	walk = func(dir string, fi *fileInfo) {
+		for _, ent := range fi.dirents {
+			p := path.Join(dir, ent.filename)
+			walk(p, ent)
+			if ent.fromHost == "" {
+				continue
+			}
+			if ent.importPath == "" && p != "/gokrazy/init" {
+				continue // not a binary
+			}
+			paths = append(paths, p)
+			fns = append(fns, ent.fromHost)
+			if ent.importPath == "" {
+				generated[p] = true // contains the build timestamp
+			}
+		}
+	}
+	walk("/", root)
+	infos, err := readBuildInfo(ctx, fns)
+	if err != nil {
+		return nil, err
+	}
+
+	bom := &cdxBOM{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+		Metadata: cdxMetadata{
+			Tools: []cdxTool{{Name: "gokr-packer", Version: packerVersion()}},
+			Component: cdxComponent{
+				Type:   "operating-system",
+				BOMRef: "image",
+				Name:   cfg.Hostname,
+				Properties: []cdxProperty{
+					{"gokrazy:hostname", cfg.Hostname},
+					{"gokrazy:target_arch", targetArchSetting(cfg)},
+				},
+			},
+		},
+	}
+	image := cdxDependency{Ref: "image"}
+	modules := make(map[string]cdxComponent)
+	for idx, p := range paths {
+		bin, ok := infos[fns[idx]]
+		if !ok {
+			return nil, fmt.Errorf("%s (%s): no Go build information found", p, fns[idx])
+		}
+		c := cdxComponent{
+			Type:    "application",
+			BOMRef:  "file:" + p,
+			Name:    bin.pkg,
+			Version: bin.main.version,
+			PURL:    bin.main.purl(bin.pkg),
+			Properties: []cdxProperty{
+				{"gokrazy:path", p},
+				{"gokrazy:go_version", bin.goVersion},
+			},
+		}
+		if generated[p] {
+			c.Name = "init" // built from the generated source, not a package
+			c.Properties = append(c.Properties, cdxProperty{"gokrazy:generated", "true"})
+		} else {
+			sum, err := fileSHA256(fns[idx])
+			if err != nil {
+				return nil, err
+			}
+			c.Hashes = []cdxHash{{Alg: "SHA-256", Content: sum}}
+		}
+		bom.Components = append(bom.Components, c)
+		image.DependsOn = append(image.DependsOn, c.BOMRef)
+
+		dep := cdxDependency{Ref: c.BOMRef}
+		for _, m := range append([]goModule{bin.main}, bin.deps...) {
+			if m.path == "" {
+				continue
+			}
+			mc := m.component()
+			modules[mc.BOMRef] = mc
+			dep.DependsOn = append(dep.DependsOn, mc.BOMRef)
+		}
+		bom.Dependencies = append(bom.Dependencies, dep)
+	}
+
+	// The kernel and firmware are not Go binaries, but are distributed as Go
+	// packages (or as -kernel_source and -firmware_source artifacts):
+	var pkgs, types []string
+	for _, pkg := range kernelPackages(cfg) {
+		if pkg != "" {
+			pkgs = append(pkgs, pkg)
+			types = append(types, "operating-system")
+		}
+	}
+	for _, pkg := range firmwarePackages(cfg) {
+		pkgs = append(pkgs, pkg)
+		types = append(types, "firmware")
+	}
+	if len(pkgs) > 0 {
+		mods := make(map[string]goModule)
+		if gopkgs := goPackages(pkgs); len(gopkgs) > 0 {
+			var err error
+			if mods, err = packageModules(ctx, gopkgs); err != nil {
+				return nil, err
+			}
+		}
+		seen := make(map[string]bool)
+		for idx, pkg := range pkgs {
+			if seen[pkg] {
+				continue
+			}
+			seen[pkg] = true
+			if isArtifactSource(pkg) {
+				c, err := artifactComponent(ctx, pkg)
+				if err != nil {
+					return nil, err
+				}
+				c.Type = types[idx]
+				bom.Components = append(bom.Components, c)
+				image.DependsOn = append(image.DependsOn, c.BOMRef)
+				continue
+			}
+			m, ok := mods[pkg]
+			if !ok {
+				return nil, fmt.Errorf("go list %s: package not found", pkg)
+			}
+			c := m.component()
+			c.Type = types[idx]
+			c.Name = pkg
+			c.PURL = m.purl(pkg)
+			c.BOMRef = "package:" + pkg
+			bom.Components = append(bom.Components, c)
+			image.DependsOn = append(image.DependsOn, c.BOMRef)
+		}
+	}
+
+	refs := make([]string, 0, len(modules))
+	for ref := range modules {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		bom.Components = append(bom.Components, modules[ref])
+	}
+	bom.Dependencies = append([]cdxDependency{image}, bom.Dependencies...)
+	return bom, nil
+}
+
+// artifactComponent returns the SBOM component of the -kernel_source or
+// -firmware_source artifact source, identified by its digest.
+func artifactComponent(ctx context.Context, source string) (cdxComponent, error) {
+	dir, err := artifactDir(ctx, source)
+	if err != nil {
+		return cdxComponent{}, err
+	}
+	return cdxComponent{
+		BOMRef: "artifact:" + source,
+		Name:   source,
+		Hashes: []cdxHash{{Alg: "SHA-256", Content: filepath.Base(dir)}},
+	}, nil
+}
+
+// render returns the SBOM as indented JSON with the specified timestamp.
+func (bom *cdxBOM) render(timestamp string) (string, error) {
+	bom.Metadata.Timestamp = timestamp
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(bom); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// addSBOM adds /etc/sbom.json (see -sbom_embed) to the root file system.
+func addSBOM(etc *fileInfo, bom *cdxBOM) error {
+	contents, err := bom.render(buildTimestamp)
+	if err != nil {
+		return err
+	}
+	// Like the generated init, the SBOM contains the build timestamp:
+	inputs, err := bom.render("")
+	if err != nil {
+		return err
+	}
+	etc.dirents = append(etc.dirents, &fileInfo{
+		filename:    "sbom.json",
+		fromLiteral: contents,
+		inputs:      inputs,
+	})
+	return nil
+}
+
+// writeSBOM writes the SBOM to the -sbom file.
+func writeSBOM(bom *cdxBOM) error {
+	// The build timestamp of a reused root file system (see -rootfs_cache)
+	// matches its embedded SBOM:
+	contents, err := bom.render(buildTimestamp)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*sbomFile, []byte(contents), 0644)
+}
@@ -0,0 +1,204 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+)
+
+var sealedSecrets = flag.String("sealed_secrets",
+	"",
+	"comma-separated list of files (e.g. API tokens, WiFi PSKs) to encrypt against the -hostname specific seal key (see gokr-packer seal-key). Init decrypts them to /tmp/secrets/<name> at boot, the image only contains the encrypted files")
+
+// sealMagic starts each sealed file. The format is:
+//
+//	sealMagic
+//	uint16 (big endian) length of the wrapped key
+//	AES-256 key, wrapped using RSA-OAEP (SHA-256) with the seal key
+//	12 byte nonce
+//	AES-256-GCM ciphertext, with the file name as additional data
+//
+// The decryption is implemented in the generated init (package gokrazyinit).
+const sealMagic = "GKSEAL1\n"
+
+// sealKeyPaths returns the paths of the private and public seal key of host,
+// e.g. ~/.config/gokrazy/hostname/seal.key.pem.
+func sealKeyPaths(host string) (priv, pub string) {
+	dir := string(config.HostnameSpecific(host))
+	return filepath.Join(dir, "seal.key.pem"), filepath.Join(dir, "seal.pub.pem")
+}
+
+// ensureSealKey returns the public seal key of host, generating a new key
+// pair if none exists yet.
+func ensureSealKey(host string) (*rsa.PublicKey, error) {
+	privPath, pubPath := sealKeyPaths(host)
+	b, err := ioutil.ReadFile(pubPath)
+	if os.IsNotExist(err) {
+		log.Printf("generating seal key for %s in %s (install it using gokr-packer seal-key -install %s)", host, privPath, host)
+		if err := generateSealKey(privPath, pubPath); err != nil {
+			return nil, err
+		}
+		b, err = ioutil.ReadFile(pubPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", pubPath)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", pubPath, err)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", pubPath)
+	}
+	return rsaPub, nil
+}
+
+func generateSealKey(privPath, pubPath string) error {
+	priv, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		return err
+	}
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(privPath), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0644)
+}
+
+// seal encrypts the contents of the secret name against pub.
+func seal(pub *rsa.PublicKey, name string, plaintext []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(sealMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(len(wrapped)))
+	buf.Write(wrapped)
+	buf.Write(nonce)
+	buf.Write(gcm.Seal(nil, nonce, plaintext, []byte(name)))
+	return buf.Bytes(), nil
+}
+
+// addSealedSecrets adds the -sealed_secrets files, sealed against the seal key
+// of hostname, to /etc/gokrazy/sealed/.
+func addSealedSecrets(hostname string, etcGokrazy *fileInfo) error {
+	if *sealedSecrets == "" {
+		return nil
+	}
+	pub, err := ensureSealKey(hostname)
+	if err != nil {
+		return err
+	}
+	sealed := etcGokrazy.dir("sealed")
+	for _, fn := range strings.Split(*sealedSecrets, ",") {
+		name := filepath.Base(fn)
+		for _, ent := range sealed.dirents {
+			if ent.filename == name {
+				return fmt.Errorf("-sealed_secrets: duplicate file name %s", name)
+			}
+		}
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		ciphertext, err := seal(pub, name, b)
+		if err != nil {
+			return fmt.Errorf("sealing %s: %v", fn, err)
+		}
+		sealed.dirents = append(sealed.dirents, &fileInfo{
+			filename:    name,
+			fromLiteral: string(ciphertext),
+			inputs:      fmt.Sprintf("%x %x", sha256.Sum256(b), pub.N.Bytes()),
+		})
+	}
+	return nil
+}
+
+// sealKeyMain generates the seal key of a gokrazy installation (if it does
+// not exist yet) and optionally installs it on the device.
+func sealKeyMain(args []string) error {
+	fset := packerFlagSet("seal-key")
+	install := fset.Bool("install",
+		false,
+		"install the private seal key on the gokrazy installation (stored in /perm/gokrazy/seal.key.pem)")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer seal-key [-flags] <host>\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	host := parseSingleArg(fset, args)
+
+	if _, err := ensureSealKey(host); err != nil {
+		return err
+	}
+	privPath, pubPath := sealKeyPaths(host)
+	if !*install {
+		fmt.Printf("public seal key: %s\n", pubPath)
+		fmt.Printf("private seal key: %s\n", privPath)
+		fmt.Printf("\n")
+		fmt.Printf("Install the private key on %s using gokr-packer seal-key -install %s,\n", host, host)
+		fmt.Printf("or by copying it to gokrazy/seal.key.pem on its permanent data partition.\n")
+		return nil
+	}
+
+	priv, err := ioutil.ReadFile(privPath)
+	if err != nil {
+		return err
+	}
+	updaterObj, err := connectHost(host)
+	if err != nil {
+		return err
+	}
+	if _, err := deviceDo(updaterObj, http.MethodPut, "seal/key", "application/x-pem-file", bytes.NewReader(priv)); err != nil {
+		return err
+	}
+	log.Printf("installed the seal key on %s, sealed secrets are decrypted when booting", host)
+	return nil
+}
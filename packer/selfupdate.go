@@ -0,0 +1,289 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// releaseManifest describes the latest gokr-packer release. It is signed
+// (ed25519) by the release key, the base64-encoded signature of the manifest
+// file is stored next to it with a .sig suffix.
+type releaseManifest struct {
+	Version string `json:"version"`
+
+	// Binaries maps GOOS/GOARCH (e.g. linux/amd64) to the release binary.
+	Binaries map[string]struct {
+		URL    string `json:"url"` // relative to the manifest URL
+		SHA256 string `json:"sha256"`
+	} `json:"binaries"`
+}
+
+// packerVersion returns the module version of the running gokr-packer binary.
+func packerVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return "(unknown)"
+}
+
+var selfUpdateClient = &http.Client{Timeout: 5 * time.Minute}
+
+// fetch returns the body of rawurl.
+func fetch(rawurl string) ([]byte, error) {
+	resp, err := selfUpdateClient.Get(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("%s: unexpected HTTP status code: got %d, want %d", rawurl, got, want)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// selfUpdateMain replaces the running gokr-packer binary with the latest
+// release, as described by a signed release manifest. This keeps unattended
+// installations (e.g. flashing stations) up to date.
+func selfUpdateMain(args []string) error {
+	fset := flag.NewFlagSet("self-update", flag.ExitOnError)
+	releaseURL := fset.String("release_url",
+		os.Getenv("GOKR_PACKER_RELEASE_URL"),
+		"URL of the release manifest (JSON) describing the latest release (default $GOKR_PACKER_RELEASE_URL)")
+	publicKey := fset.String("public_key",
+		os.Getenv("GOKR_PACKER_RELEASE_KEY"),
+		"base64-encoded ed25519 public key to verify the release manifest signature with (default $GOKR_PACKER_RELEASE_KEY)")
+	check := fset.Bool("check",
+		false,
+		"only check whether a newer release is available, do not update")
+	force := fset.Bool("force",
+		false,
+		"replace the binary even if the release is not newer than the running version, e.g. to downgrade or to update development builds")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer self-update -release_url=<url> -public_key=<key>\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if *releaseURL == "" || *publicKey == "" || fset.NArg() > 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	key, err := base64.StdEncoding.DecodeString(*publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("-public_key: not a base64-encoded ed25519 public key")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	return selfUpdate(exe, packerVersion(), *releaseURL, ed25519.PublicKey(key), *check, *force)
+}
+
+// selfUpdate replaces exe, which is gokr-packer version current, with the
+// release described by the manifest at releaseURL if the release is newer
+// (or force is set). The manifest must be signed by key.
+func selfUpdate(exe, current, releaseURL string, key ed25519.PublicKey, check, force bool) error {
+	base, err := url.Parse(releaseURL)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := fetch(releaseURL)
+	if err != nil {
+		return err
+	}
+	sig, err := fetch(releaseURL + ".sig")
+	if err != nil {
+		return err
+	}
+	sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("%s.sig: %v", releaseURL, err)
+	}
+	if !ed25519.Verify(key, manifest, sig) {
+		return fmt.Errorf("%s: signature verification failed, refusing to update", releaseURL)
+	}
+	var release releaseManifest
+	if err := json.Unmarshal(manifest, &release); err != nil {
+		return fmt.Errorf("%s: %v", releaseURL, err)
+	}
+
+	// A validly signed, but older manifest (e.g. replayed by an attacker or
+	// served by a stale mirror) must not downgrade gokr-packer:
+	rv, err := parseSemver(release.Version)
+	if err != nil {
+		return fmt.Errorf("%s: release version: %v", releaseURL, err)
+	}
+	if !force {
+		cv, err := parseSemver(current)
+		if err != nil {
+			return fmt.Errorf("cannot compare release %s with the running version %s (%v), specify -force to update anyway", release.Version, current, err)
+		}
+		switch c := rv.compare(cv); {
+		case c == 0:
+			log.Printf("gokr-packer is up to date (version %s)", current)
+			return nil
+		case c < 0:
+			return fmt.Errorf("release %s is older than the running version %s, refusing to downgrade (specify -force to downgrade)", release.Version, current)
+		}
+	}
+	log.Printf("release %s is available (running %s)", release.Version, current)
+	if check {
+		return nil
+	}
+
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	bin, ok := release.Binaries[platform]
+	if !ok {
+		return fmt.Errorf("release %s contains no binary for %s", release.Version, platform)
+	}
+	want, err := hex.DecodeString(bin.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("release %s: malformed sha256 %q for %s", release.Version, bin.SHA256, platform)
+	}
+	binURL, err := base.Parse(bin.URL)
+	if err != nil {
+		return err
+	}
+	b, err := fetch(binURL.String())
+	if err != nil {
+		return err
+	}
+	if got := sha256.Sum256(b); !bytes.Equal(got[:], want) {
+		return fmt.Errorf("%s: sha256 mismatch: got %x, want %x", binURL, got, want)
+	}
+
+	// Replace the binary atomically, so that an interrupted update does not
+	// leave a broken gokr-packer behind:
+	f, err := ioutil.TempFile(filepath.Dir(exe), ".gokr-packer-update")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	if err := f.Chmod(0755); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), exe); err != nil {
+		return err
+	}
+	log.Printf("updated %s to %s", exe, release.Version)
+	return nil
+}
+
+// semver is a parsed semantic version (https://semver.org/), like the module
+// versions of gokr-packer releases, e.g. v0.0.0-20200601000000-0123456789ab.
+type semver struct {
+	major, minor, patch uint64
+	pre                 []string // pre-release identifiers
+}
+
+// parseSemver parses v, which starts with a v like Go module versions. Build
+// metadata (+…) is ignored.
+func parseSemver(v string) (semver, error) {
+	var sv semver
+	if !strings.HasPrefix(v, "v") {
+		return sv, fmt.Errorf("%q is not a semantic version", v)
+	}
+	s := strings.TrimPrefix(v, "v")
+	if idx := strings.IndexByte(s, '+'); idx > -1 {
+		s = s[:idx]
+	}
+	if idx := strings.IndexByte(s, '-'); idx > -1 {
+		sv.pre = strings.Split(s[idx+1:], ".")
+		s = s[:idx]
+		for _, id := range sv.pre {
+			if id == "" {
+				return sv, fmt.Errorf("%q is not a semantic version", v)
+			}
+		}
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return sv, fmt.Errorf("%q is not a semantic version", v)
+	}
+	for i, n := range []*uint64{&sv.major, &sv.minor, &sv.patch} {
+		var err error
+		if *n, err = strconv.ParseUint(parts[i], 10, 64); err != nil {
+			return sv, fmt.Errorf("%q is not a semantic version", v)
+		}
+	}
+	return sv, nil
+}
+
+// compare returns -1, 0 or +1 if sv is lower than, equal to or higher than
+// o, following the precedence rules of semantic versioning.
+func (sv semver) compare(o semver) int {
+	cmp := func(a, b uint64) int {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+	if c := cmp(sv.major, o.major); c != 0 {
+		return c
+	}
+	if c := cmp(sv.minor, o.minor); c != 0 {
+		return c
+	}
+	if c := cmp(sv.patch, o.patch); c != 0 {
+		return c
+	}
+	// A version without pre-release identifiers is higher than one with:
+	switch {
+	case len(sv.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(sv.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(sv.pre) && i < len(o.pre); i++ {
+		a, aerr := strconv.ParseUint(sv.pre[i], 10, 64)
+		b, berr := strconv.ParseUint(o.pre[i], 10, 64)
+		switch {
+		case aerr == nil && berr == nil:
+			if c := cmp(a, b); c != 0 {
+				return c
+			}
+		case aerr == nil: // numeric identifiers are lower
+			return -1
+		case berr == nil:
+			return 1
+		default:
+			if c := strings.Compare(sv.pre[i], o.pre[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmp(uint64(len(sv.pre)), uint64(len(o.pre)))
+}
@@ -0,0 +1,164 @@
+package packer
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	// In ascending order of precedence, see https://semver.org/#spec-item-11:
+	versions := []string{
+		"v0.0.0-20200531194636-d96421c60091",
+		"v0.0.0-20200601000000-0123456789ab",
+		"v1.0.0-alpha",
+		"v1.0.0-alpha.1",
+		"v1.0.0-alpha.beta",
+		"v1.0.0-beta",
+		"v1.0.0-beta.2",
+		"v1.0.0-beta.11",
+		"v1.0.0-rc.1",
+		"v1.0.0",
+		"v1.0.1",
+		"v1.2.0",
+		"v1.10.0",
+		"v2.0.0+incompatible",
+	}
+	for i, a := range versions {
+		av, err := parseSemver(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, b := range versions {
+			bv, err := parseSemver(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := av.compare(bv); got != want {
+				t.Errorf("compare(%s, %s) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+	for _, v := range []string{"(devel)", "(unknown)", "1.0.0", "v1.0", "v1.0.0-", "v1.0.0-a..b", "v1.x.0"} {
+		if _, err := parseSemver(v); err == nil {
+			t.Errorf("parseSemver(%q) unexpectedly succeeded", v)
+		}
+	}
+}
+
+// releaseServer serves a release manifest for version, signed by the returned
+// key, and a release binary for the running platform.
+func releaseServer(t *testing.T, version string) (*httptest.Server, ed25519.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := []byte("gokr-packer " + version)
+	sum := sha256.Sum256(bin)
+	var release releaseManifest
+	release.Version = version
+	release.Binaries = map[string]struct {
+		URL    string `json:"url"`
+		SHA256 string `json:"sha256"`
+	}{
+		runtime.GOOS + "/" + runtime.GOARCH: {URL: "gokr-packer", SHA256: hex.EncodeToString(sum[:])},
+	}
+	manifest, err := json.Marshal(&release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest.json", func(w http.ResponseWriter, r *http.Request) { w.Write(manifest) })
+	mux.HandleFunc("/latest.json.sig", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(sig)) })
+	mux.HandleFunc("/gokr-packer", func(w http.ResponseWriter, r *http.Request) { w.Write(bin) })
+	return httptest.NewServer(mux), pub
+}
+
+func TestSelfUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-packer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, "gokr-packer")
+	const running = "gokr-packer v1.2.0"
+	reset := func() {
+		if err := ioutil.WriteFile(exe, []byte(running), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	contents := func() string {
+		b, err := ioutil.ReadFile(exe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		release string
+		current string
+		force   bool
+		wantErr string
+		want    string // contents of exe afterwards
+	}{
+		{"newer", "v1.3.0", "v1.2.0", false, "", "gokr-packer v1.3.0"},
+		{"newer pseudo-version", "v1.2.1-0.20200601000000-0123456789ab", "v1.2.0", false, "", "gokr-packer v1.2.1-0.20200601000000-0123456789ab"},
+		{"same", "v1.2.0", "v1.2.0", false, "", running},
+		{"older", "v1.1.0", "v1.2.0", false, "refusing to downgrade", running},
+		{"older pre-release", "v1.2.0-rc.1", "v1.2.0", false, "refusing to downgrade", running},
+		{"older with -force", "v1.1.0", "v1.2.0", true, "", "gokr-packer v1.1.0"},
+		{"development build", "v1.3.0", "(devel)", false, "-force", running},
+		{"development build with -force", "v1.3.0", "(devel)", true, "", "gokr-packer v1.3.0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reset()
+			srv, key := releaseServer(t, tt.release)
+			defer srv.Close()
+			err := selfUpdate(exe, tt.current, srv.URL+"/latest.json", key, false, tt.force)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("selfUpdate: got error %v, want an error containing %q", err, tt.wantErr)
+			}
+			if got := contents(); got != tt.want {
+				t.Errorf("binary after update: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// A manifest signed by another key is rejected:
+	reset()
+	srv, _ := releaseServer(t, "v1.3.0")
+	defer srv.Close()
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := selfUpdate(exe, "v1.2.0", srv.URL+"/latest.json", other, false, true); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("selfUpdate with a foreign signature: got %v, want a signature verification error", err)
+	}
+	if got := contents(); got != running {
+		t.Errorf("binary after a rejected update: got %q, want %q", got, running)
+	}
+}
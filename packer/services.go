@@ -0,0 +1,466 @@
+package packer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceConfig holds per-program settings which the generated init applies
+// when starting the program. It corresponds to gokrazyinit.ServiceConfig.
+type serviceConfig struct {
+	// Env contains additional environment variables (key=value).
+	Env []string
+
+	// Nice is the nice value (-20 to 19) to run the program with, if non-empty.
+	Nice string
+
+	// OOMScoreAdj is written to /proc/<pid>/oom_score_adj, if non-empty.
+	OOMScoreAdj string
+
+	// Cgroup maps cgroup v2 interface files (e.g. memory.max) of the
+	// program’s cgroup to their contents.
+	Cgroup map[string]string
+
+	// Log is where the program’s stdout and stderr are written to in addition
+	// to the supervisor’s log buffer: empty (nowhere), “discard” (also not to
+	// the supervisor), “tmp” (rotating files in /tmp/logs, lost when
+	// rebooting) or “perm” (rotating files in /perm/logs).
+	Log string
+
+	// LogMaxBytes and LogMaxFiles limit the size of each rotated log file and
+	// the number of log files kept.
+	LogMaxBytes int64
+	LogMaxFiles int
+
+	// Syslog is the remote syslog server (see -remote_syslog) to forward the
+	// program’s stdout and stderr to, if non-empty.
+	Syslog string
+
+	// Delay and Every schedule the program instead of supervising it as a
+	// daemon: it is started Delay after boot and then every Every (if
+	// non-zero).
+	Delay time.Duration
+	Every time.Duration
+
+	// Restart is the restart policy: empty (always restart, the supervisor’s
+	// default), “on-failure” (only when the program exits with an error) or
+	// “never”. RestartDelay is the time to wait before restarting.
+	Restart      string
+	RestartDelay time.Duration
+
+	// After contains the paths of the programs which must have been started
+	// before the program is started, waiting for at most AfterTimeout.
+	After        []string
+	AfterTimeout time.Duration
+
+	// Started is set if other programs are started after the program: it
+	// then records that it was started, see After.
+	Started bool
+
+	// Files is set if the program has /etc/gokrazy/<program>/flags or env
+	// files (see addProgramFiles): the command-line flags and environment
+	// variables they contain are passed to the program.
+	Files bool
+
+	// afterPkgs contains the import paths from which After is resolved.
+	afterPkgs []string
+}
+
+func (c *serviceConfig) empty() bool {
+	return len(c.Env) == 0 &&
+		c.Nice == "" &&
+		c.OOMScoreAdj == "" &&
+		len(c.Cgroup) == 0 &&
+		c.Log == "" &&
+		c.Syslog == "" &&
+		!c.scheduled() &&
+		!c.supervised() &&
+		len(c.afterPkgs) == 0 &&
+		!c.Started &&
+		!c.Files
+}
+
+// scheduled returns whether the program is run on a schedule.
+func (c *serviceConfig) scheduled() bool {
+	return c.Delay != 0 || c.Every != 0
+}
+
+// supervised returns whether the generated init restarts the program itself
+// instead of leaving that to the supervisor.
+func (c *serviceConfig) supervised() bool {
+	return c.Restart != "" || c.RestartDelay != 0
+}
+
+// GoString returns the serviceConfig as a composite literal for the generated
+// init.
+func (c *serviceConfig) GoString() string {
+	var b strings.Builder
+	b.WriteString("gokrazyinit.ServiceConfig{")
+	if len(c.Env) > 0 {
+		fmt.Fprintf(&b, "Env: %#v, ", c.Env)
+	}
+	if c.Nice != "" {
+		fmt.Fprintf(&b, "Nice: %q, ", c.Nice)
+	}
+	if c.OOMScoreAdj != "" {
+		fmt.Fprintf(&b, "OOMScoreAdj: %q, ", c.OOMScoreAdj)
+	}
+	if len(c.Cgroup) > 0 {
+		keys := make([]string, 0, len(c.Cgroup))
+		for key := range c.Cgroup {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteString("Cgroup: map[string]string{")
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%q: %q, ", key, c.Cgroup[key])
+		}
+		b.WriteString("}, ")
+	}
+	if c.Log != "" {
+		fmt.Fprintf(&b, "Log: %q, LogMaxBytes: %d, LogMaxFiles: %d, ", c.Log, c.LogMaxBytes, c.LogMaxFiles)
+	}
+	if c.Syslog != "" {
+		fmt.Fprintf(&b, "Syslog: %q, ", c.Syslog)
+	}
+	if c.scheduled() {
+		fmt.Fprintf(&b, "Delay: %d * time.Second, Every: %d * time.Second, ", int64(c.Delay.Seconds()), int64(c.Every.Seconds()))
+	}
+	if c.supervised() {
+		fmt.Fprintf(&b, "Restart: %q, RestartDelay: %d * time.Millisecond, ", c.Restart, c.RestartDelay.Milliseconds())
+	}
+	if len(c.After) > 0 {
+		fmt.Fprintf(&b, "After: %#v, AfterTimeout: %d * time.Second, ", c.After, int64(c.AfterTimeout.Seconds()))
+	}
+	if c.Started {
+		b.WriteString("Started: true, ")
+	}
+	if c.Files {
+		b.WriteString("Files: true, ")
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// readPackageConfig returns the non-empty, non-comment lines of the
+// configuration file <kind>/<importPath>/<kind>.txt (relative to the current
+// directory), e.g. resources/github.com/gokrazy/hello/resources.txt. A missing
+// file is not an error.
+func readPackageConfig(kind, importPath string) ([]string, error) {
+	fn := filepath.Join(kind, filepath.FromSlash(importPath), kind+".txt")
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return lines, nil
+}
+
+// cgroupSizeRe matches memory sizes as understood by cgroup v2 interface
+// files: a number of bytes with optional K, M or G suffix, or “max”.
+var cgroupSizeRe = regexp.MustCompile(`^(max|[0-9]+[KMG]?)$`)
+
+func intInRange(key, val string, min, max int) error {
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	if n < min || n > max {
+		return fmt.Errorf("%s: %d out of range [%d, %d]", key, n, min, max)
+	}
+	return nil
+}
+
+// parseResources applies the key=value lines of a resources.txt file to cfg.
+func parseResources(cfg *serviceConfig, lines []string) error {
+	for _, line := range lines {
+		idx := strings.IndexByte(line, '=')
+		if idx == -1 {
+			return fmt.Errorf("%q is not of the form key=value", line)
+		}
+		key, val := strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+		switch key {
+		case "gomaxprocs":
+			if err := intInRange(key, val, 1, 1024); err != nil {
+				return err
+			}
+			cfg.Env = append(cfg.Env, "GOMAXPROCS="+val)
+		case "nice":
+			if err := intInRange(key, val, -20, 19); err != nil {
+				return err
+			}
+			cfg.Nice = val
+		case "oom_score_adj":
+			if err := intInRange(key, val, -1000, 1000); err != nil {
+				return err
+			}
+			cfg.OOMScoreAdj = val
+		case "memory_max", "memory_high":
+			if !cgroupSizeRe.MatchString(val) {
+				return fmt.Errorf("%s: %q is not a size (e.g. 64M) or max", key, val)
+			}
+			cfg.setCgroup(strings.Replace(key, "_", ".", 1), val)
+		case "cpu_weight":
+			if err := intInRange(key, val, 1, 10000); err != nil {
+				return err
+			}
+			cfg.setCgroup("cpu.weight", val)
+		case "cpu_max":
+			// e.g. “50000 100000”: 50ms of CPU time per 100ms period
+			if fields := strings.Fields(val); len(fields) != 2 {
+				return fmt.Errorf("%s: %q is not of the form <quota|max> <period>", key, val)
+			}
+			cfg.setCgroup("cpu.max", val)
+		default:
+			return fmt.Errorf("unknown resource %q", key)
+		}
+	}
+	return nil
+}
+
+// parseSize parses a number of bytes with optional K, M or G suffix (powers of
+// 1024), e.g. 64M.
+func parseSize(val string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(val, "K"):
+		mult = 1024
+	case strings.HasSuffix(val, "M"):
+		mult = 1024 * 1024
+	case strings.HasSuffix(val, "G"):
+		mult = 1024 * 1024 * 1024
+	}
+	if mult > 1 {
+		val = val[:len(val)-1]
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative size %d", n)
+	}
+	return n * mult, nil
+}
+
+// parseLogs applies the key=value lines of a logs.txt file to cfg.
+func parseLogs(cfg *serviceConfig, lines []string) error {
+	for _, line := range lines {
+		idx := strings.IndexByte(line, '=')
+		if idx == -1 {
+			return fmt.Errorf("%q is not of the form key=value", line)
+		}
+		key, val := strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+		switch key {
+		case "destination":
+			switch val {
+			case "supervisor":
+				cfg.Log = ""
+			case "discard", "tmp", "perm":
+				cfg.Log = val
+			default:
+				return fmt.Errorf("%s: %q is not one of supervisor, discard, tmp or perm", key, val)
+			}
+		case "max_size":
+			n, err := parseSize(val)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			if n < 4096 {
+				return fmt.Errorf("%s: %d is smaller than 4K", key, n)
+			}
+			cfg.LogMaxBytes = n
+		case "max_files":
+			if err := intInRange(key, val, 1, 100); err != nil {
+				return err
+			}
+			cfg.LogMaxFiles, _ = strconv.Atoi(val)
+		default:
+			return fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	if cfg.Log != "" && cfg.LogMaxBytes == 0 {
+		cfg.LogMaxBytes = 1024 * 1024
+	}
+	if cfg.Log != "" && cfg.LogMaxFiles == 0 {
+		cfg.LogMaxFiles = 3
+	}
+	return nil
+}
+
+// parseSchedule applies the key=value lines of a schedule.txt file to cfg.
+func parseSchedule(cfg *serviceConfig, lines []string) error {
+	for _, line := range lines {
+		idx := strings.IndexByte(line, '=')
+		if idx == -1 {
+			return fmt.Errorf("%q is not of the form key=value", line)
+		}
+		key, val := strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if d < 0 || d%time.Second != 0 {
+			return fmt.Errorf("%s: %v is not a positive number of seconds", key, d)
+		}
+		switch key {
+		case "delay":
+			cfg.Delay = d
+		case "every":
+			if d < time.Second {
+				return fmt.Errorf("%s: must be at least 1s", key)
+			}
+			cfg.Every = d
+		default:
+			return fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	return nil
+}
+
+// envKeyRe matches environment variable names.
+var envKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseSupervision applies the key=value lines of a supervision.txt file to
+// cfg.
+func parseSupervision(cfg *serviceConfig, lines []string) error {
+	for _, line := range lines {
+		idx := strings.IndexByte(line, '=')
+		if idx == -1 {
+			return fmt.Errorf("%q is not of the form key=value", line)
+		}
+		key, val := strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+		switch key {
+		case "restart":
+			switch val {
+			case "always":
+				cfg.Restart = ""
+			case "on-failure", "never":
+				cfg.Restart = val
+			default:
+				return fmt.Errorf("%s: %q is not one of always, on-failure or never", key, val)
+			}
+		case "restart_delay", "after_timeout":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			if d < 0 {
+				return fmt.Errorf("%s: %v is negative", key, d)
+			}
+			if key == "restart_delay" {
+				cfg.RestartDelay = d
+			} else {
+				if d%time.Second != 0 {
+					return fmt.Errorf("%s: %v is not a number of seconds", key, d)
+				}
+				cfg.AfterTimeout = d
+			}
+		case "after":
+			for _, pkg := range strings.Split(val, ",") {
+				if pkg = strings.TrimSpace(pkg); pkg != "" {
+					cfg.afterPkgs = append(cfg.afterPkgs, pkg)
+				}
+			}
+		case "env":
+			idx := strings.IndexByte(val, '=')
+			if idx < 1 || !envKeyRe.MatchString(val[:idx]) {
+				return fmt.Errorf("%s: %q is not of the form KEY=value", key, val)
+			}
+			cfg.Env = append(cfg.Env, val)
+		default:
+			return fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	if cfg.supervised() && cfg.scheduled() {
+		return fmt.Errorf("restart and restart_delay cannot be combined with a schedule")
+	}
+	if len(cfg.afterPkgs) > 0 && cfg.AfterTimeout == 0 {
+		cfg.AfterTimeout = 1 * time.Minute
+	}
+	return nil
+}
+
+func (c *serviceConfig) setCgroup(file, val string) {
+	if c.Cgroup == nil {
+		c.Cgroup = make(map[string]string)
+	}
+	c.Cgroup[file] = val
+}
+
+// loadServiceConfig reads the per-package configuration files of importPath.
+func loadServiceConfig(importPath string) (*serviceConfig, error) {
+	var cfg serviceConfig
+	lines, err := readPackageConfig("resources", importPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseResources(&cfg, lines); err != nil {
+		return nil, fmt.Errorf("resources of %s: %v", importPath, err)
+	}
+
+	lines, err = readPackageConfig("logs", importPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseLogs(&cfg, lines); err != nil {
+		return nil, fmt.Errorf("logs of %s: %v", importPath, err)
+	}
+
+	lines, err = readPackageConfig("schedule", importPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseSchedule(&cfg, lines); err != nil {
+		return nil, fmt.Errorf("schedule of %s: %v", importPath, err)
+	}
+
+	lines, err = readPackageConfig("supervision", importPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseSupervision(&cfg, lines); err != nil {
+		return nil, fmt.Errorf("supervision of %s: %v", importPath, err)
+	}
+
+	flags, env, err := programFiles(importPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range env {
+		key := kv[:strings.IndexByte(kv, '=')+1]
+		for _, other := range cfg.Env {
+			if strings.HasPrefix(other, key) {
+				return nil, fmt.Errorf("env of %s: %s is already set by resources.txt or supervision.txt", importPath, strings.TrimSuffix(key, "="))
+			}
+		}
+	}
+	cfg.Files = len(flags) > 0 || len(env) > 0
+
+	if cfg.Syslog, err = remoteSyslogTarget(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,286 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// shrinkMain writes the smallest image which is equivalent to an existing
+// gokrazy image: unused space in the partitions is left out (as holes of a
+// sparse file) and the permanent data partition is shrunk to the minimum size
+// of its file system. This is useful for archiving and distributing golden
+// images.
+func shrinkMain(args []string) error {
+	fset := flag.NewFlagSet("shrink", flag.ExitOnError)
+	output := fset.String("o",
+		"",
+		"path of the (sparse) image to create")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer shrink <image> -o <output>\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	input := parseSingleArg(fset, args)
+	if *output == "" {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	sector := make([]byte, 512)
+	if _, err := in.ReadAt(sector, 0); err != nil {
+		return err
+	}
+	parts, err := readPartitionTable(sector)
+	if err != nil {
+		return fmt.Errorf("%s: %v", input, err)
+	}
+	if parts[0].Start == 0 {
+		return fmt.Errorf("%s: no boot partition found", input)
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(*output), filepath.Base(*output)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	// Everything before the first partition (MBR, boot code):
+	if err := copySparse(out, in, 0, int64(parts[0].Start)*512); err != nil {
+		return err
+	}
+	end := int64(parts[0].Start) * 512
+
+	for i, p := range parts[:3] {
+		if p.Size == 0 {
+			continue
+		}
+		start, size := int64(p.Start)*512, int64(p.Size)*512
+		used, err := fsSize(in, start)
+		if err != nil {
+			return fmt.Errorf("partition %d: %v", i+1, err)
+		}
+		if used == 0 || used > size {
+			used = size
+		}
+		log.Printf("partition %d: copying %d of %d bytes", i+1, used, size)
+		if err := copySparse(out, in, start, used); err != nil {
+			return err
+		}
+		end = start + size
+	}
+
+	perm := parts[3]
+	if perm.Size > 0 {
+		start := int64(perm.Start) * 512
+		newSize, err := shrinkPerm(out, in, start, int64(perm.Size)*512)
+		if err != nil {
+			return fmt.Errorf("permanent data partition: %v", err)
+		}
+		// Update the size in the MBR partition table entry:
+		if newSize == 0 {
+			copy(sector[446+16*3:446+16*4], make([]byte, 16))
+		} else {
+			binary.LittleEndian.PutUint32(sector[446+16*3+12:], uint32(newSize/512))
+			end = start + newSize
+		}
+		if _, err := out.WriteAt(sector, 0); err != nil {
+			return err
+		}
+	}
+
+	if err := out.Truncate(end); err != nil {
+		return err
+	}
+	if err := out.Chmod(0644); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), *output); err != nil {
+		return err
+	}
+	log.Printf("wrote %s (%d bytes)", *output, end)
+	return nil
+}
+
+// shrinkPerm copies the permanent data partition at start of in to out and
+// returns its new size. An ext4 file system is shrunk to its minimum size
+// using resize2fs(8). A partition without (recognized) file system is dropped,
+// indicated by a new size of 0.
+func shrinkPerm(out *os.File, in *os.File, start, size int64) (int64, error) {
+	sb := make([]byte, 2048)
+	if _, err := in.ReadAt(sb, start); err != nil {
+		return 0, err
+	}
+	switch {
+	case binary.LittleEndian.Uint16(sb[1024+56:]) == 0xef53: // ext4
+	case binary.LittleEndian.Uint32(sb[1024:]) == 0xf2f52010: // f2fs
+		log.Printf("permanent data partition: f2fs cannot be shrunk, copying all %d bytes", size)
+		return size, copySparse(out, in, start, size)
+	default:
+		log.Printf("permanent data partition: no file system found, leaving out the partition")
+		return 0, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "gokr-packer-perm")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := copySparse(tmp, io.NewSectionReader(in, start, size), 0, size); err != nil {
+		return 0, err
+	}
+	if err := tmp.Truncate(size); err != nil {
+		return 0, err
+	}
+	if err := e2fsck(tmp.Name()); err != nil {
+		return 0, err
+	}
+	log.Printf("permanent data partition: shrinking ext4 file system")
+	resize := exec.Command("resize2fs", "-M", tmp.Name())
+	resize.Stdout = os.Stderr
+	resize.Stderr = os.Stderr
+	if err := resize.Run(); err != nil {
+		return 0, fmt.Errorf("%v: %v", resize.Args, err)
+	}
+	// Discard the blocks which are unused after shrinking, so that they
+	// become holes:
+	if err := e2fsck(tmp.Name(), "-E", "discard"); err != nil {
+		return 0, err
+	}
+
+	if _, err := tmp.ReadAt(sb, 0); err != nil {
+		return 0, err
+	}
+	newSize := ext4Size(sb[1024:])
+	// Keep the partition 4K-aligned:
+	newSize = (newSize + 4095) &^ 4095
+	log.Printf("permanent data partition: copying %d bytes (was %d bytes)", newSize, size)
+	if err := copySparse(&offsetWriterAt{out, start}, tmp, 0, newSize); err != nil {
+		return 0, err
+	}
+	return newSize, nil
+}
+
+// e2fsck checks (and if necessary, repairs) the ext4 file system in path.
+func e2fsck(path string, options ...string) error {
+	fsck := exec.Command("e2fsck", append(append([]string{"-f", "-y"}, options...), path)...)
+	fsck.Stdout = os.Stderr
+	fsck.Stderr = os.Stderr
+	err := fsck.Run()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == 1 {
+		return nil // file system errors corrected
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", fsck.Args, err)
+	}
+	return nil
+}
+
+// ext4Size returns the size in bytes of the ext4 file system with superblock
+// sb.
+func ext4Size(sb []byte) int64 {
+	blocks := uint64(binary.LittleEndian.Uint32(sb[4:]))
+	const featureIncompat64bit = 0x80
+	if binary.LittleEndian.Uint32(sb[0x60:])&featureIncompat64bit != 0 {
+		blocks |= uint64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+	}
+	blockSize := uint64(1024) << binary.LittleEndian.Uint32(sb[24:])
+	return int64(blocks * blockSize)
+}
+
+// fsSize returns the number of bytes used by the FAT or SquashFS file system
+// at offset off of r, or 0 if the size cannot be determined.
+func fsSize(r io.ReaderAt, off int64) (int64, error) {
+	sb := make([]byte, 512)
+	if _, err := r.ReadAt(sb, off); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(sb) == 0x73717368 { // SquashFS: hsqs
+		bytesUsed := int64(binary.LittleEndian.Uint64(sb[40:]))
+		// SquashFS images are padded to 4K:
+		return (bytesUsed + 4095) &^ 4095, nil
+	}
+	if binary.LittleEndian.Uint16(sb[510:]) == signature {
+		// FAT boot sector
+		bytesPerSector := int64(binary.LittleEndian.Uint16(sb[11:]))
+		sectors := int64(binary.LittleEndian.Uint16(sb[19:]))
+		if sectors == 0 {
+			sectors = int64(binary.LittleEndian.Uint32(sb[32:]))
+		}
+		return bytesPerSector * sectors, nil
+	}
+	return 0, nil
+}
+
+// offsetWriterAt translates offsets of WriteAt calls by off.
+type offsetWriterAt struct {
+	io.WriterAt
+	off int64
+}
+
+func (o *offsetWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return o.WriterAt.WriteAt(p, off+o.off)
+}
+
+// copySparse copies n bytes at offset off of src to the same offset of dst,
+// skipping 4K blocks which only contain zeros so that they remain holes in a
+// sparse dst file.
+func copySparse(dst io.WriterAt, src io.ReaderAt, off, n int64) error {
+	const blockSize = 4096
+	zero := make([]byte, blockSize)
+	buf := make([]byte, 1*MB)
+	for pos := int64(0); pos < n; {
+		chunk := buf
+		if rest := n - pos; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		nr, err := src.ReadAt(chunk, off+pos)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if nr == 0 {
+			break // the remainder is implicitly zero
+		}
+		chunk = chunk[:nr]
+		// Write runs of non-zero blocks:
+		for i := 0; i < len(chunk); {
+			j := i
+			for j < len(chunk) {
+				end := j + blockSize
+				if end > len(chunk) {
+					end = len(chunk)
+				}
+				if bytes.Equal(chunk[j:end], zero[:end-j]) {
+					break
+				}
+				j = end
+			}
+			if j > i {
+				if _, err := dst.WriteAt(chunk[i:j], off+pos+int64(i)); err != nil {
+					return err
+				}
+			}
+			i = j + blockSize // skip the zero block
+		}
+		pos += int64(len(chunk))
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var signKey = flag.String("sign_key",
+	"",
+	"path to an ed25519 private key (PEM, PKCS #8, e.g. created with openssl genpkey -algorithm ed25519) to sign the boot and root file systems with. The signature is stored in /gokrazy.sig on the boot partition and can be checked with gokr-packer verify")
+
+// signatureFile is the name of the signature in the boot file system.
+const signatureFile = "/gokrazy.sig"
+
+const signatureHeader = "gokrazy image signature v1\n"
+
+// readSignKey returns the -sign_key private key.
+func readSignKey() (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(*signKey)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("-sign_key: %s does not contain a PEM-encoded PRIVATE KEY", *signKey)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("-sign_key: %v", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("-sign_key: %s contains a %T, not an ed25519 key", *signKey, key)
+	}
+	return priv, nil
+}
+
+// readVerifyKey returns the ed25519 public key (PEM, PKIX, e.g. created with
+// openssl pkey -pubout) in fn.
+func readVerifyKey(fn string) (ed25519.PublicKey, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s does not contain a PEM-encoded PUBLIC KEY", fn)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s contains a %T, not an ed25519 key", fn, key)
+	}
+	return pub, nil
+}
+
+// digest is the size and SHA256 sum of a file system or file.
+type digest struct {
+	size int64
+	sum  string // hex
+}
+
+func (d digest) String() string { return fmt.Sprintf("%d sha256:%s", d.size, d.sum) }
+
+func digestOf(r io.Reader) (digest, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return digest{}, err
+	}
+	return digest{size: n, sum: fmt.Sprintf("%x", h.Sum(nil))}, nil
+}
+
+// rootDigest returns the digest of the squashfs root file system at the start
+// of r, i.e. of its used bytes, excluding the remainder of the partition.
+func rootDigest(r io.ReaderAt) (digest, error) {
+	var sb squashfsSuperblock
+	if err := binary.Read(io.NewSectionReader(r, 0, 96), binary.LittleEndian, &sb); err != nil {
+		return digest{}, err
+	}
+	if sb.Magic != squashfsMagic {
+		return digest{}, fmt.Errorf("root file system: not a squashfs file system")
+	}
+	return digestOf(io.NewSectionReader(r, 0, sb.BytesUsed))
+}
+
+// bootDigests returns the digests of all files of the boot file system at the
+// start of r (except for the signature), keyed by path.
+func bootDigests(r io.ReaderAt) (map[string]digest, error) {
+	v, err := readFATVolume(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]digest)
+	err = v.walk(func(path string, f fatFile) error {
+		if strings.EqualFold(path, signatureFile) {
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := v.copyFile(&buf, f); err != nil {
+			return err
+		}
+		d, err := digestOf(&buf)
+		if err != nil {
+			return err
+		}
+		digests[path] = d
+		return nil
+	})
+	return digests, err
+}
+
+// signedMessage returns the part of the signature file which is signed: the
+// digests of the root file system and of each boot file.
+func signedMessage(root digest, boot map[string]digest) []byte {
+	paths := make([]string, 0, len(boot))
+	for path := range boot {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var buf bytes.Buffer
+	buf.WriteString(signatureHeader)
+	fmt.Fprintf(&buf, "root %s\n", root)
+	for _, path := range paths {
+		fmt.Fprintf(&buf, "boot %s %s\n", boot[path], path)
+	}
+	return buf.Bytes()
+}
+
+// signedBootFS returns a temporary file containing the boot file system in
+// part of boot with the signature of its files and of the root file system in
+// root added.
+func signedBootFS(boot io.ReaderAt, part imagePartition, root io.ReaderAt) (*os.File, error) {
+	priv, err := readSignKey()
+	if err != nil {
+		return nil, err
+	}
+	rd, err := rootDigest(root)
+	if err != nil {
+		return nil, err
+	}
+	bds, err := bootDigests(io.NewSectionReader(boot, part.start, part.size))
+	if err != nil {
+		return nil, err
+	}
+	msg := signedMessage(rd, bds)
+	sig, err := ioutil.TempFile("", "gokr-packer-sig")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(sig.Name())
+	defer sig.Close()
+	fmt.Fprintf(sig, "%sed25519 %s %s\n",
+		msg,
+		base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+		base64.StdEncoding.EncodeToString(ed25519.Sign(priv, msg)))
+	if err := sig.Close(); err != nil {
+		return nil, err
+	}
+	return patchBoot(boot, part, []filePatch{{path: signatureFile, hostPath: sig.Name()}})
+}
+
+// signImage adds the -sign_key signature to the boot file system of the image
+// (or device) f, covering the boot files and the active root file system. It
+// returns the new size of the boot file system.
+func signImage(f *os.File) (bootSize int64, err error) {
+	parts, err := imagePartitions(f)
+	if err != nil {
+		return 0, err
+	}
+	if len(parts) < 3 || parts[0].size == 0 {
+		return 0, fmt.Errorf("no gokrazy partition layout found")
+	}
+	boot := parts[0]
+	cmdline, err := readBootFile(io.NewSectionReader(f, boot.start, boot.size), "cmdline.txt")
+	if err != nil {
+		return 0, err
+	}
+	n, err := activeRootPartition(string(cmdline), parts)
+	if err != nil {
+		return 0, err
+	}
+	root := parts[n-1]
+	signed, err := signedBootFS(f, boot, io.NewSectionReader(f, root.start, root.size))
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(signed.Name())
+	defer signed.Close()
+	if err := writePartitionContents(f, boot, signed); err != nil {
+		return 0, err
+	}
+	if err := fixupMBR(f, boot); err != nil {
+		return 0, err
+	}
+	log.Printf("signed boot and root file system (partition %d)", n)
+	return signed.Seek(0, io.SeekEnd)
+}
+
+// signBootFile adds the -sign_key signature to the boot file system file
+// bootfn, covering its files and the root file system file rootfn, and updates
+// the MBR in mbrfn (if non-empty) for the new boot file system layout.
+func signBootFile(bootfn, rootfn, mbrfn string, partuuid uint32) error {
+	boot, err := os.OpenFile(bootfn, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer boot.Close()
+	root, err := os.Open(rootfn)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	signed, err := signedBootFS(boot, imagePartition{size: int64(layout.bootSectors) * 512}, root)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(signed.Name())
+	defer signed.Close()
+	if err := boot.Truncate(0); err != nil {
+		return err
+	}
+	if err := writePartitionContents(boot, imagePartition{}, signed); err != nil {
+		return err
+	}
+	if mbrfn != "" {
+		fmbr, err := os.OpenFile(mbrfn, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer fmbr.Close()
+		if err := writeMBR(boot, fmbr, partuuid); err != nil {
+			return err
+		}
+		if err := fmbr.Close(); err != nil {
+			return err
+		}
+	}
+	log.Printf("signed %s and %s", bootfn, rootfn)
+	return boot.Close()
+}
+
+// parseSignature parses the signature file b, returning the signed message,
+// the digests it contains, the public key and the signature.
+func parseSignature(b []byte) (msg []byte, root digest, boot map[string]digest, pub ed25519.PublicKey, sig []byte, err error) {
+	idx := bytes.LastIndex(b, []byte("\ned25519 "))
+	if !bytes.HasPrefix(b, []byte(signatureHeader)) || idx == -1 {
+		return nil, digest{}, nil, nil, nil, fmt.Errorf("%s: unknown signature format", signatureFile)
+	}
+	msg = b[:idx+1]
+	fields := strings.Fields(string(b[idx+1:]))
+	if len(fields) != 3 {
+		return nil, digest{}, nil, nil, nil, fmt.Errorf("%s: malformed ed25519 line", signatureFile)
+	}
+	if pub, err = base64.StdEncoding.DecodeString(fields[1]); err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, digest{}, nil, nil, nil, fmt.Errorf("%s: malformed public key", signatureFile)
+	}
+	if sig, err = base64.StdEncoding.DecodeString(fields[2]); err != nil {
+		return nil, digest{}, nil, nil, nil, fmt.Errorf("%s: malformed signature: %v", signatureFile, err)
+	}
+	boot = make(map[string]digest)
+	scanner := bufio.NewScanner(bytes.NewReader(msg[len(signatureHeader):]))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		var d digest
+		if len(fields) >= 3 {
+			d, err = parseDigest(fields[1:3])
+		}
+		switch {
+		case err != nil || len(fields) < 3:
+			return nil, digest{}, nil, nil, nil, fmt.Errorf("%s: malformed line %q", signatureFile, scanner.Text())
+		case fields[0] == "root" && len(fields) == 3:
+			root = d
+		case fields[0] == "boot" && len(fields) == 4:
+			boot[fields[3]] = d
+		default:
+			return nil, digest{}, nil, nil, nil, fmt.Errorf("%s: malformed line %q", signatureFile, scanner.Text())
+		}
+	}
+	return msg, root, boot, pub, sig, scanner.Err()
+}
+
+// parseDigest parses the size and sha256:<hex> fields of a digest.
+func parseDigest(fields []string) (digest, error) {
+	if len(fields) != 2 || !strings.HasPrefix(fields[1], "sha256:") {
+		return digest{}, fmt.Errorf("malformed digest")
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return digest{}, err
+	}
+	return digest{size: size, sum: strings.TrimPrefix(fields[1], "sha256:")}, nil
+}
+
+// verifyMain checks the signature (see -sign_key) of an image and the SHA256
+// sums of its boot files and active root file system.
+func verifyMain(args []string) error {
+	fset := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyFile := fset.String("key",
+		"",
+		"path to the ed25519 public key (PEM) which the image must be signed with")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gokr-packer verify -key=<public key> <image>\n\nFlags:\n")
+		fset.PrintDefaults()
+	}
+	image := parseSingleArg(fset, args)
+	if *keyFile == "" {
+		fset.Usage()
+		os.Exit(2)
+	}
+	trusted, err := readVerifyKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	parts, err := imagePartitions(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", image, err)
+	}
+	if len(parts) < 3 || parts[0].size == 0 {
+		return fmt.Errorf("%s: no gokrazy partition layout found", image)
+	}
+	boot := io.NewSectionReader(f, parts[0].start, parts[0].size)
+	b, err := readBootFile(boot, strings.TrimPrefix(signatureFile, "/"))
+	if err != nil {
+		return fmt.Errorf("%s: image is not signed: %v", image, err)
+	}
+	msg, wantRoot, wantBoot, pub, sig, err := parseSignature(b)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pub, trusted) {
+		return fmt.Errorf("%s: signed by key %s, not by %s", image, base64.StdEncoding.EncodeToString(pub), *keyFile)
+	}
+	if !ed25519.Verify(trusted, msg, sig) {
+		return fmt.Errorf("%s: signature verification failed", image)
+	}
+	log.Printf("signature by %s is valid", *keyFile)
+
+	gotBoot, err := bootDigests(boot)
+	if err != nil {
+		return err
+	}
+	// FAT file names are case-insensitive:
+	lower := make(map[string]digest)
+	for path, d := range gotBoot {
+		lower[strings.ToLower(path)] = d
+	}
+	var failed []string
+	for path, want := range wantBoot {
+		got, ok := lower[strings.ToLower(path)]
+		switch {
+		case !ok:
+			failed = append(failed, "boot file "+path+" is missing")
+		case got != want:
+			failed = append(failed, fmt.Sprintf("boot file %s: got %s, want %s", path, got, want))
+		}
+		delete(lower, strings.ToLower(path))
+	}
+	for path := range lower {
+		failed = append(failed, "boot file "+path+" is not signed")
+	}
+	if len(failed) == 0 {
+		log.Printf("boot file system: %d files OK", len(wantBoot))
+	}
+
+	cmdline, err := readBootFile(boot, "cmdline.txt")
+	if err != nil {
+		return err
+	}
+	n, err := activeRootPartition(string(cmdline), parts)
+	if err != nil {
+		return err
+	}
+	gotRoot, err := rootDigest(io.NewSectionReader(f, parts[n-1].start, parts[n-1].size))
+	if err != nil {
+		return err
+	}
+	if gotRoot != wantRoot {
+		failed = append(failed, fmt.Sprintf("root file system (partition %d): got %s, want %s", n, gotRoot, wantRoot))
+	} else {
+		log.Printf("root file system (partition %d): %s OK", n, gotRoot)
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("%s: verification failed:\n%s", image, strings.Join(failed, "\n"))
+	}
+	log.Printf("%s: OK", image)
+	return nil
+}
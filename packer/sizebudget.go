@@ -0,0 +1,204 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+var (
+	maxImageSize = flag.String("max_image_size",
+		"",
+		"maximum total size (with K, M or G suffix) of the boot and root file systems, i.e. of what -update transfers. Builds which exceed it fail after printing a size report. Empty means no limit (besides the partition sizes)")
+
+	maxBootSize = flag.String("max_boot_size",
+		"",
+		"maximum size (with K, M or G suffix) of the boot file system, in addition to the -boot_size partition limit. Empty means no limit")
+
+	maxRootSize = flag.String("max_root_size",
+		"",
+		"maximum size (with K, M or G suffix) of the root file system, in addition to the -root_size partition limit. Empty means no limit")
+
+	sizeReport = flag.Bool("size_report",
+		false,
+		"print a breakdown of the image size to stderr after packing: the size of the file systems, of the programs and the -size_report_files largest files. It is printed when a -max_*_size budget is exceeded, too")
+
+	sizeReportFiles = flag.Int("size_report_files",
+		10,
+		"number of largest files of the root file system which the size report lists")
+)
+
+// sizeBudgets are the parsed -max_*_size flags, 0 meaning no limit.
+var sizeBudgets struct {
+	image, boot, root int64
+}
+
+// fsSizes records the size of the file systems written by the current build
+// (0 if not written, e.g. the root file system with -skip_unchanged), see
+// writeBoot and writeRoot.
+var fsSizes struct {
+	boot, root int64
+}
+
+// checkSizeFlags verifies and parses the -max_*_size flags.
+func checkSizeFlags() error {
+	for _, b := range []struct {
+		name  string
+		val   string
+		bytes *int64
+	}{
+		{"max_image_size", *maxImageSize, &sizeBudgets.image},
+		{"max_boot_size", *maxBootSize, &sizeBudgets.boot},
+		{"max_root_size", *maxRootSize, &sizeBudgets.root},
+	} {
+		*b.bytes = 0
+		if b.val == "" {
+			continue
+		}
+		n, err := parseSize(b.val)
+		if err != nil {
+			return fmt.Errorf("-%s: %v", b.name, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("-%s must be larger than 0 (leave it empty for no limit)", b.name)
+		}
+		*b.bytes = n
+	}
+	if *sizeReportFiles < 0 {
+		return fmt.Errorf("-size_report_files must not be negative")
+	}
+	return nil
+}
+
+// checkImageSize verifies the sizes of the file systems written by the
+// current build against the -max_*_size budgets and prints the size report of
+// root if requested via -size_report or if a budget is exceeded.
+func checkImageSize(root *fileInfo) error {
+	var exceeded []string
+	check := func(name string, size, budget int64) {
+		if budget > 0 && size > budget {
+			exceeded = append(exceeded, fmt.Sprintf("%s (%s) exceeds -max_%s_size=%s by %s",
+				name, formatBytes(size), name, formatBytes(budget), formatBytes(size-budget)))
+		}
+	}
+	check("boot", fsSizes.boot, sizeBudgets.boot)
+	check("root", fsSizes.root, sizeBudgets.root)
+	// The total is only known if both file systems were written:
+	if fsSizes.boot > 0 && fsSizes.root > 0 {
+		check("image", fsSizes.boot+fsSizes.root, sizeBudgets.image)
+	}
+	if *sizeReport || len(exceeded) > 0 {
+		printSizeReport(os.Stderr, root)
+	}
+	switch len(exceeded) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("size budget exceeded: %s", exceeded[0])
+	}
+	return fmt.Errorf("size budgets exceeded: %s", strings.Join(exceeded, "; "))
+}
+
+// sizedFile is a file of the root file system, see rootFileSizes.
+type sizedFile struct {
+	path       string
+	importPath string
+	size       int64
+}
+
+// rootFileSizes returns the regular files of root (at dir) with their
+// uncompressed size. Hard links are skipped, as they share their target’s
+// data.
+func rootFileSizes(dir string, root *fileInfo) ([]sizedFile, error) {
+	var files []sizedFile
+	for _, ent := range root.dirents {
+		p := path.Join(dir, ent.filename)
+		switch {
+		case ent.fromHost != "":
+			st, err := os.Stat(ent.fromHost)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sizedFile{p, ent.importPath, st.Size()})
+		case ent.fromLiteral != "":
+			files = append(files, sizedFile{p, ent.importPath, int64(len(ent.fromLiteral))})
+		case ent.isDir():
+			sub, err := rootFileSizes(p, ent)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+		}
+	}
+	return files, nil
+}
+
+// printSizeReport prints the sizes of the file systems (compared to their
+// budget and partition), of the programs and of the largest files of root to
+// w.
+func printSizeReport(w io.Writer, root *fileInfo) {
+	budget := func(n int64) string {
+		if n == 0 {
+			return "-"
+		}
+		return formatBytes(n)
+	}
+	written := func(n int64) string {
+		if n == 0 {
+			return "(not written)"
+		}
+		return formatBytes(n)
+	}
+	fmt.Fprintf(w, "\nsize report:\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "size\tbudget\tpartition\t\tfile system\n")
+	fmt.Fprintf(tw, "%s\t%s\t%s\t\tboot\n", written(fsSizes.boot), budget(sizeBudgets.boot), formatBytes(int64(layout.bootSectors)*512))
+	fmt.Fprintf(tw, "%s\t%s\t%s\t\troot\n", written(fsSizes.root), budget(sizeBudgets.root), formatBytes(int64(layout.rootSectors)*512))
+	if fsSizes.boot > 0 && fsSizes.root > 0 {
+		fmt.Fprintf(tw, "%s\t%s\t\t\ttotal\n", formatBytes(fsSizes.boot+fsSizes.root), budget(sizeBudgets.image))
+	}
+	tw.Flush()
+
+	files, err := rootFileSizes("/", root)
+	if err != nil {
+		fmt.Fprintf(w, "(root file system contents unavailable: %v)\n", err)
+		return
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].size > files[j].size
+	})
+
+	fmt.Fprintf(w, "\nprograms (before SquashFS compression):\n")
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	var total int64
+	for _, f := range files {
+		if f.importPath == "" && f.path != "/gokrazy/init" {
+			continue
+		}
+		name := f.path
+		if f.importPath != "" {
+			name += " (" + f.importPath + ")"
+		}
+		fmt.Fprintf(tw, "%s\t\t%s\n", formatBytes(f.size), name)
+		total += f.size
+	}
+	fmt.Fprintf(tw, "%s\t\ttotal\n", formatBytes(total))
+	tw.Flush()
+
+	if n := *sizeReportFiles; n > 0 {
+		if len(files) > n {
+			files = files[:n]
+		}
+		fmt.Fprintf(w, "\nlargest files (before SquashFS compression):\n")
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+		for _, f := range files {
+			fmt.Fprintf(tw, "%s\t\t%s\n", formatBytes(f.size), f.path)
+		}
+		tw.Flush()
+	}
+}
@@ -0,0 +1,86 @@
+package packer
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+)
+
+var rootSlot = flag.String("root_slot",
+	"a",
+	"root partition (slot) which is populated and booted from when partitioning (-overwrite): a (partition 2) or b (partition 3). The other slot is left empty; updates are written to the inactive slot and activated by pointing cmdline.txt to it, so that they can be rolled back by switching back")
+
+// rootSlotNames maps the -root_slot values to the partition numbers.
+var rootSlotNames = map[string]int{
+	"a": 2,
+	"b": 3,
+}
+
+// rootSlotPartition returns the partition number of -root_slot.
+func rootSlotPartition() (int, error) {
+	n, ok := rootSlotNames[*rootSlot]
+	if !ok {
+		return 0, fmt.Errorf("-root_slot=%q is not one of a or b", *rootSlot)
+	}
+	return n, nil
+}
+
+// inactiveRootPartition returns the partition number of the slot other than
+// -root_slot.
+func inactiveRootPartition() int {
+	if n, _ := rootSlotPartition(); n == 3 {
+		return 2
+	}
+	return 3
+}
+
+// rootPartUUID returns the PARTUUID of root partition n, which the root=
+// kernel parameter refers to.
+func rootPartUUID(partuuid uint32, n int) string {
+	if *partitionTable == "gpt" {
+		return gptPartUUID(partuuid, n)
+	}
+	return fmt.Sprintf("%08x-%02x", partuuid, n)
+}
+
+// rootSlotInfo describes a root partition in /etc/gokrazy/slots.json.
+type rootSlotInfo struct {
+	Name        string `json:"name"`
+	Partition   int    `json:"partition"`
+	PartUUID    string `json:"partuuid"` // for root=PARTUUID=
+	StartSector uint64 `json:"start_sector"`
+	Sectors     uint64 `json:"sectors"`
+}
+
+// rootSlotsConfig returns the contents of /etc/gokrazy/slots.json, which
+// describes both root partitions, so that an updater can find the inactive
+// slot, check that a root file system fits and switch to it.
+func rootSlotsConfig(partuuid uint32) (string, error) {
+	var slots []rootSlotInfo
+	for _, name := range []string{"a", "b"} {
+		n := rootSlotNames[name]
+		slots = append(slots, rootSlotInfo{
+			Name:        name,
+			Partition:   n,
+			PartUUID:    rootPartUUID(partuuid, n),
+			StartSector: layout.rootStart(n),
+			Sectors:     layout.rootSectors,
+		})
+	}
+	b, err := json.MarshalIndent(struct {
+		Slots []rootSlotInfo `json:"slots"`
+	}{slots}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+// clearInactiveRoot overwrites the start of the inactive root partition of the
+// device f with zeros, so that no stale root file system of a previous
+// installation can be booted (e.g. by switching to it).
+func clearInactiveRoot(f io.WriterAt) error {
+	_, err := f.WriteAt(make([]byte, 1*MB), int64(layout.rootStart(inactiveRootPartition()))*512)
+	return err
+}
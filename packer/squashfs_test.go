@@ -0,0 +1,409 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/internal/squashfs"
+)
+
+// writeTestSquashfs writes a SquashFS image like writeRoot does: using
+// github.com/gokrazy/internal/squashfs, followed by fixupSquashfs,
+// addSquashfsExportTable and recompressSquashfs.
+func writeTestSquashfs(t *testing.T, files map[string][]byte, fixups map[string]*fileInfo, compression string) *os.File {
+	t.Helper()
+	f, err := ioutil.TempFile("", "gokr-packer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+	modTime := time.Date(2020, 6, 1, 12, 34, 56, 0, time.UTC)
+	fw, err := squashfs.NewWriter(f, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := fw.Root.Directory("dir", modTime)
+	for _, name := range sortedKeys(files) {
+		if fi, ok := fixups["/dir/"+name]; ok && (fi.hardlinkTarget != "" || fi.device != nil) {
+			if err := writeSquashfsPlaceholder(dir, name, modTime); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		w, err := dir.File(name, modTime, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dir.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Root.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fixupSquashfs(f, fixups); err != nil {
+		t.Fatal(err)
+	}
+	if err := addSquashfsExportTable(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := recompressSquashfs(f, compression); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestSquashfsRoundTrip(t *testing.T) {
+	defer func(dedup, fragments bool) {
+		*rootfsDedup, *rootfsFragments = dedup, fragments
+	}(*rootfsDedup, *rootfsFragments)
+
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	text := func(n int) []byte {
+		return bytes.Repeat([]byte("hello gokrazy "), n/14+1)[:n]
+	}
+	const blockSize = 131072
+	big := append(random(3*blockSize), text(100000)...)
+	files := map[string][]byte{
+		"big":            big,
+		"big-copy":       big,                                                  // identical file
+		"big-prefix":     big[:2*blockSize],                                    // run of identical blocks
+		"big-modified":   append(append([]byte(nil), big[:blockSize]...), 'x'), // shared block, different tail
+		"small":          text(10),
+		"small-copy":     text(10), // identical fragment
+		"empty":          []byte{},
+		"random-small":   random(5000),
+		"one-block":      text(blockSize),
+		"unaligned":      random(3*blockSize + 17),
+		"almost-a-block": random(120000), // too large to share a fragment block
+		"hardlink":       nil,
+		"null":           nil,
+		"initctl":        nil,
+	}
+	fixups := map[string]*fileInfo{
+		"/dir/hardlink": {filename: "hardlink", hardlinkTarget: "/dir/random-small"},
+		"/dir/null":     {filename: "null", device: &deviceNode{typ: 'c', major: 1, minor: 3, mode: 0666}},
+		"/dir/initctl":  {filename: "initctl", device: &deviceNode{typ: 'p', mode: 0600}},
+		"/dir/small":    {filename: "small", uid: 1000, gid: 1000},
+		"/dir/unaligned": {filename: "unaligned", gid: 5, xattrs: map[string][]byte{
+			"security.capability": []byte("\x01\x00\x00\x02\x00\x04\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+		}},
+	}
+
+	for _, compression := range []string{"gzip", "none", "xz", "zstd"} {
+		if c := squashfsCompressors[compression]; c.compress != nil {
+			if _, err := exec.LookPath(c.compress[0]); err != nil {
+				t.Logf("skipping -rootfs_compression=%s: %v", compression, err)
+				continue
+			}
+		}
+		sizes := make(map[[2]bool]int64)
+		for _, flags := range [][2]bool{{false, false}, {true, false}, {false, true}, {true, true}} {
+			*rootfsDedup, *rootfsFragments = flags[0], flags[1]
+			name := fmt.Sprintf("%s/dedup=%v/fragments=%v", compression, flags[0], flags[1])
+			t.Run(name, func(t *testing.T) {
+				f := writeTestSquashfs(t, files, fixups, compression)
+				defer f.Close()
+				st, err := f.Stat()
+				if err != nil {
+					t.Fatal(err)
+				}
+				sizes[flags] = st.Size()
+
+				sr, err := newSquashfsReader(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if compression == "none" {
+					// The image keeps the zlib id, its blocks are stored
+					// uncompressed:
+					if sr.sb.Flags&squashfsNoDataCompr == 0 {
+						t.Errorf("flags: %#x does not contain NoDataCompr", sr.sb.Flags)
+					}
+				} else if got, want := squashfsCompressionName(sr.sb.Compression), compression; got != want {
+					t.Errorf("compression: got %s, want %s", got, want)
+				}
+				root, err := sr.root()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(root.entries) != 1 || root.entries[0].name != "dir" {
+					t.Fatalf("unexpected root directory entries: %+v", root.entries)
+				}
+				inodes := make(map[string]uint32)
+				for _, f := range root.entries[0].entries {
+					want, ok := files[f.name]
+					if !ok {
+						t.Fatalf("unexpected file %q", f.name)
+					}
+					inodes[f.name] = f.inode
+					fi, ok := fixups["/dir/"+f.name]
+					if ok && (f.uid != fi.uid || f.gid != fi.gid) {
+						t.Errorf("%s: owner: got %d:%d, want %d:%d", f.name, f.uid, f.gid, fi.uid, fi.gid)
+					}
+					if ok && fi.xattrs != nil && !reflect.DeepEqual(f.xattrs, fi.xattrs) {
+						t.Errorf("%s: xattrs: got %q, want %q", f.name, f.xattrs, fi.xattrs)
+					}
+					if ok && fi.device != nil {
+						if f.device == nil || *f.device != *fi.device {
+							t.Errorf("%s: device: got %v, want %v", f.name, f.device, fi.device)
+						}
+						continue
+					}
+					if f.name == "hardlink" {
+						want = files["random-small"]
+					}
+					var buf bytes.Buffer
+					if err := sr.copyFile(&buf, f); err != nil {
+						t.Fatalf("%s: %v", f.name, err)
+					}
+					if !bytes.Equal(buf.Bytes(), want) {
+						t.Errorf("%s: contents differ (got %d bytes, want %d bytes)", f.name, buf.Len(), len(want))
+					}
+				}
+				if got, want := len(root.entries[0].entries), len(files); got != want {
+					t.Errorf("found %d files, want %d", got, want)
+				}
+				if inodes["hardlink"] != inodes["random-small"] {
+					t.Errorf("hardlink: inode %d, want %d (random-small)", inodes["hardlink"], inodes["random-small"])
+				}
+			})
+		}
+		if sizes[[2]bool{true, true}] >= sizes[[2]bool{false, false}] {
+			t.Errorf("%s: -rootfs_dedup and -rootfs_fragments did not reduce the image size (%d bytes, %d bytes without)",
+				compression, sizes[[2]bool{true, true}], sizes[[2]bool{false, false}])
+		}
+		if sizes[[2]bool{true, false}] >= sizes[[2]bool{false, false}] {
+			t.Errorf("%s: -rootfs_dedup did not reduce the image size", compression)
+		}
+	}
+}
+
+func TestSquashfsExportTable(t *testing.T) {
+	f, err := ioutil.TempFile("", "gokr-packer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+	defer f.Close()
+	modTime := time.Date(2020, 6, 1, 12, 34, 56, 0, time.UTC)
+	fw, err := squashfs.NewWriter(f, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// /etc, /usr/bin, /usr/lib and /usr/lib/empty: the root directory has
+	// two subdirectories, /usr has two, /usr/lib has one.
+	etc := fw.Root.Directory("etc", modTime)
+	w, err := etc.File("hostname", modTime, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("gokrazy\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := etc.Symlink("/proc/self/mounts", "mtab", modTime, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := etc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	usr := fw.Root.Directory("usr", modTime)
+	if err := usr.Directory("bin", modTime).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lib := usr.Directory("lib", modTime)
+	if err := lib.Directory("empty", modTime).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := usr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Root.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := addSquashfsExportTable(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	img, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb squashfsSuperblock
+	if err := binary.Read(bytes.NewReader(img), binary.LittleEndian, &sb); err != nil {
+		t.Fatal(err)
+	}
+	if sb.Flags&squashfsExportable == 0 {
+		t.Errorf("flags: %#x does not contain Exportable", sb.Flags)
+	}
+	if len(img)%4096 != 0 || sb.BytesUsed > int64(len(img)) {
+		t.Errorf("image size %d (%d bytes used) is not padded to 4096 bytes", len(img), sb.BytesUsed)
+	}
+
+	itable, err := readSquashfsMetadata(img[sb.InodeTableStart:sb.DirectoryTableStart])
+	if err != nil {
+		t.Fatal(err)
+	}
+	inodes, err := squashfsInodes(itable.data, sb.BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(inodes), 8; got != want {
+		t.Fatalf("found %d inodes, want %d", got, want)
+	}
+
+	// Each export table entry references the inode of its number:
+	var exportIndex []uint64
+	for off := sb.LookupTableStart; off < sb.IdTableStart && len(exportIndex)*squashfsMetadataSize/8 < int(sb.Inodes); off += 8 {
+		exportIndex = append(exportIndex, binary.LittleEndian.Uint64(img[off:]))
+	}
+	export, err := readSquashfsMetadata(img[exportIndex[0]:sb.LookupTableStart])
+	if err != nil {
+		t.Fatal(err)
+	}
+	byPos := make(map[uint64]squashfsInode)
+	for _, ino := range inodes {
+		byPos[itable.ref(ino.pos)] = ino
+	}
+	for n := uint32(1); n <= sb.Inodes; n++ {
+		ref := binary.LittleEndian.Uint64(export.data[(n-1)*8:])
+		if ino, ok := byPos[ref]; !ok || ino.number != n {
+			t.Errorf("export table: inode %d: reference %#x points to inode %d", n, ref, ino.number)
+		}
+	}
+
+	// Directories link to their parent and to themselves, subdirectories to
+	// them:
+	subdirs := make(map[uint32]uint32)
+	for _, ino := range inodes {
+		if ino.dir {
+			subdirs[ino.parent]++
+		}
+	}
+	var dirs int
+	for _, ino := range inodes {
+		if !ino.dir {
+			continue
+		}
+		dirs++
+		if got, want := binary.LittleEndian.Uint32(itable.data[ino.nlinkPos:]), 2+subdirs[ino.number]; got != want {
+			t.Errorf("directory inode %d: link count: got %d, want %d", ino.number, got, want)
+		}
+	}
+	if got, want := dirs, 6; got != want {
+		t.Errorf("found %d directories, want %d", got, want)
+	}
+
+	// The id table was moved behind the export table:
+	idBlock := binary.LittleEndian.Uint64(img[sb.IdTableStart:])
+	if int64(idBlock) < sb.LookupTableStart {
+		t.Errorf("id table block at %d precedes the export table index at %d", idBlock, sb.LookupTableStart)
+	}
+	ids, err := readSquashfsMetadata(img[idBlock:sb.IdTableStart])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ids.data), int(sb.NoIds)*4; got != want {
+		t.Errorf("id table: got %d bytes, want %d", got, want)
+	}
+
+	// Adding the export table is idempotent:
+	if err := addSquashfsExportTable(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSquashfsLargeDirectory verifies that directories whose entries span
+// multiple directory headers (at most 256 entries each) survive
+// fixupSquashfs.
+func TestSquashfsLargeDirectory(t *testing.T) {
+	f, err := ioutil.TempFile("", "gokr-packer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+	defer f.Close()
+	modTime := time.Date(2020, 6, 1, 12, 34, 56, 0, time.UTC)
+	fw, err := squashfs.NewWriter(f, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := fw.Root.Directory("large dir ✓", modTime)
+	var names []string
+	for i := 0; i < 600; i++ {
+		names = append(names, fmt.Sprintf("fïle %03d", i))
+	}
+	for _, name := range names {
+		if err := dir.Symlink("target", name, modTime, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dir.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Root.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fixupSquashfs(f, map[string]*fileInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := addSquashfsExportTable(f); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := newSquashfsReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := sr.root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := root.entries[0].entries
+	if got, want := len(entries), len(names); got != want {
+		t.Fatalf("found %d entries, want %d", got, want)
+	}
+	for i, e := range entries {
+		if e.name != names[i] || e.symlinkDest != "target" {
+			t.Errorf("entry %d: got %q -> %q, want %q -> target", i, e.name, e.symlinkDest, names[i])
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package packer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+)
+
+var rootfsCompression = flag.String("rootfs_compression",
+	"gzip",
+	"compression of the root file system data blocks: gzip, zstd or xz (smaller, slower to build, require the zstd or xz command and kernel support) or none (faster to build and read, larger)")
+
+const squashfsNoDataCompr = 1 << 1
+
+// squashfsCompressor compresses the data blocks of a SquashFS image using an
+// external command, as github.com/gokrazy/internal/squashfs only implements
+// zlib.
+type squashfsCompressor struct {
+	id uint16 // SquashFS compression id
+
+	// compress and decompress are the commands which (de)compress a single
+	// block from stdin to stdout. A nil compress stores blocks uncompressed.
+	compress, decompress []string
+}
+
+// squashfsCompressors contains the -rootfs_compression values other than gzip,
+// which github.com/gokrazy/internal/squashfs writes itself.
+var squashfsCompressors = map[string]squashfsCompressor{
+	// The kernel decompresses using the block size as dictionary (window)
+	// size and only supports CRC32 (or no) integrity checks:
+	"xz": {
+		id:         4,
+		compress:   []string{"xz", "--format=xz", "--check=crc32", "--lzma2=preset=6,dict=128KiB", "-c"},
+		decompress: []string{"xz", "-d", "-c"},
+	},
+	"zstd": {
+		id:         6,
+		compress:   []string{"zstd", "-q", "-c", "-15", "--zstd=wlog=17"},
+		decompress: []string{"zstd", "-q", "-d", "-c"},
+	},
+	"none": {id: squashfsZlib},
+}
+
+// squashfsCompressionName returns the -rootfs_compression value of the
+// SquashFS compression id, e.g. for preserving the compression when patching.
+func squashfsCompressionName(id uint16) string {
+	for name, c := range squashfsCompressors {
+		if c.id == id && c.compress != nil {
+			return name
+		}
+	}
+	return "gzip"
+}
+
+func checkRootfsCompression() error {
+	if *rootfsCompression == "gzip" {
+		return nil
+	}
+	c, ok := squashfsCompressors[*rootfsCompression]
+	if !ok {
+		return fmt.Errorf("-rootfs_compression=%q is not one of gzip, zstd, xz or none", *rootfsCompression)
+	}
+	if c.compress != nil {
+		if _, err := exec.LookPath(c.compress[0]); err != nil {
+			return fmt.Errorf("-rootfs_compression=%s: %v", *rootfsCompression, err)
+		}
+	}
+	return nil
+}
+
+// runBlockFilter pipes block through the command args.
+func runBlockFilter(args []string, block []byte) ([]byte, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(block)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return out, nil
+}
+
+// decompressSquashfsBlock returns the contents of a compressed data block.
+func decompressSquashfsBlock(compression uint16, block []byte) ([]byte, error) {
+	if compression == squashfsZlib {
+		zr, err := zlib.NewReader(bytes.NewReader(block))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(zr)
+	}
+	for _, c := range squashfsCompressors {
+		if c.id == compression && c.decompress != nil {
+			return runBlockFilter(c.decompress, block)
+		}
+	}
+	return nil, fmt.Errorf("squashfs: compression %d is not supported", compression)
+}
+
+// squashfsBlockJob is a data block recompressed by compressSquashfsBlocks.
+type squashfsBlockJob struct {
+	block []byte
+	size  uint32 // as stored in the inode, then as written
+
+	out  []byte
+	n    int // uncompressed size
+	err  error
+	done chan struct{}
+}
+
+// compress recompresses the zlib-compressed (or uncompressed) j.block using c.
+func (j *squashfsBlockJob) compress(c squashfsCompressor) {
+	defer close(j.done)
+	block := j.block
+	if j.size&squashfsBlockUncompressed == 0 {
+		if block, j.err = decompressSquashfsBlock(squashfsZlib, block); j.err != nil {
+			return
+		}
+	}
+	j.n = len(block)
+	out := block
+	if c.compress != nil {
+		if out, j.err = runBlockFilter(c.compress, block); j.err != nil {
+			return
+		}
+	}
+	if c.compress == nil || len(out) >= len(block) {
+		// Like github.com/gokrazy/internal/squashfs, store blocks which do
+		// not compress uncompressed.
+		j.out, j.size = block, uint32(len(block))|squashfsBlockUncompressed
+	} else {
+		j.out, j.size = out, uint32(len(out))
+	}
+}
+
+// compressSquashfsBlocks recompresses the blocks at olds (with the sizes
+// stored in the inodes, oldSizes) using c on up to -jobs workers, passing the results
+// to write in the order of olds. The blocks are read sequentially using
+// readAt, and only a few blocks per worker are kept in memory.
+func compressSquashfsBlocks(c squashfsCompressor, olds []int64, oldSizes []uint32, readAt func(off, n int64) ([]byte, error), write func(i int, j *squashfsBlockJob) error) error {
+	workers := buildJobs()
+	work := make(chan *squashfsBlockJob)
+	pending := make(chan *squashfsBlockJob, 2*workers)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(quit)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(pending)
+		defer close(work)
+		for i, old := range olds {
+			j := &squashfsBlockJob{size: oldSizes[i], done: make(chan struct{})}
+			j.block, j.err = readAt(old, int64(j.size&^squashfsBlockUncompressed))
+			if j.err != nil {
+				close(j.done)
+			}
+			select {
+			case pending <- j:
+			case <-quit:
+				return
+			}
+			if j.err != nil {
+				return
+			}
+			select {
+			case work <- j:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				j.compress(c)
+			}
+		}()
+	}
+	i := 0
+	for j := range pending {
+		<-j.done
+		if j.err != nil {
+			return j.err
+		}
+		if err := write(i, j); err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
+
+// recompressSquashfs recompresses the data blocks of the (zlib-compressed)
+// SquashFS image written by github.com/gokrazy/internal/squashfs at the start
+// of f as specified by compression. As the inode table is not compressed, the
+// locations and sizes of the blocks (including fragment blocks, and blocks
+// shared by several files) can be updated in place, and all tables which
+// follow the data blocks are moved accordingly. Blocks are compressed in
+// parallel (see compressSquashfsBlocks).
+func recompressSquashfs(f io.ReadWriteSeeker, compression string) error {
+	c, ok := squashfsCompressors[compression]
+	if !ok {
+		return nil // gzip
+	}
+	stage := startStage("compress root file system (" + compression + ")")
+	defer stage.done()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var sb squashfsSuperblock
+	if err := binary.Read(f, binary.LittleEndian, &sb); err != nil {
+		return err
+	}
+	if sb.Magic != squashfsMagic {
+		return fmt.Errorf("squashfs: invalid magic %x", sb.Magic)
+	}
+	if sb.Compression != squashfsZlib {
+		return fmt.Errorf("squashfs: unexpected compression %d", sb.Compression)
+	}
+	readAt := func(off, n int64) ([]byte, error) {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err := io.ReadFull(f, b)
+		return b, err
+	}
+	tables, err := readAt(sb.InodeTableStart, sb.BytesUsed-sb.InodeTableStart)
+	if err != nil {
+		return err
+	}
+	itableLen := sb.DirectoryTableStart - sb.InodeTableStart
+	itable, err := readSquashfsMetadata(tables[:itableLen])
+	if err != nil {
+		return err
+	}
+	inodes, err := squashfsInodes(itable.data, sb.BlockSize)
+	if err != nil {
+		return err
+	}
+
+	// The fragment table (see packSquashfsData) precedes its index:
+	var ftable *squashfsMetadata
+	var ftableStart int64
+	if sb.Fragments > 0 {
+		ftableStart = int64(binary.LittleEndian.Uint64(tables[sb.FragmentTableStart-sb.InodeTableStart:]))
+		if ftable, err = readSquashfsMetadata(tables[ftableStart-sb.InodeTableStart : sb.FragmentTableStart-sb.InodeTableStart]); err != nil {
+			return err
+		}
+	}
+
+	// Collect the data blocks by their location, as files might share blocks
+	// (see -rootfs_dedup):
+	b := itable.data
+	sizes := make(map[int64]uint32)
+	for _, ino := range inodes {
+		if ino.blocksPos == 0 {
+			continue // not a regular file
+		}
+		var old int64
+		if ino.extended {
+			old = int64(binary.LittleEndian.Uint64(b[ino.blocksPos:]))
+		} else {
+			old = int64(binary.LittleEndian.Uint32(b[ino.blocksPos:]))
+		}
+		for i := 0; i < ino.blocks; i++ {
+			size := binary.LittleEndian.Uint32(b[ino.sizesPos+4*i:])
+			if size == 0 {
+				continue // sparse
+			}
+			sizes[old] = size
+			old += int64(size &^ squashfsBlockUncompressed)
+		}
+	}
+	for i := 0; i < int(sb.Fragments); i++ {
+		entry := ftable.data[i*squashfsFragmentEntryLen:]
+		sizes[int64(binary.LittleEndian.Uint64(entry))] = binary.LittleEndian.Uint32(entry[8:])
+	}
+	olds := make([]int64, 0, len(sizes))
+	for old := range sizes {
+		olds = append(olds, old)
+	}
+	sort.Slice(olds, func(i, j int) bool { return olds[i] < olds[j] })
+
+	// Write the recompressed data blocks to a temporary file first, as they
+	// might take up more space than before (e.g. with none):
+	tmp, err := ioutil.TempFile("", "gokr-packer-squashfs")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	off := int64(96) // data blocks follow the superblock
+	news := make([]int64, len(olds))
+	oldSizes := make([]uint32, len(olds))
+	for i, old := range olds {
+		oldSizes[i] = sizes[old]
+	}
+	err = compressSquashfsBlocks(c, olds, oldSizes, readAt, func(i int, j *squashfsBlockJob) error {
+		if _, err := tmp.Write(j.out); err != nil {
+			return err
+		}
+		stage.bytes += int64(j.n)
+		news[i] = off
+		sizes[olds[i]] = j.size
+		off += int64(len(j.out))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// relocate returns the new location of the block at old, or of the next
+	// block for files without (non-sparse) blocks.
+	relocate := func(old int64) int64 {
+		i := sort.Search(len(olds), func(i int) bool { return olds[i] >= old })
+		if i == len(olds) {
+			return off
+		}
+		return news[i]
+	}
+
+	for _, ino := range inodes {
+		if ino.blocksPos == 0 {
+			continue // not a regular file
+		}
+		var old int64
+		if ino.extended {
+			old = int64(binary.LittleEndian.Uint64(b[ino.blocksPos:]))
+			binary.LittleEndian.PutUint64(b[ino.blocksPos:], uint64(relocate(old)))
+		} else {
+			old = int64(binary.LittleEndian.Uint32(b[ino.blocksPos:]))
+			binary.LittleEndian.PutUint32(b[ino.blocksPos:], uint32(relocate(old)))
+		}
+		for i := 0; i < ino.blocks; i++ {
+			sizePos := ino.sizesPos + 4*i
+			size := binary.LittleEndian.Uint32(b[sizePos:])
+			if size == 0 {
+				continue // sparse
+			}
+			binary.LittleEndian.PutUint32(b[sizePos:], sizes[old])
+			old += int64(size &^ squashfsBlockUncompressed)
+		}
+	}
+	if ftable != nil {
+		for i := 0; i < int(sb.Fragments); i++ {
+			entry := ftable.data[i*squashfsFragmentEntryLen:]
+			old := int64(binary.LittleEndian.Uint64(entry))
+			binary.LittleEndian.PutUint64(entry, uint64(relocate(old)))
+			binary.LittleEndian.PutUint32(entry[8:], sizes[old])
+		}
+		copy(tables[ftableStart-sb.InodeTableStart:], ftable.marshal())
+	}
+	copy(tables, itable.marshal())
+
+	// Move the tables, including the locations in the fragment, export, id and
+	// xattr table indexes:
+	delta := off - sb.InodeTableStart
+	move := func(start int64, entries, entrySize uint64) {
+		n := (entries*entrySize + squashfsMetadataSize - 1) / squashfsMetadataSize
+		for i := uint64(0); i < n; i++ {
+			pos := start - sb.InodeTableStart + int64(8*i)
+			binary.LittleEndian.PutUint64(tables[pos:], uint64(int64(binary.LittleEndian.Uint64(tables[pos:]))+delta))
+		}
+	}
+	if sb.Fragments > 0 {
+		move(sb.FragmentTableStart, uint64(sb.Fragments), squashfsFragmentEntryLen)
+	}
+	if sb.LookupTableStart != -1 {
+		move(sb.LookupTableStart, uint64(sb.Inodes), 8)
+		sb.LookupTableStart += delta
+	}
+	move(sb.IdTableStart, uint64(sb.NoIds), 4)
+	sb.IdTableStart += delta
+	if sb.XattrIdTableStart != -1 {
+		shiftSquashfsXattrTable(tables, sb.XattrIdTableStart-sb.InodeTableStart, delta)
+		sb.XattrIdTableStart += delta
+	}
+	sb.InodeTableStart += delta
+	sb.DirectoryTableStart += delta
+	sb.FragmentTableStart += delta
+	sb.BytesUsed += delta
+	sb.Compression = c.id
+	if c.compress == nil {
+		sb.Flags |= squashfsNoDataCompr
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Seek(96, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, tmp); err != nil {
+		return err
+	}
+	// Pad to 4096, required for the kernel to be able to access all pages
+	if pad := sb.BytesUsed % 4096; pad > 0 {
+		tables = append(tables, make([]byte, 4096-pad)...)
+	}
+	if _, err := f.Write(tables); err != nil {
+		return err
+	}
+	if t, ok := f.(interface{ Truncate(int64) error }); ok {
+		end, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if err := t.Truncate(end); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(f, binary.LittleEndian, &sb)
+}
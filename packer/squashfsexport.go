@@ -0,0 +1,355 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// squashfsSuperblock mirrors the superblock written by
+// github.com/gokrazy/internal/squashfs.
+type squashfsSuperblock struct {
+	Magic               uint32
+	Inodes              uint32
+	MkfsTime            int32
+	BlockSize           uint32
+	Fragments           uint32
+	Compression         uint16
+	BlockLog            uint16
+	Flags               uint16
+	NoIds               uint16
+	Major               uint16
+	Minor               uint16
+	RootInode           int64
+	BytesUsed           int64
+	IdTableStart        int64
+	XattrIdTableStart   int64
+	InodeTableStart     int64
+	DirectoryTableStart int64
+	FragmentTableStart  int64
+	LookupTableStart    int64
+}
+
+const (
+	squashfsMagic          = 0x73717368
+	squashfsNoInodeCompr   = 1 << 0
+	squashfsExportable     = 1 << 7
+	squashfsMetadataSize   = 8192
+	squashfsUncompressed   = 0x8000
+	squashfsInvalidFrag    = 0xFFFFFFFF
+	squashfsInodeHeaderLen = 16
+)
+
+// squashfsMetadata is the (uncompressed) contents of a metadata table, e.g.
+// the inode table.
+type squashfsMetadata struct {
+	data []byte
+
+	// blockStarts contains the offsets of the metadata blocks, relative to the
+	// start of the table, i.e. the block part of inode references.
+	blockStarts []int64
+}
+
+func readSquashfsMetadata(b []byte) (*squashfsMetadata, error) {
+	md := &squashfsMetadata{}
+	for off := 0; off < len(b); {
+		if off+2 > len(b) {
+			return nil, fmt.Errorf("squashfs: truncated metadata block at offset %d", off)
+		}
+		hdr := binary.LittleEndian.Uint16(b[off:])
+		if hdr&squashfsUncompressed == 0 {
+			return nil, fmt.Errorf("squashfs: compressed metadata is not supported")
+		}
+		size := int(hdr &^ squashfsUncompressed)
+		if off+2+size > len(b) {
+			return nil, fmt.Errorf("squashfs: truncated metadata block at offset %d", off)
+		}
+		if len(md.data)%squashfsMetadataSize != 0 {
+			return nil, fmt.Errorf("squashfs: unexpected partial metadata block")
+		}
+		md.blockStarts = append(md.blockStarts, int64(off))
+		md.data = append(md.data, b[off+2:off+2+size]...)
+		off += 2 + size
+	}
+	return md, nil
+}
+
+// ref returns the inode reference (block start << 16 | offset) for the
+// position pos within md.data. All blocks but the last contain
+// squashfsMetadataSize bytes.
+func (md *squashfsMetadata) ref(pos int) uint64 {
+	block := pos / squashfsMetadataSize
+	return uint64(md.blockStarts[block])<<16 | uint64(pos%squashfsMetadataSize)
+}
+
+// marshal returns the table in its on-disk format (uncompressed blocks).
+func (md *squashfsMetadata) marshal() []byte {
+	return marshalSquashfsMetadata(md.data, nil)
+}
+
+// marshalSquashfsMetadata splits data into uncompressed metadata blocks and
+// appends them to buf. The offset of each block is appended to starts.
+func marshalSquashfsMetadata(data []byte, starts *[]int64) []byte {
+	var buf bytes.Buffer
+	for len(data) > 0 {
+		n := len(data)
+		if n > squashfsMetadataSize {
+			n = squashfsMetadataSize
+		}
+		if starts != nil {
+			*starts = append(*starts, int64(buf.Len()))
+		}
+		binary.Write(&buf, binary.LittleEndian, uint16(n)|squashfsUncompressed)
+		buf.Write(data[:n])
+		data = data[n:]
+	}
+	return buf.Bytes()
+}
+
+// squashfsInode is the part of an inode relevant for the export table.
+type squashfsInode struct {
+	number uint32
+	pos    int // within the inode table
+
+	dir      bool
+	parent   uint32
+	nlinkPos int
+
+	// For regular files, blocksPos is the position of the blocks start field
+	// (a uint64 if extended), followed by the sizes of the blocks at
+	// sizesPos. blocksPos is 0 for other inodes.
+	blocksPos int
+	extended  bool
+	sizesPos  int
+	blocks    int
+}
+
+// squashfsInodes walks the inode table.
+func squashfsInodes(b []byte, blockSize uint32) ([]squashfsInode, error) {
+	u16 := func(pos int) uint16 { return binary.LittleEndian.Uint16(b[pos:]) }
+	u32 := func(pos int) uint32 { return binary.LittleEndian.Uint32(b[pos:]) }
+	u64 := func(pos int) uint64 { return binary.LittleEndian.Uint64(b[pos:]) }
+	var inodes []squashfsInode
+	for pos := 0; pos < len(b); {
+		if pos+squashfsInodeHeaderLen > len(b) {
+			return nil, fmt.Errorf("squashfs: truncated inode at offset %d", pos)
+		}
+		typ := u16(pos)
+		ino := squashfsInode{number: u32(pos + 12), pos: pos}
+		body := pos + squashfsInodeHeaderLen
+		// Check the fixed part of the inode before reading it:
+		fixed := map[uint16]int{1: 16, 2: 16, 3: 8, 4: 8, 5: 8, 6: 4, 7: 4, 8: 24, 9: 40, 10: 8, 11: 12, 12: 12, 13: 8, 14: 8}[typ]
+		if fixed == 0 {
+			return nil, fmt.Errorf("squashfs: unsupported inode type %d at offset %d", typ, pos)
+		}
+		if body+fixed > len(b) {
+			return nil, fmt.Errorf("squashfs: truncated inode at offset %d", pos)
+		}
+		blocks := func(size uint64, fragment uint32) int {
+			n := size / uint64(blockSize)
+			if fragment == squashfsInvalidFrag && size%uint64(blockSize) != 0 {
+				n++
+			}
+			return int(n)
+		}
+		var size int
+		switch typ {
+		case 1: // directory
+			ino.dir = true
+			ino.nlinkPos = body + 4
+			ino.parent = u32(body + 12)
+			size = 16
+		case 2: // regular file
+			ino.blocksPos, ino.sizesPos = body, body+16
+			ino.blocks = blocks(uint64(u32(body+12)), u32(body+4))
+			size = 16 + 4*ino.blocks
+		case 3: // symlink
+			size = 8 + int(u32(body+4))
+		case 10: // extended symlink: followed by the xattr index
+			size = 8 + int(u32(body+4)) + 4
+		case 4, 5: // block and character device
+			size = 8
+		case 6, 7: // fifo and socket
+			size = 4
+		case 11, 12: // extended block and character device
+			size = 12
+		case 13, 14: // extended fifo and socket
+			size = 8
+		case 8: // extended directory
+			ino.dir = true
+			ino.nlinkPos = body
+			ino.parent = u32(body + 12)
+			size = 24
+			// Directory index entries: index, start, name size (all uint32),
+			// followed by name size + 1 bytes.
+			for i := 0; i < int(u16(body+16)); i++ {
+				if body+size+12 > len(b) {
+					return nil, fmt.Errorf("squashfs: truncated directory index at offset %d", pos)
+				}
+				size += 12 + int(u32(body+size+8)) + 1
+			}
+		case 9: // extended regular file
+			ino.blocksPos, ino.sizesPos, ino.extended = body, body+40, true
+			ino.blocks = blocks(u64(body+8), u32(body+28))
+			size = 40 + 4*ino.blocks
+		}
+		inodes = append(inodes, ino)
+		pos = body + size
+		if pos > len(b) {
+			return nil, fmt.Errorf("squashfs: truncated inode at offset %d", ino.pos)
+		}
+	}
+	return inodes, nil
+}
+
+// addSquashfsExportTable adds an export table (mapping inode numbers to
+// inodes) to the SquashFS image written by github.com/gokrazy/internal/squashfs
+// at the start of f, so that the image can be exported via NFS. It also sets
+// the link count of each directory to 2 + its number of subdirectories, which
+// tools such as find(1) rely on.
+//
+// The export table must precede the id table, which is hence moved (along with
+// the xattr table).
+func addSquashfsExportTable(f io.ReadWriteSeeker) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var sb squashfsSuperblock
+	if err := binary.Read(f, binary.LittleEndian, &sb); err != nil {
+		return err
+	}
+	if sb.Magic != squashfsMagic {
+		return fmt.Errorf("squashfs: invalid magic %x", sb.Magic)
+	}
+	if sb.LookupTableStart != -1 {
+		return nil // already exportable
+	}
+	if sb.Flags&squashfsNoInodeCompr == 0 {
+		return fmt.Errorf("squashfs: compressed inode table is not supported")
+	}
+
+	readAt := func(off, n int64) ([]byte, error) {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err := io.ReadFull(f, b)
+		return b, err
+	}
+	raw, err := readAt(sb.InodeTableStart, sb.DirectoryTableStart-sb.InodeTableStart)
+	if err != nil {
+		return err
+	}
+	itable, err := readSquashfsMetadata(raw)
+	if err != nil {
+		return err
+	}
+	inodes, err := squashfsInodes(itable.data, sb.BlockSize)
+	if err != nil {
+		return err
+	}
+	if len(inodes) != int(sb.Inodes) {
+		return fmt.Errorf("squashfs: found %d inodes, superblock specifies %d", len(inodes), sb.Inodes)
+	}
+
+	refs := make([]uint64, sb.Inodes)
+	seen := make([]bool, sb.Inodes)
+	subdirs := make(map[uint32]uint32)
+	for _, ino := range inodes {
+		if ino.number == 0 || ino.number > sb.Inodes || seen[ino.number-1] {
+			return fmt.Errorf("squashfs: invalid inode number %d", ino.number)
+		}
+		seen[ino.number-1] = true
+		refs[ino.number-1] = itable.ref(ino.pos)
+		if ino.dir {
+			subdirs[ino.parent]++
+		}
+	}
+	for _, ino := range inodes {
+		if ino.dir {
+			binary.LittleEndian.PutUint32(itable.data[ino.nlinkPos:], 2+subdirs[ino.number])
+		}
+	}
+	if _, err := f.Seek(sb.InodeTableStart, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Write(itable.marshal()); err != nil {
+		return err
+	}
+
+	// Read the id table (metadata blocks followed by their index), which
+	// starts at its first metadata block:
+	idIndexLen := int64((uint64(sb.NoIds)*4+squashfsMetadataSize-1)/squashfsMetadataSize) * 8
+	idIndex, err := readAt(sb.IdTableStart, idIndexLen)
+	if err != nil {
+		return err
+	}
+	idStart := int64(binary.LittleEndian.Uint64(idIndex))
+	idBlocks, err := readAt(idStart, sb.IdTableStart-idStart)
+	if err != nil {
+		return err
+	}
+
+	// The xattr table (if any) follows the id table:
+	restStart := sb.IdTableStart + idIndexLen
+	rest, err := readAt(restStart, sb.BytesUsed-restStart)
+	if err != nil {
+		return err
+	}
+
+	// Write the export table, then the id table (and the xattr table), where
+	// the id table was:
+	var lookup bytes.Buffer
+	binary.Write(&lookup, binary.LittleEndian, refs)
+	var starts []int64
+	exportBlocks := marshalSquashfsMetadata(lookup.Bytes(), &starts)
+	var buf bytes.Buffer
+	buf.Write(exportBlocks)
+	for _, start := range starts {
+		binary.Write(&buf, binary.LittleEndian, uint64(idStart+start))
+	}
+	sb.LookupTableStart = idStart + int64(len(exportBlocks))
+	shift := int64(buf.Len())
+	buf.Write(idBlocks)
+	for i := int64(0); i < idIndexLen; i += 8 {
+		binary.Write(&buf, binary.LittleEndian, binary.LittleEndian.Uint64(idIndex[i:])+uint64(shift))
+	}
+	sb.IdTableStart += shift
+	if sb.XattrIdTableStart != -1 {
+		shiftSquashfsXattrTable(rest, sb.XattrIdTableStart-restStart, shift)
+		sb.XattrIdTableStart += shift
+	}
+	buf.Write(rest)
+	sb.BytesUsed = idStart + int64(buf.Len())
+	// Pad to 4096, required for the kernel to be able to access all pages
+	if pad := sb.BytesUsed % 4096; pad > 0 {
+		buf.Write(make([]byte, 4096-pad))
+	}
+	if _, err := f.Seek(idStart, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	sb.Flags |= squashfsExportable
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(f, binary.LittleEndian, &sb)
+}
+
+// shiftSquashfsXattrTable adds delta to the locations in the xattr id table
+// header at pos of tables (the start of the key/value pairs and of the id
+// blocks), for moving the xattr table.
+func shiftSquashfsXattrTable(tables []byte, pos, delta int64) {
+	le := binary.LittleEndian
+	le.PutUint64(tables[pos:], uint64(int64(le.Uint64(tables[pos:]))+delta))
+	ids := uint64(le.Uint32(tables[pos+8:]))
+	blocks := (ids*16 + squashfsMetadataSize - 1) / squashfsMetadataSize
+	for i := uint64(0); i < blocks; i++ {
+		p := pos + 16 + int64(8*i)
+		le.PutUint64(tables[p:], uint64(int64(le.Uint64(tables[p:]))+delta))
+	}
+}
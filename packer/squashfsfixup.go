@@ -0,0 +1,615 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/squashfs"
+)
+
+// SquashFS inode types (basic, and the extended directory and regular file).
+// The type of the extended inode is the basic type + 7.
+const (
+	squashfsDirType     = 1
+	squashfsFileType    = 2
+	squashfsSymlinkType = 3
+	squashfsBlkdevType  = 4
+	squashfsChrdevType  = 5
+	squashfsFifoType    = 6
+	squashfsLdirType    = 8
+	squashfsLregType    = 9
+
+	squashfsNoXattrs     = 1 << 9
+	squashfsInvalidXattr = 0xFFFFFFFF
+)
+
+// squashfsXattrPrefixes are the xattr name prefixes SquashFS supports, indexed
+// by their type.
+var squashfsXattrPrefixes = []string{"user.", "trusted.", "security."}
+
+// writeSquashfsPlaceholder writes a placeholder for a hard link, device node
+// or FIFO named name to dir, as github.com/gokrazy/internal/squashfs cannot
+// write these files: a symlink with an empty target (which Linux does not
+// allow otherwise).
+func writeSquashfsPlaceholder(dir *squashfs.Directory, name string, modTime time.Time) error {
+	return dir.Symlink("", name, modTime, 0)
+}
+
+// squashfsRawInode is an inode of a SquashFS image rewritten by fixupSquashfs.
+type squashfsRawInode struct {
+	raw    []byte // header and body
+	number uint32 // before renumbering
+	nlink  uint32 // of regular files
+	drop   bool   // placeholder of a hard link
+	pos    int    // within the rewritten inode table
+
+	uid, gid uint32
+	xattrs   map[string][]byte
+
+	// For directories:
+	entries []*squashfsRawDirent
+	dirPos  int // within the original directory table
+}
+
+func (ino *squashfsRawInode) typ() uint16 {
+	return binary.LittleEndian.Uint16(ino.raw)
+}
+
+type squashfsRawDirent struct {
+	name  string
+	typ   uint16
+	inode *squashfsRawInode
+}
+
+// squashfsRef returns the inode (or directory) reference of the position pos
+// within a table of uncompressed, full metadata blocks.
+func squashfsRef(pos int) uint64 {
+	return uint64(pos/squashfsMetadataSize*(squashfsMetadataSize+2))<<16 | uint64(pos%squashfsMetadataSize)
+}
+
+// extendSquashfsInode returns the basic inode raw as the corresponding
+// extended inode, which contains a link count (regular files) and an xattr
+// index (none). Extended inodes are returned as is.
+func extendSquashfsInode(raw []byte) []byte {
+	le := binary.LittleEndian
+	hdr := append([]byte(nil), raw[:squashfsInodeHeaderLen]...)
+	body := raw[squashfsInodeHeaderLen:]
+	typ := le.Uint16(raw)
+	le.PutUint16(hdr, typ+7)
+	switch typ {
+	case squashfsDirType:
+		// nlink, file size, start block, parent (uint32), index count,
+		// offset (uint16), xattr index (uint32)
+		ext := make([]byte, 24)
+		le.PutUint32(ext[0:], le.Uint32(body[4:]))
+		le.PutUint32(ext[4:], uint32(le.Uint16(body[8:])))
+		le.PutUint32(ext[8:], le.Uint32(body[0:]))
+		le.PutUint32(ext[12:], le.Uint32(body[12:]))
+		le.PutUint16(ext[18:], le.Uint16(body[10:]))
+		le.PutUint32(ext[20:], squashfsInvalidXattr)
+		return append(hdr, ext...)
+	case squashfsFileType:
+		// blocks start, file size, sparse bytes (uint64), nlink, fragment,
+		// fragment offset, xattr index (uint32), followed by the block sizes
+		ext := make([]byte, 40)
+		le.PutUint64(ext[0:], uint64(le.Uint32(body[0:])))
+		le.PutUint64(ext[8:], uint64(le.Uint32(body[12:])))
+		le.PutUint32(ext[24:], 1)
+		copy(ext[28:36], body[4:12])
+		le.PutUint32(ext[36:], squashfsInvalidXattr)
+		return append(append(hdr, ext...), body[16:]...)
+	case squashfsSymlinkType, squashfsBlkdevType, squashfsChrdevType, squashfsFifoType, squashfsFifoType + 1:
+		// The xattr index follows the basic inode.
+		ext := append(append(hdr, body...), 0, 0, 0, 0)
+		le.PutUint32(ext[len(ext)-4:], squashfsInvalidXattr)
+		return ext
+	}
+	return raw
+}
+
+// squashfsXattrPos returns the position of the xattr index within the
+// extended inode raw.
+func squashfsXattrPos(raw []byte) int {
+	switch binary.LittleEndian.Uint16(raw) {
+	case squashfsLdirType:
+		return squashfsInodeHeaderLen + 20
+	case squashfsLregType:
+		return squashfsInodeHeaderLen + 36
+	case squashfsSymlinkType + 7:
+		return len(raw) - 4
+	case squashfsBlkdevType + 7, squashfsChrdevType + 7:
+		return squashfsInodeHeaderLen + 8
+	default: // IPC
+		return squashfsInodeHeaderLen + 4
+	}
+}
+
+// squashfsXattrTable accumulates the xattr table: the key/value pairs of each
+// distinct set of xattrs, and their ids.
+type squashfsXattrTable struct {
+	kv   bytes.Buffer
+	ids  bytes.Buffer // reference (uint64), count and size (uint32) of each id
+	byKV map[string]uint32
+}
+
+// add returns the id of xattrs, adding their key/value pairs if required.
+func (xt *squashfsXattrTable) add(xattrs map[string][]byte) (uint32, error) {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var kv bytes.Buffer
+	for _, name := range names {
+		typ := -1
+		for i, prefix := range squashfsXattrPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				typ = i
+			}
+		}
+		if typ == -1 {
+			return 0, fmt.Errorf("squashfs: xattr %s: unsupported prefix, expected one of %s", name, strings.Join(squashfsXattrPrefixes, ", "))
+		}
+		suffix := name[len(squashfsXattrPrefixes[typ]):]
+		binary.Write(&kv, binary.LittleEndian, []uint16{uint16(typ), uint16(len(suffix))})
+		kv.WriteString(suffix)
+		binary.Write(&kv, binary.LittleEndian, uint32(len(xattrs[name])))
+		kv.Write(xattrs[name])
+	}
+	if id, ok := xt.byKV[kv.String()]; ok {
+		return id, nil
+	}
+	if xt.byKV == nil {
+		xt.byKV = make(map[string]uint32)
+	}
+	id := uint32(len(xt.byKV))
+	binary.Write(&xt.ids, binary.LittleEndian, squashfsRef(xt.kv.Len()))
+	binary.Write(&xt.ids, binary.LittleEndian, []uint32{uint32(len(names)), uint32(kv.Len())})
+	xt.byKV[kv.String()] = id
+	xt.kv.Write(kv.Bytes())
+	return id, nil
+}
+
+// fixupSquashfs applies what github.com/gokrazy/internal/squashfs cannot write
+// to the SquashFS image it wrote at the start of f: fixups maps paths (e.g.
+// /dev/console, or "" for the root directory) to files which are hard links,
+// device nodes or FIFOs (written as placeholders, see
+// writeSquashfsPlaceholder) or have an owner, group or xattrs.
+//
+// Device nodes and FIFOs are written as inodes of their type. A hard link is a
+// directory entry referring to the inode of its target, so the inode table
+// and the directory table are rewritten (with the placeholder inodes of hard
+// links removed, and regular files with multiple links or inodes with xattrs
+// stored as extended inodes). The fragment table (see packSquashfsData) is
+// followed by the owners and groups in the id table, followed by the xattr
+// table. It must be called before addSquashfsExportTable.
+//
+// The directory table is rewritten even without fixups, as
+// github.com/gokrazy/internal/squashfs writes directories with more than 256
+// entries (or inode numbers too far apart) using invalid headers.
+func fixupSquashfs(f io.ReadWriteSeeker, fixups map[string]*fileInfo) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var sb squashfsSuperblock
+	if err := binary.Read(f, binary.LittleEndian, &sb); err != nil {
+		return err
+	}
+	if sb.Magic != squashfsMagic {
+		return fmt.Errorf("squashfs: invalid magic %x", sb.Magic)
+	}
+	if sb.Flags&squashfsNoInodeCompr == 0 || sb.LookupTableStart != -1 || sb.XattrIdTableStart != -1 {
+		return fmt.Errorf("squashfs: unexpected compressed inode table, export table or xattr table")
+	}
+	readAt := func(off, n int64) ([]byte, error) {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err := io.ReadFull(f, b)
+		return b, err
+	}
+	raw, err := readAt(sb.InodeTableStart, sb.DirectoryTableStart-sb.InodeTableStart)
+	if err != nil {
+		return err
+	}
+	itable, err := readSquashfsMetadata(raw)
+	if err != nil {
+		return err
+	}
+	if raw, err = readAt(sb.DirectoryTableStart, sb.FragmentTableStart-sb.DirectoryTableStart); err != nil {
+		return err
+	}
+	dtable, err := readSquashfsMetadata(raw)
+	if err != nil {
+		return err
+	}
+	parsed, err := squashfsInodes(itable.data, sb.BlockSize)
+	if err != nil {
+		return err
+	}
+
+	inodes := make([]*squashfsRawInode, len(parsed))
+	byPos := make(map[int]*squashfsRawInode)
+	for i, p := range parsed {
+		end := len(itable.data)
+		if i+1 < len(parsed) {
+			end = parsed[i+1].pos
+		}
+		ino := &squashfsRawInode{
+			raw:    append([]byte(nil), itable.data[p.pos:end]...),
+			number: p.number,
+			nlink:  1,
+		}
+		if ino.typ() == squashfsLregType {
+			ino.nlink = binary.LittleEndian.Uint32(ino.raw[squashfsInodeHeaderLen+24:])
+		}
+		inodes[i] = ino
+		byPos[p.pos] = ino
+	}
+	lookup := func(ref uint64) (*squashfsRawInode, error) {
+		pos, err := itable.pos(ref)
+		if err != nil {
+			return nil, err
+		}
+		ino, ok := byPos[pos]
+		if !ok {
+			return nil, fmt.Errorf("squashfs: invalid inode reference %x", ref)
+		}
+		return ino, nil
+	}
+	root, err := lookup(uint64(sb.RootInode))
+	if err != nil {
+		return err
+	}
+
+	// Read all directories, finding the files by their path:
+	files := map[string]*squashfsRawDirent{"": {inode: root}}
+	var dirs []*squashfsRawInode
+	var readDir func(dir *squashfsRawInode, path string, depth int) error
+	readDir = func(dir *squashfsRawInode, path string, depth int) error {
+		if depth > 256 {
+			return fmt.Errorf("squashfs: directories nested too deeply")
+		}
+		u16 := func(off int) uint16 { return binary.LittleEndian.Uint16(dir.raw[squashfsInodeHeaderLen+off:]) }
+		u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(dir.raw[squashfsInodeHeaderLen+off:]) }
+		var start, size uint32
+		var offset uint16
+		if dir.typ() == squashfsDirType {
+			start, size, offset = u32(0), uint32(u16(8)), u16(10)
+		} else {
+			if u16(16) != 0 {
+				return fmt.Errorf("squashfs: directory indexes are not supported")
+			}
+			size, start, offset = u32(4), u32(8), u16(18)
+		}
+		pos, err := dtable.pos(uint64(start)<<16 | uint64(offset))
+		if err != nil {
+			return err
+		}
+		dir.dirPos = pos
+		dirs = append(dirs, dir)
+		d := dtable.data
+		// The directory size includes 3 bytes for the . and .. entries, which
+		// are not stored.
+		end := pos + int(size) - 3
+		if end > len(d) {
+			return fmt.Errorf("squashfs: truncated directory %s", path)
+		}
+		for pos < end {
+			if pos+12 > end {
+				return fmt.Errorf("squashfs: truncated directory %s", path)
+			}
+			count := int(binary.LittleEndian.Uint32(d[pos:])) + 1
+			start := uint64(binary.LittleEndian.Uint32(d[pos+4:]))
+			pos += 12
+			for i := 0; i < count; i++ {
+				if pos+8 > end {
+					return fmt.Errorf("squashfs: truncated directory %s", path)
+				}
+				offset := uint64(binary.LittleEndian.Uint16(d[pos:]))
+				n := int(binary.LittleEndian.Uint16(d[pos+6:])) + 1
+				if pos+8+n > end {
+					return fmt.Errorf("squashfs: truncated directory %s", path)
+				}
+				ent := &squashfsRawDirent{
+					name: string(d[pos+8 : pos+8+n]),
+					typ:  binary.LittleEndian.Uint16(d[pos+4:]),
+				}
+				pos += 8 + n
+				if ent.inode, err = lookup(start<<16 | offset); err != nil {
+					return err
+				}
+				dir.entries = append(dir.entries, ent)
+				entPath := path + "/" + ent.name
+				files[entPath] = ent
+				if typ := ent.inode.typ(); typ == squashfsDirType || typ == squashfsLdirType {
+					if err := readDir(ent.inode, entPath, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+	if err := readDir(root, "", 0); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(fixups))
+	for path := range fixups {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fi := fixups[path]
+		ent, ok := files[path]
+		if !ok {
+			return fmt.Errorf("squashfs: %s not found", path)
+		}
+		if fi.hardlinkTarget == "" && fi.device == nil {
+			continue
+		}
+		ino := ent.inode
+		if ino.typ() != squashfsSymlinkType || len(ino.raw) != squashfsInodeHeaderLen+8 {
+			return fmt.Errorf("squashfs: %s is not a placeholder", path)
+		}
+		if d := fi.device; d != nil {
+			hdr := ino.raw[:squashfsInodeHeaderLen]
+			binary.LittleEndian.PutUint16(hdr[2:], uint16(d.mode))
+			switch d.typ {
+			case 'c', 'b':
+				ent.typ = squashfsChrdevType
+				if d.typ == 'b' {
+					ent.typ = squashfsBlkdevType
+				}
+				// The placeholder is of the same size: nlink and rdev.
+				binary.LittleEndian.PutUint32(ino.raw[squashfsInodeHeaderLen:], 1)
+				binary.LittleEndian.PutUint32(ino.raw[squashfsInodeHeaderLen+4:], d.rdev())
+			case 'p':
+				ent.typ = squashfsFifoType
+				ino.raw = ino.raw[:squashfsInodeHeaderLen+4] // nlink
+			}
+			binary.LittleEndian.PutUint16(hdr, ent.typ)
+			continue
+		}
+
+		// Resolve hard links to hard links:
+		target := fi.hardlinkTarget
+		for i := 0; ; i++ {
+			next, ok := fixups[target]
+			if !ok || next.hardlinkTarget == "" {
+				break
+			}
+			if i == len(fixups) {
+				return fmt.Errorf("hard link %s: cycle of hard links", path)
+			}
+			target = next.hardlinkTarget
+		}
+		t, ok := files[target]
+		if !ok {
+			return fmt.Errorf("hard link %s: target %s not found in the root file system", path, target)
+		}
+		if typ := t.inode.typ(); typ != squashfsFileType && typ != squashfsLregType {
+			return fmt.Errorf("hard link %s: target %s is not a regular file", path, target)
+		}
+		ino.drop = true
+		ent.inode = t.inode
+		ent.typ = squashfsFileType
+		t.inode.nlink++
+	}
+	// Hard links share the owner, group and xattrs of their target.
+	for _, path := range paths {
+		if fi := fixups[path]; fi.hardlinkTarget == "" {
+			ino := files[path].inode
+			ino.uid, ino.gid, ino.xattrs = fi.uid, fi.gid, fi.xattrs
+		}
+	}
+
+	// The id table contains the owners and groups, with root first (so that
+	// all other inodes can keep id index 0).
+	ids := []uint32{0}
+	idIndex := map[uint32]uint16{0: 0}
+	index := func(id uint32) (uint16, error) {
+		if idx, ok := idIndex[id]; ok {
+			return idx, nil
+		}
+		if len(ids) > 0xFFFF {
+			return 0, fmt.Errorf("squashfs: too many distinct owners and groups")
+		}
+		idIndex[id] = uint16(len(ids))
+		ids = append(ids, id)
+		return idIndex[id], nil
+	}
+
+	var fragTable []byte
+	if packSquashfs() {
+		dataEnd, ft, err := packSquashfsData(f, &sb, inodes)
+		if err != nil {
+			return err
+		}
+		sb.InodeTableStart, fragTable = dataEnd, ft
+	}
+
+	// Renumber the inodes (the export table requires inode numbers 1 to
+	// sb.Inodes) and lay out the inode table:
+	var xattrs squashfsXattrTable
+	numbers := make(map[uint32]uint32)
+	var n uint32
+	pos := 0
+	for _, ino := range inodes {
+		if ino.drop {
+			continue
+		}
+		n++
+		numbers[ino.number] = n
+		binary.LittleEndian.PutUint32(ino.raw[12:], n)
+		uid, err := index(ino.uid)
+		if err != nil {
+			return err
+		}
+		gid, err := index(ino.gid)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint16(ino.raw[4:], uid)
+		binary.LittleEndian.PutUint16(ino.raw[6:], gid)
+		if ino.nlink > 1 || len(ino.xattrs) > 0 {
+			ino.raw = extendSquashfsInode(ino.raw)
+		}
+		if ino.nlink > 1 {
+			binary.LittleEndian.PutUint32(ino.raw[squashfsInodeHeaderLen+24:], ino.nlink)
+		}
+		if len(ino.xattrs) > 0 {
+			id, err := xattrs.add(ino.xattrs)
+			if err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint32(ino.raw[squashfsXattrPos(ino.raw):], id)
+		}
+		ino.pos = pos
+		pos += len(ino.raw)
+	}
+
+	// Write the directory table, keeping the order of the directories:
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].dirPos < dirs[j].dirPos
+	})
+	var dbuf bytes.Buffer
+	for _, dir := range dirs {
+		start := dbuf.Len()
+		for i := 0; i < len(dir.entries); {
+			// A header covers up to 256 entries whose inodes are in the same
+			// metadata block, with inode numbers relative to its base.
+			first := dir.entries[i].inode
+			block := first.pos / squashfsMetadataSize
+			base := int64(numbers[first.number])
+			j := i + 1
+			for ; j < len(dir.entries) && j-i < 256; j++ {
+				ino := dir.entries[j].inode
+				delta := int64(numbers[ino.number]) - base
+				if ino.pos/squashfsMetadataSize != block || delta < -32768 || delta > 32767 {
+					break
+				}
+			}
+			binary.Write(&dbuf, binary.LittleEndian, []uint32{
+				uint32(j - i - 1),
+				uint32(block * (squashfsMetadataSize + 2)),
+				uint32(base),
+			})
+			for _, ent := range dir.entries[i:j] {
+				binary.Write(&dbuf, binary.LittleEndian, []uint16{
+					uint16(ent.inode.pos % squashfsMetadataSize),
+					uint16(int16(int64(numbers[ent.inode.number]) - base)),
+					ent.typ,
+					uint16(len(ent.name) - 1),
+				})
+				dbuf.WriteString(ent.name)
+			}
+			i = j
+		}
+		size := dbuf.Len() - start + 3
+		ref := squashfsRef(start)
+		body := dir.raw[squashfsInodeHeaderLen:]
+		parent, ok := numbers[binary.LittleEndian.Uint32(body[12:])]
+		if !ok {
+			parent = n + 1 // root directory
+		}
+		binary.LittleEndian.PutUint32(body[12:], parent)
+		if dir.typ() == squashfsDirType {
+			if size > 0xFFFF {
+				return fmt.Errorf("squashfs: directory listing too large (%d bytes)", size)
+			}
+			binary.LittleEndian.PutUint32(body[0:], uint32(ref>>16))
+			binary.LittleEndian.PutUint16(body[8:], uint16(size))
+			binary.LittleEndian.PutUint16(body[10:], uint16(ref))
+		} else {
+			binary.LittleEndian.PutUint32(body[4:], uint32(size))
+			binary.LittleEndian.PutUint32(body[8:], uint32(ref>>16))
+			binary.LittleEndian.PutUint16(body[18:], uint16(ref))
+		}
+	}
+
+	var ibuf bytes.Buffer
+	for _, ino := range inodes {
+		if !ino.drop {
+			ibuf.Write(ino.raw)
+		}
+	}
+
+	var buf bytes.Buffer
+	offset := func() int64 { return sb.InodeTableStart + int64(buf.Len()) }
+	// writeTable writes data as metadata blocks, followed by their locations
+	// if index is true.
+	writeTable := func(data []byte, index bool) {
+		start := offset()
+		var starts []int64
+		buf.Write(marshalSquashfsMetadata(data, &starts))
+		if index {
+			for _, s := range starts {
+				binary.Write(&buf, binary.LittleEndian, uint64(start+s))
+			}
+		}
+	}
+	writeTable(ibuf.Bytes(), false)
+	sb.DirectoryTableStart = offset()
+	writeTable(dbuf.Bytes(), false)
+	sb.FragmentTableStart = offset()
+	if len(fragTable) > 0 {
+		fragBlocks := len(marshalSquashfsMetadata(fragTable, nil))
+		writeTable(fragTable, true)
+		sb.FragmentTableStart += int64(fragBlocks)
+	}
+	idStart := offset()
+	var idData bytes.Buffer
+	binary.Write(&idData, binary.LittleEndian, ids)
+	idBlocks := len(marshalSquashfsMetadata(idData.Bytes(), nil))
+	writeTable(idData.Bytes(), true)
+	sb.IdTableStart = idStart + int64(idBlocks)
+	sb.NoIds = uint16(len(ids))
+	if xattrs.byKV != nil {
+		// The key/value pairs, followed by the ids, followed by the xattr id
+		// table header: the start of the key/value pairs and the number of
+		// ids, followed by the locations of the id blocks.
+		kvStart := offset()
+		writeTable(xattrs.kv.Bytes(), false)
+		idsStart := offset()
+		var starts []int64
+		buf.Write(marshalSquashfsMetadata(xattrs.ids.Bytes(), &starts))
+		sb.XattrIdTableStart = offset()
+		binary.Write(&buf, binary.LittleEndian, uint64(kvStart))
+		binary.Write(&buf, binary.LittleEndian, []uint32{uint32(len(xattrs.byKV)), 0})
+		for _, s := range starts {
+			binary.Write(&buf, binary.LittleEndian, uint64(idsStart+s))
+		}
+		sb.Flags &^= squashfsNoXattrs
+	}
+	sb.BytesUsed = offset()
+	// Pad to 4096, required for the kernel to be able to access all pages
+	if pad := sb.BytesUsed % 4096; pad > 0 {
+		buf.Write(make([]byte, 4096-pad))
+	}
+	if _, err := f.Seek(sb.InodeTableStart, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if t, ok := f.(interface{ Truncate(int64) error }); ok {
+		if err := t.Truncate(offset()); err != nil {
+			return err
+		}
+	}
+
+	sb.Inodes = n
+	sb.RootInode = int64(squashfsRef(root.pos))
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(f, binary.LittleEndian, &sb)
+}
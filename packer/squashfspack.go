@@ -0,0 +1,282 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+var (
+	rootfsDedup = flag.Bool("rootfs_dedup",
+		true,
+		"store identical data blocks of the root file system only once: files (and runs of blocks) whose blocks were already written refer to the existing blocks")
+
+	rootfsFragments = flag.Bool("rootfs_fragments",
+		true,
+		"pack the last (partial) block of each file of the root file system together with those of other files into shared fragment blocks, instead of storing each in a block of its own")
+)
+
+const (
+	squashfsNoFragmentCompr = 1 << 3
+	squashfsNoFragments     = 1 << 4
+	squashfsDuplicates      = 1 << 6
+
+	// squashfsFragmentEntryLen is the size of a fragment table entry: the
+	// location (uint64) and size (uint32) of the fragment block, followed by
+	// an unused uint32.
+	squashfsFragmentEntryLen = 16
+)
+
+// packSquashfs returns whether fixupSquashfs deduplicates or packs fragments.
+func packSquashfs() bool {
+	return *rootfsDedup || *rootfsFragments
+}
+
+// squashfsWrittenBlock is a data block written by packSquashfsData.
+type squashfsWrittenBlock struct {
+	off  int64
+	size uint32 // as stored in the inode
+	hash [sha256.Size]byte
+}
+
+// packSquashfsData rewrites the data blocks (following the superblock) of the
+// SquashFS image in f, which github.com/gokrazy/internal/squashfs wrote
+// without fragments or deduplication, for fixupSquashfs: with -rootfs_dedup,
+// files refer to identical runs of blocks which were already written. With
+// -rootfs_fragments, the tail of each file is stored in a fragment block,
+// removing the size of its last block from the inode. The inodes are updated
+// in place; packSquashfsData returns the end of the data blocks and the
+// fragment table entries.
+func packSquashfsData(f io.ReadWriteSeeker, sb *squashfsSuperblock, inodes []*squashfsRawInode) (dataEnd int64, fragTable []byte, err error) {
+	stage := startStage("pack root file system")
+	defer stage.done()
+	le := binary.LittleEndian
+	readAt := func(off, n int64) ([]byte, error) {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err := io.ReadFull(f, b)
+		return b, err
+	}
+
+	tmp, err := ioutil.TempFile("", "gokr-packer-squashfs-pack")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	bufw := bufio.NewWriter(tmp)
+	var n int64 // written to tmp
+	off := func() int64 { return 96 + n }
+	write := func(b []byte) error {
+		n += int64(len(b))
+		_, err := bufw.Write(b)
+		return err
+	}
+
+	var (
+		written   []squashfsWrittenBlock
+		byHash    = make(map[[sha256.Size]byte][]int)
+		entries   bytes.Buffer
+		fragments uint32
+		tails     = make(map[[sha256.Size]byte][2]uint32) // fragment, offset
+		frag      bytes.Buffer                            // pending fragment block
+		zbuf      bytes.Buffer
+	)
+	zw, err := zlib.NewWriterLevel(&zbuf, zlib.BestSpeed)
+	if err != nil {
+		return 0, nil, err
+	}
+	flushFragment := func() error {
+		if frag.Len() == 0 {
+			return nil
+		}
+		zbuf.Reset()
+		zw.Reset(&zbuf)
+		if _, err := zw.Write(frag.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		out, size := zbuf.Bytes(), uint32(zbuf.Len())
+		if zbuf.Len() >= frag.Len() {
+			out, size = frag.Bytes(), uint32(frag.Len())|squashfsBlockUncompressed
+		}
+		binary.Write(&entries, le, uint64(off()))
+		binary.Write(&entries, le, []uint32{size, 0})
+		fragments++
+		if err := write(out); err != nil {
+			return err
+		}
+		frag.Reset()
+		return nil
+	}
+	// findRun returns the location of a run of written blocks identical to
+	// blocks, or -1.
+	findRun := func(blocks []squashfsWrittenBlock) int64 {
+		if !*rootfsDedup || len(blocks) == 0 {
+			return -1
+		}
+	candidates:
+		for _, p := range byHash[blocks[0].hash] {
+			if p+len(blocks) > len(written) {
+				continue
+			}
+			for i, b := range blocks {
+				w := written[p+i]
+				if w.hash != b.hash || w.size != b.size {
+					continue candidates
+				}
+				// The blocks of a file are stored contiguously:
+				if i > 0 {
+					prev := written[p+i-1]
+					if w.off != prev.off+int64(prev.size&^squashfsBlockUncompressed) {
+						continue candidates
+					}
+				}
+			}
+			return written[p].off
+		}
+		return -1
+	}
+
+	done := make(map[*squashfsRawInode]bool)
+	for _, ino := range inodes {
+		typ := ino.typ()
+		if ino.drop || done[ino] || (typ != squashfsFileType && typ != squashfsLregType) {
+			continue
+		}
+		done[ino] = true
+		body := ino.raw[squashfsInodeHeaderLen:]
+		var (
+			start    int64
+			size     int64
+			sizesOff int
+			fragPos  int // of the fragment index, followed by the offset
+		)
+		if typ == squashfsFileType {
+			start, size, sizesOff, fragPos = int64(le.Uint32(body[0:])), int64(le.Uint32(body[12:])), 16, 4
+		} else {
+			start, size, sizesOff, fragPos = int64(le.Uint64(body[0:])), int64(le.Uint64(body[8:])), 40, 28
+		}
+		if le.Uint32(body[fragPos:]) != squashfsInvalidFrag {
+			continue // already packed
+		}
+		n := int((size + int64(sb.BlockSize) - 1) / int64(sb.BlockSize))
+		var blocks []squashfsWrittenBlock
+		var data [][]byte
+		sparse := false
+		pos := start
+		for i := 0; i < n; i++ {
+			bs := le.Uint32(body[sizesOff+4*i:])
+			sparse = sparse || bs == 0
+			onDisk := int64(bs &^ squashfsBlockUncompressed)
+			b, err := readAt(pos, onDisk)
+			if err != nil {
+				return 0, nil, err
+			}
+			pos += onDisk
+			blocks = append(blocks, squashfsWrittenBlock{size: bs, hash: sha256.Sum256(b)})
+			data = append(data, b)
+		}
+
+		// The tail of the file, if it does not fill a block:
+		var tail []byte
+		if tailLen := size % int64(sb.BlockSize); *rootfsFragments && tailLen > 0 && !sparse {
+			last := len(blocks) - 1
+			tail = data[last]
+			if blocks[last].size&squashfsBlockUncompressed == 0 {
+				if tail, err = decompressSquashfsBlock(squashfsZlib, tail); err != nil {
+					return 0, nil, err
+				}
+			}
+			if int64(len(tail)) != tailLen {
+				return 0, nil, fmt.Errorf("squashfs: unexpected size %d of the last block (inode %d)", len(tail), ino.number)
+			}
+			blocks, data = blocks[:last], data[:last]
+		}
+
+		newStart := findRun(blocks)
+		if newStart == -1 || sparse {
+			newStart = off()
+			for i, b := range blocks {
+				b.off = off()
+				if !sparse {
+					byHash[b.hash] = append(byHash[b.hash], len(written))
+					written = append(written, b)
+				}
+				if err := write(data[i]); err != nil {
+					return 0, nil, err
+				}
+			}
+		}
+
+		if typ == squashfsFileType {
+			le.PutUint32(body[0:], uint32(newStart))
+		} else {
+			le.PutUint64(body[0:], uint64(newStart))
+		}
+		if tail == nil {
+			continue
+		}
+		h := sha256.Sum256(tail)
+		loc, ok := tails[h]
+		if !ok || !*rootfsDedup {
+			if frag.Len()+len(tail) > int(sb.BlockSize) {
+				if err := flushFragment(); err != nil {
+					return 0, nil, err
+				}
+			}
+			loc = [2]uint32{fragments, uint32(frag.Len())}
+			tails[h] = loc
+			frag.Write(tail)
+		}
+		le.PutUint32(body[fragPos:], loc[0])
+		le.PutUint32(body[fragPos+4:], loc[1])
+		// Remove the size of the last block:
+		ino.raw = ino.raw[:squashfsInodeHeaderLen+sizesOff+4*len(blocks)]
+	}
+	if err := flushFragment(); err != nil {
+		return 0, nil, err
+	}
+	if err := bufw.Flush(); err != nil {
+		return 0, nil, err
+	}
+	if err := copySquashfsData(f, tmp, n); err != nil {
+		return 0, nil, err
+	}
+	stage.bytes = n
+
+	sb.Fragments = fragments
+	if fragments > 0 {
+		sb.Flags &^= squashfsNoFragments | squashfsNoFragmentCompr
+	}
+	if *rootfsDedup {
+		sb.Flags |= squashfsDuplicates
+	}
+	log.Printf("packed root file system data: %s instead of %s (%d fragment blocks)", formatBytes(n), formatBytes(sb.InodeTableStart-96), fragments)
+	return off(), entries.Bytes(), nil
+}
+
+// copySquashfsData copies the n bytes of data blocks in tmp to f, following
+// the superblock.
+func copySquashfsData(f io.WriteSeeker, tmp io.ReadSeeker, n int64) error {
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Seek(96, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(f, tmp, n)
+	return err
+}
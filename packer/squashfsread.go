@@ -0,0 +1,479 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	squashfsZlib              = 1
+	squashfsBlockUncompressed = 1 << 24
+)
+
+// squashfsReader reads SquashFS images as written by
+// github.com/gokrazy/internal/squashfs (uncompressed metadata, zlib-compressed
+// data blocks), packSquashfsData (fragments, shared blocks) and
+// recompressSquashfs, e.g. for patching them.
+type squashfsReader struct {
+	r      io.ReaderAt
+	sb     squashfsSuperblock
+	inodes *squashfsMetadata
+	dirs   *squashfsMetadata
+
+	// fragments is the fragment table, if any. The most recently read
+	// fragment block is cached, as files are typically read in order.
+	fragments    *squashfsMetadata
+	lastFragment uint32
+	fragmentData []byte
+
+	// ids is the id table (owners and groups).
+	ids []uint32
+
+	// xattrKV and xattrIDs are the key/value pairs and ids of the xattr table,
+	// if any.
+	xattrKV, xattrIDs *squashfsMetadata
+}
+
+func newSquashfsReader(r io.ReaderAt) (*squashfsReader, error) {
+	sr := &squashfsReader{r: r}
+	if err := binary.Read(io.NewSectionReader(r, 0, 96), binary.LittleEndian, &sr.sb); err != nil {
+		return nil, err
+	}
+	sb := sr.sb
+	if sb.Magic != squashfsMagic {
+		return nil, fmt.Errorf("squashfs: invalid magic %x", sb.Magic)
+	}
+	if sb.Compression != squashfsZlib && squashfsCompressionName(sb.Compression) == "gzip" {
+		return nil, fmt.Errorf("squashfs: compression %d is not supported", sb.Compression)
+	}
+	read := func(start, end int64) (*squashfsMetadata, error) {
+		if start < 96 || end < start {
+			return nil, fmt.Errorf("squashfs: invalid table offsets")
+		}
+		b := make([]byte, end-start)
+		if _, err := r.ReadAt(b, start); err != nil {
+			return nil, err
+		}
+		return readSquashfsMetadata(b)
+	}
+	// The fragment, id and xattr id tables are followed by the locations of
+	// their metadata blocks; the first block starts the table.
+	firstBlock := func(index int64) (int64, error) {
+		b := make([]byte, 8)
+		if _, err := r.ReadAt(b, index); err != nil {
+			return 0, err
+		}
+		return int64(binary.LittleEndian.Uint64(b)), nil
+	}
+	var err error
+	if sr.inodes, err = read(sb.InodeTableStart, sb.DirectoryTableStart); err != nil {
+		return nil, err
+	}
+	// The fragment table (or, without fragments, its empty index) follows the
+	// directory table.
+	dirsEnd := sb.FragmentTableStart
+	if sb.Fragments > 0 {
+		if dirsEnd, err = firstBlock(sb.FragmentTableStart); err != nil {
+			return nil, err
+		}
+		if sr.fragments, err = read(dirsEnd, sb.FragmentTableStart); err != nil {
+			return nil, err
+		}
+		if len(sr.fragments.data) < int(sb.Fragments)*squashfsFragmentEntryLen {
+			return nil, fmt.Errorf("squashfs: truncated fragment table")
+		}
+	}
+	if sr.dirs, err = read(sb.DirectoryTableStart, dirsEnd); err != nil {
+		return nil, err
+	}
+	start, err := firstBlock(sb.IdTableStart)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := read(start, sb.IdTableStart)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids.data) < 4*int(sb.NoIds) {
+		return nil, fmt.Errorf("squashfs: truncated id table")
+	}
+	for i := 0; i < int(sb.NoIds); i++ {
+		sr.ids = append(sr.ids, binary.LittleEndian.Uint32(ids.data[4*i:]))
+	}
+	if sb.XattrIdTableStart != -1 {
+		kvStart, err := firstBlock(sb.XattrIdTableStart)
+		if err != nil {
+			return nil, err
+		}
+		idsStart, err := firstBlock(sb.XattrIdTableStart + 16)
+		if err != nil {
+			return nil, err
+		}
+		if sr.xattrKV, err = read(kvStart, idsStart); err != nil {
+			return nil, err
+		}
+		if sr.xattrIDs, err = read(idsStart, sb.XattrIdTableStart); err != nil {
+			return nil, err
+		}
+	}
+	return sr, nil
+}
+
+// xattrs returns the xattrs with the specified id.
+func (sr *squashfsReader) xattrs(id uint32) (map[string][]byte, error) {
+	if sr.xattrIDs == nil || int(id)*16+16 > len(sr.xattrIDs.data) {
+		return nil, fmt.Errorf("squashfs: invalid xattr id %d", id)
+	}
+	e := sr.xattrIDs.data[16*id:]
+	pos, err := sr.xattrKV.pos(binary.LittleEndian.Uint64(e))
+	if err != nil {
+		return nil, err
+	}
+	d := sr.xattrKV.data
+	xattrs := make(map[string][]byte)
+	for i := 0; i < int(binary.LittleEndian.Uint32(e[8:])); i++ {
+		// Key: type, name size (uint16), name; value: size (uint32), value.
+		if pos+4 > len(d) {
+			return nil, fmt.Errorf("squashfs: truncated xattr %d", id)
+		}
+		typ, n := binary.LittleEndian.Uint16(d[pos:]), int(binary.LittleEndian.Uint16(d[pos+2:]))
+		if int(typ) >= len(squashfsXattrPrefixes) {
+			return nil, fmt.Errorf("squashfs: unsupported xattr type %#x", typ)
+		}
+		if pos+4+n+4 > len(d) {
+			return nil, fmt.Errorf("squashfs: truncated xattr %d", id)
+		}
+		name := squashfsXattrPrefixes[typ] + string(d[pos+4:pos+4+n])
+		pos += 4 + n
+		size := int(binary.LittleEndian.Uint32(d[pos:]))
+		if pos+4+size > len(d) {
+			return nil, fmt.Errorf("squashfs: truncated xattr %d", id)
+		}
+		xattrs[name] = append([]byte(nil), d[pos+4:pos+4+size]...)
+		pos += 4 + size
+	}
+	return xattrs, nil
+}
+
+// pos returns the position of the metadata reference ref (block start << 16 |
+// offset) within md.data.
+func (md *squashfsMetadata) pos(ref uint64) (int, error) {
+	start, offset := int64(ref>>16), int(ref&0xFFFF)
+	for i, s := range md.blockStarts {
+		if s == start {
+			return i*squashfsMetadataSize + offset, nil
+		}
+	}
+	return 0, fmt.Errorf("squashfs: invalid metadata reference %x", ref)
+}
+
+// squashfsFile is a file, directory, symlink, device node or FIFO of a
+// squashfsReader.
+type squashfsFile struct {
+	name    string
+	mode    os.FileMode // permission bits only
+	modTime time.Time
+
+	// inode is the inode number, which hard links share.
+	inode uint32
+
+	uid, gid uint32
+	xattrs   map[string][]byte
+
+	dir     bool
+	entries []*squashfsFile
+
+	symlinkDest string
+
+	device *deviceNode
+
+	// fromHost is the host file replacing the contents (see patchMain).
+	fromHost string
+
+	// blocksStart, size and blockSizes locate the contents of a regular file,
+	// whose tail is stored at fragmentOffset of the fragment block (unless
+	// fragment is squashfsInvalidFrag).
+	blocksStart    int64
+	size           int64
+	blockSizes     []uint32
+	fragment       uint32
+	fragmentOffset uint32
+}
+
+// root returns the tree of all files in the file system.
+func (sr *squashfsReader) root() (*squashfsFile, error) {
+	return sr.inode("", uint64(sr.sb.RootInode), 0)
+}
+
+func (sr *squashfsReader) inode(name string, ref uint64, depth int) (*squashfsFile, error) {
+	if depth > 256 {
+		return nil, fmt.Errorf("squashfs: directories nested too deeply")
+	}
+	pos, err := sr.inodes.pos(ref)
+	if err != nil {
+		return nil, err
+	}
+	b := sr.inodes.data
+	need := func(n int) error {
+		if pos+n > len(b) {
+			return fmt.Errorf("squashfs: truncated inode %x", ref)
+		}
+		return nil
+	}
+	if err := need(squashfsInodeHeaderLen); err != nil {
+		return nil, err
+	}
+	u16 := func(off int) uint16 { return binary.LittleEndian.Uint16(b[pos+off:]) }
+	u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(b[pos+off:]) }
+	u64 := func(off int) uint64 { return binary.LittleEndian.Uint64(b[pos+off:]) }
+	f := &squashfsFile{
+		name:    name,
+		mode:    os.FileMode(u16(2)) & os.ModePerm,
+		modTime: time.Unix(int64(u32(8)), 0),
+		inode:   u32(12),
+	}
+	for i, id := range []*uint32{&f.uid, &f.gid} {
+		idx := int(u16(4 + 2*i))
+		if idx >= len(sr.ids) {
+			return nil, fmt.Errorf("squashfs: invalid id index %d (%s)", idx, name)
+		}
+		*id = sr.ids[idx]
+	}
+	const body = squashfsInodeHeaderLen
+	// xattr reads the xattrs of an extended inode, whose index is at off.
+	xattr := func(off int) error {
+		if err := need(off + 4); err != nil {
+			return err
+		}
+		idx := u32(off)
+		if idx == squashfsInvalidXattr {
+			return nil
+		}
+		var err error
+		f.xattrs, err = sr.xattrs(idx)
+		return err
+	}
+	// blocks reads the block sizes of a regular file, which follow the inode.
+	// The tail of a file with a fragment is not stored in a block.
+	blocks := func(off int) error {
+		n := int(f.size / int64(sr.sb.BlockSize))
+		if f.fragment == squashfsInvalidFrag && f.size%int64(sr.sb.BlockSize) != 0 {
+			n++
+		}
+		if err := need(off + 4*n); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			f.blockSizes = append(f.blockSizes, u32(off+4*i))
+		}
+		return nil
+	}
+	var (
+		dirStart, dirSize uint32
+		dirOffset         uint16
+	)
+	switch typ := u16(0); typ {
+	case 1: // directory
+		if err := need(body + 16); err != nil {
+			return nil, err
+		}
+		f.dir = true
+		dirStart, dirSize, dirOffset = u32(body), uint32(u16(body+8)), u16(body+10)
+	case 8: // extended directory
+		if err := need(body + 24); err != nil {
+			return nil, err
+		}
+		f.dir = true
+		dirSize, dirStart, dirOffset = u32(body+4), u32(body+8), u16(body+18)
+		if err := xattr(body + 20); err != nil {
+			return nil, err
+		}
+	case 2, 9: // regular file
+		sizesOff := body + 16
+		if typ == 2 {
+			if err := need(body + 16); err != nil {
+				return nil, err
+			}
+			f.blocksStart, f.fragment, f.fragmentOffset, f.size = int64(u32(body)), u32(body+4), u32(body+8), int64(u32(body+12))
+		} else {
+			if err := need(body + 40); err != nil {
+				return nil, err
+			}
+			f.blocksStart, f.size, f.fragment, f.fragmentOffset = int64(u64(body)), int64(u64(body+8)), u32(body+28), u32(body+32)
+			sizesOff = body + 40
+			if err := xattr(body + 36); err != nil {
+				return nil, err
+			}
+		}
+		if f.fragment != squashfsInvalidFrag && f.fragment >= sr.sb.Fragments {
+			return nil, fmt.Errorf("squashfs: invalid fragment %d (%s)", f.fragment, name)
+		}
+		if err := blocks(sizesOff); err != nil {
+			return nil, err
+		}
+		return f, nil
+	case 3, 10: // (extended) symlink
+		if err := need(body + 8); err != nil {
+			return nil, err
+		}
+		n := int(u32(body + 4))
+		if err := need(body + 8 + n); err != nil {
+			return nil, err
+		}
+		f.symlinkDest = string(b[pos+body+8 : pos+body+8+n])
+		if typ == 10 {
+			if err := xattr(body + 8 + n); err != nil {
+				return nil, err
+			}
+		}
+		return f, nil
+	case 4, 5, 11, 12: // (extended) block and character device
+		if err := need(body + 8); err != nil {
+			return nil, err
+		}
+		devType := byte('b')
+		if typ == 5 || typ == 12 {
+			devType = 'c'
+		}
+		rdev := u32(body + 4)
+		f.device = &deviceNode{typ: devType, major: (rdev & 0xfff00) >> 8, minor: rdev&0xff | (rdev>>12)&0xfff00, mode: f.mode}
+		if typ > 7 {
+			if err := xattr(body + 8); err != nil {
+				return nil, err
+			}
+		}
+		return f, nil
+	case 6, 13: // (extended) fifo
+		f.device = &deviceNode{typ: 'p', mode: f.mode}
+		if typ == 13 {
+			if err := xattr(body + 4); err != nil {
+				return nil, err
+			}
+		}
+		return f, nil
+	default:
+		return nil, fmt.Errorf("squashfs: unsupported inode type %d (%s)", typ, name)
+	}
+
+	// The directory size includes 3 bytes for the . and .. entries, which
+	// are not stored.
+	if dirSize <= 3 {
+		return f, nil // empty
+	}
+	dpos, err := sr.dirs.pos(uint64(dirStart)<<16 | uint64(dirOffset))
+	if err != nil {
+		return nil, err
+	}
+	d := sr.dirs.data
+	end := dpos + int(dirSize) - 3
+	if end > len(d) {
+		return nil, fmt.Errorf("squashfs: truncated directory %s", name)
+	}
+	for dpos < end {
+		// Header: count - 1, start block of the inodes, base inode number.
+		if dpos+12 > end {
+			return nil, fmt.Errorf("squashfs: truncated directory %s", name)
+		}
+		count := int(binary.LittleEndian.Uint32(d[dpos:])) + 1
+		start := uint64(binary.LittleEndian.Uint32(d[dpos+4:]))
+		dpos += 12
+		for i := 0; i < count; i++ {
+			// Entry: offset, inode number difference, type, name size - 1.
+			if dpos+8 > end {
+				return nil, fmt.Errorf("squashfs: truncated directory %s", name)
+			}
+			offset := uint64(binary.LittleEndian.Uint16(d[dpos:]))
+			n := int(binary.LittleEndian.Uint16(d[dpos+6:])) + 1
+			if dpos+8+n > end {
+				return nil, fmt.Errorf("squashfs: truncated directory %s", name)
+			}
+			entName := string(d[dpos+8 : dpos+8+n])
+			dpos += 8 + n
+			ent, err := sr.inode(entName, start<<16|offset, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			f.entries = append(f.entries, ent)
+		}
+	}
+	return f, nil
+}
+
+// copyFile writes the contents of the regular file f to w.
+func (sr *squashfsReader) copyFile(w io.Writer, f *squashfsFile) error {
+	off := f.blocksStart
+	remaining := f.size
+	for _, size := range f.blockSizes {
+		n := int64(sr.sb.BlockSize)
+		if n > remaining {
+			n = remaining
+		}
+		onDisk := int64(size &^ squashfsBlockUncompressed)
+		var block io.Reader
+		switch {
+		case size == 0: // sparse
+			block = io.LimitReader(zeroReader{}, n)
+		case size&squashfsBlockUncompressed != 0:
+			block = io.NewSectionReader(sr.r, off, onDisk)
+		default:
+			b := make([]byte, onDisk)
+			if _, err := sr.r.ReadAt(b, off); err != nil {
+				return err
+			}
+			b, err := decompressSquashfsBlock(sr.sb.Compression, b)
+			if err != nil {
+				return err
+			}
+			block = bytes.NewReader(b)
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, block); err != nil {
+			return err
+		}
+		if int64(buf.Len()) != n {
+			return fmt.Errorf("squashfs: %s: block at offset %d contains %d bytes, expected %d", f.name, off, buf.Len(), n)
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		off += onDisk
+		remaining -= n
+	}
+	if f.fragment == squashfsInvalidFrag || remaining == 0 {
+		return nil
+	}
+	b, err := sr.fragmentBlock(f.fragment)
+	if err != nil {
+		return err
+	}
+	if int64(f.fragmentOffset)+remaining > int64(len(b)) {
+		return fmt.Errorf("squashfs: %s: fragment %d contains %d bytes, expected %d at offset %d", f.name, f.fragment, len(b), remaining, f.fragmentOffset)
+	}
+	_, err = w.Write(b[f.fragmentOffset : int64(f.fragmentOffset)+remaining])
+	return err
+}
+
+// fragmentBlock returns the contents of the fragment block with index idx.
+func (sr *squashfsReader) fragmentBlock(idx uint32) ([]byte, error) {
+	if sr.fragmentData != nil && sr.lastFragment == idx {
+		return sr.fragmentData, nil
+	}
+	entry := sr.fragments.data[idx*squashfsFragmentEntryLen:]
+	start, size := int64(binary.LittleEndian.Uint64(entry)), binary.LittleEndian.Uint32(entry[8:])
+	b := make([]byte, size&^squashfsBlockUncompressed)
+	if _, err := sr.r.ReadAt(b, start); err != nil {
+		return nil, err
+	}
+	if size&squashfsBlockUncompressed == 0 {
+		var err error
+		if b, err = decompressSquashfsBlock(sr.sb.Compression, b); err != nil {
+			return nil, err
+		}
+	}
+	sr.lastFragment, sr.fragmentData = idx, b
+	return b, nil
+}
@@ -0,0 +1,176 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	authorizedKeys = flag.String("authorized_keys",
+		"",
+		"comma-separated list of files containing SSH public keys (e.g. ~/.ssh/id_ed25519.pub or ~/.ssh/authorized_keys) which may log in via the -ssh_pkg server. The keys are written to -authorized_keys_path in the root file system")
+
+	authorizedKeysPath = flag.String("authorized_keys_path",
+		"/etc/breakglass.authorized_keys",
+		"path in the root file system to which the -authorized_keys are written, i.e. where the -ssh_pkg server expects them")
+
+	sshPkg = flag.String("ssh_pkg",
+		breakglassPkg,
+		"Go package of the SSH server which is included in /gokrazy when -authorized_keys is specified (unless it is among the packages to install already). Empty means no SSH server is included. "+breakglassPkg+" is started with -authorized_keys=<-authorized_keys_path>")
+)
+
+const breakglassPkg = "github.com/gokrazy/breakglass"
+
+// sshKeyTypes are the public key algorithms accepted in -authorized_keys.
+var sshKeyTypes = map[string]bool{
+	"ssh-ed25519":                        true,
+	"ssh-rsa":                            true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// expandHome replaces a leading ~/ in path with the home directory, as the
+// shell does not expand it within flag values (-authorized_keys=~/…).
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := homedir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[2:]), nil
+}
+
+// checkAuthorizedKey verifies that line (of an authorized_keys file, possibly
+// starting with options) contains a public key of one of sshKeyTypes.
+func checkAuthorizedKey(line string) error {
+	fields := strings.Fields(line)
+	for i, field := range fields {
+		if !sshKeyTypes[field] {
+			continue
+		}
+		if i+1 >= len(fields) {
+			return fmt.Errorf("%s key without data", field)
+		}
+		blob, err := base64.StdEncoding.DecodeString(fields[i+1])
+		if err != nil {
+			return fmt.Errorf("%s key: %v", field, err)
+		}
+		// The key data starts with the length-prefixed key type:
+		if len(blob) < 4 || uint64(len(blob)) < 4+uint64(binary.BigEndian.Uint32(blob)) ||
+			string(blob[4:4+binary.BigEndian.Uint32(blob)]) != field {
+			return fmt.Errorf("%s key: data does not contain a %s key", field, field)
+		}
+		return nil
+	}
+	return fmt.Errorf("no SSH public key found (expected e.g. ssh-ed25519 AAAA…)")
+}
+
+// readAuthorizedKeys returns the contents of the -authorized_keys files, one
+// key per line.
+func readAuthorizedKeys() (string, error) {
+	var buf bytes.Buffer
+	for _, fn := range strings.Split(*authorizedKeys, ",") {
+		fn, err := expandHome(fn)
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return "", fmt.Errorf("-authorized_keys: %v", err)
+		}
+		var n int
+		for i, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := checkAuthorizedKey(line); err != nil {
+				return "", fmt.Errorf("-authorized_keys: %s:%d: %v", fn, i+1, err)
+			}
+			buf.WriteString(line + "\n")
+			n++
+		}
+		if n == 0 {
+			return "", fmt.Errorf("-authorized_keys: %s does not contain any keys", fn)
+		}
+	}
+	return buf.String(), nil
+}
+
+// checkSSHFlags verifies the -authorized_keys and -authorized_keys_path flags.
+func checkSSHFlags() error {
+	if *authorizedKeys == "" {
+		return nil
+	}
+	p := *authorizedKeysPath
+	if !path.IsAbs(p) || path.Clean(p) != p || p == "/" {
+		return fmt.Errorf("-authorized_keys_path=%q is not a clean absolute path", p)
+	}
+	for _, dir := range []string{"/perm", "/tmp", "/proc", "/sys", "/dev", "/gokrazy", "/user"} {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			return fmt.Errorf("-authorized_keys_path=%s is not in the root file system (or reserved for programs)", p)
+		}
+	}
+	_, err := readAuthorizedKeys()
+	return err
+}
+
+// addSSHPkg adds -ssh_pkg to gokrazyPkgs if -authorized_keys is specified and
+// neither gokrazyPkgs nor args contain it.
+func addSSHPkg(args []string) {
+	if *authorizedKeys == "" || *sshPkg == "" {
+		return
+	}
+	if containsString(gokrazyPkgs, *sshPkg) || containsString(args, *sshPkg) {
+		return
+	}
+	gokrazyPkgs = append(gokrazyPkgs, *sshPkg)
+}
+
+// sshFlags returns the command-line flags with which the program built from
+// importPath is started for -authorized_keys.
+func sshFlags(importPath string) []string {
+	if *authorizedKeys == "" || importPath != breakglassPkg {
+		return nil
+	}
+	return []string{"-authorized_keys=" + *authorizedKeysPath}
+}
+
+// addAuthorizedKeys writes the -authorized_keys to -authorized_keys_path in
+// root.
+func addAuthorizedKeys(root *fileInfo) error {
+	if *authorizedKeys == "" {
+		return nil
+	}
+	keys, err := readAuthorizedKeys()
+	if err != nil {
+		return err
+	}
+	dir, err := root.mkdirAll(path.Dir(*authorizedKeysPath))
+	if err != nil {
+		return fmt.Errorf("-authorized_keys_path: %v", err)
+	}
+	name := path.Base(*authorizedKeysPath)
+	for _, ent := range dir.dirents {
+		if ent.filename == name {
+			return fmt.Errorf("-authorized_keys_path: %s already exists in the root file system", *authorizedKeysPath)
+		}
+	}
+	dir.dirents = append(dir.dirents, &fileInfo{
+		filename:    name,
+		fromLiteral: keys,
+	})
+	return nil
+}
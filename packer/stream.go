@@ -0,0 +1,192 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// streamedImage collects the parts of a disk image which is written
+// sequentially (-overwrite=-), e.g. to a pipe. The region before the boot
+// partition (partition table, MBR boot code and u-boot files) is buffered in
+// memory, all other parts are extents at increasing offsets: the boot and root
+// file systems (temporary files) and small writes such as the -perm_mkfs file
+// system and the backup GPT. Space between the extents is written as zeros.
+type streamedImage struct {
+	head    []byte
+	extents []streamedExtent
+}
+
+type streamedExtent struct {
+	off int64
+	r   io.Reader
+	n   int64
+}
+
+func newStreamedImage() *streamedImage {
+	return &streamedImage{head: make([]byte, bootStartSector*512)}
+}
+
+// WriteAt implements io.WriterAt. Writes after the head region must not
+// overlap each other.
+func (s *streamedImage) WriteAt(p []byte, off int64) (int, error) {
+	head := int64(len(s.head))
+	if off < head {
+		if off+int64(len(p)) > head {
+			return 0, fmt.Errorf("BUG: write of %d bytes at offset %d crosses the start of the boot partition", len(p), off)
+		}
+		return copy(s.head[off:], p), nil
+	}
+	b := append([]byte(nil), p...)
+	s.extents = append(s.extents, streamedExtent{off, bytes.NewReader(b), int64(len(b))})
+	return len(p), nil
+}
+
+// ReadAt implements io.ReaderAt for the head region, e.g. for reading back the
+// partition table.
+func (s *streamedImage) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(s.head)) {
+		return 0, fmt.Errorf("BUG: read of %d bytes at offset %d beyond the start of the boot partition", len(p), off)
+	}
+	return copy(p, s.head[off:]), nil
+}
+
+// addFile adds the contents of f as an extent at offset off.
+func (s *streamedImage) addFile(f *os.File, off int64) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.extents = append(s.extents, streamedExtent{off, f, st.Size()})
+	return nil
+}
+
+// writeTo writes the image of size bytes to w.
+func (s *streamedImage) writeTo(w io.Writer, size int64) error {
+	sort.SliceStable(s.extents, func(i, j int) bool {
+		return s.extents[i].off < s.extents[j].off
+	})
+	if _, err := w.Write(s.head); err != nil {
+		return err
+	}
+	zeros := make([]byte, 1*MB)
+	writeZeros := func(n int64) error {
+		for n > 0 {
+			chunk := int64(len(zeros))
+			if n < chunk {
+				chunk = n
+			}
+			if _, err := w.Write(zeros[:chunk]); err != nil {
+				return err
+			}
+			n -= chunk
+		}
+		return nil
+	}
+	pos := int64(len(s.head))
+	for _, e := range s.extents {
+		if e.off < pos {
+			return fmt.Errorf("BUG: extent at offset %d overlaps the previous extent (ending at %d)", e.off, pos)
+		}
+		if err := writeZeros(e.off - pos); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, e.r, e.n); err != nil {
+			return err
+		}
+		pos = e.off + e.n
+	}
+	if pos > size {
+		return fmt.Errorf("BUG: image contents (%d bytes) exceed the image size (%d bytes)", pos, size)
+	}
+	return writeZeros(size - pos)
+}
+
+// streamImage writes a full disk image of size bytes to w (-overwrite=-)
+// without seeking, e.g. to a pipe into xz or an upload. The boot and root file
+// systems are written to temporary files first, as the MBR boot code refers to
+// the location of files in the boot file system.
+func streamImage(ctx context.Context, cfg *Config, w io.Writer, size uint64, root *fileInfo, partuuid uint32, usePartuuid bool) error {
+	img := newStreamedImage()
+	if err := writePartitionTable(img, size, partuuid); err != nil {
+		return err
+	}
+
+	if *permMkfs {
+		// The image is written sequentially, i.e. contains zeros
+		// everywhere else:
+		if err := mkfsPerm(cfg, img, true); err != nil {
+			return err
+		}
+	}
+
+	tmpMBR, err := ioutil.TempFile("", "gokr-packer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpMBR.Name())
+	defer tmpMBR.Close()
+
+	tmpBoot, err := ioutil.TempFile("", "gokr-packer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpBoot.Name())
+	defer tmpBoot.Close()
+	if err := writeBoot(ctx, cfg, tmpBoot, tmpMBR.Name(), partuuid, usePartuuid); err != nil {
+		return err
+	}
+
+	tmpRoot, err := ioutil.TempFile("", "gokr-packer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpRoot.Name())
+	defer tmpRoot.Close()
+	if err := writeRoot(tmpRoot, root); err != nil {
+		return err
+	}
+
+	if *signKey != "" {
+		if err := signBootFile(tmpBoot.Name(), tmpRoot.Name(), tmpMBR.Name(), partuuid); err != nil {
+			return err
+		}
+	}
+
+	// writeMBR wrote only the boot code, which precedes the partition
+	// table:
+	bootCode, err := ioutil.ReadFile(tmpMBR.Name())
+	if err != nil {
+		return err
+	}
+	if _, err := img.WriteAt(bootCode, 0); err != nil {
+		return err
+	}
+
+	if err := writeUBoot(ctx, img); err != nil {
+		return err
+	}
+
+	if err := img.addFile(tmpBoot, bootStartSector*512); err != nil {
+		return err
+	}
+	slot, err := rootSlotPartition()
+	if err != nil {
+		return err
+	}
+	if err := img.addFile(tmpRoot, int64(layout.rootStart(slot))*512); err != nil {
+		return err
+	}
+
+	stage := startStage("write image to standard output")
+	stage.bytes = 0
+	defer stage.done()
+	return img.writeTo(io.MultiWriter(w, (*stageBytesWriter)(stage)), int64(size))
+}
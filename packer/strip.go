@@ -0,0 +1,101 @@
+package packer
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var (
+	stripBinaries = flag.Bool("strip_binaries",
+		false,
+		"omit the symbol table and DWARF debug information from all binaries (passing -ldflags=\"-s -w\" in addition to the ldflags of buildflags.txt), making them considerably smaller. Stack traces still contain function names and line numbers")
+
+	compressBinaries = flag.String("compress_binaries",
+		"none",
+		"compression of the programs in /user which are larger than -compress_binaries_min_bytes: none or upx (requires the upx command). Compressed binaries decompress themselves into memory when starting, which saves space in the root file system but costs RAM and start-up time")
+
+	compressBinariesMinBytes = flag.Int64("compress_binaries_min_bytes",
+		1<<20,
+		"minimum size of the programs which -compress_binaries compresses")
+)
+
+// stripLdflags returns the -ldflags value for ldflags (e.g. from
+// buildflags.txt), which strips the binary if -strip_binaries is specified.
+// go build only considers the last -ldflags flag, so they are combined.
+func stripLdflags(ldflags string) string {
+	if !*stripBinaries {
+		return ldflags
+	}
+	if ldflags == "" {
+		return "-s -w"
+	}
+	return "-s -w " + ldflags
+}
+
+func checkCompressBinaries() error {
+	switch *compressBinaries {
+	case "none":
+		return nil
+	case "upx":
+		if _, err := exec.LookPath("upx"); err != nil {
+			return fmt.Errorf("-compress_binaries=upx: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("-compress_binaries=%q is not one of none or upx", *compressBinaries)
+}
+
+// compressUserBinaries replaces the programs in /user of root which are larger
+// than -compress_binaries_min_bytes with compressed copies in tmpdir. Programs
+// which upx cannot compress are kept as they are.
+func compressUserBinaries(ctx context.Context, root *fileInfo, tmpdir string) error {
+	if *compressBinaries == "none" {
+		return nil
+	}
+	stage := startStage("compress binaries (" + *compressBinaries + ")")
+	defer stage.done()
+	dir := filepath.Join(tmpdir, "compressed")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var before, after int64
+	for _, ent := range root.mustFindDirent("user").dirents {
+		if ent.fromHost == "" {
+			continue
+		}
+		st, err := os.Stat(ent.fromHost)
+		if err != nil {
+			return err
+		}
+		if st.Size() < *compressBinariesMinBytes {
+			continue
+		}
+		dest := filepath.Join(dir, ent.filename)
+		cmd := exec.CommandContext(ctx, "upx", "-q", "-q", "--lzma", "-o", dest, ent.fromHost)
+		cmd.Stdout = ioutil.Discard
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("-compress_binaries: not compressing /user/%s: %v", ent.filename, err)
+			os.Remove(dest)
+			continue
+		}
+		compressed, err := os.Stat(dest)
+		if err != nil {
+			return err
+		}
+		before += st.Size()
+		after += compressed.Size()
+		ent.fromHost = dest
+	}
+	stage.bytes = after
+	if before > 0 {
+		log.Printf("compressed binaries from %s to %s", formatBytes(before), formatBytes(after))
+	}
+	return nil
+}
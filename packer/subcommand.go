@@ -0,0 +1,141 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// subcommand is a gokr-packer mode of operation other than packing an image,
+// selected by the first command line argument (e.g. gokr-packer web).
+type subcommand struct {
+	usage string
+	run   func(args []string) error
+}
+
+var subcommands = map[string]*subcommand{
+	"backup": {
+		usage: "save the contents of the permanent data partition of a gokrazy installation",
+		run:   backupMain,
+	},
+	"bundle": {
+		usage: "store all inputs of a build in an archive, for building offline with -from_bundle",
+		run:   bundleMain,
+	},
+	"cache": {
+		usage: "list the entries of the cache directory (see -cache_dir), or remove least recently used entries (gokr-packer cache gc)",
+		run:   cacheMain,
+	},
+	"config": {
+		usage: "create a config file (gokrazy.toml) from the specified flags and packages (gokr-packer config init)",
+		run:   configMain,
+	},
+	"convert": {
+		usage: "convert the partition table of an existing image between MBR and GPT",
+		run:   convertMain,
+	},
+	"daemon": {
+		usage: "serve a REST API for queueing and running builds",
+		run:   daemonMain,
+	},
+	"diff": {
+		usage: "write a block-level delta between two images (or file systems), or apply one (-apply)",
+		run:   diffMain,
+	},
+	"discover": {
+		usage: "list gokrazy installations in the local network (via mDNS)",
+		run:   discoverMain,
+	},
+	"inspect": {
+		usage: "print the partition table, file system contents, cmdline.txt and config.txt of an existing image",
+		run:   inspectMain,
+	},
+	"patch": {
+		usage: "replace or add files in the root and/or boot file system of an existing image",
+		run:   patchMain,
+	},
+	"push": {
+		usage: "compile a single Go package and replace its binary on a running gokrazy installation",
+		run:   pushMain,
+	},
+	"restore": {
+		usage: "replace the contents of the permanent data partition of a gokrazy installation with a backup",
+		run:   restoreMain,
+	},
+	"run-on": {
+		usage: "compile a Go package, run it once on a gokrazy installation and show its output",
+		run:   runOnMain,
+	},
+	"seal-key": {
+		usage: "generate (and install) the key which -sealed_secrets are encrypted against",
+		run:   sealKeyMain,
+	},
+	"self-update": {
+		usage: "replace gokr-packer with its latest (signed) release",
+		run:   selfUpdateMain,
+	},
+	"shrink": {
+		usage: "write the smallest image equivalent to an existing image (e.g. for archiving)",
+		run:   shrinkMain,
+	},
+	"verify": {
+		usage: "check the signature (see -sign_key) and SHA256 sums of an image",
+		run:   verifyMain,
+	},
+	"web": {
+		usage: "serve a local web interface for configuring and running builds",
+		run:   webMain,
+	},
+}
+
+func printSubcommands() {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Subcommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", name, subcommands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+}
+
+// packerFlagSet returns a FlagSet for a subcommand which also understands all
+// gokr-packer flags (e.g. -update or -tls), so that subcommands can share code
+// with the packer.
+func packerFlagSet(name string) *flag.FlagSet {
+	fset := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fset.Var(f.Value, f.Name, f.Usage)
+	})
+	return fset
+}
+
+// parseSingleArg parses the flags of a subcommand invoked as
+// <subcommand> [-flags] <arg> [-flags], i.e. flags may also follow the
+// argument (e.g. a host name), and returns the argument.
+func parseSingleArg(fset *flag.FlagSet, args []string) string {
+	return parseArgs(fset, args, 1)[0]
+}
+
+// parseArgs is like parseSingleArg, but for subcommands with n arguments, which
+// flags may precede, separate or follow.
+func parseArgs(fset *flag.FlagSet, args []string, n int) []string {
+	var parsed []string
+	fset.Parse(args)
+	for len(parsed) < n {
+		if fset.NArg() < 1 {
+			fset.Usage()
+			os.Exit(2)
+		}
+		parsed = append(parsed, fset.Arg(0))
+		fset.Parse(fset.Args()[1:])
+	}
+	if fset.NArg() > 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	return parsed
+}
@@ -0,0 +1,145 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// supervisedServices returns the programs in root which the generated init
+// supervises, in the order in which they are started: each program after the
+// programs it is configured to start after (supervision.txt).
+func supervisedServices(root *fileInfo) ([]initService, error) {
+	services, err := initServices("/", root)
+	if err != nil {
+		return nil, err
+	}
+
+	byImportPath := make(map[string]int)
+	for idx, svc := range services {
+		if svc.ImportPath != "" {
+			byImportPath[svc.ImportPath] = idx
+		}
+	}
+	deps := make([][]int, len(services))
+	for idx, svc := range services {
+		if svc.Config == nil {
+			continue
+		}
+		for _, pkg := range svc.Config.afterPkgs {
+			dep, ok := byImportPath[pkg]
+			if !ok {
+				return nil, fmt.Errorf("%s is configured to start after %s, which is not a program of the image", svc.ImportPath, pkg)
+			}
+			if services[dep].Config == nil {
+				services[dep].Config = &serviceConfig{}
+			}
+			services[dep].Config.Started = true
+			svc.Config.After = append(svc.Config.After, services[dep].Path)
+			deps[idx] = append(deps[idx], dep)
+		}
+	}
+
+	// Topologically sort the programs, otherwise keeping their order:
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(services))
+	ordered := make([]initService, 0, len(services))
+	var visit func(idx int, chain []string) error
+	visit = func(idx int, chain []string) error {
+		chain = append(chain, services[idx].Path)
+		switch state[idx] {
+		case visiting:
+			return fmt.Errorf("programs are configured to start after each other: %s", strings.Join(chain, " → "))
+		case visited:
+			return nil
+		}
+		state[idx] = visiting
+		for _, dep := range deps[idx] {
+			if err := visit(dep, chain); err != nil {
+				return err
+			}
+		}
+		state[idx] = visited
+		ordered = append(ordered, services[idx])
+		return nil
+	}
+	for idx := range services {
+		if err := visit(idx, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// supervisionProgram describes how the generated init supervises a program.
+type supervisionProgram struct {
+	Path       string `json:"path"`
+	ImportPath string `json:"import_path,omitempty"`
+
+	// Restart is always, on-failure or never.
+	Restart      string `json:"restart"`
+	RestartDelay string `json:"restart_delay,omitempty"`
+
+	// After contains the paths of the programs which are started first.
+	After        []string `json:"after,omitempty"`
+	AfterTimeout string   `json:"after_timeout,omitempty"`
+
+	Env []string `json:"env,omitempty"`
+
+	// Delay and Every are set for programs which are run on a schedule
+	// (schedule.txt) instead of being supervised.
+	Delay string `json:"delay,omitempty"`
+	Every string `json:"every,omitempty"`
+}
+
+// supervisionManifest returns the contents of /etc/gokrazy/supervision.json,
+// which lists the supervised programs of root in the order in which they are
+// started.
+func supervisionManifest(root *fileInfo) (string, error) {
+	services, err := supervisedServices(root)
+	if err != nil {
+		return "", err
+	}
+	programs := []supervisionProgram{}
+	for _, svc := range services {
+		if svc.Path == "/gokrazy/init" {
+			continue
+		}
+		prog := supervisionProgram{
+			Path:       svc.Path,
+			ImportPath: svc.ImportPath,
+			Restart:    "always",
+		}
+		if cfg := svc.Config; cfg != nil {
+			if cfg.Restart != "" {
+				prog.Restart = cfg.Restart
+			}
+			if cfg.RestartDelay > 0 {
+				prog.RestartDelay = cfg.RestartDelay.String()
+			}
+			prog.After = cfg.After
+			if len(cfg.After) > 0 {
+				prog.AfterTimeout = cfg.AfterTimeout.String()
+			}
+			prog.Env = cfg.Env
+			if cfg.Delay > 0 {
+				prog.Delay = cfg.Delay.String()
+			}
+			if cfg.Every > 0 {
+				prog.Every = cfg.Every.String()
+			}
+		}
+		programs = append(programs, prog)
+	}
+	b, err := json.MarshalIndent(&struct {
+		Programs []supervisionProgram `json:"programs"`
+	}{programs}, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
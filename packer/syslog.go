@@ -0,0 +1,42 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+var (
+	remoteSyslog = flag.String("remote_syslog",
+		"",
+		"forward the stdout/stderr of all programs to this syslog server as RFC 5424 messages, starting at boot. One of udp://<host>:<port>, tcp://<host>:<port> or tls://<host>:<port> (RFC 5425)")
+
+	remoteSyslogCA = flag.String("remote_syslog_ca",
+		"",
+		"path to a PEM file with the CA certificate(s) to verify the -remote_syslog=tls:// server against, instead of the system trust store")
+)
+
+// remoteSyslogTarget validates -remote_syslog and returns it in the
+// <network>://<host>:<port> form which the generated init understands.
+func remoteSyslogTarget() (string, error) {
+	if *remoteSyslog == "" {
+		return "", nil
+	}
+	u, err := url.Parse(*remoteSyslog)
+	if err != nil {
+		return "", fmt.Errorf("-remote_syslog: %v", err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return "", fmt.Errorf("-remote_syslog: scheme %q is not one of udp, tcp or tls", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", fmt.Errorf("-remote_syslog: %v", err)
+	}
+	if *remoteSyslogCA != "" && u.Scheme != "tls" {
+		return "", fmt.Errorf("-remote_syslog_ca requires a tls:// -remote_syslog server")
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
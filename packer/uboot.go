@@ -0,0 +1,254 @@
+package packer
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ubootPackage = flag.String("uboot_package",
+		"",
+		"Go package to copy the u-boot files (see -uboot_files) from with -boot_mode=uboot")
+
+	ubootFiles = flag.String("uboot_files",
+		"",
+		"u-boot files of the -uboot_package to write before the boot partition (i.e. within the first 4 MB) with -boot_mode=uboot: a comma-separated list of <file>@<offset> pairs (offset in bytes, with optional K or M suffix), or the layout of a SoC family: "+ubootLayoutNames())
+
+	ubootFDT = flag.String("uboot_fdt",
+		"",
+		"device tree file of the kernel package for u-boot to load with -boot_mode=uboot, e.g. meson-gxbb-odroidc2.dtb. Empty uses the fdtfile variable of u-boot")
+)
+
+// ubootLayouts are the -uboot_files of SoC families, as described in the
+// u-boot documentation of the boards.
+var ubootLayouts = map[string]string{
+	"sunxi":   "u-boot-sunxi-with-spl.bin@8K", // Allwinner
+	"am335x":  "MLO@128K,u-boot.img@384K",     // e.g. BeagleBone
+	"amlogic": "u-boot.bin@512",               // e.g. Odroid C2
+}
+
+func ubootLayoutNames() string {
+	names := make([]string, 0, len(ubootLayouts))
+	for name := range ubootLayouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ubootFile is a file of the -uboot_package, written at offset (in bytes) of
+// the device.
+type ubootFile struct {
+	name   string
+	offset int64
+}
+
+func parseUBootFiles() ([]ubootFile, error) {
+	value := *ubootFiles
+	if preset, ok := ubootLayouts[value]; ok {
+		value = preset
+	}
+	var files []ubootFile
+	for _, pair := range strings.Split(value, ",") {
+		idx := strings.LastIndexByte(pair, '@')
+		if idx < 1 {
+			return nil, fmt.Errorf("-uboot_files: %q is neither of the form <file>@<offset> nor one of %s", pair, ubootLayoutNames())
+		}
+		offset, err := parseSize(pair[idx+1:])
+		if err != nil {
+			return nil, fmt.Errorf("-uboot_files: %q: %v", pair, err)
+		}
+		// The partition table occupies the first sector (and, with GPT, the
+		// following gptSectors):
+		min := int64(512)
+		if *partitionTable == "gpt" {
+			min = (1 + gptSectors) * 512
+		}
+		if offset < min || offset >= bootStartSector*512 {
+			return nil, fmt.Errorf("-uboot_files: %s: offset %d is not between the partition table (%d) and the boot partition (%d)", pair, offset, min, bootStartSector*512)
+		}
+		files = append(files, ubootFile{name: pair[:idx], offset: offset})
+	}
+	return files, nil
+}
+
+// checkUBoot verifies the flags of -boot_mode=uboot.
+func checkUBoot() error {
+	if _, ok := ubootArchs[targetGOARCH()]; !ok {
+		return fmt.Errorf("-boot_mode=uboot: u-boot is not supported for GOARCH=%s", targetGOARCH())
+	}
+	if (*ubootPackage == "") != (*ubootFiles == "") {
+		return fmt.Errorf("-boot_mode=uboot: -uboot_package and -uboot_files must be specified together")
+	}
+	if *ubootFiles != "" {
+		if _, err := parseUBootFiles(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ubootPackages returns the -uboot_package (if any) as a list, for resolving
+// and hashing it along with the kernel and firmware packages.
+func ubootPackages() []string {
+	if *bootMode != "uboot" || *ubootPackage == "" {
+		return nil
+	}
+	return []string{*ubootPackage}
+}
+
+// writeUBoot writes the -uboot_files to w (a device or image), before the
+// boot partition.
+func writeUBoot(ctx context.Context, w io.WriterAt) error {
+	if *bootMode != "uboot" || *ubootFiles == "" {
+		return nil
+	}
+	files, err := parseUBootFiles()
+	if err != nil {
+		return err
+	}
+	dir, err := packageDir(ctx, *ubootPackage)
+	if err != nil {
+		return err
+	}
+	type extent struct {
+		name       string
+		start, end int64
+	}
+	var extents []extent
+	for _, f := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.name))
+		if err != nil {
+			return fmt.Errorf("-uboot_package: %v", err)
+		}
+		end := f.offset + int64(len(b))
+		if end > bootStartSector*512 {
+			return fmt.Errorf("-uboot_files: %s (%d bytes at offset %d) overlaps the boot partition (starting at %d)", f.name, len(b), f.offset, bootStartSector*512)
+		}
+		for _, e := range extents {
+			if f.offset < e.end && e.start < end {
+				return fmt.Errorf("-uboot_files: %s overlaps %s", f.name, e.name)
+			}
+		}
+		extents = append(extents, extent{f.name, f.offset, end})
+		log.Printf("writing u-boot file %s (%d bytes) at offset %d", f.name, len(b), f.offset)
+		if _, err := w.WriteAt(b, f.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ubootArchs maps GOARCH values to the architecture of u-boot images
+// (IH_ARCH_*) and the u-boot command for booting the kernel.
+var ubootArchs = map[string]struct {
+	arch byte
+	boot string
+}{
+	"arm":     {2, "bootz"},
+	"arm64":   {22, "booti"},
+	"riscv64": {26, "booti"},
+}
+
+// ubootScript returns script as a u-boot script image (boot.scr), like mkimage
+// -A <arch> -T script -C none.
+func ubootScript(script string) []byte {
+	// The contents of a script image are the lengths of its parts (only one),
+	// terminated by 0, followed by the parts.
+	data := make([]byte, 8, 8+len(script))
+	binary.BigEndian.PutUint32(data, uint32(len(script)))
+	data = append(data, script...)
+
+	hdr := make([]byte, 64)
+	binary.BigEndian.PutUint32(hdr[0:], 0x27051956) // IH_MAGIC
+	binary.BigEndian.PutUint32(hdr[8:], uint32(imageTime().Unix()))
+	binary.BigEndian.PutUint32(hdr[12:], uint32(len(data)))
+	binary.BigEndian.PutUint32(hdr[24:], crc32.ChecksumIEEE(data))
+	hdr[28] = 5 // IH_OS_LINUX
+	hdr[29] = ubootArchs[targetGOARCH()].arch
+	hdr[30] = 6 // IH_TYPE_SCRIPT
+	hdr[31] = 0 // IH_COMP_NONE
+	copy(hdr[32:], "gokrazy")
+	binary.BigEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(hdr))
+	return append(hdr, data...)
+}
+
+// writeUBootConfig writes extlinux/extlinux.conf and boot.scr, which start
+// /vmlinuz (and the -initramfs) with cmdline, to the boot file system fw. u-boot’s distro boot
+// prefers extlinux.conf; boot.scr is for u-boot versions without it. Fallback
+// kernels (-kernel_package) are additional extlinux.conf menu entries.
+func writeUBootConfig(cfg *Config, fw bootFSWriter, kernelDir, cmdline string) error {
+	cmdline = strings.TrimSpace(cmdline)
+	fdt := "fdtdir /"
+	fdtFile := "${fdtfile}"
+	if *ubootFDT != "" {
+		if _, err := os.Stat(filepath.Join(kernelDir, *ubootFDT)); err != nil {
+			return fmt.Errorf("-uboot_fdt: %v", err)
+		}
+		fdt = "fdt /" + *ubootFDT
+		fdtFile = *ubootFDT
+	}
+	var initrd string
+	ramdisk := "-"
+	if *initramfs != "" {
+		initrd = "\tinitrd " + initrdPath + "\n"
+		// Loaded last, as the boot command needs its size:
+		ramdisk = "${ramdisk_addr_r}:${filesize}"
+	}
+	extlinux := "default gokrazy\ntimeout 0\n\nlabel gokrazy\n" +
+		"\tkernel /vmlinuz\n" +
+		initrd +
+		"\t" + fdt + "\n" +
+		"\tappend " + cmdline + "\n"
+	if fallbacks := fallbackKernelPackages(cfg); len(fallbacks) > 0 {
+		// Show the menu for 5 seconds (in units of 1/10 s):
+		extlinux = "menu title gokrazy\n" + strings.Replace(extlinux, "timeout 0", "timeout 50", 1)
+		for idx, pkg := range fallbacks {
+			dir := fallbackKernelDir(idx + 1)
+			fdt := "fdtdir " + dir + "/"
+			if *ubootFDT != "" {
+				fdt = "fdt " + dir + "/" + *ubootFDT
+			}
+			extlinux += "\nlabel gokrazy-" + strings.TrimPrefix(dir, "/") + "\n" +
+				"\tmenu label gokrazy (" + pkg + ")\n" +
+				"\tkernel " + dir + "/vmlinuz\n" +
+				initrd +
+				"\t" + fdt + "\n" +
+				"\tappend " + cmdline + "\n"
+		}
+	}
+	load := "load ${devtype} ${devnum}:${distro_bootpart}"
+	script := "setenv bootargs \"" + cmdline + "\"\n" +
+		load + " ${kernel_addr_r} /vmlinuz\n" +
+		load + " ${fdt_addr_r} /" + fdtFile + "\n"
+	if *initramfs != "" {
+		script += load + " ${ramdisk_addr_r} " + initrdPath + "\n"
+	}
+	script += ubootArchs[targetGOARCH()].boot + " ${kernel_addr_r} " + ramdisk + " ${fdt_addr_r}\n"
+	for _, f := range []struct {
+		path     string
+		contents []byte
+	}{
+		{"/extlinux/extlinux.conf", []byte(extlinux)},
+		{"/boot.scr", ubootScript(script)},
+	} {
+		w, err := fw.File(f.path, imageTime())
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(f.contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var efiLoader = flag.String("efi_loader",
+	"",
+	"path to the EFI boot loader (e.g. systemd-bootx64.efi) to install as EFI/BOOT/BOOT<arch>.EFI with -boot_mode=uefi. Empty uses systemd-boot<arch>.efi from the kernel package or from /usr/lib/systemd/boot/efi")
+
+// efiArchs maps GOARCH values to the architecture names of the UEFI
+// removable media boot path (EFI/BOOT/BOOT<arch>.EFI).
+var efiArchs = map[string]string{
+	"amd64":   "x64",
+	"arm64":   "aa64",
+	"riscv64": "riscv64",
+}
+
+// checkUEFI verifies the flags of -boot_mode=uefi.
+func checkUEFI() error {
+	if *bootFS != "fat32" {
+		// The FAT16 writer does not support nested directories like EFI/BOOT:
+		return fmt.Errorf("-boot_mode=uefi requires -boot_fs=fat32")
+	}
+	if _, ok := efiArchs[targetGOARCH()]; !ok {
+		return fmt.Errorf("-boot_mode=uefi: UEFI is not supported for GOARCH=%s", targetGOARCH())
+	}
+	if *efiLoader != "" {
+		if _, err := os.Stat(*efiLoader); err != nil {
+			return fmt.Errorf("-efi_loader: %v", err)
+		}
+	}
+	return nil
+}
+
+// findEFILoader returns the path of the -efi_loader boot loader.
+func findEFILoader(kernelDir string) (string, error) {
+	if *efiLoader != "" {
+		return *efiLoader, nil
+	}
+	name := "systemd-boot" + efiArchs[targetGOARCH()] + ".efi"
+	for _, dir := range []string{kernelDir, "/usr/lib/systemd/boot/efi"} {
+		fn := filepath.Join(dir, name)
+		if _, err := os.Stat(fn); err == nil {
+			return fn, nil
+		}
+	}
+	return "", fmt.Errorf("-boot_mode=uefi: %s not found in the kernel package or /usr/lib/systemd/boot/efi, specify -efi_loader", name)
+}
+
+// writeEFILoader writes the -efi_loader boot loader, its configuration and a
+// loader entry (see the Boot Loader Specification) starting /vmlinuz (and the
+// -initramfs) with cmdline to the EFI system partition fw. Fallback kernels
+// (-kernel_package) get a loader entry each.
+func writeEFILoader(cfg *Config, fw bootFSWriter, kernelDir, cmdline string) error {
+	loader, err := findEFILoader(kernelDir)
+	if err != nil {
+		return err
+	}
+	dest := "/EFI/BOOT/BOOT" + strings.ToUpper(efiArchs[targetGOARCH()]) + ".EFI"
+	if err := copyFile(fw, dest, loader); err != nil {
+		return err
+	}
+	var initrd string
+	if *initramfs != "" {
+		initrd = "initrd " + initrdPath + "\n"
+	}
+	options := "options " + strings.TrimSpace(cmdline) + "\n"
+	type entry struct {
+		path, contents string
+	}
+	entries := []entry{
+		{"/loader/loader.conf", "default gokrazy.conf\ntimeout 0\n"},
+		{"/loader/entries/gokrazy.conf", "title gokrazy\nlinux /vmlinuz\n" + initrd + options},
+	}
+	for idx, pkg := range fallbackKernelPackages(cfg) {
+		// Show the menu for 5 seconds:
+		entries[0].contents = "default gokrazy.conf\ntimeout 5\n"
+		dir := fallbackKernelDir(idx + 1)
+		entries = append(entries, entry{
+			"/loader/entries/gokrazy-" + strings.TrimPrefix(dir, "/") + ".conf",
+			"title gokrazy (" + pkg + ")\nlinux " + dir + "/vmlinuz\n" + initrd + options,
+		})
+	}
+	for _, f := range entries {
+		w, err := fw.File(f.path, imageTime())
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(f.contents)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
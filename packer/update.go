@@ -0,0 +1,174 @@
+package packer
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/gokrazy/internal/updater"
+)
+
+var (
+	updateHealthTimeout = flag.Duration("update_health_timeout",
+		5*time.Minute,
+		"after updating, how long to wait for the device to come back running the new version with all services started (and -update_health_url returning HTTP status 200). If the device runs the new version, but its services are not healthy in time, gokr-packer switches back to the previous root file system. A device which does not come back running the new version is not rolled back. 0 disables the health check")
+
+	updateHealthURL = flag.String("update_health_url",
+		"",
+		"if non-empty, a URL (e.g. http://hostname:8080/healthz) which must return HTTP status 200 after updating, see -update_health_timeout")
+)
+
+var versionRe = regexp.MustCompile(`version ([^<]+)</small>`)
+
+// deviceVersion returns the build timestamp displayed on the overview page of
+// the gokrazy installation.
+func deviceVersion(updaterObj *updater.Updater) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, updaterObj.BaseUrl.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := updaterObj.HttpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
+	}
+	m := versionRe.FindSubmatch(b)
+	if m == nil {
+		return "", fmt.Errorf("version not found on the device status page")
+	}
+	return html.UnescapeString(string(m[1])), nil
+}
+
+// checkServices returns an error unless all services of root are started on
+// the gokrazy installation and -update_health_url returns HTTP status 200.
+func checkServices(updaterObj *updater.Updater, root *fileInfo) error {
+	get := func(url string) (*http.Response, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		client := http.DefaultClient
+		if url != *updateHealthURL {
+			client = updaterObj.HttpClient
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp, nil
+	}
+	for _, dir := range []string{"gokrazy", "user"} {
+		for _, ent := range root.mustFindDirent(dir).dirents {
+			if ent.filename == "init" {
+				continue
+			}
+			p := path.Join("/", dir, ent.filename)
+			resp, err := get(updaterObj.BaseUrl.String() + "status?path=" + p)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s: unexpected HTTP status code %d", p, resp.StatusCode)
+			}
+			if status := resp.Header.Get("X-Gokrazy-Status"); status != "started" {
+				return fmt.Errorf("%s: service is %s", p, status)
+			}
+		}
+	}
+	if *updateHealthURL != "" {
+		resp, err := get(*updateHealthURL)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: unexpected HTTP status code %d", *updateHealthURL, resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// waitForReboot waits until the gokrazy installation went down and is
+// reachable again (or, if version is non-empty, until it runs version). The
+// device’s version is returned.
+func waitForReboot(updaterObj *updater.Updater, version string, deadline time.Time) (string, error) {
+	wentDown := false
+	for ; time.Now().Before(deadline); time.Sleep(1 * time.Second) {
+		got, err := deviceVersion(updaterObj)
+		if err != nil {
+			wentDown = true
+			continue
+		}
+		if (version != "" && got == version) || (version == "" && wentDown) {
+			return got, nil
+		}
+		if wentDown {
+			return got, fmt.Errorf("device came back running version %q, expected %q", got, version)
+		}
+	}
+	return "", fmt.Errorf("device did not come back within %v", *updateHealthTimeout)
+}
+
+// checkUpdate waits until the updated gokrazy installation runs the new
+// version with all services healthy. If the services do not become healthy,
+// it switches back to the previous root file system and reboots. If the device
+// does not come back running the new version, an error is returned without
+// rolling back: switching requires a reachable device, and on a device running
+// a different version, switching would activate the new root file system.
+//
+// Only the root file system can be rolled back: the boot file system (kernel,
+// firmware and command line) is not A/B partitioned.
+func checkUpdate(updaterObj *updater.Updater, root *fileInfo) error {
+	deadline := time.Now().Add(*updateHealthTimeout)
+	// A custom -init_pkg reports its own build timestamp:
+	version := buildTimestamp
+	if *initPkg != "" {
+		version = ""
+	}
+	log.Printf("waiting for the device to come back (up to %v)", *updateHealthTimeout)
+	if _, err := waitForReboot(updaterObj, version, deadline); err != nil {
+		return fmt.Errorf("health check: %v, not rolling back", err)
+	}
+	log.Printf("device is back, checking services")
+	var err error
+	for {
+		if err = checkServices(updaterObj, root); err == nil {
+			log.Printf("update healthy")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(1 * time.Second)
+	}
+	log.Printf("health check failed: %v, rolling back to the previous root file system", err)
+	if err := updater.Switch(updaterObj); err != nil {
+		return fmt.Errorf("rollback: switching to previous root partition: %v", err)
+	}
+	if err := updater.Reboot(updaterObj); err != nil {
+		return fmt.Errorf("rollback: reboot: %v", err)
+	}
+	previous, rerr := waitForReboot(updaterObj, "", time.Now().Add(*updateHealthTimeout))
+	if rerr != nil {
+		return fmt.Errorf("health check failed (%v), rolled back, but %v", err, rerr)
+	}
+	return fmt.Errorf("health check failed (%v), rolled back to version %s (the boot file system was not rolled back)", err, previous)
+}
@@ -0,0 +1,472 @@
+package packer
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var skipUnchanged = flag.Bool("skip_unchanged",
+	false,
+	"do not write the -overwrite, -overwrite_boot, -overwrite_root and -overwrite_mbr files (not devices) if they were built from identical inputs (flags, programs, assets, kernel, firmware and gokr-packer version) before, and print “up to date” instead. The hash of the inputs is stored in <output>.inputhash")
+
+// unhashedFlags do not influence the outputs.
+var unhashedFlags = map[string]bool{
+	"skip_unchanged":      true,
+	"profile":             true, // the loaded flags are hashed
+	"save_profile":        true,
+	"profile_build":       true,
+	"profile_build_pprof": true,
+	"sudo":                true,
+	"jobs":                true,
+	"rootfs_cache":        true,
+	"dry_run":             true,
+	"format":              true,
+	"progress":            true,
+	"qemu_test":           true, // does not change the image
+	"qemu_test_wait":      true,
+	"qemu_test_timeout":   true,
+	"qemu_test_bios":      true,
+	"verify_inputs":       true,
+	"update_inputs_lock":  true,
+	"http_password_out":   true,
+	"size_report":         true,
+	"size_report_files":   true,
+	"cache_dir":           true,
+	"cache_max_size":      true,
+}
+
+// outputFlags name the outputs, whose contents must not be hashed.
+var outputFlags = map[string]bool{
+	"overwrite":              true,
+	"overwrite_boot":         true,
+	"overwrite_root":         true,
+	"overwrite_mbr":          true,
+	"overwrite_init":         true,
+	"overwrite_block_device": true,
+	"sbom":                   true,
+}
+
+// inputHasher hashes the inputs of a build.
+type inputHasher struct {
+	h hash.Hash
+}
+
+// field hashes a named value (length-prefixed, so that values cannot be
+// confused with each other).
+func (ih *inputHasher) field(name, value string) {
+	fmt.Fprintf(ih.h, "%s %d %s\n", name, len(value), value)
+}
+
+func (ih *inputHasher) file(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	ih.field(name, fmt.Sprintf("%x", h.Sum(nil)))
+	return nil
+}
+
+// dir hashes the regular files in dir (not recursively).
+func (ih *inputHasher) dir(name, dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if err := ih.file(name+" "+fi.Name(), filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tree hashes the root file system tree fi. Occurrences of the build
+// timestamp (e.g. in mdns.json) are ignored.
+func (ih *inputHasher) tree(path string, fi *fileInfo) error {
+	switch {
+	case fi.inputs != "":
+		ih.field("generated "+path, fi.inputs)
+	case fi.fromHost != "":
+		return ih.file("file "+path, fi.fromHost)
+	case fi.fromLiteral != "":
+		ih.field("literal "+path, strings.ReplaceAll(fi.fromLiteral, buildTimestamp, ""))
+	case fi.symlinkDest != "":
+		ih.field("symlink "+path, fi.symlinkDest)
+	case fi.hardlinkTarget != "":
+		ih.field("hardlink "+path, fi.hardlinkTarget)
+	case fi.device != nil:
+		ih.field("device "+path, fi.device.String())
+	default:
+		ih.field("dir "+path, "")
+	}
+	if fi.uid != 0 || fi.gid != 0 {
+		ih.field("owner "+path, fmt.Sprintf("%d:%d", fi.uid, fi.gid))
+	}
+	names := make([]string, 0, len(fi.xattrs))
+	for name := range fi.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ih.field("xattr "+path+" "+name, string(fi.xattrs[name]))
+	}
+	dirents := append([]*fileInfo(nil), fi.dirents...)
+	sort.Slice(dirents, func(i, j int) bool {
+		return dirents[i].filename < dirents[j].filename
+	})
+	for _, ent := range dirents {
+		if err := ih.tree(path+"/"+ent.filename, ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configFlags returns the settings of cfg by the name of the corresponding
+// gokr-packer flag.
+func configFlags(cfg *Config) map[string]string {
+	return map[string]string{
+		"hostname":             cfg.Hostname,
+		"board":                cfg.Board,
+		"kernel_package":       cfg.KernelPackage,
+		"firmware_package":     cfg.FirmwarePackage,
+		"serial_console":       cfg.SerialConsole,
+		"tls":                  cfg.TLS,
+		"target_storage_bytes": strconv.FormatUint(cfg.TargetStorageBytes, 10),
+		"overwrite":            cfg.Image,
+		"overwrite_boot":       cfg.Boot,
+		"overwrite_root":       cfg.Root,
+		"overwrite_mbr":        cfg.MBR,
+		"update":               cfg.Update,
+	}
+}
+
+// flags hashes all flag values (and the host files they refer to), except for
+// unhashedFlags and skip. The flags which cfg covers are hashed with the
+// values of cfg, as Build does not set them.
+func (ih *inputHasher) flags(cfg *Config, skip map[string]bool) error {
+	values := configFlags(cfg)
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := values[f.Name]; !ok {
+			values[f.Name] = f.Value.String()
+		}
+	})
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if unhashedFlags[name] || skip[name] {
+			continue
+		}
+		value := values[name]
+		ih.field("flag "+name, value)
+		if outputFlags[name] {
+			continue
+		}
+		// Flag values may refer to host files (e.g. -cmdline_file or
+		// -eeprom_image) or directories (e.g. -modprobe_config). -dtoverlay
+		// separates its values by semicolons:
+		for _, path := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+			st, err := os.Stat(path)
+			if err != nil || path == "" {
+				continue
+			}
+			if st.Mode().IsRegular() {
+				err = ih.file("flag file "+path, path)
+			} else if st.IsDir() {
+				err = ih.dir("flag dir "+path, path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inputHash returns the hash of all inputs which the outputs are built from:
+// gokr-packer itself, all flag values (and the host files they refer to), the
+// root file system tree and the kernel and firmware packages.
+func inputHash(ctx context.Context, cfg *Config, root *fileInfo) (string, error) {
+	ih := &inputHasher{h: sha256.New()}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if err := ih.file("gokr-packer", exe); err != nil {
+		return "", err
+	}
+
+	if err := ih.flags(cfg, nil); err != nil {
+		return "", err
+	}
+	ih.field("args", strings.Join(cfg.Packages, " "))
+
+	if err := ih.tree("", root); err != nil {
+		return "", err
+	}
+
+	// The root file system only refers to the certificate and key:
+	if *tlsLocation == "perm" {
+		certPath, keyPath, err := getCertificate(cfg)
+		if err != nil {
+			return "", err
+		}
+		if err := ih.file("tls certificate", certPath); err != nil {
+			return "", err
+		}
+		if err := ih.file("tls key", keyPath); err != nil {
+			return "", err
+		}
+	}
+
+	for _, pkg := range append(append(kernelPackages(cfg), firmwarePackages(cfg)...), ubootPackages()...) {
+		dir, err := packageDir(ctx, pkg)
+		if err != nil {
+			return "", err
+		}
+		if err := ih.dir("package "+pkg, dir); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", ih.h.Sum(nil)), nil
+}
+
+// bootFlags only influence the boot file system (and the MBR boot code). Their
+// effects on the root file system (if any) are covered by hashing its tree.
+var bootFlags = map[string]bool{
+	"board":                true,
+	"boot_fs":              true,
+	"boot_fs_cluster_size": true,
+	"boot_fs_label":        true,
+	"boot_mode":            true,
+	"cmdline_append":       true,
+	"cmdline_file":         true,
+	"cmdline_remove":       true,
+	"config_txt":           true,
+	"dtoverlay":            true,
+	"eeprom_boot_order":    true,
+	"eeprom_config":        true,
+	"eeprom_image":         true,
+	"eeprom_recovery":      true,
+	"efi_loader":           true,
+	"initramfs":            true,
+	"firmware_package":     true,
+	"firmware_source":      true,
+	"kernel":               true,
+	"kernel_flavors":       true,
+	"kernel_oops":          true,
+	"kernel_package":       true,
+	"kernel_source":        true,
+	"kernel_panic":         true,
+	"kernel_reboot":        true,
+	"perm_luks_keyfile":    true,
+	"root_overlay":         true,
+	"serial_console":       true,
+	"tls_location":         true,
+	"uboot_fdt":            true,
+}
+
+// imageInputHash returns the hash of the inputs of all parts of an -overwrite
+// image other than the boot file system: the partitions, u-boot, the root file
+// system and the permanent data partition.
+func imageInputHash(ctx context.Context, cfg *Config, root *fileInfo) (string, error) {
+	ih := &inputHasher{h: sha256.New()}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if err := ih.file("gokr-packer", exe); err != nil {
+		return "", err
+	}
+	if err := ih.flags(cfg, bootFlags); err != nil {
+		return "", err
+	}
+	ih.field("args", strings.Join(cfg.Packages, " "))
+	if err := ih.tree("", root); err != nil {
+		return "", err
+	}
+	// u-boot is written before the boot partition:
+	for _, pkg := range ubootPackages() {
+		dir, err := packageDir(ctx, pkg)
+		if err != nil {
+			return "", err
+		}
+		if err := ih.dir("package "+pkg, dir); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", ih.h.Sum(nil)), nil
+}
+
+// initInputs returns the hash of the inputs of the generated init: its source
+// code (without the build timestamp), the Go version, -strip_binaries and the
+// source code of the non-standard library packages it is built from.
+func initInputs(root *fileInfo) (string, error) {
+	ts := buildTimestamp
+	buildTimestamp = ""
+	src, err := renderInit(root)
+	buildTimestamp = ts
+	if err != nil {
+		return "", err
+	}
+	ih := &inputHasher{h: sha256.New()}
+	ih.field("source", string(src))
+
+	version, err := exec.Command("go", "version").Output()
+	if err != nil {
+		return "", err
+	}
+	ih.field("go version", string(version))
+	ih.field("flag strip_binaries", fmt.Sprint(*stripBinaries))
+
+	cmd := exec.Command("go", "list", "-deps", "-f", "{{ if not .Standard }}{{ .Dir }}{{ range .GoFiles }} {{ . }}{{ end }}{{ end }}", initRuntimePkg)
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, fn := range fields[1:] {
+			path := filepath.Join(fields[0], fn)
+			if err := ih.file("dep "+path, path); err != nil {
+				return "", err
+			}
+		}
+	}
+	return fmt.Sprintf("%x", ih.h.Sum(nil)), nil
+}
+
+// unchangedOutputs returns the file outputs of this build, or nil if
+// -skip_unchanged cannot apply (devices cannot be checked).
+func unchangedOutputs(cfg *Config) []string {
+	if cfg.Update != "" || len(overwriteBlockDevices) > 0 || cfg.Image == "-" {
+		return nil
+	}
+	var outputs []string
+	for _, fn := range []string{cfg.Image, cfg.Boot, cfg.Root, cfg.MBR} {
+		if fn == "" {
+			continue
+		}
+		if st, err := os.Stat(fn); err == nil && !st.Mode().IsRegular() {
+			return nil // e.g. a block device
+		}
+		outputs = append(outputs, fn)
+	}
+	if cfg.Image != "" && *outputFormat == "qcow2" {
+		outputs = append(outputs, cfg.Image+".qcow2")
+	}
+	if cfg.Image != "" && *compressImage != "" {
+		outputs = append(outputs, compressedImagePath(cfg.Image))
+	}
+	return outputs
+}
+
+func inputHashPath(output string) string { return output + ".inputhash" }
+
+// outputStamp identifies the inputs and the state of output, so that outputs
+// which were modified afterwards are not considered up to date.
+func outputStamp(output, hash string) (string, error) {
+	st, err := os.Stat(output)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %d %d\n", hash, st.Size(), st.ModTime().UnixNano()), nil
+}
+
+// readInputHash returns the output stamp (see outputStamp) and the
+// imageInputHash (if any) stored for output.
+func readInputHash(output string) (stamp, imageHash string) {
+	b, err := ioutil.ReadFile(inputHashPath(output))
+	if err != nil {
+		return "", ""
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	if len(lines) > 1 {
+		imageHash = strings.TrimSpace(strings.TrimPrefix(lines[1], "image "))
+	}
+	return lines[0], imageHash
+}
+
+// upToDate returns whether all outputs were built from inputs with the
+// specified hash.
+func upToDate(outputs []string, hash string) bool {
+	for _, output := range outputs {
+		got, _ := readInputHash(output)
+		stamp, err := outputStamp(output, hash)
+		if err != nil || got != stamp {
+			return false
+		}
+	}
+	return true
+}
+
+// onlyBootChanged returns whether the -overwrite image output was built from
+// inputs with the specified imageInputHash (i.e. only the inputs of the boot
+// file system changed) and was not modified since.
+func onlyBootChanged(output, imageHash string) bool {
+	stamp, got := readInputHash(output)
+	fields := strings.Fields(stamp)
+	if got != imageHash || len(fields) != 3 {
+		return false
+	}
+	current, err := outputStamp(output, fields[0])
+	return err == nil && current == stamp
+}
+
+// removeInputHashes removes the input hashes of outputs which are about to be
+// overwritten, so that an interrupted build is never considered up to date.
+func removeInputHashes(outputs []string) error {
+	for _, output := range outputs {
+		if err := os.Remove(inputHashPath(output)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeInputHashes stores hash for all outputs, and imageHash (if non-empty)
+// for the image cfg.Image.
+func writeInputHashes(cfg *Config, outputs []string, hash, imageHash string) error {
+	for _, output := range outputs {
+		stamp, err := outputStamp(output, hash)
+		if err != nil {
+			return err
+		}
+		if output == cfg.Image && imageHash != "" {
+			stamp += "image " + imageHash + "\n"
+		}
+		if err := ioutil.WriteFile(inputHashPath(output), []byte(stamp), 0644); err != nil {
+			return err
+		}
+	}
+	log.Printf("stored input hash %s", hash)
+	return nil
+}
@@ -0,0 +1,213 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var watch = flag.Bool("watch",
+	false,
+	"after updating, watch the source directories of the Go packages of the image (the specified packages, -gokrazy_pkgs, -firstboot and the init package, with their dependencies). Changed programs in /user are pushed (see gokr-packer push) without a reboot, other changes update the whole installation again. Requires -update")
+
+// sourceDirs returns the source directories of pkgs and all of their
+// non-standard library dependencies.
+func sourceDirs(pkgs []string) ([]string, error) {
+	var buf bytes.Buffer
+	cmd := exec.Command("go", append([]string{"list", "-deps", "-f", "{{ if not .Standard }}{{ .Dir }}{{ end }}"}, pkgs...)...)
+	cmd.Env = env
+	cmd.Stdout = &buf
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return strings.Fields(buf.String()), nil
+}
+
+// dirFingerprint summarizes the names, sizes and modification times of the
+// files in dir. Go packages are not recursive, so neither is dirFingerprint.
+func dirFingerprint(dir string) string {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	var fp strings.Builder
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		fmt.Fprintf(&fp, "%s %d %d\n", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+	}
+	return fp.String()
+}
+
+func fingerprintDirs(dirs []string) map[string]string {
+	fps := make(map[string]string, len(dirs))
+	for _, dir := range dirs {
+		fps[dir] = dirFingerprint(dir)
+	}
+	return fps
+}
+
+// waitForChanges polls dirs until at least one of them changed and no further
+// changes happened for a short while (e.g. an editor saving multiple files),
+// then returns the changed directories.
+func waitForChanges(dirs []string) []string {
+	before := fingerprintDirs(dirs)
+	var changed []string
+	for {
+		time.Sleep(500 * time.Millisecond)
+		now := fingerprintDirs(dirs)
+		var changedNow []string
+		for dir, fp := range now {
+			if before[dir] != fp {
+				changedNow = append(changedNow, dir)
+			}
+		}
+		before = now
+		if len(changedNow) > 0 {
+			changed = append(changed, changedNow...)
+			continue
+		}
+		if len(changed) > 0 {
+			sort.Strings(changed)
+			return changed
+		}
+	}
+}
+
+// watchedSources are the source directories of the packages of the image,
+// see listWatchedSources.
+type watchedSources struct {
+	// system are the source directories of the gokrazy packages, the
+	// -firstboot packages and the init package.
+	system []string
+
+	// programs are the programs in /user with the source directories of
+	// their package (by import path).
+	programs []mainPackage
+	dirs     map[string][]string
+}
+
+// all returns all watched directories.
+func (ws *watchedSources) all() []string {
+	all := append([]string(nil), ws.system...)
+	for _, pkg := range ws.programs {
+		all = append(all, ws.dirs[pkg.ImportPath]...)
+	}
+	return all
+}
+
+// listWatchedSources lists the source directories of the packages of the image.
+// The packages are listed again for each iteration of watchAndUpdate, as
+// changes may add or remove dependencies.
+func listWatchedSources(ctx context.Context, cfg *Config) (*watchedSources, error) {
+	system, err := sourceDirs(buildPackages(nil))
+	if err != nil {
+		return nil, err
+	}
+	ws := &watchedSources{
+		system: system,
+		dirs:   make(map[string][]string),
+	}
+	if len(cfg.Packages) == 0 { // go list would list the current directory
+		return ws, nil
+	}
+	if ws.programs, err = mainPackages(ctx, cfg.Packages); err != nil {
+		return nil, err
+	}
+	for _, pkg := range ws.programs {
+		if ws.dirs[pkg.ImportPath], err = sourceDirs([]string{pkg.ImportPath}); err != nil {
+			return nil, err
+		}
+	}
+	return ws, nil
+}
+
+// changedPrograms returns the programs in /user affected by the changed source
+// directories, or full=true if the change affects the rest of the image.
+func (ws *watchedSources) changedPrograms(changed []string) (programs []mainPackage, full bool) {
+	isChanged := make(map[string]bool, len(changed))
+	for _, dir := range changed {
+		isChanged[dir] = true
+	}
+	for _, dir := range ws.system {
+		if isChanged[dir] {
+			return nil, true
+		}
+	}
+	for _, pkg := range ws.programs {
+		for _, dir := range ws.dirs[pkg.ImportPath] {
+			if isChanged[dir] {
+				programs = append(programs, pkg)
+				break
+			}
+		}
+	}
+	return programs, false
+}
+
+// pushPrograms compiles the programs and replaces them on the target using
+// the device API of gokr-packer push, i.e. without an update or reboot.
+func pushPrograms(ctx context.Context, cfg *Config, programs []mainPackage) error {
+	rawurl, err := deviceURL(cfg)
+	if err != nil {
+		return err
+	}
+	updaterObj, err := connectDevice(cfg, rawurl)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range programs {
+		name := filepath.Base(pkg.Target)
+		if err := pushProgram(ctx, updaterObj, pkg.ImportPath, name, "/user/"+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchAndUpdate waits for changes to the source of the packages of the image.
+// If only programs in /user are affected, it pushes just these programs (see
+// gokr-packer push), which restarts them without a reboot. Otherwise (e.g.
+// when a gokrazy package changed), it re-packs and updates the target.
+// Unchanged packages are not recompiled, as the go tool caches build results.
+func watchAndUpdate(ctx context.Context, cfg *Config) error {
+	for {
+		ws, err := listWatchedSources(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		dirs := ws.all()
+		log.Printf("watching %d source directories for changes", len(dirs))
+		changed := waitForChanges(dirs)
+		programs, full := ws.changedPrograms(changed)
+		if full {
+			log.Printf("source changed in %s, updating", strings.Join(changed, ", "))
+			if err := logic(ctx, cfg); err != nil {
+				log.Printf("updating failed, waiting for further changes: %v", err)
+			}
+			continue
+		}
+		if len(programs) == 0 {
+			continue
+		}
+		names := make([]string, len(programs))
+		for idx, pkg := range programs {
+			names[idx] = pkg.ImportPath
+		}
+		log.Printf("source changed in %s, pushing %s", strings.Join(changed, ", "), strings.Join(names, ", "))
+		if err := pushPrograms(ctx, cfg, programs); err != nil {
+			log.Printf("pushing failed, waiting for further changes: %v", err)
+		}
+	}
+}
@@ -0,0 +1,840 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gokrazy/internal/mbr"
+	"github.com/gokrazy/internal/squashfs"
+)
+
+var (
+	serialConsole = flag.String("serial_console",
+		"",
+		`serial console device and speed, e.g. "ttyAMA0,115200". "disabled" allows applications to use the UART instead. Empty selects the default of -board (ttyAMA0,115200 on the Raspberry Pi 3)`)
+
+	cmdlineFile = flag.String("cmdline_file",
+		"",
+		"path to a file which replaces the kernel package’s cmdline.txt as the base kernel command line. Lines can be split and commented (#). -serial_console, PARTUUID and the -kernel_* flags are still applied")
+
+	bootFS = flag.String("boot_fs",
+		"fat16",
+		"file system type of the boot partition: fat16 or fat32. FAT32 is required for boot file systems which exceed what FAT16 can hold (e.g. multiple kernels or large sets of device tree files) and is supported by the Raspberry Pi firmware")
+
+	firmwarePackage = flag.String("firmware_package",
+		"github.com/gokrazy/firmware",
+		"comma-separated list of Go packages to copy *.{bin,dat,elf} from for constructing the firmware file system (e.g. the Raspberry Pi firmware plus vendor firmware for a HAT). Files must not be provided by more than one package, unless their contents are identical")
+
+	kernelPanic = flag.String("kernel_panic",
+		"",
+		"seconds after which the target system reboots after a kernel panic (panic= kernel parameter). 0 waits forever, negative values reboot immediately. Empty keeps the value from the kernel package’s cmdline.txt")
+
+	kernelOops = flag.String("kernel_oops",
+		"",
+		"whether a kernel oops results in a kernel panic (and hence a reboot, see -kernel_panic): panic (oops=panic kernel parameter) or continue. Empty keeps the value from the kernel package’s cmdline.txt")
+
+	kernelReboot = flag.String("kernel_reboot",
+		"",
+		"reboot= kernel parameter selecting how to reboot, e.g. warm, cold or hard (possibly combined with force, e.g. cold,force). Empty keeps the value from the kernel package’s cmdline.txt")
+)
+
+// setCmdlineParam sets the kernel parameter key to value in cmdline, replacing
+// any previous value. An empty value removes the parameter.
+func setCmdlineParam(cmdline, key, value string) string {
+	trimmed := strings.TrimRight(cmdline, " \n")
+	suffix := cmdline[len(trimmed):]
+	var params []string
+	for _, param := range strings.Fields(trimmed) {
+		if param == key || strings.HasPrefix(param, key+"=") {
+			continue
+		}
+		params = append(params, param)
+	}
+	if value != "" {
+		params = append(params, key+"="+value)
+	}
+	return strings.Join(params, " ") + suffix
+}
+
+// kernelRebootModes are the values which the reboot= kernel parameter
+// understands (see Documentation/admin-guide/kernel-parameters.txt).
+var kernelRebootModes = map[string]bool{
+	"warm":   true,
+	"cold":   true,
+	"hard":   true,
+	"soft":   true,
+	"gpio":   true,
+	"triple": true,
+	"kbd":    true,
+	"bios":   true,
+	"acpi":   true,
+	"efi":    true,
+	"pci":    true,
+	"force":  true,
+}
+
+// applyPanicParams applies -kernel_panic, -kernel_oops and -kernel_reboot to
+// cmdline.
+func applyPanicParams(cmdline string) (string, error) {
+	if *kernelPanic != "" {
+		if _, err := strconv.Atoi(*kernelPanic); err != nil {
+			return "", fmt.Errorf("-kernel_panic: %v", err)
+		}
+		cmdline = setCmdlineParam(cmdline, "panic", *kernelPanic)
+	}
+	switch *kernelOops {
+	case "":
+	case "panic":
+		cmdline = setCmdlineParam(cmdline, "oops", "panic")
+	case "continue":
+		cmdline = setCmdlineParam(cmdline, "oops", "")
+	default:
+		return "", fmt.Errorf("-kernel_oops: %q is not one of panic or continue", *kernelOops)
+	}
+	if *kernelReboot != "" {
+		for _, mode := range strings.Split(*kernelReboot, ",") {
+			if !kernelRebootModes[mode] {
+				return "", fmt.Errorf("-kernel_reboot: unknown reboot mode %q", mode)
+			}
+		}
+		cmdline = setCmdlineParam(cmdline, "reboot", *kernelReboot)
+	}
+	return cmdline, nil
+}
+
+func copyFile(fw bootFSWriter, dest, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w, err := fw.File(dest, fileTime(st.ModTime()))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// firmwarePackages returns the packages specified in cfg.FirmwarePackage.
+func firmwarePackages(cfg *Config) []string {
+	var pkgs []string
+	for _, pkg := range strings.Split(cfg.FirmwarePackage, ",") {
+		if pkg = strings.TrimSpace(pkg); pkg != "" {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// sameContents returns whether the files a and b have identical contents.
+func sameContents(a, b string) (bool, error) {
+	ab, err := ioutil.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	bb, err := ioutil.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ab, bb), nil
+}
+
+func copyFileSquash(d *squashfs.Directory, dest, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w, err := d.File(filepath.Base(dest), fileTime(st.ModTime()), st.Mode()&os.ModePerm)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = f
+	if squashfsProgress != nil {
+		r = io.TeeReader(f, squashfsProgress)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// readCmdlineFile returns the kernel command line in the -cmdline_file src,
+// which may be split across multiple lines and contain # comments.
+func readCmdlineFile(src string) ([]byte, error) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	var params []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if idx := strings.IndexByte(line, '#'); idx > -1 {
+			line = line[:idx]
+		}
+		params = append(params, strings.Fields(line)...)
+	}
+	if len(params) == 0 {
+		return nil, fmt.Errorf("-cmdline_file=%s: no kernel parameters found", src)
+	}
+	cmdline := strings.Join(params, " ")
+	if !strings.Contains(cmdline, "root=") {
+		log.Printf("warning: -cmdline_file=%s does not specify root=, the kernel will most likely not find the root file system", src)
+	}
+	return []byte(cmdline + "\n"), nil
+}
+
+// writeCmdline writes cmdline.txt based on src and returns the kernel command
+// line.
+func writeCmdline(cfg *Config, fw bootFSWriter, src string, partuuid uint32, usePartuuid bool) (string, error) {
+	read := ioutil.ReadFile
+	if src == *cmdlineFile {
+		read = readCmdlineFile
+	}
+	b, err := read(src)
+	if err != nil {
+		return "", err
+	}
+	var cmdline string
+	if console := serialConsoleSetting(cfg); console != "disabled" {
+		if console == "UART0" {
+			// For backwards compatibility, treat the special value UART0 as
+			// ttyAMA0,115200:
+			cmdline = "console=ttyAMA0,115200 " + string(b)
+		} else {
+			cmdline = "console=" + console + " " + string(b)
+		}
+	} else {
+		cmdline = string(b)
+	}
+
+	// The kernel packages’ cmdline.txt refers to root partition 2 (slot a).
+	// TODO: change {gokrazy,rtr7}/kernel/cmdline.txt to contain a dummy PARTUUID=
+	slot, err := rootSlotPartition()
+	if err != nil {
+		return "", err
+	}
+	if usePartuuid {
+		root := "root=PARTUUID=" + rootPartUUID(partuuid, slot)
+		cmdline = strings.ReplaceAll(cmdline, "root=/dev/mmcblk0p2", root)
+		cmdline = strings.ReplaceAll(cmdline, "root=/dev/sda2", root)
+	} else {
+		log.Printf("(not using PARTUUID= in cmdline.txt yet)")
+		cmdline = strings.ReplaceAll(cmdline, "root=/dev/mmcblk0p2", fmt.Sprintf("root=/dev/mmcblk0p%d", slot))
+		cmdline = strings.ReplaceAll(cmdline, "root=/dev/sda2", fmt.Sprintf("root=/dev/sda%d", slot))
+	}
+
+	cmdline, err = applyPanicParams(cmdline)
+	if err != nil {
+		return "", err
+	}
+
+	if *rootOverlay != "" {
+		cmdline = setCmdlineParam(cmdline, "gokrazy.overlay", *rootOverlay)
+	}
+
+	cmdline, err = applyCmdlineEdits(cmdline)
+	if err != nil {
+		return "", err
+	}
+
+	w, err := fw.File("/cmdline.txt", imageTime())
+	if err != nil {
+		return "", err
+	}
+	_, err = w.Write([]byte(cmdline))
+	return cmdline, err
+}
+
+// writeConfig writes config.txt based on src, edited by -config_txt, with the
+// lines in extra (e.g. dtoverlay= or initramfs) appended.
+func writeConfig(cfg *Config, fw bootFSWriter, src, extra string) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		if goarch := targetGOARCH(); os.IsNotExist(err) && goarch != "arm" && goarch != "arm64" {
+			if extra != "" || len(configTxt) > 0 {
+				return fmt.Errorf("-dtoverlay, -initramfs and -config_txt require a config.txt in the kernel package (Raspberry Pi)")
+			}
+			return nil // config.txt is only used by the Raspberry Pi firmware
+		}
+		return err
+	}
+	config := string(b)
+	if serialConsoleSetting(cfg) != "disabled" {
+		config = strings.ReplaceAll(config, "enable_uart=0", "enable_uart=1")
+	}
+	config = editConfigTxt(config, configTxt)
+	if extra != "" {
+		if config != "" && !strings.HasSuffix(config, "\n") {
+			config += "\n"
+		}
+		config += extra
+	}
+	w, err := fw.File("/config.txt", imageTime())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(config))
+	return err
+}
+
+var (
+	firmwareGlobs = []string{
+		"*.bin",
+		"*.dat",
+		"*.elf",
+		"*.upd",
+		"*.sig",
+	}
+	kernelGlobs = []string{
+		"vmlinuz",
+		"*.dtb",
+	}
+)
+
+func writeBoot(ctx context.Context, cfg *Config, f io.Writer, mbrfilename string, partuuid uint32, usePartuuid bool) error {
+	log.Printf("writing boot file system")
+	stage := startStage("write boot file system (" + strings.ToUpper(*bootFS) + ")")
+	stage.bytes = 0
+	defer stage.done()
+
+	bufw := bufio.NewWriter(io.MultiWriter(f, (*stageBytesWriter)(stage)))
+	var fw bootFSWriter
+	var err error
+	if *bootFS == "fat32" {
+		fw, err = newFAT32Writer(bufw, *bootFSClusterSize, fatVolumeLabel(*bootFSLabel))
+	} else {
+		fw, err = newFAT16Writer(bufw, fatVolumeLabel(*bootFSLabel))
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeBootFiles(ctx, cfg, fw, partuuid, usePartuuid); err != nil {
+		return err
+	}
+	if err := fw.Flush(); err != nil {
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	fsSizes.boot = stage.bytes
+	if max := int64(layout.bootSectors) * 512; stage.bytes > max {
+		return fmt.Errorf("boot file system (%d bytes) exceeds the %s boot partition, see -boot_size", stage.bytes, formatBytes(max))
+	}
+	if mbrfilename != "" {
+		if _, ok := f.(io.ReadSeeker); !ok {
+			return fmt.Errorf("BUG: f does not implement io.ReadSeeker")
+		}
+		fmbr, err := os.OpenFile(mbrfilename, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer fmbr.Close()
+		if err := writeMBR(f.(io.ReadSeeker), fmbr, partuuid); err != nil {
+			return err
+		}
+		if err := fmbr.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBootFiles writes the files of the boot file system (kernel, firmware,
+// cmdline.txt and config.txt, or the boot loader configuration of
+// -boot_mode) to fw.
+func writeBootFiles(ctx context.Context, cfg *Config, fw bootFSWriter, partuuid uint32, usePartuuid bool) error {
+	var globs []string
+	var firmwareDirs []string
+	for _, pkg := range firmwarePackages(cfg) {
+		firmwareDir, err := packageDir(ctx, pkg)
+		if err != nil {
+			return err
+		}
+		firmwareDirs = append(firmwareDirs, firmwareDir)
+		for _, glob := range firmwareGlobs {
+			globs = append(globs, filepath.Join(firmwareDir, glob))
+		}
+	}
+	kernelDir, err := packageDir(ctx, kernelPackage(cfg))
+	if err != nil {
+		return err
+	}
+	if err := checkBoardKernel(cfg, kernelPackage(cfg), kernelDir); err != nil {
+		return err
+	}
+	for _, glob := range kernelGlobs {
+		globs = append(globs, filepath.Join(kernelDir, glob))
+	}
+
+	// sources maps boot file system file names to the file they were copied
+	// from, for detecting conflicts between packages.
+	sources := make(map[string]string)
+	for _, pattern := range globs {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			if *eepromImage != "" && eepromFiles[filepath.Base(m)] {
+				continue // replaced by writeEEPROMUpdate
+			}
+			name := filepath.Base(m)
+			if prev, ok := sources[name]; ok {
+				same, err := sameContents(prev, m)
+				if err != nil {
+					return err
+				}
+				if !same {
+					return fmt.Errorf("conflict: /%s is provided by both %s and %s", name, prev, m)
+				}
+				continue
+			}
+			sources[name] = m
+			if err := copyFile(fw, "/"+name, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	cmdlineSrc := filepath.Join(kernelDir, "cmdline.txt")
+	if *cmdlineFile != "" {
+		cmdlineSrc = *cmdlineFile
+	}
+	cmdline, err := writeCmdline(cfg, fw, cmdlineSrc, partuuid, usePartuuid)
+	if err != nil {
+		return err
+	}
+
+	if *initramfs != "" {
+		if err := writeInitramfs(fw, initrdPath); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFallbackKernels(ctx, cfg, fw, firmwareDirs, cmdline); err != nil {
+		return err
+	}
+
+	if *permLUKS {
+		if err := writePermKey(cfg, fw); err != nil {
+			return err
+		}
+	}
+
+	if *tlsLocation == "perm" {
+		if err := writeTLSFiles(cfg, fw); err != nil {
+			return err
+		}
+	}
+
+	switch *bootMode {
+	case "uefi":
+		return writeEFILoader(cfg, fw, kernelDir, cmdline)
+	case "uboot":
+		return writeUBootConfig(cfg, fw, kernelDir, cmdline)
+	}
+
+	overlayConfig, err := writeDtoverlays(fw, "", append([]string{kernelDir}, firmwareDirs...))
+	if err != nil {
+		return err
+	}
+
+	if err := writeConfig(cfg, fw, filepath.Join(kernelDir, "config.txt"), overlayConfig+initramfsConfig()+fallbackKernelConfig(cfg)); err != nil {
+		return err
+	}
+
+	if *eepromImage != "" {
+		if err := writeEEPROMUpdate(fw, firmwareDirs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type fileInfo struct {
+	filename string
+
+	// importPath is the Go package which a binary was built from.
+	importPath string
+
+	fromHost    string
+	fromLiteral string
+	symlinkDest string
+
+	// hardlinkTarget is the path (e.g. /usr/bin/foo) of the regular file in
+	// the root file system which this file is a hard link to.
+	hardlinkTarget string
+
+	// device, if non-nil, makes this file a device node or FIFO.
+	device *deviceNode
+
+	// uid and gid are the owner and group (default root), xattrs the extended
+	// attributes (e.g. security.capability) of the file. Hard links share
+	// them with their target.
+	uid, gid uint32
+	xattrs   map[string][]byte
+
+	// inputs, if non-empty, identifies the contents of a generated file which
+	// differ between builds from the same inputs (e.g. due to timestamps or
+	// random nonces). -skip_unchanged and -rootfs_cache hash it instead of the
+	// contents.
+	inputs string
+
+	dirents []*fileInfo
+}
+
+// isDir returns whether fi is a directory, i.e. not a file of any type.
+func (fi *fileInfo) isDir() bool {
+	return fi.fromHost == "" && fi.fromLiteral == "" && fi.symlinkDest == "" &&
+		fi.hardlinkTarget == "" && fi.device == nil
+}
+
+// mustFindDirent returns the file at p (e.g. etc/gokrazy), relative to fi.
+// Symbolic links are not followed, see lookupFile.
+func (fi *fileInfo) mustFindDirent(p string) *fileInfo {
+	cur := fi
+	for _, name := range pathComponents(p) {
+		var next *fileInfo
+		for _, ent := range cur.dirents {
+			if ent.filename == name {
+				next = ent
+				break
+			}
+		}
+		if next == nil {
+			log.Panicf("mustFindDirent(%q) did not find directory entry %q", p, name)
+		}
+		cur = next
+	}
+	return cur
+}
+
+// mkdirAll returns the directory at p (e.g. usr/share/foo), relative to fi,
+// creating it and its parents if they do not exist.
+func (fi *fileInfo) mkdirAll(p string) (*fileInfo, error) {
+	names := pathComponents(p)
+	cur := fi
+	for i, name := range names {
+		cur = cur.dir(name)
+		if !cur.isDir() {
+			return nil, fmt.Errorf("/%s is not a directory", strings.Join(names[:i+1], "/"))
+		}
+	}
+	return cur, nil
+}
+
+// pathComponents splits the slash-separated path p into its file names,
+// ignoring empty, “.” and “..” components (beyond the root directory).
+func pathComponents(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// checkFilename verifies that name is a valid file name in a directory of the
+// SquashFS root file system. File names are byte strings (usually UTF-8), so
+// spaces and other special characters are retained as they are.
+func checkFilename(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("invalid file name %q", name)
+	case strings.ContainsAny(name, "/\x00"):
+		return fmt.Errorf("file name %q contains a slash or NUL byte", name)
+	case len(name) > 256: // SQUASHFS_NAME_LEN
+		return fmt.Errorf("file name %q is longer than 256 bytes", name)
+	}
+	return nil
+}
+
+// dir returns the subdirectory name of fi, creating it if it does not exist.
+func (fi *fileInfo) dir(name string) *fileInfo {
+	for _, ent := range fi.dirents {
+		if ent.filename == name {
+			return ent
+		}
+	}
+	d := &fileInfo{filename: name}
+	fi.dirents = append(fi.dirents, d)
+	return d
+}
+
+func findBins(ctx context.Context, cfg *Config) (*fileInfo, error) {
+	result := fileInfo{filename: ""}
+
+	gokrazyMainPkgs, err := mainPackages(ctx, gokrazyPkgs)
+	if err != nil {
+		return nil, err
+	}
+	gokrazy := fileInfo{filename: "gokrazy"}
+	for _, pkg := range gokrazyMainPkgs {
+		gokrazy.dirents = append(gokrazy.dirents, &fileInfo{
+			filename:   filepath.Base(pkg.Target),
+			importPath: pkg.ImportPath,
+			fromHost:   pkg.Target,
+		})
+	}
+
+	if *initPkg != "" {
+		initMainPkgs, err := mainPackages(ctx, []string{*initPkg})
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range initMainPkgs {
+			if got, want := filepath.Base(pkg.Target), "init"; got != want {
+				log.Printf("Error: -init_pkg=%q produced unexpected binary name: got %q, want %q", *initPkg, got, want)
+				continue
+			}
+			gokrazy.dirents = append(gokrazy.dirents, &fileInfo{
+				filename:   "init",
+				importPath: pkg.ImportPath,
+				fromHost:   pkg.Target,
+			})
+		}
+	}
+	result.dirents = append(result.dirents, &gokrazy)
+
+	user := fileInfo{filename: "user"}
+	if len(cfg.Packages) > 0 { // go list would list the current directory
+		mainPkgs, err := mainPackages(ctx, cfg.Packages)
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range mainPkgs {
+			user.dirents = append(user.dirents, &fileInfo{
+				filename:   filepath.Base(pkg.Target),
+				importPath: pkg.ImportPath,
+				fromHost:   pkg.Target,
+			})
+		}
+	}
+	if err := addPrebuiltBinaries(&user); err != nil {
+		return nil, err
+	}
+	result.dirents = append(result.dirents, &user)
+
+	firstboot, err := findFirstBoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if firstboot != nil {
+		result.dirents = append(result.dirents, firstboot)
+	}
+	return &result, nil
+}
+
+// writeFileInfo writes fi (at path within the root file system) to dir. Hard
+// links, device nodes and FIFOs (written as placeholders) and files with an
+// owner, group or xattrs are recorded in fixups, see fixupSquashfs.
+func writeFileInfo(dir *squashfs.Directory, fi *fileInfo, path string, fixups map[string]*fileInfo) error {
+	if fi.uid != 0 || fi.gid != 0 || len(fi.xattrs) > 0 {
+		fixups[path] = fi
+	}
+	if fi.fromHost != "" { // copy a regular file
+		return copyFileSquash(dir, fi.filename, fi.fromHost)
+	}
+	if fi.fromLiteral != "" { // write a regular file
+		w, err := dir.File(fi.filename, imageTime(), 0444)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(fi.fromLiteral)); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	if fi.symlinkDest != "" { // create a symlink
+		return dir.Symlink(fi.symlinkDest, fi.filename, imageTime(), 0444)
+	}
+	if fi.hardlinkTarget != "" || fi.device != nil {
+		fixups[path] = fi
+		return writeSquashfsPlaceholder(dir, fi.filename, imageTime())
+	}
+	// subdir
+	var d *squashfs.Directory
+	if fi.filename == "" { // root
+		d = dir
+	} else {
+		d = dir.Directory(fi.filename, imageTime())
+	}
+	// SquashFS directories are sorted by the bytes of the file names:
+	sort.Slice(fi.dirents, func(i, j int) bool {
+		return fi.dirents[i].filename < fi.dirents[j].filename
+	})
+	for i, ent := range fi.dirents {
+		if err := checkFilename(ent.filename); err != nil {
+			return fmt.Errorf("%s/: %v", path, err)
+		}
+		if i > 0 && fi.dirents[i-1].filename == ent.filename {
+			return fmt.Errorf("%s/%s: duplicate directory entry", path, ent.filename)
+		}
+	}
+	for _, ent := range fi.dirents {
+		if err := writeFileInfo(d, ent, path+"/"+ent.filename, fixups); err != nil {
+			return err
+		}
+	}
+	return d.Flush()
+}
+
+// squashfsProgress reports the progress of copying host files into the root
+// file system while writeRoot is running.
+var squashfsProgress *progress
+
+// hostFileBytes returns the total size of the files of root which are copied
+// from the host.
+func hostFileBytes(root *fileInfo) int64 {
+	var total int64
+	for _, ent := range root.dirents {
+		total += hostFileBytes(ent)
+	}
+	if root.fromHost != "" {
+		if st, err := os.Stat(root.fromHost); err == nil {
+			total += st.Size()
+		}
+	}
+	return total
+}
+
+func writeRoot(f io.ReadWriteSeeker, root *fileInfo) error {
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	checkSize := func(size int64) error {
+		fsSizes.root = size
+		if max := int64(layout.rootSectors) * 512; size > max {
+			return fmt.Errorf("root file system (%d bytes) exceeds the %s root partition, see -root_size", size, formatBytes(max))
+		}
+		_, err := f.Seek(start, io.SeekStart)
+		return err
+	}
+	var hash string
+	if *rootfsCache {
+		if hash, err = rootfsHash(root); err != nil {
+			return err
+		}
+		cached, err := copyCachedRoot(f, hash)
+		if err != nil {
+			return err
+		}
+		if cached {
+			end, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			return checkSize(end - start)
+		}
+	}
+
+	log.Printf("writing root file system")
+	stage := startStage("write root file system (squashfs)")
+	defer stage.done()
+	fw, err := squashfs.NewWriter(f, imageTime())
+	if err != nil {
+		return err
+	}
+
+	squashfsProgress = newProgress("writing root file system", hostFileBytes(root))
+	defer func() { squashfsProgress = nil }()
+	fixups := make(map[string]*fileInfo)
+	if err := writeFileInfo(fw.Root, root, "", fixups); err != nil {
+		return err
+	}
+	squashfsProgress.finish()
+
+	if err := fw.Flush(); err != nil {
+		return err
+	}
+	if err := fixupSquashfs(f, fixups); err != nil {
+		return err
+	}
+	if err := addSquashfsExportTable(f); err != nil {
+		return err
+	}
+	if err := recompressSquashfs(f, *rootfsCompression); err != nil {
+		return err
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	stage.bytes = end - start
+	if err := checkSize(stage.bytes); err != nil {
+		return err
+	}
+	if hash != "" {
+		if err := storeCachedRoot(f, stage.bytes, hash); err != nil {
+			// The cache is only an optimization:
+			log.Printf("not caching the root file system: %v", err)
+		}
+	}
+	_, err = f.Seek(start, io.SeekStart)
+	return err
+}
+
+// bootFileOffset returns the offset (relative to the start of the file system)
+// of the contents of the root directory file short, an 8.3 name such as
+// "VMLINUZ    ".
+func bootFileOffset(v *fatVolume, short string) (int64, error) {
+	entry, err := v.lookup(short)
+	if err != nil {
+		return 0, err
+	}
+	return v.clusterOffset(entry.firstCluster) - v.off, nil
+}
+
+func writeMBR(f io.ReadSeeker, fw io.WriteSeeker, partuuid uint32) error {
+	v, err := readFATVolume(readSeekerAt{f}, 0)
+	if err != nil {
+		return err
+	}
+	vmlinuzOffset, err := bootFileOffset(v, "VMLINUZ    ")
+	if err != nil {
+		return err
+	}
+	cmdlineOffset, err := bootFileOffset(v, "CMDLINE TXT")
+	if err != nil {
+		return err
+	}
+
+	if _, err := fw.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	vmlinuzLba := uint32((vmlinuzOffset / 512) + bootStartSector)
+	cmdlineTxtLba := uint32((cmdlineOffset / 512) + bootStartSector)
+
+	log.Printf("writing MBR (LBAs: vmlinuz=%d, cmdline.txt=%d, PARTUUID=%08x)", vmlinuzLba, cmdlineTxtLba, partuuid)
+	mbr := mbr.Configure(vmlinuzLba, cmdlineTxtLba, partuuid)
+	if _, err := fw.Write(mbr[:]); err != nil {
+		return err
+	}
+
+	return nil
+}